@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
 	"github.com/sharding-db/etcd-sharding-proxy/pkg/server"
@@ -15,32 +19,153 @@ func main() {
 	var configPath string
 	flag.StringVar(&addr, "addr", "", "proxy listen address")
 	flag.IntVar(&port, "port", 2379, "proxy listen port")
+	var ringDiffPath string
+	var publishPath string
 	flag.StringVar(&configPath, "config", "./config.yaml", "proxy config file path")
+	flag.StringVar(&ringDiffPath, "ring-diff", "", "print the key hash ranges moved on the consistent hash ring from -config to this config file, and exit")
+	flag.StringVar(&publishPath, "publish-shard-map", "", "publish the layout of this config file as the next version of the shard map of -config, wait for all proxies to switch to it, and exit")
+	var splitShard int
+	var splitKey, splitTarget string
+	flag.IntVar(&splitShard, "split-shard", -1, "split this shard of the shard map of -config at -split-key, moving the upper half to -split-target, and exit")
+	flag.StringVar(&splitKey, "split-key", "", "the first key moved by -split-shard")
+	flag.StringVar(&splitTarget, "split-target", "", "comma separated endpoints of the etcd cluster receiving the keys moved by -split-shard")
+	var moveRange string
+	var moveTo int
+	flag.StringVar(&moveRange, "move-range", "", "move the range \"start,end\" from the shard owning start to -move-to, which is next to it, and exit. The range ends at the end of the shard if end is empty")
+	flag.IntVar(&moveTo, "move-to", -1, "the shard receiving the keys moved by -move-range")
+	var mergeShard, mergeInto int
+	flag.IntVar(&mergeShard, "merge-shard", -1, "move all keys of this shard of the shard map of -config to -merge-into, which is next to it, retire this shard, and exit")
+	flag.IntVar(&mergeInto, "merge-into", -1, "the shard receiving the keys of -merge-shard")
+	var dualWrite time.Duration
+	var shadowRead bool
+	flag.DurationVar(&dualWrite, "dual-write", 0, "write to both shards for this long before the fence of -split-shard, -move-range or -merge-shard")
+	flag.BoolVar(&shadowRead, "shadow-read", false, "shadow-read from the target while writing to both shards by -dual-write")
+	var listMigrations bool
+	var abortID string
+	flag.BoolVar(&listMigrations, "migrations", false, "print the progress of migrations of the shard map of -config, and exit")
+	flag.StringVar(&abortID, "abort-migration", "", "abort the migration of this id & roll it back, and exit")
 	flag.Parse()
 
-	fmt.Println("Etcd Sharding Proxy starting...")
-
 	conf, err := config.NewConfigurationsFromFile(configPath)
 	if err != nil {
 		exitWithErr(err, "load config file")
 	}
+	if len(ringDiffPath) > 0 {
+		printRingDiff(conf, ringDiffPath)
+		return
+	}
+	if len(publishPath) > 0 {
+		publishShardMap(conf, publishPath)
+		return
+	}
+	if splitShard >= 0 || len(moveRange) > 0 || mergeShard >= 0 || listMigrations || len(abortID) > 0 {
+		migrator := newMigrator(conf)
+		opts := []server.MigrationOption{server.WithDualWrite(dualWrite, shadowRead)}
+		switch {
+		case splitShard >= 0:
+			splitShardOnline(migrator, splitShard, splitKey, splitTarget, opts)
+		case len(moveRange) > 0:
+			moveRangeOnline(migrator, moveRange, moveTo, opts)
+		case mergeShard >= 0:
+			mergeShardOnline(migrator, mergeShard, mergeInto, opts)
+		case listMigrations:
+			printMigrations(migrator)
+		default:
+			abortMigration(migrator, abortID)
+		}
+		return
+	}
 
-	var shards = make([]server.Shard, len(conf.Shards))
-	for i, shard := range conf.Shards {
-		shards[i], err = server.NewShardImpl(i, len(shards), shard)
+	fmt.Println("Etcd Sharding Proxy starting...")
+
+	ctx := context.Background()
+	builder := server.NewShardingBuilder()
+	var shardingConfigs *server.VersionedShardingConfigs
+	layout := conf.Layout(0)
+	var migrator *server.Migrator
+	if conf.ShardMap.Enabled {
+		shardMap, err := server.NewShardMap(conf, builder)
 		if err != nil {
-			exitWithErr(err, fmt.Sprintf("create shard[%d]", i))
+			exitWithErr(err, "create shard map")
 		}
+		shardingConfigs, err = shardMap.Load(ctx)
+		if err != nil {
+			exitWithErr(err, "load shard map")
+		}
+		layout = shardMap.Layout()
+		go shardMap.Run(ctx)
+		migrator = server.NewMigrator(shardMap)
+		go migrator.Run(ctx)
+	} else {
+		configs, err := builder.Build(conf)
+		if err != nil {
+			exitWithErr(err, "create sharding configs")
+		}
+		shardingConfigs = server.NewVersionedShardingConfigs(configs, layout.Epoch)
+		server.NewConfigReloader(conf, builder, shardingConfigs).Watch()
+	}
+
+	groupRunners := server.NewDefaultGroupRunnerFactory()
+	respFilter := new(server.DefaultResponseFilter)
+	var kvOpts []server.KVProxyOption
+	var headers *server.HeaderStamper
+	if conf.Header.Synthetic {
+		headers = server.NewHeaderStamper(conf.Header.ClusterID, conf.Header.MemberID)
+		if err := headers.Sync(ctx, groupRunners, shardingConfigs); err != nil {
+			exitWithErr(err, "sync revisions of shards")
+		}
+		go headers.Run(ctx, groupRunners, shardingConfigs)
+		kvOpts = append(kvOpts, server.WithHeaderStamper(headers))
+	}
+	if conf.Range.Coalesce {
+		kvOpts = append(kvOpts, server.WithRangeCoalescer(server.NewRangeCoalescer()))
+	}
+	if conf.Range.Partial {
+		kvOpts = append(kvOpts, server.WithPartialRange())
+	}
+	if conf.Range.ShardTimeout > 0 {
+		kvOpts = append(kvOpts, server.WithShardTimeout(conf.Range.ShardTimeout))
+	}
+	if len(conf.Range.CachePrefixes) > 0 {
+		cache := server.NewRangeCache(shardingConfigs, respFilter, conf.Range.CachePrefixes)
+		go cache.Run(ctx)
+		kvOpts = append(kvOpts, server.WithRangeCache(cache))
+	}
+	var coordinator *server.TxnCoordinator
+	if conf.Txn.TwoPhaseCommit {
+		coordinator = server.NewTxnCoordinator(groupRunners, shardingConfigs, respFilter, headers, conf.InternalPrefix, conf.Txn.RecoverAfter)
+		go coordinator.Run(ctx)
+		kvOpts = append(kvOpts, server.WithTxnCoordinator(coordinator))
+	}
+	// replicated prefixes may be added by later versions of the shard map
+	if conf.ShardMap.Enabled || len(layout.ReplicatedPrefixes) > 0 {
+		replicator := server.NewReplicator(groupRunners, shardingConfigs, coordinator, headers)
+		go replicator.Run(ctx)
+		kvOpts = append(kvOpts, server.WithReplicator(replicator))
 	}
-	shardingConfigs := server.NewDefaultShardingConfigs(shards)
 
-	proxykv := server.NewKVProxy(server.NewDefaultGroupRunnerFactory(), shardingConfigs, new(server.DefaultResponseFilter))
-	proxywatch := server.NewWatchProxy(shardingConfigs)
-	proxylease := server.NewLeaseProxy(shardingConfigs)
+	if conf.ShardMap.Enabled {
+		dualWriter := server.NewDualWriter(shardingConfigs, server.WithMigrator(migrator))
+		go dualWriter.Run(ctx)
+		kvOpts = append(kvOpts, server.WithDualWriter(dualWriter))
+	}
+
+	if len(conf.Compaction.Mode) > 0 {
+		compactor, err := server.NewAutoCompactor(groupRunners, shardingConfigs, conf.Compaction.Mode, conf.Compaction.Retention)
+		if err != nil {
+			exitWithErr(err, "create auto compactor")
+		}
+		go compactor.Run(ctx)
+	}
+
+	proxykv := server.NewKVProxy(groupRunners, shardingConfigs, respFilter, kvOpts...)
+	proxywatch := server.NewWatchProxy(shardingConfigs, headers)
+	proxylease := server.NewLeaseProxy(shardingConfigs, headers)
 	bes := server.BackendServers{
-		KV:    proxykv,
-		Watch: proxywatch,
-		Lease: proxylease,
+		KV:      proxykv,
+		Watch:   proxywatch,
+		Lease:   proxylease,
+		Configs: shardingConfigs,
 	}
 	server, err := server.NewGrpcServer(bes)
 	if err != nil {
@@ -53,6 +178,138 @@ func main() {
 	}
 }
 
+// printRingDiff prints the moves of keys from the ring of conf to the ring of the config file.
+func printRingDiff(conf *config.Configurations, path string) {
+	other, err := config.NewConfigurationsFromFile(path)
+	if err != nil {
+		exitWithErr(err, "load config file to diff")
+	}
+	from, err := server.NewHashRing(conf.Shards, conf.Sharding.VirtualNodes)
+	if err != nil {
+		exitWithErr(err, "create hash ring")
+	}
+	to, err := server.NewHashRing(other.Shards, other.Sharding.VirtualNodes)
+	if err != nil {
+		exitWithErr(err, "create hash ring to diff")
+	}
+	var total float64
+	for _, move := range server.DiffHashRings(from, to) {
+		fmt.Println(move)
+		total += move.Fraction()
+	}
+	fmt.Printf("%.4f%% of keys move\n", total*100)
+}
+
+// publishShardMapTimeout is how long to wait for all proxies to switch to the published shard map.
+const publishShardMapTimeout = 30 * time.Second
+
+// publishShardMap publishes the layout of the config file as the next version of the shard map of conf.
+func publishShardMap(conf *config.Configurations, path string) {
+	other, err := config.NewConfigurationsFromFile(path)
+	if err != nil {
+		exitWithErr(err, "load config file to publish")
+	}
+	builder := server.NewShardingBuilder()
+	shardMap, err := server.NewShardMap(conf, builder)
+	if err != nil {
+		exitWithErr(err, "create shard map")
+	}
+	ctx := context.Background()
+	_, err = shardMap.Load(ctx)
+	if err != nil {
+		exitWithErr(err, "load shard map")
+	}
+	layout := other.Layout(0)
+	_, err = builder.Build(conf.WithLayout(layout))
+	if err != nil {
+		exitWithErr(err, "validate layout")
+	}
+	epoch, err := shardMap.Publish(ctx, layout)
+	if err != nil {
+		exitWithErr(err, "publish shard map")
+	}
+	fmt.Printf("published shard map at epoch %d\n", epoch)
+	waitCtx, cancel := context.WithTimeout(ctx, publishShardMapTimeout)
+	defer cancel()
+	err = shardMap.WaitEpoch(waitCtx, epoch)
+	if err != nil {
+		exitWithErr(err, "wait for proxies")
+	}
+	fmt.Println("all proxies switched")
+}
+
+// newMigrator creates the migrator of the shard map of conf.
+func newMigrator(conf *config.Configurations) *server.Migrator {
+	shardMap, err := server.NewShardMap(conf, server.NewShardingBuilder())
+	if err != nil {
+		exitWithErr(err, "create shard map")
+	}
+	_, err = shardMap.Load(context.Background())
+	if err != nil {
+		exitWithErr(err, "load shard map")
+	}
+	return server.NewMigrator(shardMap)
+}
+
+// splitShardOnline splits the shard of the shard map while the proxies serve it.
+func splitShardOnline(migrator *server.Migrator, shard int, splitKey, target string, opts []server.MigrationOption) {
+	if len(splitKey) == 0 || len(target) == 0 {
+		exitWithErr(errors.New("-split-key & -split-target are required"), "split shard")
+	}
+	endpoints := strings.Split(target, ",")
+	targetConf := config.Shard{Address: endpoints[0], Endpoints: endpoints[1:]}
+	cp, err := migrator.Split(context.Background(), shard, []byte(splitKey), targetConf, opts...)
+	if err != nil {
+		exitWithErr(err, "split shard")
+	}
+	fmt.Println(cp)
+}
+
+// moveRangeOnline moves the range between shards of the shard map while the proxies serve it.
+func moveRangeOnline(migrator *server.Migrator, keyRange string, target int, opts []server.MigrationOption) {
+	start, end, _ := strings.Cut(keyRange, ",")
+	if len(start) == 0 || target < 0 {
+		exitWithErr(errors.New("-move-range with a start key & -move-to are required"), "move range")
+	}
+	cp, err := migrator.Move(context.Background(), []byte(start), []byte(end), target, opts...)
+	if err != nil {
+		exitWithErr(err, "move range")
+	}
+	fmt.Println(cp)
+}
+
+// mergeShardOnline merges the shard into the shard next to it while the proxies serve it.
+func mergeShardOnline(migrator *server.Migrator, shard, target int, opts []server.MigrationOption) {
+	if target < 0 {
+		exitWithErr(errors.New("-merge-into is required"), "merge shard")
+	}
+	cp, err := migrator.Merge(context.Background(), shard, target, opts...)
+	if err != nil {
+		exitWithErr(err, "merge shard")
+	}
+	fmt.Println(cp)
+}
+
+// printMigrations prints the checkpoints of the migrations.
+func printMigrations(migrator *server.Migrator) {
+	checkpoints, err := migrator.List(context.Background())
+	if err != nil {
+		exitWithErr(err, "list migrations")
+	}
+	for _, cp := range checkpoints {
+		fmt.Println(cp)
+	}
+}
+
+// abortMigration aborts the migration & waits until it's rolled back.
+func abortMigration(migrator *server.Migrator, id string) {
+	cp, err := migrator.Abort(context.Background(), id)
+	if err != nil {
+		exitWithErr(err, "abort migration")
+	}
+	fmt.Println(cp)
+}
+
 func exitWithErr(err error, stage string) {
 	fmt.Println(stage, " failed: ", err, stage)
 	os.Exit(1)
@@ -1,8 +1,12 @@
 package config
 
 import (
+	"hash/fnv"
 	"log"
+	"os"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
@@ -12,22 +16,169 @@ type Configurations struct {
 	// ShardingRules is the sharding rules of the cluster.
 	// start key of first shard & end key of last shard are ignored.
 	Shards []Shard `json:"shards"`
+	// Sharding is the configurations of the sharding strategy.
+	Sharding Sharding `json:"sharding"`
+	// InternalPrefix is the key prefix reserved for the keys written by the proxy itself,
+	// e.g. txn locks & intents. Default is DefaultInternalPrefix.
+	InternalPrefix string `json:"internalPrefix"`
+	// Txn is the configurations of transactions.
+	Txn Txn `json:"txn"`
+	// Header is the configurations of response headers.
+	Header Header `json:"header"`
+	// Compaction is the configurations of auto compaction.
+	Compaction Compaction `json:"compaction"`
+	// Range is the configurations of range requests.
+	Range Range `json:"range"`
+	// ReplicatedPrefixes are the key prefixes stored in every shard,
+	// e.g. small & frequently read feature flags.
+	ReplicatedPrefixes []string `json:"replicatedPrefixes"`
+	// ShardMap is the configurations of the shard map stored in etcd.
+	ShardMap ShardMap `json:"shardMap"`
+	// Migrations are the key ranges being moved between shards, only set by the shard map.
+	Migrations []Migration `json:"-"`
 }
 
+// Layout is the part of Configurations deciding which shard a key is in.
+// It's the value of the shard map, in JSON.
+type Layout struct {
+	// Epoch is the version of the layout, increased by every change.
+	Epoch              int64    `json:"epoch"`
+	Shards             []Shard  `json:"shards"`
+	Sharding           Sharding `json:"sharding"`
+	ReplicatedPrefixes []string `json:"replicatedPrefixes"`
+	// Migrations are the key ranges being moved between shards.
+	Migrations []Migration `json:"migrations"`
+}
+
+const (
+	// MigrationCopying is the state of a migration copying keys to the target,
+	// the source still owns the range.
+	MigrationCopying = "copying"
+	// MigrationDualWrite is the state of a migration writing to both shards, the source still owns
+	// the range. Writes to the range are mirrored to the target, and reads may be shadow-read from it.
+	MigrationDualWrite = "dual-write"
+	// MigrationFenced is the state of a migration catching up the last writes to the target,
+	// writes to the range wait until the range is moved.
+	MigrationFenced = "fenced"
+	// MigrationCleanup is the state of a migration deleting the range from the source,
+	// the target owns the range.
+	MigrationCleanup = "cleanup"
+)
+
+// Migration is a key range being moved from a shard to another.
+type Migration struct {
+	// ID identifies the migration, and its checkpoint under the shard map key.
+	ID string `json:"id"`
+	// Start & End of the range, End is exclusive. End is []byte{0} for no end.
+	Start []byte `json:"start"`
+	End   []byte `json:"end"`
+	// Source is the index of the shard the range is moved from.
+	Source int `json:"source"`
+	// Target is the index of the shard the range is moved to.
+	Target int `json:"target"`
+	// TargetShard is the configuration of the target if it's not in Shards yet,
+	// it's added at index Target when the range is moved.
+	TargetShard *Shard `json:"targetShard,omitempty"`
+	// State is one of MigrationCopying, MigrationDualWrite, MigrationFenced & MigrationCleanup.
+	State string `json:"state"`
+	// DualWrite is how long the migration stays in MigrationDualWrite before the fence, 0 skips it.
+	DualWrite time.Duration `json:"dualWrite"`
+	// ShadowRead makes the reads in MigrationDualWrite shadow-read from the target.
+	ShadowRead bool `json:"shadowRead"`
+	// Merge moves the whole source to the target next to it, the source is retired at the cutover.
+	Merge bool `json:"merge"`
+}
+
+// Layout returns the layout of the configurations at the epoch.
+func (c *Configurations) Layout(epoch int64) Layout {
+	return Layout{
+		Epoch:              epoch,
+		Shards:             c.Shards,
+		Sharding:           c.Sharding,
+		ReplicatedPrefixes: c.ReplicatedPrefixes,
+		Migrations:         c.Migrations,
+	}
+}
+
+// WithLayout returns a copy of the configurations with the layout.
+func (c *Configurations) WithLayout(layout Layout) *Configurations {
+	ret := *c
+	ret.Shards = layout.Shards
+	ret.Sharding = layout.Sharding
+	ret.ReplicatedPrefixes = layout.ReplicatedPrefixes
+	ret.Migrations = layout.Migrations
+	return &ret
+}
+
+// DefaultInternalPrefix is the default value of Configurations.InternalPrefix
+const DefaultInternalPrefix = "/__sharding_proxy/"
+
+// DefaultShardMapKey is the default key of the shard map under Configurations.InternalPrefix
+const DefaultShardMapKey = "shard-map"
+
 // NewConfigurationsFromFile  creates a new Configurations from a file.
 func NewConfigurationsFromFile(path string) (*Configurations, error) {
-	ret := new(Configurations)
 	viper.SetConfigFile(path)
 	viper.SetConfigType("yaml")
 	err := viper.ReadInConfig()
 	if err != nil {
 		return nil, errors.Wrap(err, "read config file failed")
 	}
-	err = viper.Unmarshal(ret)
+	return unmarshalConfigurations()
+}
+
+// WatchConfigurationsFile watches the file read by NewConfigurationsFromFile, and calls onChange
+// with the configurations reloaded from it whenever it's changed.
+func WatchConfigurationsFile(onChange func(conf *Configurations, err error)) {
+	viper.OnConfigChange(func(fsnotify.Event) {
+		onChange(unmarshalConfigurations())
+	})
+	viper.WatchConfig()
+}
+
+// unmarshalConfigurations creates the Configurations from the config file read by viper.
+func unmarshalConfigurations() (*Configurations, error) {
+	ret := new(Configurations)
+	err := viper.Unmarshal(ret)
+	if len(ret.InternalPrefix) == 0 {
+		ret.InternalPrefix = DefaultInternalPrefix
+	}
+	if len(ret.ShardMap.Key) == 0 {
+		ret.ShardMap.Key = ret.InternalPrefix + DefaultShardMapKey
+	}
+	ret.Header.setDefaults(ret.Shards)
 	log.Println("config:", ret)
 	return ret, errors.Wrap(err, "unmarshal config file failed")
 }
 
+// Sharding is the configurations of the sharding strategy
+type Sharding struct {
+	// Strategy is how keys are assigned to shards:
+	// "range" (default) by the start & end keys of shards, "hash" by the hash of keys,
+	// "hash-tag" by the hash of the hash tags of keys, "prefix" by the routing table of prefixes,
+	// "consistent-hash" by a consistent hash ring.
+	// Start & end keys of shards are only used by "range".
+	Strategy string `json:"strategy"`
+	// HashTagPattern is the regexp whose first capture group is the hash tag of "hash-tag".
+	// Default is the text between the first "{" and the next "}".
+	HashTagPattern string `json:"hashTagPattern"`
+	// Routes are the routing table of "prefix": a key belongs to the shard of the
+	// longest prefix it matches.
+	Routes []Route `json:"routes"`
+	// DefaultShard is the shard of the keys matching no route of "prefix".
+	DefaultShard int `json:"defaultShard"`
+	// VirtualNodes is the number of virtual nodes of a shard with weight 1 on the ring of
+	// "consistent-hash". Default is 100.
+	VirtualNodes int `json:"virtualNodes"`
+}
+
+// Route maps the keys with a prefix to a shard
+type Route struct {
+	Prefix string `json:"prefix"`
+	// Shard is the index of the shard in Shards
+	Shard int `json:"shard"`
+}
+
 // Shard is the configuration of one shard
 // implements server.Shard
 type Shard struct {
@@ -41,4 +192,115 @@ type Shard struct {
 	EndBytes []byte `json:"endBytes"`
 	// Address is the address of the shard. Address format is "host:port".
 	Address string `json:"address"`
+	// Endpoints are the addresses of more members of the shard.
+	// Linearizable reads & writes are balanced among Address & Endpoints.
+	Endpoints []string `json:"endpoints"`
+	// ReadEndpoints are the addresses of followers or learners of the shard.
+	// Serializable ranges are sent to them if given.
+	ReadEndpoints []string `json:"readEndpoints"`
+	// ReadBalancer chooses the read endpoint of a serializable range,
+	// "round-robin" or "least-latency". Default is "round-robin".
+	ReadBalancer string `json:"readBalancer"`
+	// HedgePercentile enables hedged ranges if positive: a range not replied within
+	// this percentile of the recent latencies of its endpoint, e.g. 95,
+	// is sent to another endpoint too, and the first reply is taken.
+	HedgePercentile float64 `json:"hedgePercentile"`
+	// Name identifies the shard on the ring of "consistent-hash" sharding. Default is the first endpoint.
+	// Renaming a shard moves its keys.
+	Name string `json:"name"`
+	// Weight scales the virtual nodes of the shard on the ring of "consistent-hash" sharding. Default is 1.
+	Weight float64 `json:"weight"`
+	// Retired is true if the shard is merged into another one. A retired shard owns no keys,
+	// it's kept in Shards so that the indexes of the others don't change.
+	Retired bool `json:"retired"`
+	// QuotaBackendBytes is the --quota-backend-bytes of the etcd cluster of the shard,
+	// checked before merging another shard into it. Default is 2GiB, the default of etcd.
+	QuotaBackendBytes int64 `json:"quotaBackendBytes"`
+	// CutoverRevision is the revision of the shard when keys were last moved into it by a migration.
+	// The watches attached to the shard after that start after it, so no event of the moved keys is missed.
+	CutoverRevision int64 `json:"cutoverRevision"`
+}
+
+// DefaultEndpoints returns the addresses serving linearizable reads & writes.
+func (s Shard) DefaultEndpoints() []string {
+	var ret []string
+	if len(s.Address) > 0 {
+		ret = append(ret, s.Address)
+	}
+	return append(ret, s.Endpoints...)
+}
+
+// Txn is the configurations of transactions
+type Txn struct {
+	// TwoPhaseCommit enables transactions across multiple shards.
+	// They are committed by a two-phase commit coordinated by the proxy.
+	TwoPhaseCommit bool `json:"twoPhaseCommit"`
+	// RecoverAfter is how long an unfinished cross-shard txn is left to its proxy
+	// before another proxy finishes it. Default is 1 minute.
+	RecoverAfter time.Duration `json:"recoverAfter"`
+}
+
+// Header is the configurations of response headers
+type Header struct {
+	// Synthetic makes the proxy emit its own response headers instead of the ones of shards.
+	Synthetic bool `json:"synthetic"`
+	// ClusterID of the proxy. Default is generated from the addresses of shards,
+	// so proxies with the same shards have the same cluster id.
+	ClusterID uint64 `json:"clusterId"`
+	// MemberID of the proxy. Default is generated from the hostname.
+	MemberID uint64 `json:"memberId"`
+}
+
+func (h *Header) setDefaults(shards []Shard) {
+	if h.ClusterID == 0 {
+		hash := fnv.New64a()
+		for _, shard := range shards {
+			hash.Write([]byte(shard.Address))
+			hash.Write([]byte{0})
+		}
+		h.ClusterID = hash.Sum64()
+	}
+	if h.MemberID == 0 {
+		hostname, _ := os.Hostname()
+		hash := fnv.New64a()
+		hash.Write([]byte(hostname))
+		h.MemberID = hash.Sum64()
+	}
+}
+
+// Compaction is the configurations of auto compaction, like the ones of etcd
+type Compaction struct {
+	// Mode is "periodic" or "revision". Empty means auto compaction is disabled.
+	Mode string `json:"mode"`
+	// Retention is a duration like "1h" in periodic mode, or the number of revisions to keep in revision mode.
+	Retention string `json:"retention"`
+}
+
+// Range is the configurations of range requests
+type Range struct {
+	// Coalesce coalesces identical concurrent ranges into one set of shard calls.
+	// Only serializable ranges & ranges at a pinned revision are coalesced.
+	Coalesce bool `json:"coalesce"`
+	// CachePrefixes are the hot prefixes cached in memory by watching the shards.
+	// Serializable ranges within them are served from the cache.
+	CachePrefixes []string `json:"cachePrefixes"`
+	// Partial makes ranges return the keys from healthy shards when some shards fail,
+	// unless disabled by the metadata of the range.
+	Partial bool `json:"partial"`
+	// ShardTimeout is the timeout of the range in each shard. 0 means no timeout.
+	ShardTimeout time.Duration `json:"shardTimeout"`
+}
+
+// ShardMap is the configurations of the shard map: the layout stored in etcd,
+// shared & watched by all proxies, so that they switch to a new layout together.
+type ShardMap struct {
+	// Enabled makes the proxy load the layout from the shard map instead of this file,
+	// and switch to new versions of it at runtime. The layout in this file is only
+	// published as the first version if the shard map doesn't exist.
+	Enabled bool `json:"enabled"`
+	// Endpoints are the addresses of the metadata etcd cluster storing the shard map.
+	// Default is the first shard in this file.
+	Endpoints []string `json:"endpoints"`
+	// Key of the shard map. Default is InternalPrefix + DefaultShardMapKey.
+	Key string `json:"key"`
 }
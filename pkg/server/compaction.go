@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// CompactionResultsKey is the gRPC metadata key of the per-shard results of Compact.
+// Each value is "<shard id>:<revision>:<ok or error>".
+const CompactionResultsKey = "x-etcd-shard-compactions"
+
+// ShardCompactionResult is the result of compaction in one shard
+type ShardCompactionResult struct {
+	ShardID  int
+	Revision int64
+	Header   *pb.ResponseHeader
+	Err      error
+}
+
+func (r ShardCompactionResult) String() string {
+	result := "ok"
+	if r.Err != nil {
+		result = r.Err.Error()
+	}
+	return fmt.Sprintf("%d:%d:%s", r.ShardID, r.Revision, result)
+}
+
+// compactShards compacts the shards in revs to their revisions.
+// A shard already compacted after its revision counts as compacted, with the header of its current revision.
+func compactShards(ctx context.Context, groupRunners GroupRunnerFactory, configs ShardingConfigs, revs RevisionVector, physical bool) []ShardCompactionResult {
+	shardClis := make([]ShardClient, 0, len(revs))
+	for _, shardCli := range configs.GetAllShardClis() {
+		if _, ok := revs[shardCli.GetShardID()]; ok {
+			shardClis = append(shardClis, shardCli)
+		}
+	}
+	results := make([]ShardCompactionResult, len(shardClis))
+	groupRunner := groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			shardID := shardClis[index].GetShardID()
+			result := &results[index]
+			result.ShardID = shardID
+			result.Revision = revs.Get(shardID)
+			resp, err := shardClis[index].Compact(ctx, &pb.CompactionRequest{Revision: result.Revision, Physical: physical})
+			if err != nil {
+				if status.Convert(err).Message() != rpctypes.ErrorDesc(rpctypes.ErrGRPCCompacted) {
+					result.Err = err
+					return nil
+				}
+				rangeResp, err := shardClis[index].Range(ctx, &pb.RangeRequest{Key: []byte{0}, CountOnly: true})
+				if err != nil {
+					result.Err = errors.Wrap(err, "failed to get header of compacted shard")
+					return nil
+				}
+				result.Header = rangeResp.Header
+				return nil
+			}
+			result.Header = resp.Header
+			return nil
+		})
+	}
+	_ = groupRunner.Wait()
+	return results
+}
+
+// compactionError returns an error describing all failed shards, nil if all shards are compacted.
+func compactionError(results []ShardCompactionResult) error {
+	var failed []string
+	var code = codes.OK
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if code == codes.OK {
+			code = status.Code(result.Err)
+		}
+		failed = append(failed, fmt.Sprintf("shard[%d]: %v", result.ShardID, result.Err))
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return status.Errorf(code, "compaction failed in %d of %d shards: %s", len(failed), len(results), strings.Join(failed, "; "))
+}
+
+// setCompactionResultsHeader sends the results in the response header of the gRPC call.
+func setCompactionResultsHeader(ctx context.Context, results []ShardCompactionResult) {
+	if grpc.ServerTransportStreamFromContext(ctx) == nil {
+		return
+	}
+	values := make([]string, len(results))
+	for i, result := range results {
+		values[i] = result.String()
+	}
+	_ = grpc.SetHeader(ctx, metadata.MD{CompactionResultsKey: values})
+}
+
+// currentRevisions returns the current revision of every shard.
+func currentRevisions(ctx context.Context, groupRunners GroupRunnerFactory, configs ShardingConfigs) (RevisionVector, error) {
+	shardClis := configs.GetAllShardClis()
+	revs := make([]int64, len(shardClis))
+	groupRunner := groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			// header revision of any range is the current revision
+			resp, err := shardClis[index].Range(ctx, &pb.RangeRequest{Key: []byte{0}, CountOnly: true})
+			if err != nil {
+				return errors.Wrapf(err, "failed to get revision of shard[%d]", shardClis[index].GetShardID())
+			}
+			revs[index] = resp.Header.Revision
+			return nil
+		})
+	}
+	err := groupRunner.Wait()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(RevisionVector, len(shardClis))
+	for i, shardCli := range shardClis {
+		ret[shardCli.GetShardID()] = revs[i]
+	}
+	return ret, nil
+}
+
+const (
+	// AutoCompactionPeriodic keeps the history of the retention period
+	AutoCompactionPeriodic = "periodic"
+	// AutoCompactionRevision keeps the latest retention revisions of every shard
+	AutoCompactionRevision = "revision"
+)
+
+const (
+	// autoCompactionRevisionInterval is how often the revision mode compacts, same as etcd.
+	autoCompactionRevisionInterval = 5 * time.Minute
+	// minAutoCompactionInterval is the min interval of sampling revisions in periodic mode.
+	minAutoCompactionInterval = time.Second
+)
+
+// AutoCompactor compacts all shards in background, like the auto compaction of etcd.
+type AutoCompactor struct {
+	groupRunners GroupRunnerFactory
+	configs      ShardingConfigs
+	lg           *zap.Logger
+
+	mode string
+	// period is the retention of periodic mode
+	period time.Duration
+	// revisions is the retention of revision mode
+	revisions int64
+	// interval is how often revisions are sampled in periodic mode, or compacted in revision mode
+	interval time.Duration
+}
+
+// NewAutoCompactor creates an AutoCompactor.
+// retention is a duration like "1h" in periodic mode, or a number of revisions in revision mode.
+func NewAutoCompactor(groupRunners GroupRunnerFactory, configs ShardingConfigs, mode string, retention string) (*AutoCompactor, error) {
+	ret := &AutoCompactor{
+		groupRunners: groupRunners,
+		configs:      configs,
+		lg:           zap.L().Named("AutoCompactor"),
+		mode:         mode,
+		interval:     autoCompactionRevisionInterval,
+	}
+	var err error
+	switch mode {
+	case AutoCompactionPeriodic:
+		ret.period, err = time.ParseDuration(retention)
+		if err == nil && ret.period <= 0 {
+			err = errors.New("retention must be positive")
+		}
+		// sample revisions 10 times in a period, same as etcd
+		ret.interval = ret.period / 10
+		if ret.interval < minAutoCompactionInterval {
+			ret.interval = minAutoCompactionInterval
+		}
+	case AutoCompactionRevision:
+		ret.revisions, err = strconv.ParseInt(retention, 10, 64)
+		if err == nil && ret.revisions <= 0 {
+			err = errors.New("retention must be positive")
+		}
+	default:
+		return nil, errors.Errorf("unknown auto compaction mode [%s]", mode)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad auto compaction retention [%s]", retention)
+	}
+	return ret, nil
+}
+
+// Run compacts periodically until ctx is done.
+func (c *AutoCompactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	type sample struct {
+		time time.Time
+		revs RevisionVector
+	}
+	var samples []sample
+	var compacted RevisionVector
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		revs, err := currentRevisions(ctx, c.groupRunners, c.configs)
+		if err != nil {
+			c.lg.Warn("failed to get revisions of shards", zap.Error(err))
+			continue
+		}
+		var target RevisionVector
+		if c.mode == AutoCompactionPeriodic {
+			now := time.Now()
+			samples = append(samples, sample{time: now, revs: revs})
+			// compact to the newest sample out of the period
+			for len(samples) > 0 && now.Sub(samples[0].time) >= c.period {
+				target = samples[0].revs
+				samples = samples[1:]
+			}
+		} else {
+			target = make(RevisionVector, len(revs))
+			for shardID, rev := range revs {
+				if rev > c.revisions {
+					target[shardID] = rev - c.revisions
+				}
+			}
+		}
+		if len(target) == 0 || !isAfter(target, compacted) {
+			continue
+		}
+		results := compactShards(ctx, c.groupRunners, c.configs, target, false)
+		err = compactionError(results)
+		if err != nil {
+			c.lg.Warn("failed to auto compact", zap.Error(err))
+			continue
+		}
+		c.lg.Info("auto compacted", zap.String("revisions", fmt.Sprint(target)))
+		if compacted == nil {
+			compacted = make(RevisionVector, len(target))
+		}
+		for shardID, rev := range target {
+			compacted[shardID] = rev
+		}
+	}
+}
+
+// isAfter returns true if any revision in a is after b.
+func isAfter(a, b RevisionVector) bool {
+	for shardID, rev := range a {
+		if rev > b.Get(shardID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// newCompactionTest returns the configs of 2 shards in memory, at revisions 6 & 3
+func newCompactionTest() (ShardingConfigs, []*memEtcd) {
+	shards, clis := newMemShards("b")
+	for i, n := range []int{5, 2} {
+		for j := 0; j < n; j++ {
+			_, _ = clis[i].Put(context.Background(), &pb.PutRequest{Key: []byte{byte('a' + i)}})
+		}
+	}
+	return NewDefaultShardingConfigs(shards), clis
+}
+
+func compactedRevision(m *memEtcd) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.compacted
+}
+
+func TestNewAutoCompactor(t *testing.T) {
+	configs, _ := newCompactionTest()
+	c, err := NewAutoCompactor(NewDefaultGroupRunnerFactory(), configs, AutoCompactionPeriodic, "1ns")
+	assert.NoError(t, err)
+	assert.Equal(t, minAutoCompactionInterval, c.interval)
+	c, err = NewAutoCompactor(NewDefaultGroupRunnerFactory(), configs, AutoCompactionPeriodic, "1h")
+	assert.NoError(t, err)
+	assert.Equal(t, 6*time.Minute, c.interval)
+	_, err = NewAutoCompactor(NewDefaultGroupRunnerFactory(), configs, AutoCompactionRevision, "0")
+	assert.Error(t, err)
+}
+
+func TestAutoCompactor_Run(t *testing.T) {
+	t.Run("revision", func(t *testing.T) {
+		configs, clis := newCompactionTest()
+		c, err := NewAutoCompactor(NewDefaultGroupRunnerFactory(), configs, AutoCompactionRevision, "2")
+		assert.NoError(t, err)
+		c.interval = time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go c.Run(ctx)
+		assert.Eventually(t, func() bool {
+			return compactedRevision(clis[0]) == 4 && compactedRevision(clis[1]) == 1
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		configs, clis := newCompactionTest()
+		c, err := NewAutoCompactor(NewDefaultGroupRunnerFactory(), configs, AutoCompactionPeriodic, "20ms")
+		assert.NoError(t, err)
+		c.interval = 2 * time.Millisecond
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go c.Run(ctx)
+		// the revisions sampled a period ago are compacted
+		assert.Eventually(t, func() bool {
+			return compactedRevision(clis[0]) == 6 && compactedRevision(clis[1]) == 3
+		}, time.Second, time.Millisecond)
+		_, _ = clis[0].Put(ctx, &pb.PutRequest{Key: []byte("a")})
+		assert.Eventually(t, func() bool {
+			return compactedRevision(clis[0]) == 7
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func TestKVProxy_Compact_allCompacted(t *testing.T) {
+	configs, clis := newCompactionTest()
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	ctx := context.Background()
+	resp, err := proxy.Compact(ctx, &pb.CompactionRequest{Revision: 2})
+	assert.NoError(t, err)
+	assert.NotNil(t, resp.Header)
+	assert.Equal(t, int64(2), compactedRevision(clis[1]))
+
+	resp, err = proxy.Compact(ctx, &pb.CompactionRequest{Revision: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), resp.Header.Revision)
+}
+
+func TestKVProxy_Compact_laggingShard(t *testing.T) {
+	configs, clis := newCompactionTest()
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	// shard[1] at revision 3 is compacted to its current revision
+	_, err := proxy.Compact(context.Background(), &pb.CompactionRequest{Revision: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), compactedRevision(clis[0]))
+	assert.Equal(t, int64(3), compactedRevision(clis[1]))
+}
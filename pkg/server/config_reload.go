@@ -0,0 +1,114 @@
+package server
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"go.uber.org/zap"
+)
+
+// ConfigReloader switches the versioned sharding configs to the layout of the configurations
+// reloaded from the config file, when the layout is not loaded from the shard map.
+// Changes of the clients of shards, like their endpoints, are applied at once, while changes
+// moving keys between shards are refused: keys are moved by migrations through the shard map.
+// The settings out of the layout take effect after a restart.
+type ConfigReloader struct {
+	builder *ShardingBuilder
+	configs *VersionedShardingConfigs
+	lg      *zap.Logger
+
+	mu sync.Mutex
+	// conf is the configurations in use
+	conf *config.Configurations
+}
+
+func NewConfigReloader(conf *config.Configurations, builder *ShardingBuilder, configs *VersionedShardingConfigs) *ConfigReloader {
+	return &ConfigReloader{
+		builder: builder,
+		configs: configs,
+		lg:      zap.L().Named("ConfigReloader"),
+		conf:    conf,
+	}
+}
+
+// Watch reloads the config file whenever it's changed.
+func (r *ConfigReloader) Watch() {
+	config.WatchConfigurationsFile(func(conf *config.Configurations, err error) {
+		if err == nil {
+			err = r.Reload(conf)
+		}
+		if err != nil {
+			r.lg.Warn("failed to reload config file", zap.Error(err))
+		}
+	})
+}
+
+// Reload switches to the layout of the configurations if it's changed, at the next epoch.
+func (r *ConfigReloader) Reload(conf *config.Configurations) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	from, to := r.conf.Layout(0), conf.Layout(0)
+	if reflect.DeepEqual(from, to) {
+		return nil
+	}
+	err := checkKeysNotMoved(from, to)
+	if err != nil {
+		return err
+	}
+	reloaded := r.conf.WithLayout(to)
+	prepared, err := r.builder.Prepare(reloaded)
+	if err != nil {
+		return err
+	}
+	epoch := r.configs.Current().Epoch + 1
+	if !r.configs.Switch(prepared.Configs, epoch) {
+		prepared.Discard()
+		return errors.Errorf("switched to epoch %d by others", epoch)
+	}
+	prepared.Commit()
+	r.conf = reloaded
+	r.lg.Info("switched to reloaded config", zap.Int64("epoch", epoch))
+	return nil
+}
+
+// shardKeys is what decides the keys owned by a shard, besides its index.
+type shardKeys struct {
+	keyRange KeyRange
+	ringName string
+	weight   float64
+	retired  bool
+}
+
+// checkKeysNotMoved returns an error if any key is owned by another shard in the layout to.
+func checkKeysNotMoved(from, to config.Layout) error {
+	if !reflect.DeepEqual(from.Sharding, to.Sharding) {
+		return errors.New("sharding can't be changed by reloading")
+	}
+	if !reflect.DeepEqual(from.ReplicatedPrefixes, to.ReplicatedPrefixes) {
+		return errors.New("replicated prefixes can't be changed by reloading")
+	}
+	if len(from.Shards) != len(to.Shards) {
+		return errors.Errorf("shards can't be added or removed by reloading, from %d to %d shards", len(from.Shards), len(to.Shards))
+	}
+	for i := range from.Shards {
+		if !reflect.DeepEqual(layoutShardKeys(from, i), layoutShardKeys(to, i)) {
+			return errors.Errorf("keys of shard[%d] can't be changed by reloading", i)
+		}
+	}
+	return nil
+}
+
+func layoutShardKeys(layout config.Layout, shard int) shardKeys {
+	conf := layout.Shards[shard]
+	ret := shardKeys{retired: conf.Retired}
+	switch {
+	case conf.Retired:
+	case isRangeSharding(layout.Sharding.Strategy):
+		ret.keyRange = layoutShardRange(layout.Shards, shard)
+	case layout.Sharding.Strategy == ShardingStrategyConsistentHash:
+		ret.ringName, ret.weight = ringName(conf), conf.Weight
+	}
+	return ret
+}
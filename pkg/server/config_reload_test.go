@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReloader_Reload(t *testing.T) {
+	conf := testConfigurations()
+	builder := NewShardingBuilder()
+	built, err := builder.Build(conf)
+	assert.NoError(t, err)
+	configs := NewVersionedShardingConfigs(built, 0)
+	reloader := NewConfigReloader(conf, builder, configs)
+
+	assert.NoError(t, reloader.Reload(testConfigurations()))
+	assert.Equal(t, int64(0), configs.Current().Epoch)
+
+	changed := testConfigurations()
+	changed.Shards[1].Endpoints = []string{"127.0.0.1:22479"}
+	assert.NoError(t, reloader.Reload(changed))
+	assert.Equal(t, int64(1), configs.Current().Epoch)
+	assert.Same(t, built.GetShardCli(0), configs.GetShardCli(0))
+	assert.NotSame(t, built.GetShardCli(1), configs.GetShardCli(1))
+
+	moved := testConfigurations()
+	moved.Shards[1].Endpoints = changed.Shards[1].Endpoints
+	moved.Shards[2].Start = "t"
+	assert.Error(t, reloader.Reload(moved))
+	added := testConfigurations()
+	added.Shards = append(added.Shards, added.Shards[2])
+	assert.Error(t, reloader.Reload(added))
+	assert.Equal(t, int64(1), configs.Current().Epoch)
+}
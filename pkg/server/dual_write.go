@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+)
+
+const (
+	// dualWriteStatsInterval is how often the stats of dual writes are logged.
+	dualWriteStatsInterval = time.Minute
+	// shadowReadTimeout is the timeout of a shadow read from the target.
+	shadowReadTimeout = 5 * time.Second
+	// maxShadowReads is the max number of shadow reads in flight, more are skipped.
+	maxShadowReads = 64
+	// mirrorTimeout is the timeout of mirroring a write to the targets.
+	mirrorTimeout = 5 * time.Second
+	// maxMirrors is the max number of mirrors in flight, more are dropped.
+	maxMirrors = 256
+	// shadowReadPollInterval is how often a shadow read polls the checkpoint of the migration,
+	// until the source at its revision is copied.
+	shadowReadPollInterval = migrationSaveInterval / 2
+)
+
+// DualWriter serves the ranges of migrations in config.MigrationDualWrite, whose source still owns them:
+// the writes to the sources are mirrored to the targets, and the reads from the sources are
+// shadow-read from the targets if enabled by the migrations, counting the mismatches.
+// Writes are mirrored in background, so they don't wait for the targets. A failed or dropped mirror
+// doesn't fail the write, the target is kept current by the migration anyway.
+type DualWriter struct {
+	configs ShardingConfigs
+	lg      *zap.Logger
+	// checkpoints are the checkpoints of migrations, nil if unknown
+	checkpoints migrationCheckpoints
+	// leases are the leases known to exist in targets
+	leases sync.Map
+	// copied is the latest revision of the source known to be copied by each migration
+	copied sync.Map
+	// shadowReads limits the shadow reads in flight
+	shadowReads chan struct{}
+	// mirrors limits the mirrors in flight
+	mirrors chan struct{}
+
+	mirrored       uint64
+	mirrorFailures uint64
+	mirrorsDropped uint64
+	shadowed       uint64
+	mismatches     uint64
+}
+
+// DualWriteStats is the counts of mirror writes & shadow reads
+type DualWriteStats struct {
+	Mirrored       uint64
+	MirrorFailures uint64
+	MirrorsDropped uint64
+	ShadowReads    uint64
+	Mismatches     uint64
+}
+
+type targetLease struct {
+	target ShardClient
+	id     int64
+}
+
+// migrationCheckpoints is implemented by Migrator
+type migrationCheckpoints interface {
+	Checkpoint(ctx context.Context, id string) (MigrationCheckpoint, error)
+}
+
+type DualWriterOption func(*DualWriter)
+
+// WithMigrator makes the shadow reads wait for the migrations of the migrator to copy the sources
+// at the revisions read, so the targets lagging behind aren't counted as mismatches.
+func WithMigrator(migrator *Migrator) DualWriterOption {
+	return func(w *DualWriter) {
+		if migrator != nil {
+			w.checkpoints = migrator
+		}
+	}
+}
+
+func NewDualWriter(configs ShardingConfigs, opts ...DualWriterOption) *DualWriter {
+	ret := &DualWriter{
+		configs:     configs,
+		lg:          zap.L().Named("DualWriter"),
+		shadowReads: make(chan struct{}, maxShadowReads),
+		mirrors:     make(chan struct{}, maxMirrors),
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
+
+// Run logs the stats periodically until ctx is done.
+func (w *DualWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(dualWriteStatsInterval)
+	defer ticker.Stop()
+	var last DualWriteStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := w.Stats()
+		if stats != last {
+			w.lg.Info("dual write stats", zap.Uint64("mirrored", stats.Mirrored), zap.Uint64("mirrorFailures", stats.MirrorFailures),
+				zap.Uint64("mirrorsDropped", stats.MirrorsDropped), zap.Uint64("shadowReads", stats.ShadowReads),
+				zap.Uint64("mismatches", stats.Mismatches))
+			last = stats
+		}
+	}
+}
+
+// Stats returns the counts since start.
+func (w *DualWriter) Stats() DualWriteStats {
+	return DualWriteStats{
+		Mirrored:       atomic.LoadUint64(&w.mirrored),
+		MirrorFailures: atomic.LoadUint64(&w.mirrorFailures),
+		MirrorsDropped: atomic.LoadUint64(&w.mirrorsDropped),
+		ShadowReads:    atomic.LoadUint64(&w.shadowed),
+		Mismatches:     atomic.LoadUint64(&w.mismatches),
+	}
+}
+
+// mirrorPut mirrors the put done in the source to the targets in background, then calls done.
+// done ends the write, so that a migration fencing the range waits for the mirror too.
+func (w *DualWriter) mirrorPut(req *pb.PutRequest, done func()) {
+	w.mirror(done, func(ctx context.Context) {
+		w.copyPut(ctx, req)
+	})
+}
+
+// mirrorDeleteRange mirrors the delete done in the source to the targets in background, then calls done.
+func (w *DualWriter) mirrorDeleteRange(req *pb.DeleteRangeRequest, done func()) {
+	w.mirror(done, func(ctx context.Context) {
+		w.copyDeleteRange(ctx, req)
+	})
+}
+
+// mirrorTxn mirrors the writes of the txn done in the source to the targets in background, then calls done.
+func (w *DualWriter) mirrorTxn(req *pb.TxnRequest, resp *pb.TxnResponse, done func()) {
+	w.mirror(done, func(ctx context.Context) {
+		w.copyTxn(ctx, req, resp)
+	})
+}
+
+// mirror runs fn in background with mirrorTimeout, then calls done.
+// It's dropped if there're too many mirrors in flight.
+func (w *DualWriter) mirror(done func(), fn func(ctx context.Context)) {
+	select {
+	case w.mirrors <- struct{}{}:
+	default:
+		atomic.AddUint64(&w.mirrorsDropped, 1)
+		done()
+		return
+	}
+	go func() {
+		defer func() { <-w.mirrors }()
+		defer done()
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// copyPut copies the key put in the source to the targets.
+func (w *DualWriter) copyPut(ctx context.Context, req *pb.PutRequest) {
+	for _, m := range dualWriteMigrations(w.configs, req.Key, nil) {
+		w.mirrorKey(ctx, m, req.Key)
+	}
+}
+
+// copyDeleteRange copies the delete done in the source to the targets.
+func (w *DualWriter) copyDeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) {
+	for _, m := range dualWriteMigrations(w.configs, req.Key, req.RangeEnd) {
+		if len(req.RangeEnd) == 0 {
+			w.mirrorKey(ctx, m, req.Key)
+			continue
+		}
+		part, _ := intersectRange(KeyRange{Key: req.Key, RangeEnd: req.RangeEnd}, m.KeyRange)
+		w.mirrorDelete(ctx, m, part)
+	}
+}
+
+// copyTxn copies the writes of the txn branches taken in the source to the targets.
+func (w *DualWriter) copyTxn(ctx context.Context, req *pb.TxnRequest, resp *pb.TxnResponse) {
+	ops := req.Failure
+	if resp.Succeeded {
+		ops = req.Success
+	}
+	for i, op := range ops {
+		switch r := op.Request.(type) {
+		case *pb.RequestOp_RequestPut:
+			w.copyPut(ctx, r.RequestPut)
+		case *pb.RequestOp_RequestDeleteRange:
+			w.copyDeleteRange(ctx, r.RequestDeleteRange)
+		case *pb.RequestOp_RequestTxn:
+			if i < len(resp.Responses) {
+				if nested := resp.Responses[i].GetResponseTxn(); nested != nil {
+					w.copyTxn(ctx, r.RequestTxn, nested)
+				}
+			}
+		}
+	}
+}
+
+// mirrorKey copies the current state of the key in the source to the target.
+// The migration copies the changes of the source in order too, so the target is read before the source,
+// and the key is only written if it's not changed in the target since then: a mirror delayed behind
+// the migration never overwrites a newer change with a stale one.
+func (w *DualWriter) mirrorKey(ctx context.Context, m RangeMigration, key []byte) {
+	target, err := m.Target.Range(ctx, &pb.RangeRequest{Key: key, KeysOnly: true})
+	if err != nil {
+		w.mirrorFailed(m, key, err)
+		return
+	}
+	var modRevision int64
+	if len(target.Kvs) > 0 {
+		modRevision = target.Kvs[0].ModRevision
+	}
+	source := w.configs.GetShardCli(m.Source)
+	resp, err := source.Range(ctx, &pb.RangeRequest{Key: key})
+	if err != nil {
+		w.mirrorFailed(m, key, err)
+		return
+	}
+	op := &pb.RequestOp{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: key}}}
+	if len(resp.Kvs) > 0 {
+		kv := resp.Kvs[0]
+		if kv.Lease != 0 {
+			err = w.grantLease(ctx, source, m.Target, kv.Lease)
+			if err != nil {
+				w.mirrorFailed(m, key, err)
+				return
+			}
+		}
+		op = &pb.RequestOp{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: key, Value: kv.Value, Lease: kv.Lease}}}
+	}
+	w.mirrorUnchanged(ctx, m, key, modRevision, op)
+}
+
+// mirrorDelete deletes the keys of the part of a range in the target which are deleted in the source,
+// if they're not changed in the target since read, like mirrorKey.
+func (w *DualWriter) mirrorDelete(ctx context.Context, m RangeMigration, part KeyRange) {
+	target, err := m.Target.Range(ctx, &pb.RangeRequest{Key: part.Key, RangeEnd: part.RangeEnd, KeysOnly: true})
+	if err != nil {
+		w.mirrorFailed(m, part.Key, err)
+		return
+	}
+	source, err := w.configs.GetShardCli(m.Source).Range(ctx, &pb.RangeRequest{Key: part.Key, RangeEnd: part.RangeEnd, KeysOnly: true})
+	if err != nil {
+		w.mirrorFailed(m, part.Key, err)
+		return
+	}
+	exists := make(map[string]bool, len(source.Kvs))
+	for _, kv := range source.Kvs {
+		exists[string(kv.Key)] = true
+	}
+	for _, kv := range target.Kvs {
+		if !exists[string(kv.Key)] {
+			op := &pb.RequestOp{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: kv.Key}}}
+			w.mirrorUnchanged(ctx, m, kv.Key, kv.ModRevision, op)
+		}
+	}
+}
+
+// mirrorUnchanged does the op in the target if the key isn't changed since read at its mod revision.
+// A changed key is left to the migration, which has copied a newer change of the source.
+func (w *DualWriter) mirrorUnchanged(ctx context.Context, m RangeMigration, key []byte, modRevision int64, op *pb.RequestOp) {
+	resp, err := m.Target.Txn(ctx, &pb.TxnRequest{
+		Compare: []*pb.Compare{{Key: key, Target: pb.Compare_MOD, Result: pb.Compare_EQUAL,
+			TargetUnion: &pb.Compare_ModRevision{ModRevision: modRevision}}},
+		Success: []*pb.RequestOp{op},
+	})
+	if err != nil {
+		w.mirrorFailed(m, key, err)
+		return
+	}
+	if resp.Succeeded {
+		atomic.AddUint64(&w.mirrored, 1)
+	}
+}
+
+func (w *DualWriter) mirrorFailed(m RangeMigration, key []byte, err error) {
+	atomic.AddUint64(&w.mirrorFailures, 1)
+	w.lg.Warn("failed to mirror write to target", zap.String("migration", m.ID), zap.ByteString("key", key), zap.Error(err))
+}
+
+// grantLease grants the lease of the source in the target if it's missing.
+func (w *DualWriter) grantLease(ctx context.Context, source, target ShardClient, id int64) error {
+	key := targetLease{target: target, id: id}
+	if _, ok := w.leases.Load(key); ok {
+		return nil
+	}
+	err := grantTargetLease(ctx, source, target, id)
+	if err != nil {
+		return err
+	}
+	w.leases.Store(key, struct{}{})
+	return nil
+}
+
+// shadowRange reads the parts of the range in migrations with shadow reads from their targets
+// in background, and compares them with the keys read from the sources at the read revisions.
+// Only latest, unfiltered & complete ranges are compared.
+func (w *DualWriter) shadowRange(req *pb.RangeRequest, resp *pb.RangeResponse, readRevs RevisionVector) {
+	if req.Revision != 0 || req.CountOnly || resp.More || req.MinModRevision != 0 || req.MaxModRevision != 0 ||
+		req.MinCreateRevision != 0 || req.MaxCreateRevision != 0 {
+		return
+	}
+	for _, m := range dualWriteMigrations(w.configs, req.Key, req.RangeEnd) {
+		rev := readRevs[m.Source]
+		if !m.ShadowRead || rev == 0 {
+			continue
+		}
+		select {
+		case w.shadowReads <- struct{}{}:
+		default:
+			// too many in flight, skipped
+			continue
+		}
+		go func(m RangeMigration) {
+			defer func() { <-w.shadowReads }()
+			w.shadowRead(m, req, resp.Kvs, rev)
+		}(m)
+	}
+}
+
+// shadowRead compares the part of the range in the target with the keys read from the source at rev.
+// The target is read after the migration has copied the source at rev, and the keys changed
+// in the source since then are skipped, as their changes may not be copied or mirrored yet.
+func (w *DualWriter) shadowRead(m RangeMigration, req *pb.RangeRequest, kvs []*mvccpb.KeyValue, rev int64) {
+	part := KeyRange{Key: req.Key}
+	if len(req.RangeEnd) > 0 {
+		part, _ = intersectRange(KeyRange{Key: req.Key, RangeEnd: req.RangeEnd}, m.KeyRange)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shadowReadTimeout)
+	defer cancel()
+	err := w.waitCopied(ctx, m.ID, rev)
+	if err != nil {
+		w.lg.Warn("failed to wait for migration to copy the source", zap.String("migration", m.ID), zap.Int64("revision", rev), zap.Error(err))
+		return
+	}
+	shadow, err := m.Target.Range(ctx, &pb.RangeRequest{Key: part.Key, RangeEnd: part.RangeEnd, KeysOnly: req.KeysOnly})
+	if err != nil {
+		w.lg.Warn("failed to shadow read from target", zap.String("migration", m.ID), zap.Error(err))
+		return
+	}
+	current, err := w.configs.GetShardCli(m.Source).Range(ctx, &pb.RangeRequest{Key: part.Key, RangeEnd: part.RangeEnd, KeysOnly: true})
+	if err != nil {
+		w.lg.Warn("failed to reread from source", zap.String("migration", m.ID), zap.Error(err))
+		return
+	}
+	atomic.AddUint64(&w.shadowed, 1)
+	inPart := func(key []byte) bool {
+		if part.RangeEnd == nil {
+			return bytes.Equal(key, part.Key)
+		}
+		return bytes.Compare(key, part.Key) >= 0 && rangeEndBefore(key, part.RangeEnd)
+	}
+	read := make(map[string]*mvccpb.KeyValue)
+	for _, kv := range kvs {
+		if inPart(kv.Key) {
+			read[string(kv.Key)] = kv
+		}
+	}
+	modRevisions := make(map[string]int64, len(current.Kvs))
+	for _, kv := range current.Kvs {
+		modRevisions[string(kv.Key)] = kv.ModRevision
+	}
+	// changed returns true if the key is put or deleted in the source since read
+	changed := func(key string) bool {
+		readKv, read := read[key]
+		modRevision, exists := modRevisions[key]
+		return read != exists || read && readKv.ModRevision != modRevision
+	}
+	var mismatches int
+	shadowed := make(map[string]bool, len(shadow.Kvs))
+	for _, kv := range shadow.Kvs {
+		key := string(kv.Key)
+		shadowed[key] = true
+		if readKv, ok := read[key]; !changed(key) && (!ok || !bytes.Equal(readKv.Value, kv.Value)) {
+			mismatches++
+		}
+	}
+	for key := range read {
+		if !shadowed[key] && !changed(key) {
+			// missing in the target
+			mismatches++
+		}
+	}
+	if mismatches > 0 {
+		atomic.AddUint64(&w.mismatches, 1)
+		w.lg.Warn("shadow read mismatch", zap.String("migration", m.ID), zap.ByteString("key", part.Key),
+			zap.ByteString("rangeEnd", part.RangeEnd), zap.Int("mismatchedKeys", mismatches))
+	}
+}
+
+// waitCopied waits until the migration has copied the source at the revision to the target,
+// polling its checkpoint. It doesn't wait without the checkpoints of migrations.
+func (w *DualWriter) waitCopied(ctx context.Context, id string, rev int64) error {
+	if w.checkpoints == nil {
+		return nil
+	}
+	for {
+		if copied, ok := w.copied.Load(id); ok && copied.(int64) >= rev {
+			return nil
+		}
+		cp, err := w.checkpoints.Checkpoint(ctx, id)
+		if err != nil {
+			return err
+		}
+		if cp.Revision >= rev {
+			w.copied.Store(id, cp.Revision)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(shadowReadPollInterval):
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// fakeCheckpoints returns the checkpoints of a migration copying the source at revisions in turn
+type fakeCheckpoints struct {
+	revisions []int64
+}
+
+func (f *fakeCheckpoints) Checkpoint(ctx context.Context, id string) (MigrationCheckpoint, error) {
+	cp := MigrationCheckpoint{Revision: f.revisions[0]}
+	if len(f.revisions) > 1 {
+		f.revisions = f.revisions[1:]
+	}
+	return cp, nil
+}
+
+// waitMirrors waits until the mirrors in flight are done
+func waitMirrors(t *testing.T, w *DualWriter) {
+	assert.Eventually(t, func() bool {
+		return len(w.mirrors) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestDualWriter(t *testing.T) {
+	source, other, target := &hookedEtcd{memEtcd: newMemEtcd(0)}, newMemEtcd(1), newMemEtcd(2)
+	migration := RangeMigration{
+		KeyRange: KeyRange{Key: []byte("m"), RangeEnd: []byte("s")}, ID: "split",
+		Source: 0, Target: target, State: config.MigrationDualWrite, ShadowRead: true,
+	}
+	configs := NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("s"), cli: source},
+		&ShardImpl{start: []byte("s"), end: noEnd, cli: other},
+	}, WithMigrations(migration))
+	w := NewDualWriter(configs)
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter), WithDualWriter(w))
+	ctx := context.Background()
+	put := func(key, value string) {
+		_, err := proxy.Put(ctx, &pb.PutRequest{Key: []byte(key), Value: []byte(value)})
+		assert.NoError(t, err)
+		waitMirrors(t, w)
+	}
+
+	put("a", "1")
+	put("o", "2")
+	_, err := proxy.Txn(ctx, &pb.TxnRequest{Success: []*pb.RequestOp{
+		{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: []byte("p"), Value: []byte("3")}}},
+	}})
+	assert.NoError(t, err)
+	waitMirrors(t, w)
+	assert.Equal(t, []string{"o", "p"}, target.keys())
+	assert.Equal(t, DualWriteStats{Mirrored: 2}, w.Stats())
+
+	_, err = proxy.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: []byte("o"), RangeEnd: []byte("p")})
+	assert.NoError(t, err)
+	waitMirrors(t, w)
+	assert.Equal(t, []string{"p"}, target.keys())
+
+	// a newer put of p is copied by the migration before the mirror of the older one,
+	// which doesn't overwrite it
+	source.hook(nil, func(in *pb.RangeRequest) error {
+		if !in.KeysOnly && string(in.Key) == "p" {
+			_, _ = target.Put(ctx, &pb.PutRequest{Key: []byte("p"), Value: []byte("5")})
+		}
+		return nil
+	})
+	put("p", "4")
+	source.hook(nil, nil)
+	_, _ = source.memEtcd.Put(ctx, &pb.PutRequest{Key: []byte("p"), Value: []byte("5")})
+	assert.Equal(t, []byte("5"), target.get("p"))
+	assert.Equal(t, DualWriteStats{Mirrored: 3}, w.Stats())
+
+	// n is in the source only, read after the migration copies the source at the revision read
+	_, _ = source.memEtcd.Put(ctx, &pb.PutRequest{Key: []byte("n"), Value: []byte("vn")})
+	req := &pb.RangeRequest{Key: []byte("a"), RangeEnd: []byte("q")}
+	read, _ := source.Range(ctx, req)
+	checkpoints := &fakeCheckpoints{revisions: []int64{read.Header.Revision - 1, read.Header.Revision}}
+	w.checkpoints = checkpoints
+	w.shadowRead(migration, req, read.Kvs, read.Header.Revision)
+	assert.Equal(t, []int64{read.Header.Revision}, checkpoints.revisions)
+	assert.Equal(t, uint64(1), w.Stats().Mismatches)
+
+	// n is put in the source again after read, so it's not compared
+	_, _ = source.memEtcd.Put(ctx, &pb.PutRequest{Key: []byte("n"), Value: []byte("vn2")})
+	w.shadowRead(migration, req, read.Kvs, read.Header.Revision)
+	assert.Equal(t, uint64(1), w.Stats().Mismatches)
+
+	_, _ = target.Put(ctx, &pb.PutRequest{Key: []byte("n"), Value: []byte("vn2")})
+	read, _ = source.Range(ctx, req)
+	checkpoints.revisions = []int64{read.Header.Revision}
+	w.shadowRead(migration, req, read.Kvs, read.Header.Revision)
+	assert.Equal(t, DualWriteStats{Mirrored: 3, ShadowReads: 3, Mismatches: 1}, w.Stats())
+}
+
+func TestDualWriter_mirror(t *testing.T) {
+	w := NewDualWriter(newFakeShardingConfigs([]string{"a"}))
+	release := make(chan struct{})
+	done := make(chan struct{})
+	w.mirror(func() { close(done) }, func(ctx context.Context) {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		<-release
+	})
+	// the write isn't done until it's mirrored
+	select {
+	case <-done:
+		t.Fatal("done before mirrored")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-done
+	waitMirrors(t, w)
+
+	// dropped if too many in flight
+	for i := 0; i < maxMirrors; i++ {
+		w.mirrors <- struct{}{}
+	}
+	var called bool
+	w.mirror(func() { called = true }, func(ctx context.Context) {
+		t.Fatal("dropped mirror run")
+	})
+	assert.True(t, called)
+	assert.Equal(t, uint64(1), w.Stats().MirrorsDropped)
+}
+
+func TestDefaultShardingConfigs_clipNotOwned(t *testing.T) {
+	clis := []*memEtcd{newMemEtcd(0), newMemEtcd(1)}
+	migration := RangeMigration{
+		KeyRange: KeyRange{Key: []byte("m"), RangeEnd: []byte("s")},
+		Source:   0, Target: clis[1], State: config.MigrationDualWrite,
+	}
+	shards := []Shard{
+		&ShardImpl{start: []byte{}, end: []byte("s"), cli: clis[0]},
+		&ShardImpl{start: []byte("s"), end: noEnd, cli: clis[1]},
+	}
+	configs := NewDefaultShardingConfigs(shards, WithMigrations(migration))
+	got := configs.GetShardClis([]byte("a"), noEnd)
+	assert.Same(t, clis[0], got[0])
+	assert.Equal(t, &clippedShardClient{ShardClient: clis[1], keyRange: KeyRange{Key: []byte("s"), RangeEnd: noEnd}}, got[1])
+	assert.True(t, notOwned([]RangeMigration{migration}, 1))
+	assert.False(t, notOwned([]RangeMigration{migration}, 0))
+
+	migration.State = config.MigrationCleanup
+	configs = NewDefaultShardingConfigs(shards, WithMigrations(migration))
+	got = configs.GetShardClis([]byte("a"), noEnd)
+	assert.IsType(t, new(clippedShardClient), got[0])
+	assert.Same(t, clis[1], got[1])
+}
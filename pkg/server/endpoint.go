@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// ReadBalancerRoundRobin sends reads to endpoints in turn
+	ReadBalancerRoundRobin = "round-robin"
+	// ReadBalancerLeastLatency sends reads to the endpoint with the least latency
+	ReadBalancerLeastLatency = "least-latency"
+)
+
+const (
+	// readFailureBackoff is how long an endpoint is not picked after a failed read,
+	// doubled for every consecutive failure up to maxReadFailureBackoff.
+	readFailureBackoff = 100 * time.Millisecond
+	// maxReadFailureBackoff is the max backoff of a failing endpoint
+	maxReadFailureBackoff = 5 * time.Second
+)
+
+// latencyEWMAWeight is the weight of a new sample in the moving average of latency.
+const latencyEWMAWeight = 0.2
+
+// latencySampleSize is the number of recent samples kept for latency percentiles.
+const latencySampleSize = 256
+
+// latencyDecayHalfLife is the half life of the moving average of latency without new samples,
+// so that an endpoint not picked for its high latency is tried again.
+const latencyDecayHalfLife = 5 * time.Second
+
+// endpoint is a member of a shard
+type endpoint struct {
+	address string
+	conn    *grpc.ClientConn
+	EtcdGrpcClient
+	latency *latencyTracker
+}
+
+func newEndpoint(address string) (*endpoint, error) {
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial etcd server [%s]", address)
+	}
+	return &endpoint{
+		address:        address,
+		conn:           conn,
+		EtcdGrpcClient: newEtcdGrpcClient(conn),
+		latency:        new(latencyTracker),
+	}, nil
+}
+
+func newEtcdGrpcClient(conn *grpc.ClientConn) EtcdGrpcClientImpl {
+	return EtcdGrpcClientImpl{
+		KVClient:    pb.NewKVClient(conn),
+		WatchClient: pb.NewWatchClient(conn),
+		LeaseClient: pb.NewLeaseClient(conn),
+	}
+}
+
+func (e *endpoint) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	start := time.Now()
+	resp, err := e.EtcdGrpcClient.Range(ctx, in, opts...)
+	latency := time.Since(start)
+	// a canceled read, e.g. the loser of hedged reads, didn't take its whole latency
+	if ctx.Err() != nil {
+		return resp, err
+	}
+	// a failed read is not a latency sample, or it'd skew the latency by how fast it fails
+	if err != nil {
+		e.latency.ObserveFailure()
+		return resp, err
+	}
+	e.latency.Observe(latency)
+	return resp, err
+}
+
+// latencyTracker tracks the moving average & the recent samples of latency of successful reads,
+// and the consecutive failed reads.
+type latencyTracker struct {
+	mu      sync.Mutex
+	average time.Duration
+	// updated is when the last sample is observed
+	updated time.Time
+	samples [latencySampleSize]time.Duration
+	// count is the number of all observed samples
+	count int
+	// failures is the number of consecutive failed reads
+	failures int
+	// failed is when the last failed read is observed
+	failed time.Time
+}
+
+func (l *latencyTracker) Observe(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.samples[l.count%latencySampleSize] = latency
+	l.count++
+	l.failures = 0
+	if l.average == 0 {
+		l.average, l.updated = latency, now
+		return
+	}
+	l.average = time.Duration(float64(l.decayed(now))*(1-latencyEWMAWeight) + float64(latency)*latencyEWMAWeight)
+	l.updated = now
+}
+
+// ObserveFailure observes a failed read, which backs off the endpoint.
+func (l *latencyTracker) ObserveFailure() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures++
+	l.failed = time.Now()
+}
+
+// BackingOff returns true if the endpoint is backing off after failed reads at now.
+func (l *latencyTracker) BackingOff(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures == 0 {
+		return false
+	}
+	backoff := maxReadFailureBackoff
+	if l.failures < 32 && readFailureBackoff<<(l.failures-1) < maxReadFailureBackoff {
+		backoff = readFailureBackoff << (l.failures - 1)
+	}
+	return now.Before(l.failed.Add(backoff))
+}
+
+// Average returns the moving average decayed since the last sample, 0 if no sample yet.
+func (l *latencyTracker) Average() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.decayed(time.Now())
+}
+
+// decayed returns the moving average halved every latencyDecayHalfLife since the last sample.
+func (l *latencyTracker) decayed(now time.Time) time.Duration {
+	idle := now.Sub(l.updated)
+	if idle <= 0 {
+		return l.average
+	}
+	return time.Duration(float64(l.average) * math.Exp2(-float64(idle)/float64(latencyDecayHalfLife)))
+}
+
+// Percentile returns the p-th percentile of recent samples, p in (0, 100].
+// ok is false if there're less than minSamples samples.
+func (l *latencyTracker) Percentile(p float64, minSamples int) (latency time.Duration, ok bool) {
+	l.mu.Lock()
+	n := l.count
+	if n > latencySampleSize {
+		n = latencySampleSize
+	}
+	if n == 0 || n < minSamples {
+		l.mu.Unlock()
+		return 0, false
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, l.samples[:n])
+	l.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	index := int(math.Ceil(p/100*float64(n))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return samples[index], true
+}
+
+// endpointPicker chooses an endpoint for a request
+type endpointPicker interface {
+	Pick(endpoints []*endpoint) *endpoint
+}
+
+func newEndpointPicker(balancer string) (endpointPicker, error) {
+	switch balancer {
+	case "", ReadBalancerRoundRobin:
+		return new(roundRobinPicker), nil
+	case ReadBalancerLeastLatency:
+		return leastLatencyPicker{}, nil
+	}
+	return nil, errors.Errorf("unknown read balancer [%s]", balancer)
+}
+
+type roundRobinPicker struct {
+	next uint64
+}
+
+func (r *roundRobinPicker) Pick(endpoints []*endpoint) *endpoint {
+	next := atomic.AddUint64(&r.next, 1)
+	return endpoints[next%uint64(len(endpoints))]
+}
+
+type leastLatencyPicker struct{}
+
+// Pick returns the endpoint with least latency. An endpoint without sample is tried first,
+// and an endpoint not picked for long is tried again as its latency decays.
+// An endpoint backing off after failed reads is picked only if all endpoints are.
+func (leastLatencyPicker) Pick(endpoints []*endpoint) *endpoint {
+	now := time.Now()
+	var ret *endpoint
+	var min time.Duration
+	var retBackingOff bool
+	for _, e := range endpoints {
+		latency := e.latency.Average()
+		backingOff := e.latency.BackingOff(now)
+		if ret == nil || retBackingOff && !backingOff || backingOff == retBackingOff && latency < min {
+			ret, min, retBackingOff = e, latency, backingOff
+		}
+	}
+	return ret
+}
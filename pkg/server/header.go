@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
+)
+
+// HeaderStamper replaces the response headers of shards with proxy-level headers.
+// A proxy-level header has the stable cluster id & member id of the proxy, and a
+// composite revision: the sum of the revisions of all shards.
+// The revisions are synced from all shards at start & every headerSyncInterval, and raised
+// by every response seen in between. As revisions of shards only grow, the composite revision
+// is monotonic across restarts, and proxies agree on it up to the sync interval.
+//
+// Every stamped composite revision is recorded in the history with the revision vector it's
+// composed of, to be mapped back by RevisionsAt. The history reaches back headerHistoryRetention,
+// or the latest headerHistorySize stamped revisions under heavy writes, whichever is shorter.
+//
+// A nil *HeaderStamper leaves headers of shards as is.
+type HeaderStamper struct {
+	clusterID uint64
+	memberID  uint64
+	lg        *zap.Logger
+
+	mu       sync.Mutex
+	revs     RevisionVector
+	raftTerm uint64
+	// history is the stamped composite revisions & their revision vectors in ascending order.
+	history []revisionSnapshot
+}
+
+type revisionSnapshot struct {
+	revision int64
+	revs     RevisionVector
+	// recorded is when the revision is stamped first
+	recorded time.Time
+}
+
+const (
+	// headerHistoryRetention is how long a stamped composite revision can be mapped back to its revision vector.
+	headerHistoryRetention = 10 * time.Minute
+	// headerHistorySize is the max number of stamped composite revisions kept in the history.
+	headerHistorySize = 1 << 16
+	// headerSyncInterval is the interval to sync the revisions of all shards.
+	headerSyncInterval = time.Second
+)
+
+func NewHeaderStamper(clusterID, memberID uint64) *HeaderStamper {
+	return &HeaderStamper{
+		clusterID: clusterID,
+		memberID:  memberID,
+		lg:        zap.L().Named("HeaderStamper"),
+		revs:      make(RevisionVector),
+	}
+}
+
+// Observe records the header of a response from the shard.
+func (h *HeaderStamper) Observe(shardID int, header *pb.ResponseHeader) {
+	if h == nil || header == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if header.Revision > h.revs[shardID] {
+		h.revs[shardID] = header.Revision
+	}
+	if header.RaftTerm > h.raftTerm {
+		h.raftTerm = header.RaftTerm
+	}
+}
+
+// Stamp returns the proxy-level header to replace header.
+func (h *HeaderStamper) Stamp(header *pb.ResponseHeader) *pb.ResponseHeader {
+	if h == nil {
+		return header
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	revision := h.revs.Sum()
+	h.record(revision, time.Now())
+	return &pb.ResponseHeader{
+		ClusterId: h.clusterID,
+		MemberId:  h.memberID,
+		Revision:  revision,
+		RaftTerm:  h.raftTerm,
+	}
+}
+
+// Sync raises the revisions to the current revisions of all shards.
+func (h *HeaderStamper) Sync(ctx context.Context, groupRunners GroupRunnerFactory, configs ShardingConfigs) error {
+	if h == nil {
+		return nil
+	}
+	revs, err := currentRevisions(ctx, groupRunners, configs)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for shardID, revision := range revs {
+		if revision > h.revs[shardID] {
+			h.revs[shardID] = revision
+		}
+	}
+	return nil
+}
+
+// Run syncs the revisions of all shards every headerSyncInterval until ctx is done.
+func (h *HeaderStamper) Run(ctx context.Context, groupRunners GroupRunnerFactory, configs ShardingConfigs) {
+	if h == nil {
+		return
+	}
+	ticker := time.NewTicker(headerSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := h.Sync(ctx, groupRunners, configs)
+			if err != nil && ctx.Err() == nil {
+				h.lg.Warn("failed to sync revisions of shards", zap.Error(err))
+			}
+		}
+	}
+}
+
+// record records the stamped composite revision if it's new, and evicts the snapshots
+// out of the retention or the size of the history.
+func (h *HeaderStamper) record(revision int64, now time.Time) {
+	if n := len(h.history); n > 0 && h.history[n-1].revision >= revision {
+		return
+	}
+	h.history = append(h.history, revisionSnapshot{revision: revision, revs: h.revs.Clone(), recorded: now})
+	var evicted int
+	if len(h.history) > headerHistorySize {
+		evicted = len(h.history) - headerHistorySize
+	}
+	for evicted < len(h.history)-1 && now.Sub(h.history[evicted].recorded) > headerHistoryRetention {
+		evicted++
+	}
+	// the evicted ones are freed once the history is grown by append
+	h.history = h.history[evicted:]
+}
+
+// RevisionsAt maps a composite revision back to the revision vector it's composed of.
+// If the revision is not stamped, it returns the newest vector before it.
+// ok is false if the revision is older than the history, or is a future revision.
+func (h *HeaderStamper) RevisionsAt(revision int64) (revs RevisionVector, ok bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := h.revs.Sum()
+	if revision > current {
+		return nil, false
+	}
+	// the current revision may be stamped by other proxies
+	h.record(current, time.Now())
+	// the index of the first snapshot after the revision
+	i := sort.Search(len(h.history), func(i int) bool {
+		return h.history[i].revision > revision
+	})
+	if i == 0 {
+		return nil, false
+	}
+	return h.history[i-1].revs.Clone(), true
+}
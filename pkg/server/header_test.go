@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHeaderStamper_Sync(t *testing.T) {
+	configs, clis := newCompactionTest()
+	ctx := context.Background()
+	// a proxy which served a write to shard[0], and another one started later
+	h := NewHeaderStamper(1, 1)
+	h.Observe(0, &pb.ResponseHeader{Revision: 6})
+	restarted := NewHeaderStamper(1, 2)
+	assert.NoError(t, restarted.Sync(ctx, NewDefaultGroupRunnerFactory(), configs))
+	assert.Equal(t, int64(9), restarted.Stamp(nil).Revision)
+	assert.Equal(t, int64(6), h.Stamp(nil).Revision)
+
+	// both agree on the revision once synced
+	_, _ = clis[1].Put(ctx, &pb.PutRequest{Key: []byte("b")})
+	for _, stamper := range []*HeaderStamper{h, restarted} {
+		assert.NoError(t, stamper.Sync(ctx, NewDefaultGroupRunnerFactory(), configs))
+		assert.Equal(t, int64(10), stamper.Stamp(nil).Revision)
+		revs, ok := stamper.RevisionsAt(10)
+		assert.True(t, ok)
+		assert.Equal(t, RevisionVector{0: 6, 1: 4}, revs)
+	}
+	// a stale header doesn't move the revision back
+	h.Observe(1, &pb.ResponseHeader{Revision: 2})
+	assert.Equal(t, int64(10), h.Stamp(nil).Revision)
+}
+
+func TestHeaderStamper_RevisionsAt(t *testing.T) {
+	h := NewHeaderStamper(1, 1)
+	h.Observe(0, &pb.ResponseHeader{Revision: 5})
+	h.Observe(1, &pb.ResponseHeader{Revision: 3})
+	// observed but not stamped revisions are not recorded
+	h.Observe(0, &pb.ResponseHeader{Revision: 6})
+	assert.Equal(t, int64(9), h.Stamp(nil).Revision)
+	h.Observe(1, &pb.ResponseHeader{Revision: 5})
+	assert.Equal(t, int64(11), h.Stamp(nil).Revision)
+	assert.Len(t, h.history, 2)
+
+	revs, ok := h.RevisionsAt(10)
+	assert.True(t, ok)
+	assert.Equal(t, RevisionVector{0: 6, 1: 3}, revs)
+	_, ok = h.RevisionsAt(8)
+	assert.False(t, ok)
+	_, ok = h.RevisionsAt(12)
+	assert.False(t, ok)
+
+	// the revisions out of the retention are evicted
+	for i := range h.history {
+		h.history[i].recorded = h.history[i].recorded.Add(-headerHistoryRetention - time.Second)
+	}
+	h.Observe(0, &pb.ResponseHeader{Revision: 7})
+	assert.Equal(t, int64(12), h.Stamp(nil).Revision)
+	_, ok = h.RevisionsAt(11)
+	assert.False(t, ok)
+	revs, ok = h.RevisionsAt(12)
+	assert.True(t, ok)
+	assert.Equal(t, RevisionVector{0: 7, 1: 5}, revs)
+
+	// at most headerHistorySize revisions are kept
+	for i := 0; i < headerHistorySize; i++ {
+		h.Observe(0, &pb.ResponseHeader{Revision: int64(8 + i)})
+		h.Stamp(nil)
+	}
+	assert.Len(t, h.history, headerHistorySize)
+	_, ok = h.RevisionsAt(12)
+	assert.False(t, ok)
+	_, ok = h.RevisionsAt(13)
+	assert.True(t, ok)
+}
+
+func TestHeaderStamper_getThenWatch(t *testing.T) {
+	clis := []*memEtcd{newMemEtcd(0), newMemEtcd(1)}
+	configs := NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("m"), cli: clis[0]},
+		&ShardImpl{start: []byte("m"), end: noEnd, cli: clis[1]},
+	})
+	headers := NewHeaderStamper(1, 1)
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter), WithHeaderStamper(headers))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	put := func(key, value string) {
+		_, err := proxy.Put(ctx, &pb.PutRequest{Key: []byte(key), Value: []byte(value)})
+		assert.NoError(t, err)
+	}
+	put("a", "1")
+	put("n", "1")
+	resp, err := proxy.Range(ctx, &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd})
+	assert.NoError(t, err)
+	revision := resp.Header.Revision
+	put("a", "2")
+	put("n", "2")
+
+	// a get at the composite revision reads the snapshot of every shard at it
+	resp, err = proxy.Range(ctx, &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd, Revision: revision})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "n"}, kvKeys(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		assert.Equal(t, []byte("1"), kv.Value)
+	}
+	_, err = proxy.Range(ctx, &pb.RangeRequest{Key: []byte("a"), Revision: 1})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// a watch after the composite revision receives the writes after the get only
+	watch := func(startRev int64) (*fakeWatchServer, chan error) {
+		client := &fakeWatchServer{ctx: ctx, reqs: make(chan *pb.WatchRequest, 10), resps: make(chan *pb.WatchResponse, 10)}
+		done := make(chan error, 1)
+		go func() {
+			done <- NewSingleWatchStreamProxy(client, configs, headers).Run()
+		}()
+		client.reqs <- &pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{
+			CreateRequest: &pb.WatchCreateRequest{Key: []byte("a"), RangeEnd: noEnd, StartRevision: startRev},
+		}}
+		return client, done
+	}
+	client, _ := watch(revision + 1)
+	var values []string
+	for len(values) < 2 {
+		for _, ev := range receiveResponse(t, client).Events {
+			values = append(values, string(ev.Kv.Key)+"="+string(ev.Kv.Value))
+		}
+	}
+	assert.ElementsMatch(t, []string{"a=2", "n=2"}, values)
+
+	_, done := watch(2)
+	select {
+	case err := <-done:
+		assert.Equal(t, codes.OutOfRange, status.Code(err))
+	case <-time.After(time.Second):
+		t.Fatal("watch at an unknown composite revision not failed")
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+// hedgeMinSamples is the number of latency samples an endpoint needs before its reads are hedged.
+const hedgeMinSamples = 20
+
+// hedger sends a read to a second endpoint if the first endpoint doesn't reply
+// within the latency percentile of it, and takes whichever reply arrives first.
+type hedger struct {
+	// percentile of latency to wait before hedging, in (0, 100)
+	percentile float64
+	picker     endpointPicker
+}
+
+// Range reads from an endpoint, hedged by another endpoint if it's slow.
+func (h *hedger) Range(ctx context.Context, endpoints []*endpoint, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	primary := h.picker.Pick(endpoints)
+	delay, ok := primary.latency.Percentile(h.percentile, hedgeMinSamples)
+	if !ok || len(endpoints) < 2 {
+		return primary.Range(ctx, in, opts...)
+	}
+
+	// the loser is canceled once a reply is taken
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		resp *pb.RangeResponse
+		err  error
+	}
+	results := make(chan result, 2)
+	send := func(e *endpoint) {
+		go func() {
+			resp, err := e.Range(ctx, in, opts...)
+			results <- result{resp: resp, err: err}
+		}()
+	}
+	send(primary)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		if r.err == nil {
+			return r.resp, nil
+		}
+		// the primary failed fast, hedge right now
+		pending--
+	case <-timer.C:
+	}
+	others := make([]*endpoint, 0, len(endpoints)-1)
+	for _, e := range endpoints {
+		if e != primary {
+			others = append(others, e)
+		}
+	}
+	send(h.picker.Pick(others))
+	pending++
+
+	var r result
+	for ; pending > 0; pending-- {
+		r = <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+	}
+	return r.resp, r.err
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+// delayedClient replies to Range after delay, or fails when canceled
+type delayedClient struct {
+	EtcdGrpcClient
+	delay    time.Duration
+	revision int64
+	canceled chan struct{}
+}
+
+func (c *delayedClient) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	select {
+	case <-time.After(c.delay):
+		return &pb.RangeResponse{Header: &pb.ResponseHeader{Revision: c.revision}}, nil
+	case <-ctx.Done():
+		close(c.canceled)
+		return nil, ctx.Err()
+	}
+}
+
+// firstPicker always picks the first endpoint
+type firstPicker struct{}
+
+func (firstPicker) Pick(endpoints []*endpoint) *endpoint {
+	return endpoints[0]
+}
+
+func TestHedger_Range(t *testing.T) {
+	slow := &delayedClient{delay: time.Hour, revision: 1, canceled: make(chan struct{})}
+	fast := &delayedClient{delay: 0, revision: 2, canceled: make(chan struct{})}
+	endpoints := []*endpoint{
+		{address: "slow", EtcdGrpcClient: slow, latency: new(latencyTracker)},
+		{address: "fast", EtcdGrpcClient: fast, latency: new(latencyTracker)},
+	}
+	h := &hedger{percentile: 90, picker: firstPicker{}}
+
+	// not hedged without enough samples
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := h.Range(ctx, endpoints, &pb.RangeRequest{})
+	assert.Error(t, err)
+
+	slow.canceled = make(chan struct{})
+	for i := 0; i < hedgeMinSamples; i++ {
+		endpoints[0].latency.Observe(time.Millisecond)
+	}
+	resp, err := h.Range(context.Background(), endpoints, &pb.RangeRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Header.Revision)
+	select {
+	case <-slow.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("slow request not canceled")
+	}
+}
+
+func TestEndpoint_Range(t *testing.T) {
+	e := &endpoint{address: "slow", EtcdGrpcClient: &delayedClient{delay: time.Hour, canceled: make(chan struct{})}, latency: new(latencyTracker)}
+	// no sample of a canceled read
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := e.Range(ctx, &pb.RangeRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 0, e.latency.count)
+
+	// a failed read is not a sample, but backs off the endpoint
+	e.EtcdGrpcClient = newMemEtcd(0)
+	_, err = e.Range(context.Background(), &pb.RangeRequest{})
+	assert.NoError(t, err)
+	failed := newMemEtcd(0)
+	failed.failOn("Range", errors.New("endpoint down"))
+	e.EtcdGrpcClient = failed
+	_, err = e.Range(context.Background(), &pb.RangeRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, e.latency.count)
+	assert.Equal(t, 1, e.latency.failures)
+	assert.True(t, e.latency.BackingOff(time.Now()))
+
+	// a deadline exceeded read is neither
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	e.EtcdGrpcClient = &delayedClient{delay: time.Hour, canceled: make(chan struct{})}
+	_, err = e.Range(ctx, &pb.RangeRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, 1, e.latency.count)
+	assert.Equal(t, 1, e.latency.failures)
+
+	// a successful read ends the backoff
+	e.EtcdGrpcClient = newMemEtcd(0)
+	_, err = e.Range(context.Background(), &pb.RangeRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, e.latency.count)
+	assert.False(t, e.latency.BackingOff(time.Now()))
+}
+
+func TestLatencyTracker_BackingOff(t *testing.T) {
+	l := new(latencyTracker)
+	assert.False(t, l.BackingOff(time.Now()))
+	l.ObserveFailure()
+	assert.True(t, l.BackingOff(l.failed.Add(readFailureBackoff-1)))
+	assert.False(t, l.BackingOff(l.failed.Add(readFailureBackoff)))
+
+	// the backoff doubles for every consecutive failure, up to the max
+	l.ObserveFailure()
+	assert.True(t, l.BackingOff(l.failed.Add(2*readFailureBackoff-1)))
+	assert.False(t, l.BackingOff(l.failed.Add(2*readFailureBackoff)))
+	for i := 0; i < 100; i++ {
+		l.ObserveFailure()
+	}
+	assert.True(t, l.BackingOff(l.failed.Add(maxReadFailureBackoff-1)))
+	assert.False(t, l.BackingOff(l.failed.Add(maxReadFailureBackoff)))
+}
+
+func TestLatencyTracker_Percentile(t *testing.T) {
+	l := new(latencyTracker)
+	_, ok := l.Percentile(50, 1)
+	assert.False(t, ok)
+	for i := 1; i <= 100; i++ {
+		l.Observe(time.Duration(i) * time.Millisecond)
+	}
+	latency, ok := l.Percentile(95, 1)
+	assert.True(t, ok)
+	assert.Equal(t, 95*time.Millisecond, latency)
+	_, ok = l.Percentile(95, 101)
+	assert.False(t, ok)
+}
+
+func TestLeastLatencyPicker_Pick(t *testing.T) {
+	endpoints := []*endpoint{
+		{address: "slow", latency: new(latencyTracker)},
+		{address: "fast", latency: new(latencyTracker)},
+	}
+	var picker leastLatencyPicker
+	assert.Same(t, endpoints[0], picker.Pick(endpoints))
+	endpoints[0].latency.Observe(time.Second)
+	endpoints[1].latency.Observe(5 * time.Millisecond)
+	assert.Same(t, endpoints[1], picker.Pick(endpoints))
+
+	// the latency decays while the slow endpoint isn't picked, until it's tried again
+	endpoints[0].latency.updated = endpoints[0].latency.updated.Add(-10 * latencyDecayHalfLife)
+	assert.Same(t, endpoints[0], picker.Pick(endpoints))
+	endpoints[0].latency.Observe(2 * time.Millisecond)
+	assert.Same(t, endpoints[0], picker.Pick(endpoints))
+	assert.Less(t, endpoints[0].latency.Average(), 2*time.Millisecond)
+
+	// a failing endpoint isn't picked while backing off, even if it's the fastest
+	endpoints[0].latency.ObserveFailure()
+	assert.Same(t, endpoints[1], picker.Pick(endpoints))
+	// the endpoint with least latency is picked if all are backing off
+	endpoints[1].latency.ObserveFailure()
+	assert.Same(t, endpoints[0], picker.Pick(endpoints))
+	// tried again after the backoff
+	endpoints[0].latency.failed = endpoints[0].latency.failed.Add(-readFailureBackoff)
+	assert.Same(t, endpoints[0], picker.Pick(endpoints))
+	endpoints[0].latency.failed = time.Now()
+	endpoints[1].latency.failed = endpoints[1].latency.failed.Add(-readFailureBackoff)
+	assert.Same(t, endpoints[1], picker.Pick(endpoints))
+}
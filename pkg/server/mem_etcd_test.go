@@ -0,0 +1,554 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// memEtcd is an etcd in memory serving the kv, watch & lease APIs with revisions.
+// Leases don't expire by time, revoke them instead.
+// An error set by failOn is returned by the method of the name, instead of serving it.
+type memEtcd struct {
+	shardID int
+
+	mu        sync.Mutex
+	revision  int64
+	compacted int64
+	kvs       map[string]*mvccpb.KeyValue
+	// events are all events ever happened, for ranges at old revisions & watches
+	events    []*mvccpb.Event
+	leases    map[int64]int64
+	lastLease int64
+	watchers  map[*memWatchStream]struct{}
+	errs      map[string]error
+}
+
+func newMemEtcd(shardID int) *memEtcd {
+	return &memEtcd{
+		shardID:  shardID,
+		revision: 1,
+		kvs:      make(map[string]*mvccpb.KeyValue),
+		leases:   make(map[int64]int64),
+		watchers: make(map[*memWatchStream]struct{}),
+		errs:     make(map[string]error),
+	}
+}
+
+// newMemShards returns the shards of memEtcds split at the keys,
+// e.g. ["", "i"), ["i", "s") & ["s", ...) by "i" & "s", and the memEtcds.
+func newMemShards(splits ...string) ([]Shard, []*memEtcd) {
+	clis := make([]*memEtcd, len(splits)+1)
+	shards := make([]Shard, len(clis))
+	start := []byte{}
+	for i := range clis {
+		end := noEnd
+		if i < len(splits) {
+			end = []byte(splits[i])
+		}
+		clis[i] = newMemEtcd(i)
+		shards[i] = &ShardImpl{start: start, end: end, cli: clis[i]}
+		start = end
+	}
+	return shards, clis
+}
+
+func (m *memEtcd) GetShardID() int {
+	return m.shardID
+}
+
+// failOn makes the method return err, or serve again if err is nil.
+func (m *memEtcd) failOn(method string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs[method] = err
+}
+
+// get returns the value of the key, nil if missing.
+func (m *memEtcd) get(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kv, ok := m.kvs[key]; ok {
+		return kv.Value
+	}
+	return nil
+}
+
+// keys returns the keys in order.
+func (m *memEtcd) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make([]string, 0, len(m.kvs))
+	for key := range m.kvs {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (m *memEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: m.revision}
+}
+
+func inKeyRange(key, start, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, start)
+	case bytes.Equal(end, noEnd):
+		return bytes.Compare(key, start) >= 0
+	default:
+		return bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+// rangeKvs returns the kvs in the range at the revision in key order, the latest if rev is 0.
+func (m *memEtcd) rangeKvs(key, end []byte, rev int64) []*mvccpb.KeyValue {
+	kvs := m.kvs
+	if rev > 0 && rev < m.revision {
+		kvs = make(map[string]*mvccpb.KeyValue)
+		for _, ev := range m.events {
+			if ev.Kv.ModRevision > rev {
+				break
+			}
+			if ev.Type == mvccpb.PUT {
+				kvs[string(ev.Kv.Key)] = ev.Kv
+			} else {
+				delete(kvs, string(ev.Kv.Key))
+			}
+		}
+	}
+	var ret []*mvccpb.KeyValue
+	for _, kv := range kvs {
+		if inKeyRange(kv.Key, key, end) {
+			ret = append(ret, kv)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return bytes.Compare(ret[i].Key, ret[j].Key) < 0 })
+	return ret
+}
+
+func (m *memEtcd) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["Range"]; err != nil {
+		return nil, err
+	}
+	return m.rangeLocked(in)
+}
+
+func (m *memEtcd) rangeLocked(in *pb.RangeRequest) (*pb.RangeResponse, error) {
+	if in.Revision > 0 && in.Revision < m.compacted {
+		return nil, rpctypes.ErrGRPCCompacted
+	}
+	if in.Revision > m.revision {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+	kvs := m.rangeKvs(in.Key, in.RangeEnd, in.Revision)
+	if in.SortOrder == pb.RangeRequest_DESCEND {
+		for i, j := 0, len(kvs)-1; i < j; i, j = i+1, j-1 {
+			kvs[i], kvs[j] = kvs[j], kvs[i]
+		}
+	}
+	ret := &pb.RangeResponse{Header: m.header(), Count: int64(len(kvs))}
+	if in.CountOnly {
+		return ret, nil
+	}
+	if in.Limit > 0 && int64(len(kvs)) > in.Limit {
+		kvs, ret.More = kvs[:in.Limit], true
+	}
+	for _, kv := range kvs {
+		kv := *kv
+		if in.KeysOnly {
+			kv.Value = nil
+		}
+		ret.Kvs = append(ret.Kvs, &kv)
+	}
+	return ret, nil
+}
+
+// memWrite applies ops at the next revision, which is taken only if anything is changed.
+type memWrite struct {
+	m      *memEtcd
+	rev    int64
+	events []*mvccpb.Event
+}
+
+func (m *memEtcd) begin() *memWrite {
+	return &memWrite{m: m, rev: m.revision + 1}
+}
+
+func (w *memWrite) put(in *pb.PutRequest) (*pb.PutResponse, error) {
+	if in.Lease != 0 {
+		if _, ok := w.m.leases[in.Lease]; !ok {
+			return nil, rpctypes.ErrGRPCLeaseNotFound
+		}
+	}
+	prev := w.m.kvs[string(in.Key)]
+	kv := &mvccpb.KeyValue{Key: in.Key, Value: in.Value, Lease: in.Lease, ModRevision: w.rev, CreateRevision: w.rev, Version: 1}
+	if prev != nil {
+		kv.CreateRevision, kv.Version = prev.CreateRevision, prev.Version+1
+	}
+	w.m.kvs[string(in.Key)] = kv
+	w.events = append(w.events, &mvccpb.Event{Type: mvccpb.PUT, Kv: kv, PrevKv: prev})
+	ret := &pb.PutResponse{}
+	if in.PrevKv {
+		ret.PrevKv = prev
+	}
+	return ret, nil
+}
+
+func (w *memWrite) deleteRange(in *pb.DeleteRangeRequest) *pb.DeleteRangeResponse {
+	ret := &pb.DeleteRangeResponse{}
+	for _, kv := range w.m.rangeKvs(in.Key, in.RangeEnd, 0) {
+		delete(w.m.kvs, string(kv.Key))
+		w.events = append(w.events, &mvccpb.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: kv.Key, ModRevision: w.rev}, PrevKv: kv})
+		ret.Deleted++
+		if in.PrevKv {
+			ret.PrevKvs = append(ret.PrevKvs, kv)
+		}
+	}
+	return ret
+}
+
+func (w *memWrite) txn(in *pb.TxnRequest) (*pb.TxnResponse, error) {
+	ret := &pb.TxnResponse{Succeeded: true}
+	for _, cmp := range in.Compare {
+		if !w.m.compare(cmp) {
+			ret.Succeeded = false
+			break
+		}
+	}
+	ops := in.Success
+	if !ret.Succeeded {
+		ops = in.Failure
+	}
+	for _, op := range ops {
+		var resp pb.ResponseOp
+		switch r := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			rangeResp, err := w.m.rangeLocked(r.RequestRange)
+			if err != nil {
+				return nil, err
+			}
+			resp.Response = &pb.ResponseOp_ResponseRange{ResponseRange: rangeResp}
+		case *pb.RequestOp_RequestPut:
+			putResp, err := w.put(r.RequestPut)
+			if err != nil {
+				return nil, err
+			}
+			resp.Response = &pb.ResponseOp_ResponsePut{ResponsePut: putResp}
+		case *pb.RequestOp_RequestDeleteRange:
+			resp.Response = &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: w.deleteRange(r.RequestDeleteRange)}
+		case *pb.RequestOp_RequestTxn:
+			txnResp, err := w.txn(r.RequestTxn)
+			if err != nil {
+				return nil, err
+			}
+			resp.Response = &pb.ResponseOp_ResponseTxn{ResponseTxn: txnResp}
+		}
+		ret.Responses = append(ret.Responses, &resp)
+	}
+	return ret, nil
+}
+
+// commit takes the revision if anything is changed, and notifies the watchers.
+func (w *memWrite) commit() {
+	if len(w.events) == 0 {
+		return
+	}
+	w.m.revision = w.rev
+	w.m.events = append(w.m.events, w.events...)
+	for watcher := range w.m.watchers {
+		if watcher.ctx.Err() != nil {
+			delete(w.m.watchers, watcher)
+			continue
+		}
+		watcher.notify(w.m.header(), w.events)
+	}
+}
+
+// compare evaluates the compare like etcd.
+func (m *memEtcd) compare(cmp *pb.Compare) bool {
+	return compareKvs(cmp, m.rangeKvs(cmp.Key, cmp.RangeEnd, 0))
+}
+
+func (m *memEtcd) Put(ctx context.Context, in *pb.PutRequest, opts ...grpc.CallOption) (*pb.PutResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["Put"]; err != nil {
+		return nil, err
+	}
+	w := m.begin()
+	ret, err := w.put(in)
+	if err != nil {
+		return nil, err
+	}
+	w.commit()
+	ret.Header = m.header()
+	return ret, nil
+}
+
+func (m *memEtcd) DeleteRange(ctx context.Context, in *pb.DeleteRangeRequest, opts ...grpc.CallOption) (*pb.DeleteRangeResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["DeleteRange"]; err != nil {
+		return nil, err
+	}
+	w := m.begin()
+	ret := w.deleteRange(in)
+	w.commit()
+	ret.Header = m.header()
+	return ret, nil
+}
+
+func (m *memEtcd) Txn(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["Txn"]; err != nil {
+		return nil, err
+	}
+	w := m.begin()
+	ret, err := w.txn(in)
+	if err != nil {
+		return nil, err
+	}
+	w.commit()
+	ret.Header = m.header()
+	return ret, nil
+}
+
+func (m *memEtcd) Compact(ctx context.Context, in *pb.CompactionRequest, opts ...grpc.CallOption) (*pb.CompactionResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["Compact"]; err != nil {
+		return nil, err
+	}
+	if in.Revision <= m.compacted {
+		return nil, rpctypes.ErrGRPCCompacted
+	}
+	if in.Revision > m.revision {
+		return nil, rpctypes.ErrGRPCFutureRev
+	}
+	m.compacted = in.Revision
+	return &pb.CompactionResponse{Header: m.header()}, nil
+}
+
+func (m *memEtcd) LeaseGrant(ctx context.Context, in *pb.LeaseGrantRequest, opts ...grpc.CallOption) (*pb.LeaseGrantResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["LeaseGrant"]; err != nil {
+		return nil, err
+	}
+	id := in.ID
+	for id == 0 {
+		m.lastLease++
+		if _, ok := m.leases[m.lastLease]; !ok {
+			id = m.lastLease
+		}
+	}
+	if _, ok := m.leases[id]; ok {
+		return nil, rpctypes.ErrGRPCLeaseExist
+	}
+	m.leases[id] = in.TTL
+	return &pb.LeaseGrantResponse{Header: m.header(), ID: id, TTL: in.TTL}, nil
+}
+
+func (m *memEtcd) LeaseRevoke(ctx context.Context, in *pb.LeaseRevokeRequest, opts ...grpc.CallOption) (*pb.LeaseRevokeResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["LeaseRevoke"]; err != nil {
+		return nil, err
+	}
+	if _, ok := m.leases[in.ID]; !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	delete(m.leases, in.ID)
+	w := m.begin()
+	for _, kv := range m.rangeKvs([]byte{0}, noEnd, 0) {
+		if kv.Lease == in.ID {
+			w.deleteRange(&pb.DeleteRangeRequest{Key: kv.Key})
+		}
+	}
+	w.commit()
+	return &pb.LeaseRevokeResponse{Header: m.header()}, nil
+}
+
+func (m *memEtcd) LeaseTimeToLive(ctx context.Context, in *pb.LeaseTimeToLiveRequest, opts ...grpc.CallOption) (*pb.LeaseTimeToLiveResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["LeaseTimeToLive"]; err != nil {
+		return nil, err
+	}
+	ttl, ok := m.leases[in.ID]
+	if !ok {
+		return &pb.LeaseTimeToLiveResponse{Header: m.header(), ID: in.ID, TTL: -1}, nil
+	}
+	ret := &pb.LeaseTimeToLiveResponse{Header: m.header(), ID: in.ID, TTL: ttl, GrantedTTL: ttl}
+	if in.Keys {
+		for _, kv := range m.rangeKvs([]byte{0}, noEnd, 0) {
+			if kv.Lease == in.ID {
+				ret.Keys = append(ret.Keys, kv.Key)
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (m *memEtcd) LeaseLeases(ctx context.Context, in *pb.LeaseLeasesRequest, opts ...grpc.CallOption) (*pb.LeaseLeasesResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["LeaseLeases"]; err != nil {
+		return nil, err
+	}
+	ret := &pb.LeaseLeasesResponse{Header: m.header()}
+	for id := range m.leases {
+		ret.Leases = append(ret.Leases, &pb.LeaseStatus{ID: id})
+	}
+	sort.Slice(ret.Leases, func(i, j int) bool { return ret.Leases[i].ID < ret.Leases[j].ID })
+	return ret, nil
+}
+
+func (m *memEtcd) LeaseKeepAlive(ctx context.Context, opts ...grpc.CallOption) (pb.Lease_LeaseKeepAliveClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["LeaseKeepAlive"]; err != nil {
+		return nil, err
+	}
+	return &memKeepAliveStream{ctx: ctx, m: m, resps: make(chan *pb.LeaseKeepAliveResponse, 100)}, nil
+}
+
+type memKeepAliveStream struct {
+	grpc.ClientStream
+	ctx   context.Context
+	m     *memEtcd
+	resps chan *pb.LeaseKeepAliveResponse
+}
+
+func (s *memKeepAliveStream) Send(req *pb.LeaseKeepAliveRequest) error {
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if err := s.m.errs["LeaseKeepAlive"]; err != nil {
+		return err
+	}
+	s.resps <- &pb.LeaseKeepAliveResponse{Header: s.m.header(), ID: req.ID, TTL: s.m.leases[req.ID]}
+	return nil
+}
+
+func (s *memKeepAliveStream) Recv() (*pb.LeaseKeepAliveResponse, error) {
+	select {
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	case resp := <-s.resps:
+		return resp, nil
+	}
+}
+
+func (m *memEtcd) Watch(ctx context.Context, opts ...grpc.CallOption) (pb.Watch_WatchClient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs["Watch"]; err != nil {
+		return nil, err
+	}
+	ret := &memWatchStream{
+		ctx:     ctx,
+		m:       m,
+		resps:   make(chan *pb.WatchResponse, 1000),
+		watches: make(map[int64]*pb.WatchCreateRequest),
+	}
+	m.watchers[ret] = struct{}{}
+	return ret, nil
+}
+
+// memWatchStream is a watch stream on memEtcd, whose responses are queued by the writes.
+type memWatchStream struct {
+	grpc.ClientStream
+	ctx   context.Context
+	m     *memEtcd
+	resps chan *pb.WatchResponse
+	// watches are guarded by the mutex of memEtcd
+	watches map[int64]*pb.WatchCreateRequest
+}
+
+func (s *memWatchStream) Header() (metadata.MD, error) {
+	return nil, nil
+}
+
+func (s *memWatchStream) Send(req *pb.WatchRequest) error {
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	switch r := req.RequestUnion.(type) {
+	case *pb.WatchRequest_CreateRequest:
+		create := r.CreateRequest
+		id := create.WatchId
+		for create.WatchId == 0 && s.watches[id] != nil {
+			id++
+		}
+		s.resps <- &pb.WatchResponse{Header: s.m.header(), WatchId: id, Created: true}
+		if create.StartRevision > 0 && create.StartRevision <= s.m.compacted {
+			s.resps <- &pb.WatchResponse{Header: s.m.header(), WatchId: id, Canceled: true, CompactRevision: s.m.compacted}
+			return nil
+		}
+		s.watches[id] = create
+		if create.StartRevision > 0 {
+			var events []*mvccpb.Event
+			for _, ev := range s.m.events {
+				if ev.Kv.ModRevision >= create.StartRevision {
+					events = append(events, ev)
+				}
+			}
+			s.notifyWatch(id, create, s.m.header(), events)
+		}
+	case *pb.WatchRequest_CancelRequest:
+		id := r.CancelRequest.WatchId
+		delete(s.watches, id)
+		s.resps <- &pb.WatchResponse{Header: s.m.header(), WatchId: id, Canceled: true}
+	case *pb.WatchRequest_ProgressRequest:
+		s.resps <- &pb.WatchResponse{Header: s.m.header(), WatchId: -1}
+	}
+	return nil
+}
+
+func (s *memWatchStream) notify(header *pb.ResponseHeader, events []*mvccpb.Event) {
+	for id, create := range s.watches {
+		s.notifyWatch(id, create, header, events)
+	}
+}
+
+func (s *memWatchStream) notifyWatch(id int64, create *pb.WatchCreateRequest, header *pb.ResponseHeader, events []*mvccpb.Event) {
+	var matched []*mvccpb.Event
+	for _, ev := range events {
+		if !inKeyRange(ev.Kv.Key, create.Key, create.RangeEnd) {
+			continue
+		}
+		ev := *ev
+		if !create.PrevKv {
+			ev.PrevKv = nil
+		}
+		matched = append(matched, &ev)
+	}
+	if len(matched) > 0 {
+		s.resps <- &pb.WatchResponse{Header: header, WatchId: id, Events: matched}
+	}
+}
+
+func (s *memWatchStream) Recv() (*pb.WatchResponse, error) {
+	select {
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	case resp := <-s.resps:
+		return resp, nil
+	}
+}
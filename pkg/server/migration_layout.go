@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+)
+
+// splitMigration returns the migration moving the keys from splitKey to the end of the shard
+// to the target, which is added after the other shards.
+func splitMigration(layout config.Layout, shard int, splitKey []byte, target config.Shard) (config.Migration, error) {
+	if shard < 0 || shard >= len(layout.Shards) || layout.Shards[shard].Retired {
+		return config.Migration{}, errors.Errorf("unknown shard[%d]", shard)
+	}
+	if len(target.DefaultEndpoints()) == 0 {
+		return config.Migration{}, errors.New("no endpoint of target")
+	}
+	keyRange := layoutShardRange(layout.Shards, shard)
+	if bytes.Compare(splitKey, keyRange.Key) <= 0 || !rangeEndBefore(splitKey, keyRange.RangeEnd) {
+		return config.Migration{}, errors.Errorf("split key [%q] not inside shard[%d] range [%q, %q)", splitKey, shard, keyRange.Key, keyRange.RangeEnd)
+	}
+	return config.Migration{
+		Start:       splitKey,
+		End:         keyRange.RangeEnd,
+		Source:      shard,
+		Target:      len(layout.Shards),
+		TargetShard: &target,
+	}, nil
+}
+
+// moveMigration returns the migration moving the range from the shard owning start to the target,
+// end is the end of that shard if empty.
+func moveMigration(layout config.Layout, start, end []byte, target int) (config.Migration, error) {
+	for i := range layout.Shards {
+		if layout.Shards[i].Retired {
+			continue
+		}
+		keyRange := layoutShardRange(layout.Shards, i)
+		if bytes.Compare(start, keyRange.Key) < 0 || !rangeEndBefore(start, keyRange.RangeEnd) {
+			continue
+		}
+		if len(end) == 0 {
+			end = keyRange.RangeEnd
+		}
+		return config.Migration{Start: start, End: end, Source: i, Target: target}, nil
+	}
+	return config.Migration{}, errors.Errorf("no shard owns [%q]", start)
+}
+
+// mergeMigration returns the migration moving all keys of the source to the target next to it.
+// Shard[0] can't be the source, as it holds the first keys & the log of transactions.
+func mergeMigration(layout config.Layout, source, target int) (config.Migration, error) {
+	if source <= 0 || source >= len(layout.Shards) || layout.Shards[source].Retired {
+		return config.Migration{}, errors.Errorf("bad source shard[%d], merge shard[%d] into shard[%d] instead", source, target, source)
+	}
+	keyRange := layoutShardRange(layout.Shards, source)
+	return config.Migration{Start: keyRange.Key, End: keyRange.RangeEnd, Source: source, Target: target, Merge: true}, nil
+}
+
+// startMigrationLayout returns the layout copying the range of the migration.
+// The range must be at either end of the source, the target is either a new shard
+// added after the others, or the shard next to the range.
+// A merge moves the whole source to the shard next to it.
+func startMigrationLayout(layout config.Layout, m config.Migration) (config.Layout, error) {
+	if !isRangeSharding(layout.Sharding.Strategy) {
+		return layout, errors.Errorf("migrations are not supported by %s sharding", layout.Sharding.Strategy)
+	}
+	if len(layout.ReplicatedPrefixes) > 0 {
+		return layout, errors.New("migrations are not supported with replicated prefixes")
+	}
+	if len(layout.Migrations) > 0 {
+		return layout, errors.Errorf("migration %s is in progress", layout.Migrations[0].ID)
+	}
+	if m.Source < 0 || m.Source >= len(layout.Shards) || layout.Shards[m.Source].Retired {
+		return layout, errors.Errorf("unknown source shard[%d]", m.Source)
+	}
+	source := layoutShardRange(layout.Shards, m.Source)
+	if !rangeEndBefore(m.Start, m.End) {
+		return layout, errors.Errorf("empty range [%q, %q)", m.Start, m.End)
+	}
+	if bytes.Compare(m.Start, source.Key) < 0 || rangeEndBefore(source.RangeEnd, m.End) {
+		return layout, errors.Errorf("range [%q, %q) not inside shard[%d] range [%q, %q)", m.Start, m.End, m.Source, source.Key, source.RangeEnd)
+	}
+	top, bottom := bytes.Equal(m.End, source.RangeEnd), bytes.Equal(m.Start, source.Key)
+	switch {
+	case m.Merge:
+		if !top || !bottom || m.Source == 0 || m.TargetShard != nil {
+			return layout, errors.Errorf("range [%q, %q) can't be merged from shard[%d]", m.Start, m.End, m.Source)
+		}
+	case top && bottom:
+		return layout, errors.Errorf("range [%q, %q) is the whole shard[%d], merge it instead", m.Start, m.End, m.Source)
+	case !top && !bottom:
+		return layout, errors.Errorf("range [%q, %q) not at either end of shard[%d]", m.Start, m.End, m.Source)
+	}
+	if m.TargetShard != nil {
+		if m.Target != len(layout.Shards) {
+			return layout, errors.Errorf("new target shard must be shard[%d]", len(layout.Shards))
+		}
+		if bottom && m.Source == 0 {
+			return layout, errors.New("the first keys of shard[0] can't be moved to a new shard")
+		}
+	} else {
+		if m.Target < 0 || m.Target >= len(layout.Shards) || m.Target == m.Source || layout.Shards[m.Target].Retired {
+			return layout, errors.Errorf("bad target shard[%d]", m.Target)
+		}
+		target := layoutShardRange(layout.Shards, m.Target)
+		above, below := bytes.Equal(target.Key, source.RangeEnd), bytes.Equal(target.RangeEnd, source.Key)
+		if (m.Merge && !above && !below) || (!m.Merge && (top && !above || bottom && !below)) {
+			return layout, errors.Errorf("target shard[%d] is not next to range [%q, %q)", m.Target, m.Start, m.End)
+		}
+	}
+	m.State = config.MigrationCopying
+	layout.Migrations = []config.Migration{m}
+	return layout, nil
+}
+
+// migrationCutoverLayout returns the layout where the target owns the range of the migration,
+// while the moved keys are deleted from the source. The source of a merge is retired.
+// cutoverRev is the revision of the target before the cutover, see config.Shard.CutoverRevision.
+func migrationCutoverLayout(layout config.Layout, id string, cutoverRev int64) (config.Layout, error) {
+	i := migrationIndex(layout, id)
+	if i < 0 {
+		return layout, errors.Errorf("migration %s not in layout", id)
+	}
+	m := layout.Migrations[i]
+	shards := append([]config.Shard{}, layout.Shards...)
+	sourceRange := layoutShardRange(shards, m.Source)
+	source := shards[m.Source]
+	top := bytes.Equal(m.End, sourceRange.RangeEnd)
+	if m.Merge {
+		if bytes.Equal(layoutShardRange(shards, m.Target).Key, sourceRange.RangeEnd) {
+			setShardStart(&shards[m.Target], sourceRange.Key)
+		} else {
+			shards[m.Target].End, shards[m.Target].EndBytes = source.End, source.EndBytes
+		}
+	} else if m.TargetShard != nil {
+		target := *m.TargetShard
+		if top {
+			setShardStart(&target, m.Start)
+			target.End, target.EndBytes = source.End, source.EndBytes
+		} else {
+			setShardStart(&target, sourceRange.Key)
+			setShardEnd(&target, m.End)
+		}
+		target.CutoverRevision = cutoverRev
+		shards = append(shards, target)
+	} else if top {
+		setShardStart(&shards[m.Target], m.Start)
+	} else {
+		setShardEnd(&shards[m.Target], m.End)
+	}
+	if m.TargetShard == nil {
+		shards[m.Target].CutoverRevision = cutoverRev
+	}
+	switch {
+	case m.Merge:
+		source.Retired = true
+	case top:
+		setShardEnd(&source, m.Start)
+	default:
+		setShardStart(&source, m.End)
+	}
+	shards[m.Source] = source
+	layout.Shards = shards
+
+	m.TargetShard = nil
+	m.State = config.MigrationCleanup
+	layout.Migrations = append([]config.Migration{}, layout.Migrations...)
+	layout.Migrations[i] = m
+	return layout, nil
+}
+
+func setShardStart(conf *config.Shard, start []byte) {
+	conf.Start, conf.StartBytes = "", start
+}
+
+func setShardEnd(conf *config.Shard, end []byte) {
+	conf.End, conf.EndBytes = "", end
+}
+
+// withMigrationState returns the layout with the migration in the state.
+func withMigrationState(layout config.Layout, id string, state string) config.Layout {
+	migrations := make([]config.Migration, len(layout.Migrations))
+	for i, m := range layout.Migrations {
+		if m.ID == id {
+			m.State = state
+		}
+		migrations[i] = m
+	}
+	layout.Migrations = migrations
+	return layout
+}
+
+// withoutMigration returns the layout without the migration.
+func withoutMigration(layout config.Layout, id string) config.Layout {
+	var migrations []config.Migration
+	for _, m := range layout.Migrations {
+		if m.ID != id {
+			migrations = append(migrations, m)
+		}
+	}
+	layout.Migrations = migrations
+	return layout
+}
+
+// migrationIndex returns the index of the migration in the layout, -1 if not found.
+func migrationIndex(layout config.Layout, id string) int {
+	for i, m := range layout.Migrations {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// layoutShardRange returns the key range of the shard in the layout of range sharding.
+func layoutShardRange(shards []config.Shard, shard int) KeyRange {
+	start, end := newShardImpl(shard == 0, shard == lastShardInKeyOrder(shards), shards[shard], nil).KeyRange()
+	return KeyRange{Key: start, RangeEnd: end}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func startSplit(t *testing.T, layout config.Layout, shard int, splitKey string, target config.Shard) config.Layout {
+	m, err := splitMigration(layout, shard, []byte(splitKey), target)
+	assert.NoError(t, err)
+	m.ID = "split"
+	started, err := startMigrationLayout(layout, m)
+	assert.NoError(t, err)
+	return started
+}
+
+func TestSplitMigration(t *testing.T) {
+	conf := testConfigurations()
+	target := config.Shard{Address: "127.0.0.1:42379"}
+	layout := conf.Layout(1)
+	for _, splitKey := range []string{"i", "h", "s", "t"} {
+		_, err := splitMigration(layout, 1, []byte(splitKey), target)
+		assert.Error(t, err, splitKey)
+	}
+
+	copying := startSplit(t, layout, 1, "m", target)
+	assert.Equal(t, []config.Migration{{
+		ID: "split", Start: []byte("m"), End: []byte("s"), Source: 1, Target: 3, TargetShard: &target, State: config.MigrationCopying,
+	}}, copying.Migrations)
+	assert.Empty(t, layout.Migrations)
+	m, err := splitMigration(copying, 0, []byte("b"), target)
+	assert.NoError(t, err)
+	_, err = startMigrationLayout(copying, m)
+	assert.Error(t, err)
+
+	builder := NewShardingBuilder()
+	configs, err := builder.Build(conf.WithLayout(withMigrationState(copying, "split", config.MigrationFenced)))
+	assert.NoError(t, err)
+	_, ok := fencedMigration(configs, []byte("n"), nil)
+	assert.True(t, ok)
+	_, ok = fencedMigration(configs, []byte("j"), nil)
+	assert.False(t, ok)
+	assert.Equal(t, 1, configs.GetShardClis([]byte("n"), nil)[0].GetShardID())
+
+	cutover, err := migrationCutoverLayout(copying, "split", 20)
+	assert.NoError(t, err)
+	assert.Len(t, copying.Shards, 3)
+	assert.Len(t, cutover.Shards, 4)
+	assert.Equal(t, int64(20), cutover.Shards[3].CutoverRevision)
+	assert.Equal(t, KeyRange{Key: []byte("i"), RangeEnd: []byte("m")}, layoutShardRange(cutover.Shards, 1))
+	assert.Equal(t, KeyRange{Key: []byte("m"), RangeEnd: []byte("s")}, layoutShardRange(cutover.Shards, 3))
+	assert.Equal(t, config.MigrationCleanup, cutover.Migrations[0].State)
+	assert.Nil(t, cutover.Migrations[0].TargetShard)
+
+	configs, err = builder.Build(conf.WithLayout(cutover))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, configs.GetShardClis([]byte("n"), nil)[0].GetShardID())
+	assert.Equal(t, int64(20), configs.(CutoverRevisionGetter).GetCutoverRevision(3))
+	var ids []int
+	for _, cli := range configs.GetShardClis([]byte("a"), noEnd) {
+		ids = append(ids, cli.GetShardID())
+	}
+	assert.Equal(t, []int{0, 1, 3, 2}, ids)
+	clipped, ok := configs.GetShardClis([]byte("j"), []byte("p"))[0].(*clippedShardClient)
+	assert.True(t, ok)
+	assert.Equal(t, KeyRange{Key: []byte("i"), RangeEnd: []byte("m")}, clipped.keyRange)
+	assert.Empty(t, withoutMigration(cutover, "split").Migrations)
+
+	// splitting the last shard moves the keys to the end
+	copying = startSplit(t, layout, 2, "x", target)
+	assert.Equal(t, noEnd, copying.Migrations[0].End)
+	cutover, err = migrationCutoverLayout(copying, "split", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, KeyRange{Key: []byte("s"), RangeEnd: []byte("x")}, layoutShardRange(cutover.Shards, 2))
+	assert.Equal(t, KeyRange{Key: []byte("x"), RangeEnd: noEnd}, layoutShardRange(cutover.Shards, 3))
+}
+
+func TestMoveMigration(t *testing.T) {
+	layout := testConfigurations().Layout(1)
+	for _, c := range []struct {
+		start, end string
+		target     int
+		ok         bool
+		ranges     []KeyRange
+	}{
+		// the top of shard[1] to shard[2]
+		{start: "p", target: 2, ok: true, ranges: []KeyRange{
+			{Key: []byte{}, RangeEnd: []byte("i")}, {Key: []byte("i"), RangeEnd: []byte("p")}, {Key: []byte("p"), RangeEnd: noEnd},
+		}},
+		// the bottom of shard[1] to shard[0]
+		{start: "i", end: "k", target: 0, ok: true, ranges: []KeyRange{
+			{Key: []byte{}, RangeEnd: []byte("k")}, {Key: []byte("k"), RangeEnd: []byte("s")}, {Key: []byte("s"), RangeEnd: noEnd},
+		}},
+		{start: "p", target: 0},
+		{start: "j", end: "k", target: 0},
+		{start: "i", target: 0},
+		{start: "p", target: 1},
+	} {
+		m, err := moveMigration(layout, []byte(c.start), []byte(c.end), c.target)
+		assert.NoError(t, err)
+		m.ID = "move"
+		started, err := startMigrationLayout(layout, m)
+		if !c.ok {
+			assert.Error(t, err, c)
+			continue
+		}
+		assert.NoError(t, err)
+		cutover, err := migrationCutoverLayout(started, "move", 0)
+		assert.NoError(t, err)
+		for i, r := range c.ranges {
+			assert.Equal(t, r, layoutShardRange(cutover.Shards, i), c)
+		}
+	}
+}
+
+func TestMergeMigration(t *testing.T) {
+	conf := testConfigurations()
+	layout := conf.Layout(1)
+	_, err := mergeMigration(layout, 0, 1)
+	assert.Error(t, err)
+	for _, c := range []struct {
+		source, target int
+		ok             bool
+		ranges         map[int]KeyRange
+	}{
+		{source: 2, target: 1, ok: true, ranges: map[int]KeyRange{
+			0: {Key: []byte{}, RangeEnd: []byte("i")}, 1: {Key: []byte("i"), RangeEnd: noEnd},
+		}},
+		{source: 1, target: 0, ok: true, ranges: map[int]KeyRange{
+			0: {Key: []byte{}, RangeEnd: []byte("s")}, 2: {Key: []byte("s"), RangeEnd: noEnd},
+		}},
+		{source: 1, target: 2, ok: true, ranges: map[int]KeyRange{
+			0: {Key: []byte{}, RangeEnd: []byte("i")}, 2: {Key: []byte("i"), RangeEnd: noEnd},
+		}},
+		{source: 2, target: 0},
+		{source: 1, target: 1},
+	} {
+		m, err := mergeMigration(layout, c.source, c.target)
+		assert.NoError(t, err)
+		m.ID = "merge"
+		started, err := startMigrationLayout(layout, m)
+		if !c.ok {
+			assert.Error(t, err, c)
+			continue
+		}
+		assert.NoError(t, err)
+		cutover, err := migrationCutoverLayout(started, "merge", 0)
+		assert.NoError(t, err)
+		assert.True(t, cutover.Shards[c.source].Retired)
+		for i, r := range c.ranges {
+			assert.Equal(t, r, layoutShardRange(cutover.Shards, i), c)
+		}
+
+		configs, err := NewShardingBuilder().Build(conf.WithLayout(withoutMigration(cutover, "merge")))
+		assert.NoError(t, err)
+		assert.Nil(t, configs.GetShardCli(c.source))
+		assert.Len(t, configs.GetAllShardClis(), 2)
+		assert.Len(t, configs.GetShardClis([]byte("a"), noEnd), 2)
+		assert.Equal(t, c.target, configs.GetShardClis([]byte("m"), nil)[0].GetShardID())
+	}
+
+	// moving a whole shard is a merge
+	m, err := moveMigration(layout, []byte("i"), nil, 0)
+	assert.NoError(t, err)
+	_, err = startMigrationLayout(layout, m)
+	assert.Error(t, err)
+}
+
+func TestCheckMergeSpace(t *testing.T) {
+	source, target := &pb.StatusResponse{DbSizeInUse: 500}, &pb.StatusResponse{DbSizeInUse: 300}
+	assert.NoError(t, checkMergeSpace(1000, source, target))
+	assert.Error(t, checkMergeSpace(900, source, target))
+	assert.NoError(t, checkMergeSpace(0, source, target))
+}
+
+func TestKVProxy_beginWrite(t *testing.T) {
+	conf := testConfigurations()
+	copying := startSplit(t, conf.Layout(1), 1, "m", config.Shard{Address: "127.0.0.1:42379"})
+	builder := NewShardingBuilder()
+	fenced, err := builder.Build(conf.WithLayout(withMigrationState(copying, "split", config.MigrationFenced)))
+	assert.NoError(t, err)
+	configs := NewVersionedShardingConfigs(fenced, 2)
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+
+	done, err := proxy.beginWrite(context.Background(), KeyRange{Key: []byte("a")})
+	assert.NoError(t, err)
+	done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = proxy.beginWrite(ctx, KeyRange{Key: []byte("a")}, KeyRange{Key: []byte("n")})
+	assert.Error(t, err)
+
+	cutoverLayout, err := migrationCutoverLayout(copying, "split", 0)
+	assert.NoError(t, err)
+	cutover, err := builder.Build(conf.WithLayout(cutoverLayout))
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		configs.Switch(cutover, 3)
+	}()
+	done, err = proxy.beginWrite(context.Background(), KeyRange{Key: []byte("n")})
+	assert.NoError(t, err)
+	done()
+	assert.Equal(t, int64(3), configs.Current().Epoch)
+
+	// no write while suspended
+	configs.Suspend(errors.New("not a member"))
+	_, err = proxy.beginWrite(context.Background(), KeyRange{Key: []byte("a")})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	configs.Resume()
+	done, err = proxy.beginWrite(context.Background(), KeyRange{Key: []byte("a")})
+	assert.NoError(t, err)
+	done()
+}
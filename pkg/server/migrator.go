@@ -0,0 +1,898 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// migrationClaimTTL is the TTL in seconds of the claim of a migration by the process running it.
+	migrationClaimTTL = 10
+	// migrationCheckInterval is how often unclaimed migrations are looked for, to be resumed.
+	migrationCheckInterval = 5 * time.Second
+	// migrationSaveInterval is how often the checkpoint is saved while copying.
+	migrationSaveInterval = time.Second
+	// migrationLeaseRefreshInterval is how often the leases copied to the target are kept alive.
+	migrationLeaseRefreshInterval = 2 * time.Second
+	// migrationWaitTimeout is how long to wait for all proxies to switch to each step of a migration.
+	migrationWaitTimeout = 30 * time.Second
+	// migrationMaxFenceLag is the lag in revisions of the source under which writes are fenced.
+	migrationMaxFenceLag = 100
+	// migrationMaxCatchUps is how many times the copy catches up before writes are fenced anyway.
+	migrationMaxCatchUps = 10
+	// defaultQuotaBackendBytes is the default --quota-backend-bytes of etcd.
+	defaultQuotaBackendBytes = 2 * 1024 * 1024 * 1024
+	// mergeMaxQuotaUsage is the max fraction of the quota of the target used after a merge.
+	mergeMaxQuotaUsage = 0.8
+	// migrationCheckpointRetention is how long the checkpoints of finished migrations are kept.
+	migrationCheckpointRetention = 7 * 24 * time.Hour
+)
+
+// Phases of MigrationCheckpoint
+const (
+	// MigrationPhasePending is a migration not started yet
+	MigrationPhasePending = "pending"
+	// MigrationPhaseSnapshot is a migration copying the keys at a revision of the source
+	MigrationPhaseSnapshot = "snapshot"
+	// MigrationPhaseCatchUp is a migration copying the events after the snapshot
+	MigrationPhaseCatchUp = "catch-up"
+	// MigrationPhaseDualWrite is a migration copying the events while writes are mirrored to the target
+	MigrationPhaseDualWrite = "dual-write"
+	// MigrationPhaseFenced is a migration copying the last events while writes are fenced
+	MigrationPhaseFenced = "fenced"
+	// MigrationPhaseCleanup is a migration deleting the moved keys from the source
+	MigrationPhaseCleanup = "cleanup"
+	// MigrationPhaseDone is a migration finished
+	MigrationPhaseDone = "done"
+	// MigrationPhaseAborted is a migration aborted & rolled back
+	MigrationPhaseAborted = "aborted"
+)
+
+var errMigrationAborted = status.Error(codes.Aborted, "migration aborted")
+
+// MigrationCheckpoint is the progress of a migration, saved under the shard map key,
+// so that the migration is resumed from it after a restart.
+type MigrationCheckpoint struct {
+	Migration config.Migration `json:"migration"`
+	Phase     string           `json:"phase"`
+	// Revision is the revision of the source copied to the target
+	Revision int64 `json:"revision"`
+	// NextKey is the next key to copy by the snapshot at Revision
+	NextKey []byte `json:"nextKey,omitempty"`
+	// Copied is the number of keys put & deleted in the target
+	Copied int64 `json:"copied"`
+	// Lag is the number of revisions of the source not copied yet
+	Lag int64 `json:"lag"`
+	// DualWriteUntil is when the migration leaves config.MigrationDualWrite
+	DualWriteUntil time.Time `json:"dualWriteUntil,omitempty"`
+	// Error is the last error of the migration, which is retried
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Finished returns true if the migration is done or aborted.
+func (c MigrationCheckpoint) Finished() bool {
+	return c.Phase == MigrationPhaseDone || c.Phase == MigrationPhaseAborted
+}
+
+func (c MigrationCheckpoint) String() string {
+	m := c.Migration
+	ret := fmt.Sprintf("%s [%q, %q) shard[%d] -> shard[%d]: %s, %d keys copied at revision %d, lag %d",
+		m.ID, m.Start, m.End, m.Source, m.Target, c.Phase, c.Copied, c.Revision, c.Lag)
+	if len(c.Error) > 0 {
+		ret += ", last error: " + c.Error
+	}
+	return ret
+}
+
+// Migrator moves key ranges between shards of range sharding, through the shard map:
+//  1. the range is copied to the target by a snapshot at a revision of the source, then a watch
+//     catching up with the source, while the source still owns it;
+//  2. optionally, writes to the range are mirrored to the target for a while, see DualWriter;
+//  3. writes to the range are fenced, the last writes are caught up, and the copy is verified;
+//  4. the target owns the range, and the moved keys are deleted from the source.
+//
+// A merge moves the whole source, whose leases are all granted in the target in step 3,
+// and retires the source in step 4.
+// Each step waits for all proxies to switch to it. A migration is run by one process at a time,
+// which claims it under a lease. Its checkpoint is saved under the shard map key, so that
+// any proxy resumes it if the process running it stops.
+// Writes wait at most fenceWaitTimeout in step 3, which takes as long as the proxies switching twice.
+type Migrator struct {
+	shardMap *ShardMap
+	lg       *zap.Logger
+	// newClient creates the client of a shard in the layout
+	newClient func(shard int, conf config.Shard) (ShardClient, error)
+	// claimTTL is the TTL in seconds of the claims of migrations
+	claimTTL int64
+
+	mu sync.Mutex
+	// running are the ids of migrations run by the migrator
+	running map[string]struct{}
+}
+
+// NewMigrator creates the migrator of the loaded shard map.
+func NewMigrator(shardMap *ShardMap) *Migrator {
+	return &Migrator{
+		shardMap:  shardMap,
+		lg:        zap.L().Named("Migrator"),
+		newClient: newMigrationClient,
+		claimTTL:  migrationClaimTTL,
+		running:   make(map[string]struct{}),
+	}
+}
+
+func newMigrationClient(shard int, conf config.Shard) (ShardClient, error) {
+	cli, err := NewShardClientImpl(shard, conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create shard[%d] client to %v", shard, conf.DefaultEndpoints())
+	}
+	return cli, nil
+}
+
+// closeMigrationClient closes the client created by newClient.
+func closeMigrationClient(cli ShardClient) {
+	if closer, ok := cli.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+func (m *Migrator) checkpointKey(id string) []byte {
+	return append(append([]byte{}, m.shardMap.key...), "/migrations/"+id...)
+}
+
+func (m *Migrator) claimKey(id string) []byte {
+	return append(append([]byte{}, m.shardMap.key...), "/claims/"+id...)
+}
+
+func (m *Migrator) abortKey(id string) []byte {
+	return append(append([]byte{}, m.shardMap.key...), "/aborts/"+id...)
+}
+
+// MigrationOption is the option of a migration
+type MigrationOption func(*config.Migration)
+
+// WithDualWrite makes the migration write to both shards for the duration before the fence,
+// and shadow-read from the target if shadowRead is true.
+func WithDualWrite(duration time.Duration, shadowRead bool) MigrationOption {
+	return func(m *config.Migration) {
+		m.DualWrite, m.ShadowRead = duration, shadowRead
+	}
+}
+
+// Split moves the keys from splitKey to the end of the shard to the target, added as a new shard,
+// and returns the checkpoint once finished.
+func (m *Migrator) Split(ctx context.Context, shard int, splitKey []byte, target config.Shard, opts ...MigrationOption) (MigrationCheckpoint, error) {
+	migration, err := splitMigration(m.shardMap.Layout(), shard, splitKey, target)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	return m.Migrate(ctx, migration, opts...)
+}
+
+// Move moves the range from the shard owning start to the target shard next to it,
+// and returns the checkpoint once finished. End is the end of the source if empty.
+func (m *Migrator) Move(ctx context.Context, start, end []byte, target int, opts ...MigrationOption) (MigrationCheckpoint, error) {
+	migration, err := moveMigration(m.shardMap.Layout(), start, end, target)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	return m.Migrate(ctx, migration, opts...)
+}
+
+// Merge moves all keys of the source to the target next to it, retires the source,
+// and returns the checkpoint once finished. No migration may be in progress,
+// and the target must have room for the keys of the source.
+func (m *Migrator) Merge(ctx context.Context, source, target int, opts ...MigrationOption) (MigrationCheckpoint, error) {
+	layout := m.shardMap.Layout()
+	migration, err := mergeMigration(layout, source, target)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	_, err = startMigrationLayout(layout, migration)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	checkpoints, err := m.List(ctx)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	for _, cp := range checkpoints {
+		if !cp.Finished() {
+			return MigrationCheckpoint{}, errors.Errorf("migration %s is in progress", cp.Migration.ID)
+		}
+	}
+	sourceStatus, err := m.shardStatus(ctx, source, layout.Shards[source])
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	err = m.checkShardNoTxnKeys(ctx, source, layout.Shards[source])
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	targetStatus, err := m.shardStatus(ctx, target, layout.Shards[target])
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	err = checkMergeSpace(layout.Shards[target].QuotaBackendBytes, sourceStatus, targetStatus)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	return m.Migrate(ctx, migration, opts...)
+}
+
+// shardStatus returns the status of the shard of the configuration.
+func (m *Migrator) shardStatus(ctx context.Context, shard int, conf config.Shard) (*pb.StatusResponse, error) {
+	cli, err := m.newClient(shard, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer closeMigrationClient(cli)
+	statusCli, ok := cli.(interface {
+		Status(ctx context.Context) (*pb.StatusResponse, error)
+	})
+	if !ok {
+		return nil, errors.Errorf("no status of shard[%d]", shard)
+	}
+	resp, err := statusCli.Status(ctx)
+	return resp, errors.Wrapf(err, "failed to get status of shard[%d]", shard)
+}
+
+// checkShardNoTxnKeys returns an error if the shard of the configuration holds keys of unfinished txns.
+func (m *Migrator) checkShardNoTxnKeys(ctx context.Context, shard int, conf config.Shard) error {
+	cli, err := m.newClient(shard, conf)
+	if err != nil {
+		return err
+	}
+	defer closeMigrationClient(cli)
+	return checkNoTxnKeys(ctx, cli, m.shardMap.conf.InternalPrefix)
+}
+
+// checkNoTxnKeys returns an error if the shard holds intents or locks of unfinished cross-shard txns,
+// which are lost if the shard is retired. They are dropped once the txns are finished, or recovered.
+func checkNoTxnKeys(ctx context.Context, cli ShardClient, internalPrefix string) error {
+	for _, prefix := range [][]byte{txnIntentPrefix(internalPrefix), txnLockPrefix(internalPrefix)} {
+		resp, err := cli.Range(ctx, &pb.RangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix), CountOnly: true})
+		if err != nil {
+			return errors.Wrapf(err, "failed to count txn keys in shard[%d]", cli.GetShardID())
+		}
+		if resp.Count > 0 {
+			return errors.Errorf("shard[%d] holds %d keys of unfinished txns under %q", cli.GetShardID(), resp.Count, prefix)
+		}
+	}
+	return nil
+}
+
+// checkMergeSpace returns an error if the keys in use of both shards take more than
+// mergeMaxQuotaUsage of the quota of the target, whose default is defaultQuotaBackendBytes.
+func checkMergeSpace(quota int64, source, target *pb.StatusResponse) error {
+	if quota <= 0 {
+		quota = defaultQuotaBackendBytes
+	}
+	merged := source.DbSizeInUse + target.DbSizeInUse
+	if float64(merged) > float64(quota)*mergeMaxQuotaUsage {
+		return errors.Errorf("not enough space in target: %d bytes in use after merge, over %.0f%% of quota %d bytes",
+			merged, mergeMaxQuotaUsage*100, quota)
+	}
+	return nil
+}
+
+// Migrate starts the migration and runs it until it's finished.
+func (m *Migrator) Migrate(ctx context.Context, migration config.Migration, opts ...MigrationOption) (MigrationCheckpoint, error) {
+	for _, opt := range opts {
+		opt(&migration)
+	}
+	id, err := m.Start(ctx, migration)
+	if err != nil {
+		return MigrationCheckpoint{}, err
+	}
+	return m.Drive(ctx, id)
+}
+
+// Start saves the pending checkpoint of the migration, and returns its id.
+// The migration is run by Drive, or by the Run of any proxy.
+func (m *Migrator) Start(ctx context.Context, migration config.Migration) (string, error) {
+	migration.ID = fmt.Sprintf("%d-%d-%d", migration.Source, migration.Target, time.Now().UnixNano())
+	_, err := startMigrationLayout(m.shardMap.Layout(), migration)
+	if err != nil {
+		return "", err
+	}
+	cp := MigrationCheckpoint{Migration: migration, Phase: MigrationPhasePending, Updated: time.Now()}
+	value, err := json.Marshal(cp)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode checkpoint")
+	}
+	key := m.checkpointKey(migration.ID)
+	_, err = m.shardMap.cli.Put(ctx, &pb.PutRequest{Key: key, Value: value})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to save checkpoint")
+	}
+	m.lg.Info("migration started", zap.String("migration", cp.String()))
+	return migration.ID, nil
+}
+
+// Abort requests to abort the migration, and waits until it's rolled back.
+// A migration can't be aborted after the target owns the range.
+func (m *Migrator) Abort(ctx context.Context, id string) (MigrationCheckpoint, error) {
+	cp, err := m.Checkpoint(ctx, id)
+	if err != nil {
+		return cp, err
+	}
+	if cp.Finished() || cp.Phase == MigrationPhaseCleanup {
+		return cp, errors.Errorf("migration %s can't be aborted in phase %s", id, cp.Phase)
+	}
+	_, err = m.shardMap.cli.Put(ctx, &pb.PutRequest{Key: m.abortKey(id)})
+	if err != nil {
+		return cp, errors.Wrap(err, "failed to request abort")
+	}
+	return m.Drive(ctx, id)
+}
+
+// Checkpoint returns the checkpoint of the migration.
+func (m *Migrator) Checkpoint(ctx context.Context, id string) (MigrationCheckpoint, error) {
+	var cp MigrationCheckpoint
+	resp, err := m.shardMap.cli.Range(ctx, &pb.RangeRequest{Key: m.checkpointKey(id)})
+	if err != nil {
+		return cp, errors.Wrap(err, "failed to load checkpoint")
+	}
+	if len(resp.Kvs) == 0 {
+		return cp, errors.Errorf("migration %s not found", id)
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &cp)
+	return cp, errors.Wrapf(err, "bad checkpoint of migration %s", id)
+}
+
+// List returns the checkpoints of all migrations.
+func (m *Migrator) List(ctx context.Context) ([]MigrationCheckpoint, error) {
+	prefix := m.checkpointKey("")
+	resp, err := m.shardMap.cli.Range(ctx, &pb.RangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list checkpoints")
+	}
+	ret := make([]MigrationCheckpoint, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var cp MigrationCheckpoint
+		err = json.Unmarshal(kv.Value, &cp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad checkpoint [%s]", kv.Key)
+		}
+		ret = append(ret, cp)
+	}
+	return ret, nil
+}
+
+// Drive runs the migration until it's finished, or waits for the process running it.
+func (m *Migrator) Drive(ctx context.Context, id string) (MigrationCheckpoint, error) {
+	for {
+		cp, err := m.Checkpoint(ctx, id)
+		if err != nil || cp.Finished() {
+			return cp, err
+		}
+		ran, err := m.resume(ctx, cp)
+		if ran {
+			if err != nil {
+				return cp, err
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return cp, ctx.Err()
+		case <-time.After(migrationCheckInterval):
+		}
+	}
+}
+
+// Run resumes the unfinished migrations not claimed by others until ctx is done.
+func (m *Migrator) Run(ctx context.Context) {
+	ticker := time.NewTicker(migrationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		checkpoints, err := m.List(ctx)
+		if err != nil {
+			m.lg.Warn("failed to list migrations", zap.Error(err))
+			continue
+		}
+		for _, cp := range checkpoints {
+			if !cp.Finished() {
+				go func(cp MigrationCheckpoint) {
+					_, _ = m.resume(ctx, cp)
+				}(cp)
+			}
+		}
+		m.gc(ctx, checkpoints)
+	}
+}
+
+// gc deletes the checkpoints of the migrations finished for migrationCheckpointRetention.
+func (m *Migrator) gc(ctx context.Context, checkpoints []MigrationCheckpoint) {
+	for _, cp := range checkpoints {
+		if !cp.Finished() || time.Since(cp.Updated) < migrationCheckpointRetention {
+			continue
+		}
+		_, err := m.shardMap.cli.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: m.checkpointKey(cp.Migration.ID)})
+		if err != nil {
+			m.lg.Warn("failed to delete checkpoint of finished migration", zap.String("migration", cp.Migration.ID), zap.Error(err))
+			continue
+		}
+		m.lg.Info("deleted checkpoint of finished migration", zap.String("migration", cp.String()))
+	}
+}
+
+// resume runs the migration from the checkpoint if it's not run by others, ran is false if it is.
+func (m *Migrator) resume(ctx context.Context, cp MigrationCheckpoint) (ran bool, err error) {
+	id := cp.Migration.ID
+	m.mu.Lock()
+	if _, ok := m.running[id]; ok {
+		m.mu.Unlock()
+		return false, nil
+	}
+	m.running[id] = struct{}{}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, id)
+		m.mu.Unlock()
+	}()
+
+	runCtx, release, ok, err := m.claim(ctx, id)
+	if !ok {
+		return false, err
+	}
+	defer release()
+	r := &migrationRun{Migrator: m, cp: cp, lg: m.lg.With(zap.String("migration", id))}
+	err = r.run(runCtx)
+	if err != nil {
+		r.lg.Warn("migration failed, it's resumed later", zap.Error(err))
+		r.cp.Error = err.Error()
+		_ = r.save(ctx, false)
+	}
+	return true, err
+}
+
+// claim claims the migration under a lease kept alive until release is called,
+// ok is false if it's claimed by others. The returned ctx is canceled if the claim is lost.
+func (m *Migrator) claim(ctx context.Context, id string) (context.Context, func(), bool, error) {
+	cli := m.shardMap.cli
+	lease, err := cli.LeaseGrant(ctx, &pb.LeaseGrantRequest{TTL: m.claimTTL})
+	if err != nil {
+		return nil, nil, false, errors.Wrap(err, "failed to grant lease")
+	}
+	revoke := func() {
+		revokeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = cli.LeaseRevoke(revokeCtx, &pb.LeaseRevokeRequest{ID: lease.ID})
+	}
+	key := m.claimKey(id)
+	resp, err := cli.Txn(ctx, &pb.TxnRequest{
+		Compare: []*pb.Compare{{Target: pb.Compare_CREATE, Key: key, Result: pb.Compare_EQUAL}},
+		Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: key, Value: []byte(m.shardMap.member), Lease: lease.ID}}}},
+	})
+	if err != nil || !resp.Succeeded {
+		revoke()
+		return nil, nil, false, errors.Wrap(err, "failed to claim migration")
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	stream, err := cli.LeaseKeepAlive(runCtx)
+	if err != nil {
+		cancel()
+		revoke()
+		return nil, nil, false, errors.Wrap(err, "failed to keep alive claim")
+	}
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(time.Duration(m.claimTTL) * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			if stream.Send(&pb.LeaseKeepAliveRequest{ID: lease.ID}) != nil {
+				return
+			}
+			resp, err := stream.Recv()
+			if err != nil || resp.TTL <= 0 {
+				m.lg.Warn("lost claim of migration", zap.String("migration", id))
+				return
+			}
+		}
+	}()
+	return runCtx, func() {
+		cancel()
+		revoke()
+	}, true, nil
+}
+
+// migrationRun is a run of a migration by the process claiming it.
+type migrationRun struct {
+	*Migrator
+	cp     MigrationCheckpoint
+	copier *rangeCopier
+	saved  time.Time
+	lg     *zap.Logger
+}
+
+func (r *migrationRun) run(ctx context.Context) error {
+	err := r.shardMap.Reload(ctx)
+	if err != nil {
+		return err
+	}
+	id := r.cp.Migration.ID
+	layout := r.shardMap.Layout()
+	if i := migrationIndex(layout, id); i >= 0 {
+		r.cp.Migration = layout.Migrations[i]
+	} else {
+		switch r.cp.Phase {
+		case MigrationPhasePending:
+			started, err := startMigrationLayout(layout, r.cp.Migration)
+			if err != nil {
+				r.cp.Phase, r.cp.Error = MigrationPhaseAborted, err.Error()
+				return r.save(ctx, false)
+			}
+			err = r.publish(ctx, started)
+			if err != nil {
+				return err
+			}
+			r.cp.Migration = started.Migrations[0]
+		case MigrationPhaseCleanup:
+			r.cp.Phase = MigrationPhaseDone
+			return r.save(ctx, false)
+		default:
+			// removed from the layout by others
+			r.cp.Phase = MigrationPhaseAborted
+			return r.save(ctx, false)
+		}
+	}
+
+	m := r.cp.Migration
+	source, err := r.newClient(m.Source, layout.Shards[m.Source])
+	if err != nil {
+		return err
+	}
+	defer closeMigrationClient(source)
+	targetConf := m.TargetShard
+	if targetConf == nil {
+		targetConf = &layout.Shards[m.Target]
+	}
+	target, err := r.newClient(m.Target, *targetConf)
+	if err != nil {
+		return err
+	}
+	defer closeMigrationClient(target)
+	r.copier = newRangeCopier(source, target, KeyRange{Key: m.Start, RangeEnd: m.End})
+	r.copier.revision, r.copier.nextKey, r.copier.copied = r.cp.Revision, r.cp.NextKey, r.cp.Copied
+	if r.cp.Phase == MigrationPhaseSnapshot && r.copier.nextKey == nil {
+		r.copier.nextKey = []byte{}
+	}
+	r.copier.progress = func() error {
+		return r.save(ctx, true)
+	}
+	if r.cp.Phase != MigrationPhasePending {
+		err = r.copier.loadLeases(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	go r.refreshLeases(refreshCtx)
+
+	if m.State != config.MigrationCleanup {
+		var aborted bool
+		aborted, err = r.aborted(ctx)
+		if err != nil {
+			return err
+		}
+		if aborted {
+			return r.rollback(ctx)
+		}
+		err = r.copy(ctx)
+		if err == errMigrationAborted {
+			return r.rollback(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return r.cleanup(ctx)
+}
+
+// copy copies the range while the source owns it, then fences the range, catches up
+// the last writes, verifies the copy, and cuts over to the target.
+func (r *migrationRun) copy(ctx context.Context) error {
+	id := r.cp.Migration.ID
+	state := r.cp.Migration.State
+	if state == config.MigrationCopying {
+		err := r.catchUp(ctx)
+		if err != nil {
+			return err
+		}
+		state = config.MigrationFenced
+		if r.cp.Migration.DualWrite > 0 {
+			state = config.MigrationDualWrite
+		}
+		err = r.publish(ctx, withMigrationState(r.shardMap.Layout(), id, state))
+		if err != nil {
+			return err
+		}
+	}
+	if state == config.MigrationDualWrite {
+		err := r.dualWrite(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.publish(ctx, withMigrationState(r.shardMap.Layout(), id, config.MigrationFenced))
+		if err != nil {
+			return err
+		}
+	}
+	r.cp.Phase = MigrationPhaseFenced
+	err := r.save(ctx, false)
+	if err != nil {
+		return err
+	}
+	// all writes before the fence are done once all proxies are switched to it
+	err = r.catchUpOnce(ctx)
+	if err == nil && r.cp.Migration.Merge {
+		// the intents & locks left in the source would be lost with it, the merge waits for their txns
+		err = checkNoTxnKeys(ctx, r.copier.source, r.shardMap.conf.InternalPrefix)
+	}
+	if err == nil && r.cp.Migration.Merge {
+		err = r.copier.copyLeases(ctx)
+	}
+	if err == nil {
+		err = r.copier.refreshLeases(ctx)
+	}
+	if err == nil {
+		err = r.copier.verify(ctx)
+	}
+	// watches attached to the target after the cutover start after this revision,
+	// nothing is written to the range in the target from now until the cutover
+	var cutoverRev int64
+	if err == nil {
+		cutoverRev, err = r.copier.targetRevision(ctx)
+	}
+	if err != nil {
+		// unfence the writes, and copy again by a new snapshot
+		r.cp.Phase, r.cp.NextKey, r.cp.DualWriteUntil = MigrationPhasePending, nil, time.Time{}
+		_ = r.publish(ctx, withMigrationState(r.shardMap.Layout(), id, config.MigrationCopying))
+		return err
+	}
+	cutover, err := migrationCutoverLayout(r.shardMap.Layout(), id, cutoverRev)
+	if err != nil {
+		return err
+	}
+	err = r.publish(ctx, cutover)
+	if err != nil {
+		// the cutover may be seen by some proxies, so it's retried instead of aborted
+		return errors.Wrap(err, "failed to cut over")
+	}
+	r.cp.Migration = cutover.Migrations[migrationIndex(cutover, id)]
+	r.cp.Phase = MigrationPhaseCleanup
+	return r.save(ctx, false)
+}
+
+// dualWrite keeps catching up with the source while writes are mirrored to the target,
+// until the migration has been in dual-write for its DualWrite.
+func (r *migrationRun) dualWrite(ctx context.Context) error {
+	if r.cp.DualWriteUntil.IsZero() {
+		r.cp.DualWriteUntil = time.Now().Add(r.cp.Migration.DualWrite)
+	}
+	r.cp.Phase = MigrationPhaseDualWrite
+	r.lg.Info("writing to both shards", zap.Time("until", r.cp.DualWriteUntil))
+	ticker := time.NewTicker(migrationSaveInterval)
+	defer ticker.Stop()
+	for time.Now().Before(r.cp.DualWriteUntil) {
+		err := r.catchUpOnce(ctx)
+		if err == errSourceCompacted {
+			r.lg.Warn("source compacted before caught up, copying a new snapshot")
+			r.cp.Phase = MigrationPhasePending
+			err = r.snapshot(ctx)
+			r.cp.Phase = MigrationPhaseDualWrite
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// catchUp copies the snapshot if not copied, then catches up with the source until the lag is small.
+func (r *migrationRun) catchUp(ctx context.Context) error {
+	for i := 0; ; i++ {
+		err := r.snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		err = r.catchUpOnce(ctx)
+		if err == errSourceCompacted {
+			r.lg.Warn("source compacted before caught up, copying a new snapshot")
+			r.cp.Phase = MigrationPhasePending
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if r.cp.Lag <= migrationMaxFenceLag || i >= migrationMaxCatchUps {
+			return nil
+		}
+	}
+}
+
+// snapshot copies the snapshot of the source, or resumes it.
+func (r *migrationRun) snapshot(ctx context.Context) error {
+	var err error
+	switch r.cp.Phase {
+	case MigrationPhaseCatchUp, MigrationPhaseDualWrite, MigrationPhaseFenced:
+		return nil
+	case MigrationPhaseSnapshot:
+		r.lg.Info("resuming snapshot", zap.Int64("revision", r.copier.revision), zap.ByteString("nextKey", r.copier.nextKey))
+		err = r.copier.resumeSnapshot(ctx)
+	}
+	if r.cp.Phase == MigrationPhasePending || err == errSourceCompacted {
+		r.lg.Info("copying snapshot")
+		r.cp.Phase = MigrationPhaseSnapshot
+		err = r.copier.snapshot(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	r.cp.Phase = MigrationPhaseCatchUp
+	return r.save(ctx, false)
+}
+
+// catchUpOnce catches up with the current revision of the source.
+func (r *migrationRun) catchUpOnce(ctx context.Context) error {
+	rev, err := r.copier.currentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	err = r.copier.catchUp(ctx, rev)
+	if err != nil {
+		return err
+	}
+	return r.save(ctx, false)
+}
+
+// cleanup deletes the moved keys from the source, and removes the migration from the layout.
+func (r *migrationRun) cleanup(ctx context.Context) error {
+	m := r.cp.Migration
+	r.lg.Info("deleting moved keys from source")
+	_, err := r.copier.source.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: m.Start, RangeEnd: m.End})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete moved keys from source")
+	}
+	err = r.publish(ctx, withoutMigration(r.shardMap.Layout(), m.ID))
+	if err != nil {
+		return err
+	}
+	r.cp.Phase, r.cp.Error = MigrationPhaseDone, ""
+	r.lg.Info("migration done")
+	err = r.save(ctx, false)
+	if err != nil {
+		return err
+	}
+	// an abort requested too late
+	_, err = r.shardMap.cli.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: r.abortKey(m.ID)})
+	return errors.Wrap(err, "failed to delete abort request")
+}
+
+// rollback removes the migration from the layout, and deletes the keys copied to the target,
+// which doesn't own the range before the cutover.
+func (r *migrationRun) rollback(ctx context.Context) error {
+	m := r.cp.Migration
+	r.lg.Warn("aborting migration")
+	err := r.publish(ctx, withoutMigration(r.shardMap.Layout(), m.ID))
+	if err != nil {
+		return err
+	}
+	_, err = r.copier.target.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: m.Start, RangeEnd: m.End})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete copied keys from target")
+	}
+	r.cp.Phase, r.cp.Error = MigrationPhaseAborted, ""
+	err = r.save(ctx, false)
+	if err != nil {
+		return err
+	}
+	_, err = r.shardMap.cli.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: r.abortKey(m.ID)})
+	return errors.Wrap(err, "failed to delete abort request")
+}
+
+// publish publishes the layout and waits for all proxies to switch to it.
+func (r *migrationRun) publish(ctx context.Context, layout config.Layout) error {
+	epoch, err := r.shardMap.Publish(ctx, layout)
+	if err != nil {
+		return err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, migrationWaitTimeout)
+	defer cancel()
+	return r.shardMap.WaitEpoch(waitCtx, epoch)
+}
+
+// save saves the checkpoint with the progress of the copier, throttled if throttle is true.
+// It fails with errMigrationAborted if the migration is requested to abort before the cutover.
+func (r *migrationRun) save(ctx context.Context, throttle bool) error {
+	if throttle && time.Since(r.saved) < migrationSaveInterval {
+		return nil
+	}
+	if c := r.copier; c != nil {
+		r.cp.Revision, r.cp.Copied = c.revision, c.copied
+		r.cp.NextKey = nil
+		if r.cp.Phase == MigrationPhaseSnapshot {
+			r.cp.NextKey = c.nextKey
+		}
+		if rev, err := c.currentRevision(ctx); err == nil {
+			r.cp.Lag = rev - c.revision
+		}
+	}
+	r.cp.Updated = time.Now()
+	value, err := json.Marshal(r.cp)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode checkpoint")
+	}
+	id := r.cp.Migration.ID
+	put := &pb.RequestOp{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: r.checkpointKey(id), Value: value}}}
+	req := &pb.TxnRequest{Success: []*pb.RequestOp{put}}
+	if r.cp.Phase != MigrationPhaseCleanup && !r.cp.Finished() {
+		req.Compare = []*pb.Compare{{Target: pb.Compare_CREATE, Key: r.abortKey(id), Result: pb.Compare_EQUAL}}
+	}
+	resp, err := r.shardMap.cli.Txn(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "failed to save checkpoint")
+	}
+	if !resp.Succeeded {
+		return errMigrationAborted
+	}
+	r.saved = time.Now()
+	return nil
+}
+
+// aborted returns true if the migration is requested to abort.
+func (r *migrationRun) aborted(ctx context.Context) (bool, error) {
+	resp, err := r.shardMap.cli.Range(ctx, &pb.RangeRequest{Key: r.abortKey(r.cp.Migration.ID), CountOnly: true})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check abort request")
+	}
+	return resp.Count > 0, nil
+}
+
+// refreshLeases keeps alive the leases copied to the target until ctx is done.
+func (r *migrationRun) refreshLeases(ctx context.Context) {
+	ticker := time.NewTicker(migrationLeaseRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := r.copier.refreshLeases(ctx)
+		if err != nil && ctx.Err() == nil {
+			r.lg.Warn("failed to refresh leases in target", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+func TestCheckNoTxnKeys(t *testing.T) {
+	ctx := context.Background()
+	cli := newMemEtcd(1)
+	_, err := cli.Put(ctx, &pb.PutRequest{Key: []byte("a"), Value: []byte("1")})
+	assert.NoError(t, err)
+	assert.NoError(t, checkNoTxnKeys(ctx, cli, config.DefaultInternalPrefix))
+
+	lock := append(txnLockPrefix(config.DefaultInternalPrefix), 'a')
+	_, err = cli.Put(ctx, &pb.PutRequest{Key: lock, Value: []byte("t1")})
+	assert.NoError(t, err)
+	assert.Error(t, checkNoTxnKeys(ctx, cli, config.DefaultInternalPrefix))
+
+	_, err = cli.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: lock})
+	assert.NoError(t, err)
+	intent := append(txnIntentPrefix(config.DefaultInternalPrefix), "t1"...)
+	_, err = cli.Put(ctx, &pb.PutRequest{Key: intent, Value: []byte("{}")})
+	assert.NoError(t, err)
+	assert.Error(t, checkNoTxnKeys(ctx, cli, config.DefaultInternalPrefix))
+}
+
+// checkpointFailingEtcd is the etcd of the shard map, whose saves of checkpoints fail
+// from the failAt-th on, as if the process running the migration stopped.
+type checkpointFailingEtcd struct {
+	*memEtcd
+	mu     sync.Mutex
+	saves  int
+	failAt int
+	// failedPhase is the phase of the first checkpoint failed to save
+	failedPhase string
+}
+
+func (e *checkpointFailingEtcd) Txn(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	for _, op := range in.Success {
+		put := op.GetRequestPut()
+		if put == nil || !bytes.Contains(put.Key, []byte("/migrations/")) {
+			continue
+		}
+		e.mu.Lock()
+		e.saves++
+		fail := e.failAt > 0 && e.saves >= e.failAt
+		if e.failAt > 0 && e.saves == e.failAt {
+			var cp MigrationCheckpoint
+			_ = json.Unmarshal(put.Value, &cp)
+			e.failedPhase = cp.Phase
+		}
+		e.mu.Unlock()
+		if fail {
+			return nil, errors.New("process stopped")
+		}
+	}
+	return e.memEtcd.Txn(ctx, in, opts...)
+}
+
+func (e *checkpointFailingEtcd) stopFailing() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failAt = 0
+}
+
+// hookedEtcd is a shard whose puts & ranges can be hooked
+type hookedEtcd struct {
+	*memEtcd
+	mu      sync.Mutex
+	onPut   func(ctx context.Context) error
+	onRange func(in *pb.RangeRequest) error
+}
+
+func (e *hookedEtcd) Put(ctx context.Context, in *pb.PutRequest, opts ...grpc.CallOption) (*pb.PutResponse, error) {
+	e.mu.Lock()
+	hook := e.onPut
+	e.mu.Unlock()
+	if hook != nil {
+		if err := hook(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return e.memEtcd.Put(ctx, in, opts...)
+}
+
+func (e *hookedEtcd) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	e.mu.Lock()
+	hook := e.onRange
+	e.mu.Unlock()
+	if hook != nil {
+		if err := hook(in); err != nil {
+			return nil, err
+		}
+	}
+	return e.memEtcd.Range(ctx, in, opts...)
+}
+
+func (e *hookedEtcd) hook(onPut func(ctx context.Context) error, onRange func(in *pb.RangeRequest) error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onPut, e.onRange = onPut, onRange
+}
+
+// migrationTest moves ["m", "p") from shard[1] to shard[0] in memory
+type migrationTest struct {
+	conf   *config.Configurations
+	meta   *checkpointFailingEtcd
+	shards []*hookedEtcd
+}
+
+func newMigrationTest(t *testing.T) *migrationTest {
+	ret := &migrationTest{
+		conf: &config.Configurations{
+			Shards:         []config.Shard{{End: "m", Address: "mem-0"}, {Start: "m", Address: "mem-1"}},
+			InternalPrefix: config.DefaultInternalPrefix,
+			ShardMap:       config.ShardMap{Key: config.DefaultInternalPrefix + config.DefaultShardMapKey},
+		},
+		meta:   &checkpointFailingEtcd{memEtcd: newMemEtcd(-1)},
+		shards: []*hookedEtcd{{memEtcd: newMemEtcd(0)}, {memEtcd: newMemEtcd(1)}},
+	}
+	ctx := context.Background()
+	value, err := json.Marshal(ret.conf.Layout(1))
+	assert.NoError(t, err)
+	_, err = ret.meta.Put(ctx, &pb.PutRequest{Key: []byte(ret.conf.ShardMap.Key), Value: value})
+	assert.NoError(t, err)
+	// leases are granted in all shards with the same id
+	for _, shard := range ret.shards {
+		_, err = shard.LeaseGrant(ctx, &pb.LeaseGrantRequest{ID: 7, TTL: 60})
+		assert.NoError(t, err)
+	}
+	for _, key := range []string{"a", "m", "n", "o", "p", "q"} {
+		shard := ret.shards[1]
+		if key < "m" {
+			shard = ret.shards[0]
+		}
+		_, err = shard.Put(ctx, &pb.PutRequest{Key: []byte(key), Value: []byte("v" + key), Lease: 7})
+		assert.NoError(t, err)
+	}
+	return ret
+}
+
+func (mt *migrationTest) migrator(t *testing.T) *Migrator {
+	shardMap := newShardMap(mt.meta, mt.conf, nil)
+	assert.NoError(t, shardMap.Reload(context.Background()))
+	ret := NewMigrator(shardMap)
+	ret.newClient = func(shard int, conf config.Shard) (ShardClient, error) {
+		return mt.shards[shard], nil
+	}
+	ret.claimTTL = 1
+	return ret
+}
+
+func (mt *migrationTest) assertMoved(t *testing.T, m *Migrator) {
+	assert.Equal(t, []string{"a", "m", "n", "o"}, mt.shards[0].keys())
+	assert.Equal(t, []string{"p", "q"}, mt.shards[1].keys())
+	layout := m.shardMap.Layout()
+	assert.Empty(t, layout.Migrations)
+	assert.Equal(t, KeyRange{Key: []byte{}, RangeEnd: []byte("p")}, layoutShardRange(layout.Shards, 0))
+	assert.Equal(t, KeyRange{Key: []byte("p"), RangeEnd: noEnd}, layoutShardRange(layout.Shards, 1))
+}
+
+func TestMigrator_Move(t *testing.T) {
+	mt := newMigrationTest(t)
+	m := mt.migrator(t)
+	cp, err := m.Move(context.Background(), []byte("m"), []byte("p"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, MigrationPhaseDone, cp.Phase)
+	mt.assertMoved(t, m)
+}
+
+func TestMigrator_resume(t *testing.T) {
+	ctx := context.Background()
+	var phases []string
+	for failAt := 1; ; failAt++ {
+		mt := newMigrationTest(t)
+		mt.meta.failAt = failAt
+		cp, err := mt.migrator(t).Move(ctx, []byte("m"), []byte("p"), 0)
+		if err == nil {
+			break
+		}
+		phases = append(phases, mt.meta.failedPhase)
+
+		// another process resumes the migration from the last checkpoint saved
+		mt.meta.stopFailing()
+		m := mt.migrator(t)
+		cp, err = m.Drive(ctx, cp.Migration.ID)
+		assert.NoError(t, err, "stopped at phase %s", mt.meta.failedPhase)
+		assert.Equal(t, MigrationPhaseDone, cp.Phase)
+		mt.assertMoved(t, m)
+	}
+	for _, phase := range []string{MigrationPhaseSnapshot, MigrationPhaseCatchUp, MigrationPhaseFenced, MigrationPhaseCleanup, MigrationPhaseDone} {
+		assert.Contains(t, phases, phase)
+	}
+}
+
+func TestMigrator_verifyFailed(t *testing.T) {
+	ctx := context.Background()
+	mt := newMigrationTest(t)
+	verifyFails := true
+	mt.shards[0].hook(nil, func(in *pb.RangeRequest) error {
+		// only verify reads batches of the target
+		if verifyFails && in.Limit == copyBatchSize {
+			verifyFails = false
+			return errors.New("target unavailable")
+		}
+		return nil
+	})
+	m := mt.migrator(t)
+	cp, err := m.Move(ctx, []byte("m"), []byte("p"), 0)
+	assert.Error(t, err)
+
+	// the writes are unfenced, and the range is copied again by a new snapshot
+	layout := m.shardMap.Layout()
+	assert.Equal(t, config.MigrationCopying, layout.Migrations[0].State)
+	cp, err = m.Checkpoint(ctx, cp.Migration.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, MigrationPhasePending, cp.Phase)
+	cp, err = m.Drive(ctx, cp.Migration.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, MigrationPhaseDone, cp.Phase)
+	mt.assertMoved(t, m)
+}
+
+func TestMigrator_Abort(t *testing.T) {
+	ctx := context.Background()
+	mt := newMigrationTest(t)
+	// stopped once the snapshot is copied
+	mt.meta.failAt = 3
+	cp, err := mt.migrator(t).Move(ctx, []byte("m"), []byte("p"), 0)
+	assert.Error(t, err)
+	mt.meta.stopFailing()
+
+	m := mt.migrator(t)
+	cp, err = m.Abort(ctx, cp.Migration.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, MigrationPhaseAborted, cp.Phase)
+	assert.Equal(t, []string{"a"}, mt.shards[0].keys())
+	assert.Equal(t, []string{"m", "n", "o", "p", "q"}, mt.shards[1].keys())
+	assert.Empty(t, m.shardMap.Layout().Migrations)
+	assert.Equal(t, KeyRange{Key: []byte{}, RangeEnd: []byte("m")}, layoutShardRange(m.shardMap.Layout().Shards, 0))
+}
+
+func TestMigrator_claimLost(t *testing.T) {
+	ctx := context.Background()
+	mt := newMigrationTest(t)
+	copying := make(chan struct{})
+	var once sync.Once
+	mt.shards[0].hook(func(ctx context.Context) error {
+		once.Do(func() { close(copying) })
+		<-ctx.Done()
+		return ctx.Err()
+	}, nil)
+	m := mt.migrator(t)
+	done := make(chan error, 1)
+	var id string
+	go func() {
+		cp, err := m.Move(ctx, []byte("m"), []byte("p"), 0)
+		id = cp.Migration.ID
+		done <- err
+	}()
+	<-copying
+
+	// the lease of the claim expires, so the migration may be claimed by others
+	claims := m.claimKey("")
+	resp, err := mt.meta.Range(ctx, &pb.RangeRequest{Key: claims, RangeEnd: prefixEnd(claims)})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Kvs, 1)
+	_, err = mt.meta.LeaseRevoke(ctx, &pb.LeaseRevokeRequest{ID: resp.Kvs[0].Lease})
+	assert.NoError(t, err)
+	select {
+	case err = <-done:
+		assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("migration not stopped after its claim is lost")
+	}
+
+	mt.shards[0].hook(nil, nil)
+	m = mt.migrator(t)
+	cp, err := m.Drive(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, MigrationPhaseDone, cp.Phase)
+	mt.assertMoved(t, m)
+}
+
+func TestMigrator_gc(t *testing.T) {
+	ctx := context.Background()
+	mt := newMigrationTest(t)
+	m := mt.migrator(t)
+	checkpoints := []MigrationCheckpoint{
+		{Migration: config.Migration{ID: "old"}, Phase: MigrationPhaseDone, Updated: time.Now().Add(-migrationCheckpointRetention - time.Hour)},
+		{Migration: config.Migration{ID: "recent"}, Phase: MigrationPhaseAborted, Updated: time.Now()},
+		{Migration: config.Migration{ID: "running"}, Phase: MigrationPhaseCatchUp, Updated: time.Now().Add(-migrationCheckpointRetention - time.Hour)},
+	}
+	for _, cp := range checkpoints {
+		value, err := json.Marshal(cp)
+		assert.NoError(t, err)
+		_, err = mt.meta.Put(ctx, &pb.PutRequest{Key: m.checkpointKey(cp.Migration.ID), Value: value})
+		assert.NoError(t, err)
+	}
+	m.gc(ctx, checkpoints)
+	left, err := m.List(ctx)
+	assert.NoError(t, err)
+	var ids []string
+	for _, cp := range left {
+		ids = append(ids, cp.Migration.ID)
+	}
+	assert.ElementsMatch(t, []string{"recent", "running"}, ids)
+}
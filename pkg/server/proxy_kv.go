@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var _ pb.KVServer = &KVProxy{}
@@ -13,68 +16,360 @@ type KVProxy struct {
 	groupRunners GroupRunnerFactory
 	configs      ShardingConfigs
 	respFilter   ResponseFilter
+	txnValidator *TxnValidator
+	// txnCoordinator runs txns across shards, nil if not enabled
+	txnCoordinator *TxnCoordinator
+	// headers rewrites response headers, nil if not enabled
+	headers *HeaderStamper
+	// coalescer coalesces identical ranges, nil if not enabled
+	coalescer *RangeCoalescer
+	// cache serves serializable ranges of hot prefixes, nil if not enabled
+	cache *RangeCache
+	// partialRange makes ranges partial by default, see RangePartialKey
+	partialRange bool
+	// shardTimeout is the timeout of the range in each shard, 0 if none
+	shardTimeout time.Duration
+	// replicator writes replicated keys, nil if no replicated prefix
+	replicator *Replicator
+	// dualWriter mirrors writes & shadow-reads ranges in dual-write migrations, nil if not enabled
+	dualWriter *DualWriter
 }
 
-func NewKVProxy(groupRunners GroupRunnerFactory, configs ShardingConfigs, respFilter ResponseFilter) *KVProxy {
-	return &KVProxy{
+// KVProxyOption is the option to create KVProxy
+type KVProxyOption func(*KVProxy)
+
+// WithTxnCoordinator enables txns across shards by the coordinator
+func WithTxnCoordinator(coordinator *TxnCoordinator) KVProxyOption {
+	return func(s *KVProxy) {
+		s.txnCoordinator = coordinator
+	}
+}
+
+// WithHeaderStamper makes the proxy emit proxy-level response headers
+func WithHeaderStamper(headers *HeaderStamper) KVProxyOption {
+	return func(s *KVProxy) {
+		s.headers = headers
+	}
+}
+
+// WithRangeCoalescer makes the proxy coalesce identical concurrent ranges
+func WithRangeCoalescer(coalescer *RangeCoalescer) KVProxyOption {
+	return func(s *KVProxy) {
+		s.coalescer = coalescer
+	}
+}
+
+// WithRangeCache makes the proxy serve serializable ranges of cached prefixes from the cache
+func WithRangeCache(cache *RangeCache) KVProxyOption {
+	return func(s *KVProxy) {
+		s.cache = cache
+	}
+}
+
+// WithPartialRange makes ranges return the keys from healthy shards when some shards fail,
+// unless disabled by metadata.
+func WithPartialRange() KVProxyOption {
+	return func(s *KVProxy) {
+		s.partialRange = true
+	}
+}
+
+// WithShardTimeout limits the time of the range in each shard
+func WithShardTimeout(timeout time.Duration) KVProxyOption {
+	return func(s *KVProxy) {
+		s.shardTimeout = timeout
+	}
+}
+
+// WithReplicator makes the proxy write replicated keys to all shards by the replicator
+func WithReplicator(replicator *Replicator) KVProxyOption {
+	return func(s *KVProxy) {
+		s.replicator = replicator
+	}
+}
+
+// WithDualWriter makes the proxy mirror writes to the targets of migrations in dual-write,
+// and shadow-read from them, by the dual writer
+func WithDualWriter(dualWriter *DualWriter) KVProxyOption {
+	return func(s *KVProxy) {
+		s.dualWriter = dualWriter
+	}
+}
+
+func NewKVProxy(groupRunners GroupRunnerFactory, configs ShardingConfigs, respFilter ResponseFilter, opts ...KVProxyOption) *KVProxy {
+	ret := &KVProxy{
 		groupRunners: groupRunners,
 		configs:      configs,
 		respFilter:   respFilter,
+		txnValidator: NewTxnValidator(configs),
 	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
 }
 
 // Range gets the keys in the range from the key-value store.
+// If a revision vector is given in metadata, every shard is read at its revision in the vector.
+// With proxy-level headers, the revision of the request is a composite revision, see rangeRevisions.
+// The revision vector of the read is sent back in the response header.
+// A range with a continuation token in metadata is paged, see RangeContinueKey.
+// Serializable ranges of cached prefixes are served by the cache if it's enabled.
+// Identical concurrent ranges are coalesced if the coalescer is enabled and it's safe.
+// A partial range tolerates failed shards, see RangePartialKey.
+// A range in a migration in dual-write may be shadow-read from its target by the dual writer.
 func (s *KVProxy) Range(ctx context.Context, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	if token, ok := rangeContinueFromContext(ctx); ok && !req.CountOnly {
+		return s.rangeByCursor(ctx, req, token)
+	}
+	revs, err := s.rangeRevisions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	partial := s.isPartialRange(ctx)
+	var result *rangeResult
+	var cached bool
+	if s.cache != nil && revs == nil {
+		result, cached = s.cache.Range(req)
+	}
+	switch {
+	case cached:
+	case s.coalescer != nil && s.coalescer.CanCoalesce(req) && !partial:
+		result, err = s.coalescer.Do(ctx, req, revs, func(ctx context.Context) (*rangeResult, error) {
+			return s.doRange(ctx, req, revs, false)
+		})
+	default:
+		result, err = s.doRange(ctx, req, revs, partial)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.dualWriter != nil && !cached && revs == nil && len(result.missing) == 0 {
+		s.dualWriter.shadowRange(req, result.resp, result.readRevs)
+	}
+	setRevisionVectorHeader(ctx, result.readRevs)
+	setMissingRangesTrailer(ctx, result.missing)
+	// the response may be shared, so copy it before stamping
+	ret := *result.resp
+	ret.Header = s.headers.Stamp(ret.Header)
+	return &ret, nil
+}
+
+// doRange does the range in shards. A partial range skips failed shards.
+func (s *KVProxy) doRange(ctx context.Context, req *pb.RangeRequest, revs RevisionVector, partial bool) (*rangeResult, error) {
 	shardClis := s.configs.GetShardClis(req.Key, req.RangeEnd)
-	var rets = make([]*pb.RangeResponse, len(shardClis))
+	var rets []*pb.RangeResponse
+	var missing []missingRange
 	var err error
-	if len(rets) > 1 {
-		groupRunner := s.groupRunners.GetGroupRunner()
-		for i := range shardClis {
-			index := i
-			groupRunner.Go(func() error {
-				rets[index], err = shardClis[index].Range(ctx, req)
-				return errors.Wrapf(err, "failed to do range in shard[%d]", shardClis[index].GetShardID())
-			})
-		}
-		err := groupRunner.Wait()
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		rets[0], err = shardClis[0].Range(ctx, req)
+	switch {
+	case len(shardClis) < 2:
+		var ret *pb.RangeResponse
+		ret, err = s.rangeShard(ctx, shardClis[0], rangeRequestAt(req, shardClis[0].GetShardID(), revs))
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to do range in shard[%d]", shardClis[0].GetShardID())
 		}
+		rets = []*pb.RangeResponse{ret}
+	case partial:
+		rets, shardClis, missing, err = s.rangePartial(ctx, RangeRequestForShards(req), shardClis, revs)
+		if err == nil && len(rets) == 1 && req.KeysOnly {
+			// a single response is not filtered, drop the values needed by merge
+			dropValues(rets[0].Kvs)
+		}
+	case isLimitedInKeyOrder(req) && shardsInKeyOrder(s.configs):
+		rets, err = s.rangeInKeyOrder(ctx, req, shardClis, revs)
+	default:
+		rets, err = s.rangeInParallel(ctx, RangeRequestForShards(req), shardClis, revs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	readRevs := readRevisions(req, shardClis, rets, revs)
+	for i, ret := range rets {
+		s.headers.Observe(shardClis[i].GetShardID(), ret.Header)
 	}
 	ret, err := s.respFilter.FilterRange(req, rets)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to filter range response")
 	}
-	return ret, nil
+	return &rangeResult{resp: ret, readRevs: readRevs, missing: missing}, nil
+}
+
+// rangeRevisions returns the revision vector in metadata to read the range at.
+// With proxy-level headers, the shards of the range not in it are read at the revision vector
+// the composite revision of the request is composed of, and the range fails with OutOfRange
+// if the composite revision is unknown.
+func (s *KVProxy) rangeRevisions(ctx context.Context, req *pb.RangeRequest) (RevisionVector, error) {
+	revs, err := RevisionVectorFromContext(ctx)
+	if err != nil || req.Revision <= 0 || s.headers == nil {
+		return revs, err
+	}
+	composed, ok := s.headers.RevisionsAt(req.Revision)
+	if !ok {
+		return nil, status.Errorf(codes.OutOfRange, "unknown composite revision %d", req.Revision)
+	}
+	if revs == nil {
+		revs = make(RevisionVector)
+	}
+	for _, shardCli := range s.configs.GetShardClis(req.Key, req.RangeEnd) {
+		shardID := shardCli.GetShardID()
+		if revs.Get(shardID) > 0 {
+			continue
+		}
+		if composed.Get(shardID) <= 0 {
+			return nil, status.Errorf(codes.OutOfRange, "shard[%d] is not in composite revision %d", shardID, req.Revision)
+		}
+		revs[shardID] = composed.Get(shardID)
+	}
+	return revs, nil
+}
+
+// rangeRequestAt returns the request reading the shard at its revision in revs.
+func rangeRequestAt(req *pb.RangeRequest, shardID int, revs RevisionVector) *pb.RangeRequest {
+	rev := revs.Get(shardID)
+	if rev == 0 {
+		return req
+	}
+	ret := *req
+	ret.Revision = rev
+	return &ret
+}
+
+// readRevisions returns the revision vector a range is read at.
+// Shards not in the range keep their revisions in revs.
+func readRevisions(req *pb.RangeRequest, shardClis []ShardClient, rets []*pb.RangeResponse, revs RevisionVector) RevisionVector {
+	ret := revs.Clone()
+	for i, resp := range rets {
+		shardID := shardClis[i].GetShardID()
+		rev := rangeRequestAt(req, shardID, revs).Revision
+		if rev <= 0 {
+			// header revision is the current revision of the shard
+			rev = resp.Header.GetRevision()
+		}
+		ret[shardID] = rev
+	}
+	return ret
+}
+
+// isLimitedInKeyOrder returns true if the request wants the first limit keys in ascending key order,
+// which can be read shard by shard.
+func isLimitedInKeyOrder(req *pb.RangeRequest) bool {
+	if req.Limit <= 0 || req.CountOnly || hasRevisionFilters(req) {
+		return false
+	}
+	return req.SortTarget == pb.RangeRequest_KEY && req.SortOrder != pb.RangeRequest_DESCEND
+}
+
+// rangeInParallel does the range in all shards at the same time.
+func (s *KVProxy) rangeInParallel(ctx context.Context, req *pb.RangeRequest, shardClis []ShardClient, revs RevisionVector) ([]*pb.RangeResponse, error) {
+	var rets = make([]*pb.RangeResponse, len(shardClis))
+	groupRunner := s.groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			var err error
+			shardID := shardClis[index].GetShardID()
+			rets[index], err = s.rangeShard(ctx, shardClis[index], rangeRequestAt(req, shardID, revs))
+			return errors.Wrapf(err, "failed to do range in shard[%d]", shardID)
+		})
+	}
+	err := groupRunner.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return rets, nil
+}
+
+// rangeInKeyOrder reads the shards one by one in key order until limit keys are got,
+// then only counts the keys in the rest shards.
+// So at most limit keys are read instead of limit keys from every shard.
+func (s *KVProxy) rangeInKeyOrder(ctx context.Context, req *pb.RangeRequest, shardClis []ShardClient, revs RevisionVector) ([]*pb.RangeResponse, error) {
+	var rets = make([]*pb.RangeResponse, 0, len(shardClis))
+	var remaining = req.Limit
+	var i int
+	for ; i < len(shardClis) && remaining > 0; i++ {
+		shardReq := *rangeRequestAt(req, shardClis[i].GetShardID(), revs)
+		shardReq.Limit = remaining
+		ret, err := s.rangeShard(ctx, shardClis[i], &shardReq)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to do range in shard[%d]", shardClis[i].GetShardID())
+		}
+		rets = append(rets, ret)
+		remaining -= int64(len(ret.Kvs))
+	}
+	if i == len(shardClis) {
+		return rets, nil
+	}
+	countReq := *req
+	countReq.Limit = 0
+	countReq.CountOnly = true
+	counts, err := s.rangeInParallel(ctx, &countReq, shardClis[i:], revs)
+	if err != nil {
+		return nil, err
+	}
+	return append(rets, counts...), nil
 }
 
 // Put puts the given key into the key-value store.
 // A put request increments the revision of the key-value store
 // and generates one event in the event history.
+// Replicated keys are put in all shards.
+// A put of a key locked by a txn across shards fails with an Aborted status.
+// A put in a range being moved waits until it's moved, and is mirrored to the target in dual-write.
 func (s *KVProxy) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	done, err := s.beginWrite(ctx, KeyRange{Key: req.Key})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done() }()
+	if s.replicator != nil {
+		if _, whole := replicatedRanges(s.configs, req.Key, nil); whole {
+			return s.replicator.Put(ctx, req)
+		}
+	}
 	shardCli := s.configs.GetShardClis(req.Key, nil)[0]
-	return shardCli.Put(ctx, req)
+	ret, err := s.txnCoordinator.putShard(ctx, shardCli, req)
+	if err != nil {
+		return nil, err
+	}
+	if s.dualWriter != nil {
+		// the write is done when it's mirrored
+		s.dualWriter.mirrorPut(req, done)
+		done = func() {}
+	}
+	s.headers.Observe(shardCli.GetShardID(), ret.Header)
+	ret.Header = s.headers.Stamp(ret.Header)
+	return ret, nil
 }
 
 // DeleteRange deletes the given range from the key-value store.
 // A delete request increments the revision of the key-value store
 // and generates a delete event in the event history for every deleted key.
+// Replicated keys are deleted in all shards.
+// A delete of keys locked by a txn across shards fails with an Aborted status.
+// A delete in a range being moved waits until it's moved, and is mirrored to the target in dual-write.
 func (s *KVProxy) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	done, err := s.beginWrite(ctx, KeyRange{Key: req.Key, RangeEnd: req.RangeEnd})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { done() }()
+	var replicatedParts []KeyRange
+	if s.replicator != nil {
+		var whole bool
+		replicatedParts, whole = replicatedRanges(s.configs, req.Key, req.RangeEnd)
+		if whole {
+			return s.replicator.DeleteRange(ctx, req)
+		}
+	}
 	shardClis := s.configs.GetShardClis(req.Key, req.RangeEnd)
 	var rets = make([]*pb.DeleteRangeResponse, len(shardClis))
-	var err error
 	groupRunner := s.groupRunners.GetGroupRunner()
 	if len(rets) > 1 {
 		for i := range shardClis {
 			index := i
 			groupRunner.Go(func() error {
-				rets[index], err = shardClis[index].DeleteRange(ctx, req)
+				var err error
+				rets[index], err = s.txnCoordinator.deleteRangeShard(ctx, shardClis[index], req)
 				if err != nil {
 					return errors.Wrapf(err, "failed to do delete range in shard[%d]", shardClis[index].GetShardID())
 				}
@@ -83,7 +378,7 @@ func (s *KVProxy) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (
 		}
 		err = groupRunner.Wait()
 	} else {
-		rets[0], err = shardClis[0].DeleteRange(ctx, req)
+		rets[0], err = s.txnCoordinator.deleteRangeShard(ctx, shardClis[0], req)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to do delete range in shard[%d]", shardClis[0].GetShardID())
 		}
@@ -91,10 +386,22 @@ func (s *KVProxy) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (
 	if err != nil {
 		return nil, err
 	}
+	for i, ret := range rets {
+		s.headers.Observe(shardClis[i].GetShardID(), ret.Header)
+	}
+	if s.dualWriter != nil {
+		s.dualWriter.mirrorDeleteRange(req, done)
+		done = func() {}
+	}
+	// the primary copies are deleted in their shards, then the replicas
+	for _, part := range replicatedParts {
+		s.replicator.repairOrSchedule(ctx, part)
+	}
 	ret, err := s.respFilter.FilterDeleteRange(rets)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to filter delete range response")
 	}
+	ret.Header = s.headers.Stamp(ret.Header)
 	return ret, nil
 }
 
@@ -102,42 +409,43 @@ func (s *KVProxy) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (
 // A txn request increments the revision of the key-value store
 // and generates events with the same revision for every completed request.
 // It is not allowed to modify the same key several times within one txn.
+// Txns across shards are committed by the txn coordinator if it's enabled,
+// otherwise they're rejected with a FailedPrecondition status.
+// A txn writing in a range being moved waits until it's moved, and its writes are mirrored
+// to the target in dual-write.
 func (s *KVProxy) Txn(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
-	shardID, err := s.getShardID(req)
+	done, err := s.beginWrite(ctx, txnWriteRanges(req)...)
 	if err != nil {
 		return nil, err
 	}
-	return s.configs.GetShardCli(shardID).Txn(ctx, req)
-}
-
-func (s *KVProxy) getShardID(req *pb.TxnRequest) (int, error) {
-	var getShardIDByOp = func(op *pb.RequestOp) (int, error) {
-		rangeOp := op.GetRequestRange()
-		if rangeOp != nil {
-			clis := s.configs.GetShardClis(rangeOp.Key, nil)
-			return clis[0].GetShardID(), nil
-		}
-		putOp := op.GetRequestPut()
-		if putOp != nil {
-			clis := s.configs.GetShardClis(putOp.Key, nil)
-			return clis[0].GetShardID(), nil
+	defer func() { done() }()
+	var ret *pb.TxnResponse
+	if s.txnCoordinator != nil {
+		ret, err = s.txnCoordinator.Txn(ctx, req)
+		if err != nil {
+			return nil, err
 		}
-		deleteOp := op.GetRequestDeleteRange()
-		if deleteOp != nil {
-			clis := s.configs.GetShardClis(deleteOp.Key, nil)
-			return clis[0].GetShardID(), nil
+		if s.dualWriter != nil {
+			s.dualWriter.mirrorTxn(req, ret, done)
+			done = func() {}
 		}
-		// assume txn
-		return s.getShardID(op.GetRequestTxn())
+		return ret, nil
+	}
+	shardID, err := s.txnValidator.Validate(req)
+	if err != nil {
+		return nil, err
 	}
-	for _, op := range req.Success {
-		return getShardIDByOp(op)
+	ret, err = s.configs.GetShardCli(shardID).Txn(ctx, req)
+	if err != nil {
+		return nil, err
 	}
-	for _, op := range req.Failure {
-		return getShardIDByOp(op)
+	if s.dualWriter != nil {
+		s.dualWriter.mirrorTxn(req, ret, done)
+		done = func() {}
 	}
-	// empty txn, use first shard
-	return 0, nil
+	s.headers.Observe(shardID, ret.Header)
+	ret.Header = s.headers.Stamp(ret.Header)
+	return ret, nil
 }
 
 var ErrNotSupported = errors.New("not supported")
@@ -146,6 +454,63 @@ var ErrTxnDifferentShard = errors.Wrap(ErrNotSupported, "txn in different shard"
 // Compact compacts the event history in the etcd key-value store. The key-value
 // store should be periodically compacted or the event history will continue to grow
 // indefinitely.
+// Every shard is compacted to its own revision, mapped from the request by compactRevisions.
+// The results of shards are sent in the response header, and it only succeeds
+// when every shard is compacted.
 func (s *KVProxy) Compact(ctx context.Context, req *pb.CompactionRequest) (*pb.CompactionResponse, error) {
-	return nil, ErrNotSupported
+	revs, err := s.compactRevisions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	results := compactShards(ctx, s.groupRunners, s.configs, revs, req.Physical)
+	setCompactionResultsHeader(ctx, results)
+	err = compactionError(results)
+	if err != nil {
+		return nil, err
+	}
+	ret := &pb.CompactionResponse{}
+	for _, result := range results {
+		s.headers.Observe(result.ShardID, result.Header)
+		if ret.Header == nil {
+			ret.Header = result.Header
+		}
+	}
+	ret.Header = s.headers.Stamp(ret.Header)
+	return ret, nil
+}
+
+// compactRevisions maps the compaction request to the revisions of all shards:
+//   - a revision vector in metadata: the revision of each shard in it.
+//   - with proxy-level headers: the revision vector the composite revision is composed of.
+//   - otherwise: the revision of request in every shard, or the current revision of a shard behind it.
+func (s *KVProxy) compactRevisions(ctx context.Context, req *pb.CompactionRequest) (RevisionVector, error) {
+	revs, err := RevisionVectorFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if revs == nil && s.headers != nil {
+		var ok bool
+		revs, ok = s.headers.RevisionsAt(req.Revision)
+		if !ok {
+			return nil, status.Errorf(codes.OutOfRange, "unknown composite revision %d", req.Revision)
+		}
+	}
+	if revs == nil {
+		// shards have revisions of their own, a lagging shard can't be compacted after its current revision
+		revs, err = currentRevisions(ctx, s.groupRunners, s.configs)
+		if err != nil {
+			return nil, err
+		}
+		for shardID, rev := range revs {
+			if rev > req.Revision {
+				revs[shardID] = req.Revision
+			}
+		}
+	}
+	for _, shardCli := range s.configs.GetAllShardClis() {
+		if revs.Get(shardCli.GetShardID()) <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "no compaction revision for shard[%d]", shardCli.GetShardID())
+		}
+	}
+	return revs, nil
 }
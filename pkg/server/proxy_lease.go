@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"io"
+	"sync/atomic"
 
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -12,11 +14,14 @@ var _ pb.LeaseServer = &LeaseProxy{}
 
 type LeaseProxy struct {
 	configs ShardingConfigs
+	// headers rewrites response headers, nil if not enabled
+	headers *HeaderStamper
 }
 
-func NewLeaseProxy(configs ShardingConfigs) *LeaseProxy {
+func NewLeaseProxy(configs ShardingConfigs, headers *HeaderStamper) *LeaseProxy {
 	return &LeaseProxy{
 		configs: configs,
+		headers: headers,
 	}
 }
 
@@ -29,10 +34,12 @@ func (p *LeaseProxy) LeaseGrant(ctx context.Context, in *pb.LeaseGrantRequest) (
 		if err != nil {
 			return nil, err
 		}
+		p.headers.Observe(shardCli.GetShardID(), resp.Header)
 		if ret == nil {
 			ret = resp
 		}
 	}
+	ret.Header = p.headers.Stamp(ret.Header)
 	return ret, nil
 }
 
@@ -42,10 +49,12 @@ func (p *LeaseProxy) LeaseRevoke(ctx context.Context, in *pb.LeaseRevokeRequest)
 		if err != nil {
 			return nil, err
 		}
+		p.headers.Observe(shardCli.GetShardID(), resp.Header)
 		if ret == nil {
 			ret = resp
 		}
 	}
+	ret.Header = p.headers.Stamp(ret.Header)
 	return ret, nil
 }
 
@@ -55,11 +64,14 @@ func (p *LeaseProxy) LeaseTimeToLive(ctx context.Context, in *pb.LeaseTimeToLive
 		if err != nil {
 			return nil, err
 		}
+		p.headers.Observe(shardCli.GetShardID(), resp.Header)
 		if ret == nil {
 			ret = resp
+			continue
 		}
-		ret.Keys = append(resp.Keys, resp.Keys...)
+		ret.Keys = append(ret.Keys, resp.Keys...)
 	}
+	ret.Header = p.headers.Stamp(ret.Header)
 	return ret, nil
 }
 
@@ -69,49 +81,92 @@ func (p *LeaseProxy) LeaseLeases(ctx context.Context, in *pb.LeaseLeasesRequest)
 		if err != nil {
 			return nil, err
 		}
+		p.headers.Observe(shardCli.GetShardID(), resp.Header)
 		if ret == nil {
 			ret = resp
+			continue
 		}
-		ret.Leases = append(resp.Leases, resp.Leases...)
+		ret.Leases = append(ret.Leases, resp.Leases...)
 	}
+	ret.Header = p.headers.Stamp(ret.Header)
 	return ret, nil
 }
 
 func (p *LeaseProxy) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
-	keepAliveStream := NewSingleLeaseKeepAliveProxy(p.configs, stream)
+	keepAliveStream := NewSingleLeaseKeepAliveProxy(p.configs, stream, p.headers)
 	return keepAliveStream.Run()
 }
 
+// SingleLeaseKeepAliveProxy sends the keep alive requests of a stream to all shards,
+// and the responses of the primary shard, the first one in use, back to the client.
+// It re-attaches to the shards switched to by versioned sharding configs: keep alive streams
+// are opened on new shards and shards with new clients, and closed on removed shards.
+// Streams failed to send or receive are reopened by the next request.
 type SingleLeaseKeepAliveProxy struct {
 	configs ShardingConfigs
 	ctx     context.Context
 	stream  pb.Lease_LeaseKeepAliveServer
 	cancel  context.CancelFunc
+	lg      *zap.Logger
+	// headers rewrites response headers, nil if not enabled
+	headers *HeaderStamper
 
-	groupRunner    GroupRunner
-	mapShardStream map[int]pb.Lease_LeaseKeepAliveClient
-	recvChan       chan *pb.LeaseKeepAliveRequest
-	respChan       chan *pb.LeaseKeepAliveResponse
+	groupRunner GroupRunner
+	// shardStreams are the keep alive streams by shard id, only used by handleRecvLoop
+	shardStreams map[int]*shardKeepAliveStream
+	// primary is the id of the shard whose responses are sent to the client, accessed atomically
+	primary  int64
+	recvChan chan *pb.LeaseKeepAliveRequest
+	respChan chan *pb.LeaseKeepAliveResponse
 }
 
-func NewSingleLeaseKeepAliveProxy(configs ShardingConfigs, stream pb.Lease_LeaseKeepAliveServer) *SingleLeaseKeepAliveProxy {
+// shardKeepAliveStream is the keep alive stream on a shard
+type shardKeepAliveStream struct {
+	cli    ShardClient
+	stream pb.Lease_LeaseKeepAliveClient
+	cancel context.CancelFunc
+	// done is closed once the stream stops receiving
+	done chan struct{}
+}
+
+// failed returns true if the stream stopped receiving.
+func (s *shardKeepAliveStream) failed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func NewSingleLeaseKeepAliveProxy(configs ShardingConfigs, stream pb.Lease_LeaseKeepAliveServer, headers *HeaderStamper) *SingleLeaseKeepAliveProxy {
 	ctx, cancel := context.WithCancel(stream.Context())
 	return &SingleLeaseKeepAliveProxy{
-		configs:        configs,
-		ctx:            ctx,
-		stream:         stream,
-		cancel:         cancel,
-		groupRunner:    new(errgroup.Group),
-		mapShardStream: make(map[int]pb.Lease_LeaseKeepAliveClient),
-		recvChan:       make(chan *pb.LeaseKeepAliveRequest, 10),
-		respChan:       make(chan *pb.LeaseKeepAliveResponse, 10),
+		configs:      configs,
+		ctx:          ctx,
+		stream:       stream,
+		cancel:       cancel,
+		lg:           zap.L().Named("ProxyLeaseKeepAlive"),
+		headers:      headers,
+		groupRunner:  new(errgroup.Group),
+		shardStreams: make(map[int]*shardKeepAliveStream),
+		primary:      -1,
+		recvChan:     make(chan *pb.LeaseKeepAliveRequest, 10),
+		respChan:     make(chan *pb.LeaseKeepAliveResponse, 10),
 	}
 }
 
 func (l *SingleLeaseKeepAliveProxy) Run() error {
+	// recvLoop is not waited, as it's blocked receiving from the client until the stream ends
+	go func() {
+		_ = l.recvLoop()
+	}()
 	l.groupRunner.Go(l.sendLoop)
-	l.groupRunner.Go(l.recvLoop)
-	l.groupRunner.Go(l.handleRecvLoop)
+	l.groupRunner.Go(func() error {
+		err := l.handleRecvLoop()
+		l.cancel()
+		return err
+	})
 	return l.groupRunner.Wait()
 }
 
@@ -139,32 +194,116 @@ func (l *SingleLeaseKeepAliveProxy) recvLoop() error {
 			l.cancel()
 			return err
 		}
-		l.recvChan <- req
+		select {
+		case <-l.ctx.Done():
+			return l.ctx.Err()
+		case l.recvChan <- req:
+		}
 	}
 }
 
 func (p *SingleLeaseKeepAliveProxy) handleRecvLoop() error {
+	var changed <-chan struct{}
+	versioned, isVersioned := p.configs.(*VersionedShardingConfigs)
+	if isVersioned {
+		changed = versioned.Changed()
+	}
 	for {
 		var req *pb.LeaseKeepAliveRequest
-		var err error
 		select {
 		case <-p.ctx.Done():
 			return p.ctx.Err()
+		case <-changed:
+			changed = versioned.Changed()
+			if err := suspendedErr(p.configs); err != nil {
+				return err
+			}
+			// the streams are opened by the first request
+			if len(p.shardStreams) > 0 {
+				p.attach()
+			}
+			continue
 		case req = <-p.recvChan:
 		}
+		if err := suspendedErr(p.configs); err != nil {
+			return err
+		}
 
-		for _, shardCli := range p.configs.GetAllShardClis() {
-			shardStream, exist := p.mapShardStream[shardCli.GetShardID()]
-			if !exist {
-				shardStream, err = shardCli.LeaseKeepAlive(p.ctx)
-				if err != nil {
-					if err == io.EOF {
-						return nil
-					}
-				}
-				p.mapShardStream[shardCli.GetShardID()] = shardStream
+		p.attach()
+		for shardID, shardStream := range p.shardStreams {
+			err := shardStream.stream.Send(req)
+			if err != nil {
+				p.lg.Warn("failed to send keep alive request to shard stream", zap.Int("shard", shardID), zap.Error(err))
+				shardStream.cancel()
+				delete(p.shardStreams, shardID)
 			}
-			shardStream.Send(req)
+		}
+	}
+}
+
+// attach opens the keep alive streams on the shards in use without one, with an older client,
+// or with a failed stream, and closes the streams on the shards not in use. The leases are kept
+// alive in new shards by the next requests of the client.
+func (p *SingleLeaseKeepAliveProxy) attach() {
+	inUse := make(map[int]struct{})
+	primary := -1
+	for _, shardCli := range p.configs.GetAllShardClis() {
+		shardID := shardCli.GetShardID()
+		if primary < 0 {
+			primary = shardID
+		}
+		inUse[shardID] = struct{}{}
+		old, exist := p.shardStreams[shardID]
+		if exist && old.cli == shardCli && !old.failed() {
+			continue
+		}
+		if exist {
+			old.cancel()
+			delete(p.shardStreams, shardID)
+		}
+		ctx, cancel := context.WithCancel(p.ctx)
+		stream, err := shardCli.LeaseKeepAlive(ctx)
+		if err != nil {
+			p.lg.Warn("failed to create keep alive stream on shard", zap.Int("shard", shardID), zap.Error(err))
+			cancel()
+			continue
+		}
+		shardStream := &shardKeepAliveStream{cli: shardCli, stream: stream, cancel: cancel, done: make(chan struct{})}
+		p.shardStreams[shardID] = shardStream
+		go p.recvShardStream(ctx, shardID, shardStream)
+	}
+	atomic.StoreInt64(&p.primary, int64(primary))
+	for shardID, shardStream := range p.shardStreams {
+		if _, ok := inUse[shardID]; !ok {
+			shardStream.cancel()
+			delete(p.shardStreams, shardID)
+		}
+	}
+}
+
+// recvShardStream receives the responses of the keep alive stream on a shard until it fails or
+// is closed, sending those of the primary shard to the client.
+func (p *SingleLeaseKeepAliveProxy) recvShardStream(ctx context.Context, shardID int, shardStream *shardKeepAliveStream) {
+	// the stream is released once it's marked failed
+	defer shardStream.cancel()
+	defer close(shardStream.done)
+	for {
+		resp, err := shardStream.stream.Recv()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				p.lg.Warn("failed to receive keep alive response from shard stream", zap.Int("shard", shardID), zap.Error(err))
+			}
+			return
+		}
+		p.headers.Observe(shardID, resp.Header)
+		if int64(shardID) != atomic.LoadInt64(&p.primary) {
+			continue
+		}
+		resp.Header = p.headers.Stamp(resp.Header)
+		select {
+		case <-ctx.Done():
+			return
+		case p.respChan <- resp:
 		}
 	}
 }
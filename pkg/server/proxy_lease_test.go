@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeKeepAliveStream is the keep alive stream on a shard, requests sent to it are in reqs,
+// and responses or errors pushed to resps and errs are received from it.
+type fakeKeepAliveStream struct {
+	grpc.ClientStream
+	ctx     context.Context
+	reqs    chan *pb.LeaseKeepAliveRequest
+	resps   chan *pb.LeaseKeepAliveResponse
+	errs    chan error
+	sendErr error
+}
+
+func (f *fakeKeepAliveStream) Send(req *pb.LeaseKeepAliveRequest) error {
+	if f.sendErr != nil {
+		return f.sendErr
+	}
+	f.reqs <- req
+	return nil
+}
+
+func (f *fakeKeepAliveStream) Recv() (*pb.LeaseKeepAliveResponse, error) {
+	select {
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	case err := <-f.errs:
+		return nil, err
+	case resp := <-f.resps:
+		return resp, nil
+	}
+}
+
+// fakeKeepAliveServer is the client side of the proxy, whose requests are pushed to reqs,
+// and responses sent to it are in resps.
+type fakeKeepAliveServer struct {
+	grpc.ServerStream
+	ctx   context.Context
+	reqs  chan *pb.LeaseKeepAliveRequest
+	resps chan *pb.LeaseKeepAliveResponse
+}
+
+func (f *fakeKeepAliveServer) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeKeepAliveServer) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (f *fakeKeepAliveServer) Send(resp *pb.LeaseKeepAliveResponse) error {
+	f.resps <- resp
+	return nil
+}
+
+func (f *fakeKeepAliveServer) Recv() (*pb.LeaseKeepAliveRequest, error) {
+	select {
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	case req := <-f.reqs:
+		return req, nil
+	}
+}
+
+type keepAliveShardClient struct {
+	*memEtcd
+	streams chan *fakeKeepAliveStream
+}
+
+func newKeepAliveShardClient(shardID int) *keepAliveShardClient {
+	return &keepAliveShardClient{memEtcd: newMemEtcd(shardID), streams: make(chan *fakeKeepAliveStream, 10)}
+}
+
+func (k *keepAliveShardClient) LeaseKeepAlive(ctx context.Context, opts ...grpc.CallOption) (pb.Lease_LeaseKeepAliveClient, error) {
+	stream := &fakeKeepAliveStream{
+		ctx:   ctx,
+		reqs:  make(chan *pb.LeaseKeepAliveRequest, 10),
+		resps: make(chan *pb.LeaseKeepAliveResponse, 10),
+		errs:  make(chan error, 1),
+	}
+	k.streams <- stream
+	return stream, nil
+}
+
+func receiveKeepAliveStream(t *testing.T, cli *keepAliveShardClient) *fakeKeepAliveStream {
+	select {
+	case stream := <-cli.streams:
+		return stream
+	case <-time.After(time.Second):
+		t.Fatalf("no stream opened on shard[%d]", cli.shardID)
+		return nil
+	}
+}
+
+func receiveKeepAliveRequest(t *testing.T, stream *fakeKeepAliveStream) *pb.LeaseKeepAliveRequest {
+	select {
+	case req := <-stream.reqs:
+		return req
+	case <-time.After(time.Second):
+		t.Fatal("no request received")
+		return nil
+	}
+}
+
+func TestSingleLeaseKeepAliveProxy(t *testing.T) {
+	clis := []*keepAliveShardClient{newKeepAliveShardClient(0), newKeepAliveShardClient(1)}
+	configs := NewVersionedShardingConfigs(NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("m"), cli: clis[0]},
+		&ShardImpl{start: []byte("m"), end: noEnd, cli: clis[1]},
+	}), 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &fakeKeepAliveServer{ctx: ctx, reqs: make(chan *pb.LeaseKeepAliveRequest, 10), resps: make(chan *pb.LeaseKeepAliveResponse, 10)}
+	go func() {
+		_ = NewSingleLeaseKeepAliveProxy(configs, client, nil).Run()
+	}()
+	receiveResponse := func() *pb.LeaseKeepAliveResponse {
+		select {
+		case resp := <-client.resps:
+			return resp
+		case <-time.After(time.Second):
+			t.Fatal("no response received")
+			return nil
+		}
+	}
+
+	// the requests are sent to all shards, and only the responses of the primary shard are sent back
+	client.reqs <- &pb.LeaseKeepAliveRequest{ID: 7}
+	streams := []*fakeKeepAliveStream{receiveKeepAliveStream(t, clis[0]), receiveKeepAliveStream(t, clis[1])}
+	for _, stream := range streams {
+		assert.Equal(t, int64(7), receiveKeepAliveRequest(t, stream).ID)
+	}
+	streams[1].resps <- &pb.LeaseKeepAliveResponse{ID: 7, TTL: 9}
+	streams[0].resps <- &pb.LeaseKeepAliveResponse{ID: 7, TTL: 10}
+	assert.Equal(t, int64(10), receiveResponse().TTL)
+
+	// a stream failed to receive is reopened by the next request
+	streams[0].errs <- errors.New("connection reset")
+	<-streams[0].ctx.Done()
+	client.reqs <- &pb.LeaseKeepAliveRequest{ID: 7}
+	reopened := receiveKeepAliveStream(t, clis[0])
+	assert.Equal(t, int64(7), receiveKeepAliveRequest(t, reopened).ID)
+	assert.Equal(t, int64(7), receiveKeepAliveRequest(t, streams[1]).ID)
+	reopened.resps <- &pb.LeaseKeepAliveResponse{ID: 7, TTL: 8}
+	assert.Equal(t, int64(8), receiveResponse().TTL)
+
+	// a stream failed to send is closed, and reopened by the next request
+	streams[1].sendErr = errors.New("connection reset")
+	client.reqs <- &pb.LeaseKeepAliveRequest{ID: 7}
+	assert.Equal(t, int64(7), receiveKeepAliveRequest(t, reopened).ID)
+	<-streams[1].ctx.Done()
+	client.reqs <- &pb.LeaseKeepAliveRequest{ID: 8}
+	assert.Equal(t, int64(8), receiveKeepAliveRequest(t, reopened).ID)
+	streams[1] = receiveKeepAliveStream(t, clis[1])
+	assert.Equal(t, int64(8), receiveKeepAliveRequest(t, streams[1]).ID)
+
+	// the responses of the new primary shard are sent back once the first shard is removed
+	configs.Switch(NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: noEnd, cli: clis[1]},
+	}), 2)
+	<-reopened.ctx.Done()
+	streams[1].resps <- &pb.LeaseKeepAliveResponse{ID: 8, TTL: 7}
+	assert.Equal(t, int64(7), receiveResponse().TTL)
+}
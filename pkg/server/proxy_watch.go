@@ -3,10 +3,13 @@ package server
 import (
 	"context"
 	"io"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
@@ -16,13 +19,19 @@ import (
 
 var _ pb.WatchServer = &WatchProxy{}
 
+// autoWatchID is the id of a create request asking etcd to assign the watch id.
+const autoWatchID = 0
+
 type WatchProxy struct {
 	configs ShardingConfigs
+	// headers rewrites response headers, nil if not enabled
+	headers *HeaderStamper
 }
 
-func NewWatchProxy(configs ShardingConfigs) *WatchProxy {
+func NewWatchProxy(configs ShardingConfigs, headers *HeaderStamper) *WatchProxy {
 	return &WatchProxy{
 		configs: configs,
+		headers: headers,
 	}
 }
 
@@ -32,28 +41,59 @@ func NewWatchProxy(configs ShardingConfigs) *WatchProxy {
 // for several watches at once. The entire event history can be watched starting from the
 // last compaction revision.
 func (s *WatchProxy) Watch(stream pb.Watch_WatchServer) (err error) {
-	return NewSingleWatchStreamProxy(stream, s.configs).
+	return NewSingleWatchStreamProxy(stream, s.configs, s.headers).
 		Run()
 }
 
-// SingleWatchStreamProxy implements ProxyWatchStream
+// SingleWatchStreamProxy implements ProxyWatchStream.
+// It keeps a watch stream on every shard, and re-attaches to the shards switched to
+// by versioned sharding configs: the watches are replayed on new shards and shards with
+// new clients, after the last revisions received from them, and the streams on removed
+// shards are closed.
 type SingleWatchStreamProxy struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	lg         *zap.Logger
 	gRPCStream pb.Watch_WatchServer
 	configs    ShardingConfigs
+	headers    *HeaderStamper
 	// TODO:
 	callOpts []grpc.CallOption
 
-	groupRunner    GroupRunner
-	mapShardStream map[int]pb.Watch_WatchClient
+	groupRunner GroupRunner
+	// shardStreams are the watch streams by shard id, only used by handleRecvLoop
+	shardStreams map[int]*shardWatchStream
+	// revs is the revision vector in stream metadata, watchers created without
+	// start revision start right after it.
+	revs RevisionVector
 
 	recvChan chan *pb.WatchRequest
 	respChan chan *pb.WatchResponse
+
+	mu sync.Mutex
+	// watches are the create requests of active watches by watch id
+	watches map[int64]*pb.WatchCreateRequest
+	// nextWatchID is the next id assigned to watches created without id
+	nextWatchID int64
 }
 
-func NewSingleWatchStreamProxy(gRPCStream pb.Watch_WatchServer, sharding ShardingConfigs) *SingleWatchStreamProxy {
+// shardWatchStream is the watch stream on a shard
+type shardWatchStream struct {
+	cli    ShardClient
+	stream pb.Watch_WatchClient
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// nextRevs are the revisions to resume the watches from by watch id
+	nextRevs map[int64]int64
+	// replayed are the ids of watches replayed on the stream, whose created responses are swallowed
+	replayed map[int64]struct{}
+	// detached is true once the stream is replaced or removed, its responses are dropped
+	detached bool
+}
+
+func NewSingleWatchStreamProxy(gRPCStream pb.Watch_WatchServer, sharding ShardingConfigs, headers *HeaderStamper) *SingleWatchStreamProxy {
 	ctx, cancel := context.WithCancel(gRPCStream.Context())
 	return &SingleWatchStreamProxy{
 		ctx:         ctx,
@@ -61,19 +101,33 @@ func NewSingleWatchStreamProxy(gRPCStream pb.Watch_WatchServer, sharding Shardin
 		lg:          zap.L().Named("ProxyWatchStream"),
 		gRPCStream:  gRPCStream,
 		configs:     sharding,
+		headers:     headers,
 		groupRunner: new(errgroup.Group),
 
-		mapShardStream: make(map[int]pb.Watch_WatchClient),
+		shardStreams: make(map[int]*shardWatchStream),
 
 		recvChan: make(chan *pb.WatchRequest, 10),
 		respChan: make(chan *pb.WatchResponse, 10),
+		watches:  make(map[int64]*pb.WatchCreateRequest),
 	}
 }
 
 func (p *SingleWatchStreamProxy) Run() error {
+	var err error
+	p.revs, err = RevisionVectorFromContext(p.gRPCStream.Context())
+	if err != nil {
+		return err
+	}
+	// recvLoop is not waited, as it's blocked receiving from the client until the stream ends
+	go func() {
+		_ = p.recvLoop()
+	}()
 	p.groupRunner.Go(p.sendLoop)
-	p.groupRunner.Go(p.recvLoop)
-	p.groupRunner.Go(p.handleRecvLoop)
+	p.groupRunner.Go(func() error {
+		err := p.handleRecvLoop()
+		p.cancel()
+		return err
+	})
 	return p.groupRunner.Wait()
 }
 
@@ -87,44 +141,332 @@ func (p *SingleWatchStreamProxy) recvLoop() error {
 			p.cancel()
 			return err
 		}
-		p.recvChan <- req
+		select {
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		case p.recvChan <- req:
+		}
 	}
 }
 
 func (p *SingleWatchStreamProxy) handleRecvLoop() error {
+	var changed <-chan struct{}
+	versioned, isVersioned := p.configs.(*VersionedShardingConfigs)
+	if isVersioned {
+		changed = versioned.Changed()
+	}
 	for {
 		var req *pb.WatchRequest
-		var err error
 		select {
 		case <-p.ctx.Done():
 			return p.ctx.Err()
+		case <-changed:
+			changed = versioned.Changed()
+			if err := suspendedErr(p.configs); err != nil {
+				return err
+			}
+			// the streams are opened by the first request
+			if len(p.shardStreams) > 0 {
+				err := p.attach()
+				if err != nil {
+					return err
+				}
+			}
+			continue
 		case req = <-p.recvChan:
 		}
+		if err := suspendedErr(p.configs); err != nil {
+			return err
+		}
 
-		for _, shardCli := range p.configs.GetAllShardClis() {
-			shardStream, exist := p.mapShardStream[shardCli.GetShardID()]
-			if !exist {
-				shardStream, err = shardCli.Watch(p.ctx, p.callOpts...)
-				if err != nil {
-					p.lg.Warn("failed to create watch stream on shard", zap.Error(err))
-					return errors.Wrapf(err, "watch on shard[%d]", shardCli.GetShardID())
+		startRevs, err := p.startRevisions(req)
+		if err != nil {
+			return err
+		}
+		err = p.attach()
+		if err != nil {
+			return err
+		}
+		req = p.trackWatches(req)
+		for shardID, shardStream := range p.shardStreams {
+			shardStream.send(shardWatchRequest(req, shardID, startRevs), false)
+		}
+	}
+}
+
+// attach opens the watch streams on the shards in use without one, or with an older client,
+// replaying the watches on them, and closes the streams on the shards not in use.
+func (p *SingleWatchStreamProxy) attach() error {
+	inUse := make(map[int]struct{})
+	for _, shardCli := range p.configs.GetAllShardClis() {
+		shardID := shardCli.GetShardID()
+		inUse[shardID] = struct{}{}
+		old, exist := p.shardStreams[shardID]
+		if exist && old.cli == shardCli {
+			continue
+		}
+		nextRevs := make(map[int64]int64)
+		var startRev int64
+		if exist {
+			nextRevs = old.detach()
+		} else if cutover, ok := currentShardingConfigs(p.configs).(CutoverRevisionGetter); ok {
+			// the events of the keys moved into the new shard since its cutover are not missed,
+			// including those written between the switch and now
+			if rev := cutover.GetCutoverRevision(shardID); rev > 0 {
+				startRev = rev + 1
+			}
+		}
+		shardStream, err := p.openShardStream(shardCli, nextRevs, startRev)
+		if err != nil {
+			p.lg.Warn("failed to create watch stream on shard", zap.Error(err))
+			return errors.Wrapf(err, "watch on shard[%d]", shardID)
+		}
+		p.shardStreams[shardID] = shardStream
+	}
+	for shardID, shardStream := range p.shardStreams {
+		if _, ok := inUse[shardID]; !ok {
+			shardStream.detach()
+			delete(p.shardStreams, shardID)
+		}
+	}
+	return nil
+}
+
+// openShardStream opens the watch stream on the shard, and replays the active watches on it
+// from nextRevs, or from the revision in p.revs if the shard is not watched yet, or from startRev.
+func (p *SingleWatchStreamProxy) openShardStream(shardCli ShardClient, nextRevs map[int64]int64, startRev int64) (*shardWatchStream, error) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	stream, err := shardCli.Watch(ctx, p.callOpts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	shardID := shardCli.GetShardID()
+	ret := &shardWatchStream{
+		cli:      shardCli,
+		stream:   stream,
+		ctx:      ctx,
+		cancel:   cancel,
+		nextRevs: make(map[int64]int64),
+		replayed: make(map[int64]struct{}),
+	}
+	go p.recvShardStream(shardID, ret)
+
+	p.mu.Lock()
+	watches := make([]pb.WatchCreateRequest, 0, len(p.watches))
+	for _, create := range p.watches {
+		watches = append(watches, *create)
+	}
+	p.mu.Unlock()
+	// a watch of id 0 is replayed first without id, which is assigned 0 by etcd
+	sort.Slice(watches, func(i, j int) bool { return watches[i].WatchId < watches[j].WatchId })
+	for i := range watches {
+		create := &watches[i]
+		create.StartRevision = nextRevs[create.WatchId]
+		if create.StartRevision == 0 && p.revs.Get(shardID) > 0 {
+			create.StartRevision = p.revs.Get(shardID) + 1
+		}
+		if create.StartRevision == 0 {
+			create.StartRevision = startRev
+		}
+		ret.send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: create}}, true)
+	}
+	return ret, nil
+}
+
+func (p *SingleWatchStreamProxy) recvShardStream(shardID int, shardStream *shardWatchStream) {
+	for {
+		resp, err := shardStream.stream.Recv()
+		if err != nil {
+			if err != io.EOF && shardStream.ctx.Err() == nil {
+				p.lg.Warn("failed to receive watch response from shard stream", zap.Error(err))
+			}
+			return
+		}
+		p.headers.Observe(shardID, resp.Header)
+		if !shardStream.track(resp) {
+			continue
+		}
+		if resp.Canceled {
+			p.mu.Lock()
+			delete(p.watches, resp.WatchId)
+			p.mu.Unlock()
+		}
+		if len(resp.Events) > 0 {
+			resp.Events = p.dropForeignEvents(shardID, resp.Events)
+			if len(resp.Events) == 0 {
+				continue
+			}
+		}
+		resp.Header = p.headers.Stamp(resp.Header)
+		p.respChan <- resp
+	}
+}
+
+// trackWatches records the watches created & canceled by the request, and returns the request
+// to send to the shards. The proxy assigns the ids of watches created without id like etcd does,
+// so that a watch has the same id in all shards, including the ones attached later.
+func (p *SingleWatchStreamProxy) trackWatches(req *pb.WatchRequest) *pb.WatchRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch r := req.RequestUnion.(type) {
+	case *pb.WatchRequest_CreateRequest:
+		create := *r.CreateRequest
+		if create.WatchId == autoWatchID {
+			for {
+				if _, ok := p.watches[p.nextWatchID]; !ok {
+					break
 				}
-				go func() {
-					for {
-						resp, err := shardStream.Recv()
-						if err != nil {
-							if err == io.EOF {
-								return
-							}
-							p.lg.Warn("failed to receive watch response from shard stream", zap.Error(err))
-						}
-						p.respChan <- resp
-					}
-				}()
-				p.mapShardStream[shardCli.GetShardID()] = shardStream
+				p.nextWatchID++
+			}
+			// id 0 is sent without id, which is assigned 0 by all shards
+			create.WatchId = p.nextWatchID
+			p.nextWatchID++
+		}
+		if _, ok := p.watches[create.WatchId]; !ok {
+			p.watches[create.WatchId] = &create
+		}
+		return &pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &create}}
+	case *pb.WatchRequest_CancelRequest:
+		delete(p.watches, r.CancelRequest.WatchId)
+	}
+	return req
+}
+
+// send sends the request to the shard. The start revision of a create request is where
+// its watch is resumed from until an event is received.
+func (s *shardWatchStream) send(req *pb.WatchRequest, replayed bool) {
+	if create := req.GetCreateRequest(); create != nil {
+		s.mu.Lock()
+		if create.StartRevision > 0 {
+			s.nextRevs[create.WatchId] = create.StartRevision
+		}
+		if replayed {
+			s.replayed[create.WatchId] = struct{}{}
+		}
+		s.mu.Unlock()
+	}
+	_ = s.stream.Send(req)
+}
+
+// track records the revision to resume the watch of the response from, and returns false
+// if the response is the created response of a replayed watch, which is not sent to the client.
+func (s *shardWatchStream) track(resp *pb.WatchResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.detached {
+		return false
+	}
+	if n := len(resp.Events); n > 0 {
+		s.nextRevs[resp.WatchId] = resp.Events[n-1].Kv.ModRevision + 1
+	}
+	if resp.Created {
+		if _, ok := s.nextRevs[resp.WatchId]; !ok && resp.Header != nil {
+			// watching from the current revision
+			s.nextRevs[resp.WatchId] = resp.Header.Revision + 1
+		}
+		if _, ok := s.replayed[resp.WatchId]; ok && !resp.Canceled {
+			delete(s.replayed, resp.WatchId)
+			return false
+		}
+	}
+	if resp.Canceled {
+		delete(s.nextRevs, resp.WatchId)
+		delete(s.replayed, resp.WatchId)
+	}
+	return true
+}
+
+// detach closes the stream, and returns the revisions to resume its watches from.
+// The responses received after it are dropped, so they're not sent twice once resumed.
+func (s *shardWatchStream) detach() map[int64]int64 {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.detached = true
+	ret := make(map[int64]int64, len(s.nextRevs))
+	for id, rev := range s.nextRevs {
+		ret[id] = rev
+	}
+	return ret
+}
+
+// dropForeignEvents drops the events of keys the shard holds but doesn't own:
+// replicas of replicated keys, keys moved away but not deleted yet, and keys being moved in,
+// so that only the events of primary copies are sent.
+func (p *SingleWatchStreamProxy) dropForeignEvents(shardID int, events []*mvccpb.Event) []*mvccpb.Event {
+	configs := currentShardingConfigs(p.configs)
+	replicated, isReplicated := configs.(ReplicatedSharding)
+	migrating, isMigrating := configs.(MigratingSharding)
+	if !isReplicated && !isMigrating {
+		return events
+	}
+	ret := events[:0]
+	for _, ev := range events {
+		if isReplicated {
+			if _, whole := replicated.ReplicatedRanges(ev.Kv.Key, nil); whole &&
+				replicated.GetPrimaryShardClis(ev.Kv.Key, nil)[0].GetShardID() != shardID {
+				continue
 			}
-			shardStream.Send(req)
 		}
+		if isMigrating && notOwned(migrating.GetMigrations(ev.Kv.Key, nil), shardID) {
+			continue
+		}
+		ret = append(ret, ev)
+	}
+	return ret
+}
+
+// notOwned returns true if the shard doesn't own the key of the migrations.
+func notOwned(migrations []RangeMigration, shardID int) bool {
+	for _, m := range migrations {
+		if m.notOwnedBy(shardID) {
+			return true
+		}
+	}
+	return false
+}
+
+// startRevisions returns the revision vector a create request starts after, nil if it's sent as is.
+// A create request without start revision starts after the revision vector in stream metadata.
+// With proxy-level headers, the start revision of a create request is a composite revision,
+// it starts after the revision vector the composite revision before it is composed of,
+// and the stream fails with OutOfRange if the composite revision is unknown.
+func (p *SingleWatchStreamProxy) startRevisions(req *pb.WatchRequest) (RevisionVector, error) {
+	createReq := req.GetCreateRequest()
+	switch {
+	case createReq == nil:
+		return nil, nil
+	case createReq.StartRevision == 0:
+		return p.revs, nil
+	case createReq.StartRevision == 1 || p.headers == nil:
+		// every shard starts from its first revision
+		return nil, nil
+	}
+	composed, ok := p.headers.RevisionsAt(createReq.StartRevision - 1)
+	if !ok {
+		return nil, status.Errorf(codes.OutOfRange, "unknown composite revision %d", createReq.StartRevision)
+	}
+	for _, shardCli := range p.configs.GetAllShardClis() {
+		if composed.Get(shardCli.GetShardID()) <= 0 {
+			return nil, status.Errorf(codes.OutOfRange, "shard[%d] is not in composite revision %d", shardCli.GetShardID(), createReq.StartRevision)
+		}
+	}
+	return composed, nil
+}
+
+// shardWatchRequest returns the request to send to the shard.
+// A create request starts after the shard's revision in startRevs if any.
+func shardWatchRequest(req *pb.WatchRequest, shardID int, startRevs RevisionVector) *pb.WatchRequest {
+	createReq := req.GetCreateRequest()
+	rev := startRevs.Get(shardID)
+	if createReq == nil || rev == 0 {
+		return req
+	}
+	shardCreateReq := *createReq
+	shardCreateReq.StartRevision = rev + 1
+	return &pb.WatchRequest{
+		RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &shardCreateReq},
 	}
 }
 
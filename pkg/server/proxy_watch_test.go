@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeWatchStream is the watch stream on a shard, requests sent to it are in reqs,
+// and responses pushed to resps are received from it.
+type fakeWatchStream struct {
+	grpc.ClientStream
+	ctx   context.Context
+	reqs  chan *pb.WatchRequest
+	resps chan *pb.WatchResponse
+}
+
+func newFakeWatchStream(ctx context.Context) *fakeWatchStream {
+	return &fakeWatchStream{ctx: ctx, reqs: make(chan *pb.WatchRequest, 10), resps: make(chan *pb.WatchResponse, 10)}
+}
+
+func (f *fakeWatchStream) Send(req *pb.WatchRequest) error {
+	f.reqs <- req
+	return nil
+}
+
+func (f *fakeWatchStream) Recv() (*pb.WatchResponse, error) {
+	select {
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	case resp := <-f.resps:
+		return resp, nil
+	}
+}
+
+// fakeWatchServer is the client side of the proxy, whose requests are pushed to reqs,
+// and responses sent to it are in resps.
+type fakeWatchServer struct {
+	grpc.ServerStream
+	ctx   context.Context
+	reqs  chan *pb.WatchRequest
+	resps chan *pb.WatchResponse
+}
+
+func (f *fakeWatchServer) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeWatchServer) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (f *fakeWatchServer) Send(resp *pb.WatchResponse) error {
+	f.resps <- resp
+	return nil
+}
+
+func (f *fakeWatchServer) Recv() (*pb.WatchRequest, error) {
+	select {
+	case <-f.ctx.Done():
+		return nil, f.ctx.Err()
+	case req := <-f.reqs:
+		return req, nil
+	}
+}
+
+type watchShardClient struct {
+	*memEtcd
+	streams chan *fakeWatchStream
+}
+
+func newWatchShardClient(shardID int) *watchShardClient {
+	return &watchShardClient{memEtcd: newMemEtcd(shardID), streams: make(chan *fakeWatchStream, 10)}
+}
+
+func (w *watchShardClient) Watch(ctx context.Context, opts ...grpc.CallOption) (pb.Watch_WatchClient, error) {
+	stream := newFakeWatchStream(ctx)
+	w.streams <- stream
+	return stream, nil
+}
+
+func receiveStream(t *testing.T, cli *watchShardClient) *fakeWatchStream {
+	select {
+	case stream := <-cli.streams:
+		return stream
+	case <-time.After(time.Second):
+		t.Fatalf("no stream opened on shard[%d]", cli.shardID)
+		return nil
+	}
+}
+
+func receiveRequest(t *testing.T, stream *fakeWatchStream) *pb.WatchRequest {
+	select {
+	case req := <-stream.reqs:
+		return req
+	case <-time.After(time.Second):
+		t.Fatal("no request received")
+		return nil
+	}
+}
+
+func receiveResponse(t *testing.T, client *fakeWatchServer) *pb.WatchResponse {
+	select {
+	case resp := <-client.resps:
+		return resp
+	case <-time.After(time.Second):
+		t.Fatal("no response received")
+		return nil
+	}
+}
+
+func TestSingleWatchStreamProxy_attach(t *testing.T) {
+	clis := []*watchShardClient{newWatchShardClient(0), newWatchShardClient(1)}
+	configs := NewVersionedShardingConfigs(NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("m"), cli: clis[0]},
+		&ShardImpl{start: []byte("m"), end: noEnd, cli: clis[1]},
+	}), 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &fakeWatchServer{ctx: ctx, reqs: make(chan *pb.WatchRequest, 10), resps: make(chan *pb.WatchResponse, 10)}
+	go func() {
+		_ = NewSingleWatchStreamProxy(client, configs, nil).Run()
+	}()
+
+	create := func() {
+		client.reqs <- &pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{
+			CreateRequest: &pb.WatchCreateRequest{Key: []byte("a"), RangeEnd: noEnd},
+		}}
+	}
+	create()
+	streams := []*fakeWatchStream{receiveStream(t, clis[0]), receiveStream(t, clis[1])}
+	for _, stream := range streams {
+		assert.Equal(t, int64(0), receiveRequest(t, stream).GetCreateRequest().WatchId)
+	}
+	streams[1].resps <- &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: 3}, WatchId: 0, Created: true}
+	assert.True(t, receiveResponse(t, client).Created)
+	streams[1].resps <- &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: 9}, WatchId: 0, Events: []*mvccpb.Event{
+		{Kv: &mvccpb.KeyValue{Key: []byte("n"), ModRevision: 8}},
+	}}
+	assert.Len(t, receiveResponse(t, client).Events, 1)
+	create()
+	for _, stream := range streams {
+		assert.Equal(t, int64(1), receiveRequest(t, stream).GetCreateRequest().WatchId)
+	}
+
+	// shard[1] is switched to a new client, and shard[2] is added by a cutover at its revision 20,
+	// the watches on it start after that, not missing the writes between the switch & the attach
+	switched := []*watchShardClient{newWatchShardClient(1), newWatchShardClient(2)}
+	configs.Switch(NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("m"), cli: clis[0]},
+		&ShardImpl{start: []byte("m"), end: []byte("s"), cli: switched[0]},
+		&ShardImpl{start: []byte("s"), end: noEnd, cli: switched[1], cutoverRevision: 20},
+	}), 2)
+	for i, startRevs := range [][]int64{{9, 0}, {21, 21}} {
+		stream := receiveStream(t, switched[i])
+		for id, startRev := range startRevs {
+			replayed := receiveRequest(t, stream).GetCreateRequest()
+			assert.Equal(t, int64(id), replayed.WatchId)
+			assert.Equal(t, startRev, replayed.StartRevision)
+			assert.Equal(t, []byte("a"), replayed.Key)
+		}
+		streams = append(streams, stream)
+	}
+	select {
+	case <-streams[1].ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream on the old client not closed")
+	}
+	assert.NoError(t, streams[0].ctx.Err())
+
+	// the created responses of replayed watches are not sent to the client
+	streams[2].resps <- &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: 10}, WatchId: 0, Created: true}
+	streams[2].resps <- &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: 11}, WatchId: 0, Events: []*mvccpb.Event{
+		{Kv: &mvccpb.KeyValue{Key: []byte("o"), ModRevision: 11}},
+	}}
+	resp := receiveResponse(t, client)
+	assert.False(t, resp.Created)
+	assert.Equal(t, []byte("o"), resp.Events[0].Kv.Key)
+
+	// the write to shard[2] at revision 21, after the switch but before the attach, is received
+	streams[3].resps <- &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: 22}, WatchId: 1, Created: true}
+	streams[3].resps <- &pb.WatchResponse{Header: &pb.ResponseHeader{Revision: 22}, WatchId: 1, Events: []*mvccpb.Event{
+		{Kv: &mvccpb.KeyValue{Key: []byte("t"), ModRevision: 21}},
+	}}
+	resp = receiveResponse(t, client)
+	assert.Equal(t, int64(1), resp.WatchId)
+	assert.Equal(t, []byte("t"), resp.Events[0].Kv.Key)
+}
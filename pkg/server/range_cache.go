@@ -0,0 +1,324 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+)
+
+// rangeCacheRetryInterval is the wait before reloading a cache after errors.
+const rangeCacheRetryInterval = time.Second
+
+// rangeCacheStatsInterval is how often the stats of cache are logged.
+const rangeCacheStatsInterval = time.Minute
+
+// RangeCache keeps the keys of configured prefixes in memory, to serve serializable
+// ranges on them without touching the shards.
+// The keys of a prefix in each owning shard are loaded by a range, then kept current
+// by a watch from the revision of the range. The cache of a shard is reloaded when
+// the watch is compacted or broken, ranges are not served from it in the meantime.
+type RangeCache struct {
+	configs    ShardingConfigs
+	respFilter ResponseFilter
+	lg         *zap.Logger
+	prefixes   []*cachedPrefix
+
+	hits   uint64
+	misses uint64
+}
+
+// RangeCacheStats is the hit & miss counts of the cache
+type RangeCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type cachedPrefix struct {
+	prefix []byte
+	end    []byte
+	shards []*cachedShard
+}
+
+// cachedShard is the cache of a prefix in one shard
+type cachedShard struct {
+	cli ShardClient
+	// shardCli is the client of the whole shard when the cache is created, cli may be clipped
+	shardCli ShardClient
+
+	mu    sync.RWMutex
+	ready bool
+	// header is the latest header from the shard, with the revision the cache is current to.
+	header *pb.ResponseHeader
+	// kvs are sorted by key
+	kvs []*mvccpb.KeyValue
+}
+
+func NewRangeCache(configs ShardingConfigs, respFilter ResponseFilter, prefixes []string) *RangeCache {
+	ret := &RangeCache{
+		configs:    configs,
+		respFilter: respFilter,
+		lg:         zap.L().Named("RangeCache"),
+	}
+	for _, prefix := range prefixes {
+		p := &cachedPrefix{
+			prefix: []byte(prefix),
+			end:    prefixEnd([]byte(prefix)),
+		}
+		for _, cli := range configs.GetShardClis(p.prefix, p.end) {
+			p.shards = append(p.shards, &cachedShard{cli: cli, shardCli: configs.GetShardCli(cli.GetShardID())})
+		}
+		ret.prefixes = append(ret.prefixes, p)
+	}
+	return ret
+}
+
+// Run loads & watches all cached prefixes until ctx is done.
+func (c *RangeCache) Run(ctx context.Context) {
+	for _, p := range c.prefixes {
+		for _, shard := range p.shards {
+			go c.runShard(ctx, p, shard)
+		}
+	}
+	ticker := time.NewTicker(rangeCacheStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := c.Stats()
+		c.lg.Info("range cache stats", zap.Uint64("hits", stats.Hits), zap.Uint64("misses", stats.Misses))
+	}
+}
+
+// Stats returns the hit & miss counts since start.
+func (c *RangeCache) Stats() RangeCacheStats {
+	return RangeCacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+func (c *RangeCache) runShard(ctx context.Context, p *cachedPrefix, shard *cachedShard) {
+	for {
+		err := c.syncShard(ctx, p, shard)
+		shard.mu.Lock()
+		shard.ready = false
+		shard.kvs = nil
+		shard.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		c.lg.Warn("range cache out of sync, reloading", zap.ByteString("prefix", p.prefix),
+			zap.Int("shard", shard.cli.GetShardID()), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rangeCacheRetryInterval):
+		}
+	}
+}
+
+// syncShard loads the prefix in the shard, then applies the watched events until an error.
+func (c *RangeCache) syncShard(ctx context.Context, p *cachedPrefix, shard *cachedShard) error {
+	resp, err := shard.cli.Range(ctx, &pb.RangeRequest{Key: p.prefix, RangeEnd: p.end})
+	if err != nil {
+		return errors.Wrap(err, "failed to load")
+	}
+	shard.mu.Lock()
+	shard.kvs = resp.Kvs
+	shard.header = resp.Header
+	shard.ready = true
+	shard.mu.Unlock()
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := shard.cli.Watch(watchCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to watch")
+	}
+	err = stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &pb.WatchCreateRequest{
+		Key:            p.prefix,
+		RangeEnd:       p.end,
+		StartRevision:  resp.Header.Revision + 1,
+		ProgressNotify: true,
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "failed to create watch")
+	}
+	for {
+		watchResp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("watch closed")
+			}
+			return errors.Wrap(err, "failed to receive watch response")
+		}
+		if watchResp.CompactRevision > 0 {
+			return errors.Errorf("watch compacted at %d", watchResp.CompactRevision)
+		}
+		if watchResp.Canceled {
+			return errors.Errorf("watch canceled: %s", watchResp.CancelReason)
+		}
+		shard.apply(watchResp)
+	}
+}
+
+func (s *cachedShard) apply(resp *pb.WatchResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ev := range resp.Events {
+		i := sort.Search(len(s.kvs), func(i int) bool { return bytes.Compare(s.kvs[i].Key, ev.Kv.Key) >= 0 })
+		found := i < len(s.kvs) && bytes.Equal(s.kvs[i].Key, ev.Kv.Key)
+		switch {
+		case ev.Type == mvccpb.PUT && found:
+			s.kvs[i] = ev.Kv
+		case ev.Type == mvccpb.PUT:
+			s.kvs = append(s.kvs, nil)
+			copy(s.kvs[i+1:], s.kvs[i:])
+			s.kvs[i] = ev.Kv
+		case ev.Type == mvccpb.DELETE && found:
+			s.kvs = append(s.kvs[:i], s.kvs[i+1:]...)
+		}
+	}
+	if resp.Header != nil && resp.Header.Revision > s.header.Revision {
+		s.header = resp.Header
+	}
+}
+
+// Range serves the range from cache. ok is false if the range is not cached,
+// in which case it should be served by the shards.
+// Only serializable ranges at the latest revision within a cached prefix are served.
+func (c *RangeCache) Range(req *pb.RangeRequest) (result *rangeResult, ok bool) {
+	defer func() {
+		if ok {
+			atomic.AddUint64(&c.hits, 1)
+		} else {
+			atomic.AddUint64(&c.misses, 1)
+		}
+	}()
+	if !req.Serializable || req.Revision != 0 {
+		return nil, false
+	}
+	p := c.findPrefix(req.Key, req.RangeEnd)
+	if p == nil {
+		return nil, false
+	}
+	cached := make(map[int]*cachedShard, len(p.shards))
+	for _, shard := range p.shards {
+		cached[shard.cli.GetShardID()] = shard
+	}
+	var shards []*cachedShard
+	for _, shardCli := range c.configs.GetShardClis(req.Key, req.RangeEnd) {
+		shard, ok := cached[shardCli.GetShardID()]
+		// the shard may be switched to a new client since the cache is created
+		if !ok || shard.shardCli != c.configs.GetShardCli(shardCli.GetShardID()) {
+			return nil, false
+		}
+		shards = append(shards, shard)
+	}
+	if len(shards) == 0 {
+		return nil, false
+	}
+	shardReq := req
+	if len(shards) > 1 {
+		shardReq = RangeRequestForShards(req)
+	}
+	resps := make([]*pb.RangeResponse, 0, len(shards))
+	readRevs := make(RevisionVector, len(shards))
+	for _, shard := range shards {
+		resp, ok := shard.localRange(shardReq)
+		if !ok {
+			return nil, false
+		}
+		resps = append(resps, resp)
+		readRevs[shard.cli.GetShardID()] = resp.Header.Revision
+	}
+	ret, err := c.respFilter.FilterRange(req, resps)
+	if err != nil {
+		return nil, false
+	}
+	return &rangeResult{resp: ret, readRevs: readRevs}, true
+}
+
+// findPrefix returns the cached prefix covering the range, nil if none.
+func (c *RangeCache) findPrefix(key, rangeEnd []byte) *cachedPrefix {
+	for _, p := range c.prefixes {
+		if !bytes.HasPrefix(key, p.prefix) {
+			continue
+		}
+		if len(rangeEnd) == 0 {
+			return p
+		}
+		if !bytes.Equal(rangeEnd, noEnd) && bytes.Compare(rangeEnd, p.end) <= 0 {
+			return p
+		}
+	}
+	return nil
+}
+
+// localRange does the range on cached kvs like etcd does in a shard.
+func (s *cachedShard) localRange(req *pb.RangeRequest) (*pb.RangeResponse, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.ready {
+		return nil, false
+	}
+	header := *s.header
+	ret := &pb.RangeResponse{Header: &header}
+
+	start := sort.Search(len(s.kvs), func(i int) bool { return bytes.Compare(s.kvs[i].Key, req.Key) >= 0 })
+	end := start
+	if len(req.RangeEnd) == 0 {
+		if end < len(s.kvs) && bytes.Equal(s.kvs[end].Key, req.Key) {
+			end++
+		}
+	} else {
+		end = sort.Search(len(s.kvs), func(i int) bool { return bytes.Compare(s.kvs[i].Key, req.RangeEnd) >= 0 })
+	}
+	if end < start {
+		end = start
+	}
+	ret.Count = int64(end - start)
+	if req.CountOnly {
+		return ret, true
+	}
+
+	kvs := make([]*mvccpb.KeyValue, 0, end-start)
+	for _, kv := range s.kvs[start:end] {
+		if req.MaxModRevision != 0 && kv.ModRevision > req.MaxModRevision ||
+			req.MinModRevision != 0 && kv.ModRevision < req.MinModRevision ||
+			req.MaxCreateRevision != 0 && kv.CreateRevision > req.MaxCreateRevision ||
+			req.MinCreateRevision != 0 && kv.CreateRevision < req.MinCreateRevision {
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+	if req.SortTarget != pb.RangeRequest_KEY || req.SortOrder == pb.RangeRequest_DESCEND {
+		less := kvLessFunc(req)
+		sort.SliceStable(kvs, func(i, j int) bool { return less(kvs[i], kvs[j]) })
+	}
+	if req.Limit > 0 && int64(len(kvs)) > req.Limit {
+		kvs = kvs[:req.Limit]
+		ret.More = true
+	}
+	if req.KeysOnly {
+		for i, kv := range kvs {
+			keyOnly := *kv
+			keyOnly.Value = nil
+			kvs[i] = &keyOnly
+		}
+	}
+	ret.Kvs = kvs
+	return ret, true
+}
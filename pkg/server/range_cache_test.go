@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestRangeCache_Range(t *testing.T) {
+	configs := newFakeShardingConfigs([]string{"a"}, []string{"k/a"}, []string{"x"})
+	cache := NewRangeCache(configs, new(DefaultResponseFilter), []string{"k/"})
+	assert.Len(t, cache.prefixes[0].shards, 1)
+	shard := cache.prefixes[0].shards[0]
+
+	req := &pb.RangeRequest{Key: []byte("k/"), RangeEnd: []byte("k0"), Serializable: true}
+	_, ok := cache.Range(req)
+	assert.False(t, ok, "not loaded yet")
+
+	shard.kvs = []*mvccpb.KeyValue{{Key: []byte("k/a"), ModRevision: 10}}
+	shard.header = &pb.ResponseHeader{Revision: 10}
+	shard.ready = true
+	shard.apply(&pb.WatchResponse{
+		Header: &pb.ResponseHeader{Revision: 12},
+		Events: []*mvccpb.Event{
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("k/c"), ModRevision: 11}},
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("k/b"), ModRevision: 12}},
+			{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("k/a"), ModRevision: 12}},
+		},
+	})
+
+	result, ok := cache.Range(req)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"k/b", "k/c"}, kvKeys(result.resp.Kvs))
+	assert.Equal(t, int64(12), result.resp.Header.Revision)
+	assert.Equal(t, RevisionVector{1: 12}, result.readRevs)
+
+	limited := *req
+	limited.Limit = 1
+	limited.SortOrder = pb.RangeRequest_DESCEND
+	result, ok = cache.Range(&limited)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"k/c"}, kvKeys(result.resp.Kvs))
+	assert.True(t, result.resp.More)
+	assert.Equal(t, int64(2), result.resp.Count)
+
+	for _, miss := range []*pb.RangeRequest{
+		{Key: []byte("k/b")},
+		{Key: []byte("k/b"), Serializable: true, Revision: 11},
+		{Key: []byte("a"), RangeEnd: []byte("k0"), Serializable: true},
+	} {
+		_, ok = cache.Range(miss)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, RangeCacheStats{Hits: 2, Misses: 4}, cache.Stats())
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"golang.org/x/sync/singleflight"
+)
+
+// rangeCoalesceTimeout limits the time of a coalesced range shared by callers
+const rangeCoalesceTimeout = 30 * time.Second
+
+// rangeResult is the result of a range shared by coalesced callers
+type rangeResult struct {
+	resp     *pb.RangeResponse
+	readRevs RevisionVector
+	// missing are the ranges of failed shards in a partial range
+	missing []missingRange
+}
+
+// RangeCoalescer coalesces identical concurrent ranges, so that only one set of
+// shard calls runs and all callers share the result.
+// It's only safe for ranges which may not see the latest writes anyway:
+// serializable ranges and ranges at a pinned revision.
+type RangeCoalescer struct {
+	group singleflight.Group
+}
+
+func NewRangeCoalescer() *RangeCoalescer {
+	return new(RangeCoalescer)
+}
+
+// CanCoalesce returns true if the range is safe to be coalesced
+func (c *RangeCoalescer) CanCoalesce(req *pb.RangeRequest) bool {
+	return req.Serializable || req.Revision > 0
+}
+
+// Do runs fn once for all concurrent callers of the same request & revision vector.
+// fn runs with its own context limited by rangeCoalesceTimeout, not with the context of
+// any caller, so that the first caller leaving or having a short deadline doesn't fail the others.
+// Each caller waits for the result until its own context is done.
+// The shared response must not be modified.
+func (c *RangeCoalescer) Do(ctx context.Context, req *pb.RangeRequest, revs RevisionVector, fn func(ctx context.Context) (*rangeResult, error)) (*rangeResult, error) {
+	ch, err := c.join(req, revs, fn)
+	if err != nil {
+		return nil, err
+	}
+	return waitRangeResult(ctx, ch)
+}
+
+// join joins the running call of the same request & revision vector, or starts fn if none.
+func (c *RangeCoalescer) join(req *pb.RangeRequest, revs RevisionVector, fn func(ctx context.Context) (*rangeResult, error)) (<-chan singleflight.Result, error) {
+	key, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if revs != nil {
+		key = append(append(key, 0), revs.Encode()...)
+	}
+	return c.group.DoChan(string(key), func() (interface{}, error) {
+		runCtx, cancel := context.WithTimeout(context.Background(), rangeCoalesceTimeout)
+		defer cancel()
+		return fn(runCtx)
+	}), nil
+}
+
+// waitRangeResult waits for the result of the joined call, or until ctx is done.
+func waitRangeResult(ctx context.Context, ch <-chan singleflight.Result) (*rangeResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-ch:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*rangeResult), nil
+	}
+}
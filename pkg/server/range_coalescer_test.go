@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestRangeCoalescer_Do(t *testing.T) {
+	c := NewRangeCoalescer()
+	req := &pb.RangeRequest{Key: []byte("a"), Serializable: true}
+	assert.True(t, c.CanCoalesce(req))
+	assert.False(t, c.CanCoalesce(&pb.RangeRequest{Key: []byte("a")}))
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*rangeResult, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		// the call goes on after the first caller leaves
+		assert.NoError(t, ctx.Err())
+		return &rangeResult{resp: &pb.RangeResponse{Count: 1}}, nil
+	}
+
+	// the first caller leaves, the others still get the result
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, err := c.Do(leaderCtx, req, nil, fn)
+		leaderDone <- err
+	}()
+	<-started
+	var chs []<-chan singleflight.Result
+	for i := 0; i < 10; i++ {
+		ch, err := c.join(req, nil, fn)
+		assert.NoError(t, err)
+		chs = append(chs, ch)
+	}
+	cancel()
+	assert.ErrorIs(t, <-leaderDone, context.Canceled)
+	close(release)
+	for _, ch := range chs {
+		result, err := waitRangeResult(context.Background(), ch)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.resp.Count)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRangeCoalescer_Do_deadline(t *testing.T) {
+	c := NewRangeCoalescer()
+	req := &pb.RangeRequest{Key: []byte("a"), Serializable: true}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (*rangeResult, error) {
+		close(started)
+		<-release
+		// the call isn't limited by the deadline of the first caller
+		assert.NoError(t, ctx.Err())
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.True(t, time.Until(deadline) > time.Second)
+		return &rangeResult{resp: &pb.RangeResponse{Count: 1}}, nil
+	}
+
+	// the first caller times out, a joiner with a longer deadline still gets the result
+	leaderCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	leaderDone := make(chan error)
+	go func() {
+		_, err := c.Do(leaderCtx, req, nil, fn)
+		leaderDone <- err
+	}()
+	<-started
+	joinerCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	joinerDone := make(chan *rangeResult)
+	go func() {
+		result, err := c.Do(joinerCtx, req, nil, fn)
+		assert.NoError(t, err)
+		joinerDone <- result
+	}()
+	assert.ErrorIs(t, <-leaderDone, context.DeadlineExceeded)
+	close(release)
+	result := <-joinerDone
+	assert.Equal(t, int64(1), result.resp.Count)
+}
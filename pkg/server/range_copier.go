@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// copyBatchSize is the number of keys read from the source at a time
+	copyBatchSize = 1000
+	// copyProgressInterval is how often the progress of the watch is requested while catching up
+	copyProgressInterval = 100 * time.Millisecond
+)
+
+// errSourceCompacted is returned when the revision copied is compacted in the source,
+// the copy has to be restarted by a new snapshot.
+var errSourceCompacted = errors.New("source compacted before copied")
+
+// rangeCopier copies a key range from a shard to another: a snapshot at a revision
+// of the source, then the events after it by watching the source.
+// Keys are put with their leases, which are granted in the target if missing,
+// and kept alive in the target while alive in the source, see refreshLeases.
+type rangeCopier struct {
+	source   ShardClient
+	target   ShardClient
+	keyRange KeyRange
+	// revision is the revision of the source copied to the target
+	revision int64
+	// nextKey is the next key to copy by the snapshot at revision, nil once the snapshot is done
+	nextKey []byte
+	// copied is the number of keys put & deleted in the target
+	copied int64
+	// leases are the leases known to exist in the target
+	leases   map[int64]struct{}
+	leasesMu sync.Mutex
+	// progress is called after each batch of the snapshot & each watch response applied, if set
+	progress func() error
+}
+
+func newRangeCopier(source, target ShardClient, keyRange KeyRange) *rangeCopier {
+	return &rangeCopier{
+		source:   source,
+		target:   target,
+		keyRange: keyRange,
+		leases:   make(map[int64]struct{}),
+	}
+}
+
+// snapshot clears the range in the target, then copies the keys in the source at its current revision.
+func (c *rangeCopier) snapshot(ctx context.Context) error {
+	_, err := c.target.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: c.keyRange.Key, RangeEnd: c.keyRange.RangeEnd})
+	if err != nil {
+		return errors.Wrap(err, "failed to clear target")
+	}
+	rev, err := c.currentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	c.revision, c.nextKey, c.copied = rev, append([]byte{}, c.keyRange.Key...), 0
+	return c.resumeSnapshot(ctx)
+}
+
+// resumeSnapshot copies the keys from nextKey in the source at the copied revision.
+func (c *rangeCopier) resumeSnapshot(ctx context.Context) error {
+	for c.nextKey != nil {
+		kvs, next, err := readBatch(ctx, c.source, c.nextKey, c.keyRange.RangeEnd, c.revision)
+		if err != nil {
+			if isCompacted(err) {
+				return errSourceCompacted
+			}
+			return errors.Wrapf(err, "failed to read source at revision %d", c.revision)
+		}
+		for _, kv := range kvs {
+			err = c.put(ctx, kv)
+			if err != nil {
+				return err
+			}
+		}
+		c.nextKey = next
+		err = c.reportProgress()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *rangeCopier) reportProgress() error {
+	if c.progress == nil {
+		return nil
+	}
+	return c.progress()
+}
+
+// currentRevision returns the current revision of the source.
+func (c *rangeCopier) currentRevision(ctx context.Context) (int64, error) {
+	resp, err := c.source.Range(ctx, &pb.RangeRequest{Key: c.keyRange.Key, CountOnly: true})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get revision of source")
+	}
+	return resp.Header.Revision, nil
+}
+
+// targetRevision returns the current revision of the target.
+func (c *rangeCopier) targetRevision(ctx context.Context) (int64, error) {
+	resp, err := c.target.Range(ctx, &pb.RangeRequest{Key: c.keyRange.Key, CountOnly: true})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get revision of target")
+	}
+	return resp.Header.Revision, nil
+}
+
+// catchUp applies the events in the source after the copied revision to the target,
+// until the target is caught up with the revision of the source.
+func (c *rangeCopier) catchUp(ctx context.Context, until int64) error {
+	if c.revision >= until {
+		return nil
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.source.Watch(watchCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to watch source")
+	}
+	err = stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &pb.WatchCreateRequest{
+		Key:           c.keyRange.Key,
+		RangeEnd:      c.keyRange.RangeEnd,
+		StartRevision: c.revision + 1,
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "failed to create watch on source")
+	}
+	// a progress response is only sent by a watch synced with the source,
+	// its revision means all events before it are sent
+	go func() {
+		ticker := time.NewTicker(copyProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watchCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			_ = stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_ProgressRequest{ProgressRequest: &pb.WatchProgressRequest{}}})
+		}
+	}()
+	for c.revision < until {
+		resp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("watch on source closed")
+			}
+			return errors.Wrap(err, "failed to receive watch response from source")
+		}
+		if resp.CompactRevision > 0 {
+			return errSourceCompacted
+		}
+		if resp.Canceled {
+			return errors.Errorf("watch on source canceled: %s", resp.CancelReason)
+		}
+		if resp.Created {
+			continue
+		}
+		for _, ev := range resp.Events {
+			err = c.apply(ctx, ev)
+			if err != nil {
+				return err
+			}
+			c.revision = ev.Kv.ModRevision
+		}
+		if len(resp.Events) == 0 && resp.Header.Revision > c.revision {
+			c.revision = resp.Header.Revision
+		}
+		err = c.reportProgress()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *rangeCopier) apply(ctx context.Context, ev *mvccpb.Event) error {
+	if ev.Type == mvccpb.PUT {
+		return c.put(ctx, ev.Kv)
+	}
+	c.copied++
+	_, err := c.target.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: ev.Kv.Key})
+	return errors.Wrapf(err, "failed to delete [%s] in target", ev.Kv.Key)
+}
+
+func (c *rangeCopier) put(ctx context.Context, kv *mvccpb.KeyValue) error {
+	if kv.Lease != 0 {
+		err := c.grantLease(ctx, kv.Lease)
+		if err != nil {
+			return err
+		}
+	}
+	c.copied++
+	_, err := c.target.Put(ctx, &pb.PutRequest{Key: kv.Key, Value: kv.Value, Lease: kv.Lease})
+	return errors.Wrapf(err, "failed to put [%s] in target", kv.Key)
+}
+
+// grantLease grants the lease in the target with its TTL in the source if it's missing.
+func (c *rangeCopier) grantLease(ctx context.Context, id int64) error {
+	c.leasesMu.Lock()
+	_, ok := c.leases[id]
+	c.leasesMu.Unlock()
+	if ok {
+		return nil
+	}
+	err := grantTargetLease(ctx, c.source, c.target, id)
+	if err != nil {
+		return err
+	}
+	c.leasesMu.Lock()
+	c.leases[id] = struct{}{}
+	c.leasesMu.Unlock()
+	return nil
+}
+
+// grantTargetLease grants the lease of the source in the target with the same TTL if it's missing.
+// Leases are granted in all shards with the same ID & TTL, so a lease of the ID existing
+// in the target with another TTL is not the same one, and the keys can't be put with it.
+func grantTargetLease(ctx context.Context, source, target ShardClient, id int64) error {
+	ttl, err := source.LeaseTimeToLive(ctx, &pb.LeaseTimeToLiveRequest{ID: id})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get lease %x in source", id)
+	}
+	expired := ttl.TTL <= 0
+	if expired {
+		// the key is deleted soon in the source
+		ttl.GrantedTTL = 1
+	}
+	_, err = target.LeaseGrant(ctx, &pb.LeaseGrantRequest{ID: id, TTL: ttl.GrantedTTL})
+	if err == nil {
+		return nil
+	}
+	if status.Convert(err).Message() != rpctypes.ErrorDesc(rpctypes.ErrGRPCLeaseExist) {
+		return errors.Wrapf(err, "failed to grant lease %x in target", id)
+	}
+	existing, err := target.LeaseTimeToLive(ctx, &pb.LeaseTimeToLiveRequest{ID: id})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get lease %x in target", id)
+	}
+	if !expired && existing.GrantedTTL != ttl.GrantedTTL {
+		return errors.Errorf("lease %x exists in target with TTL %d, not %d as in source", id, existing.GrantedTTL, ttl.GrantedTTL)
+	}
+	return nil
+}
+
+// loadLeases loads the leases of the keys copied to the target, when resuming a copy.
+func (c *rangeCopier) loadLeases(ctx context.Context) error {
+	key := c.keyRange.Key
+	for key != nil {
+		kvs, next, err := readBatch(ctx, c.target, key, c.keyRange.RangeEnd, 0)
+		if err != nil {
+			return errors.Wrap(err, "failed to read target")
+		}
+		c.leasesMu.Lock()
+		for _, kv := range kvs {
+			if kv.Lease != 0 {
+				c.leases[kv.Lease] = struct{}{}
+			}
+		}
+		c.leasesMu.Unlock()
+		key = next
+	}
+	return nil
+}
+
+// copyLeases grants all leases of the source in the target, including those without keys
+// in the range, when the whole source is moved. The leases existing in both are kept.
+func (c *rangeCopier) copyLeases(ctx context.Context) error {
+	resp, err := c.source.LeaseLeases(ctx, &pb.LeaseLeasesRequest{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list leases in source")
+	}
+	for _, lease := range resp.Leases {
+		err = c.grantLease(ctx, lease.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshLeases keeps alive the leases granted in the target, which are not kept alive
+// by clients until the target owns the range, and revokes those expired in the source.
+func (c *rangeCopier) refreshLeases(ctx context.Context) error {
+	c.leasesMu.Lock()
+	ids := make([]int64, 0, len(c.leases))
+	for id := range c.leases {
+		ids = append(ids, id)
+	}
+	c.leasesMu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	keepAliveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.target.LeaseKeepAlive(keepAliveCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to keep alive leases in target")
+	}
+	for _, id := range ids {
+		ttl, err := c.source.LeaseTimeToLive(ctx, &pb.LeaseTimeToLiveRequest{ID: id})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get lease %x in source", id)
+		}
+		if ttl.TTL <= 0 {
+			_, err = c.target.LeaseRevoke(ctx, &pb.LeaseRevokeRequest{ID: id})
+			if err != nil && status.Convert(err).Message() != rpctypes.ErrorDesc(rpctypes.ErrGRPCLeaseNotFound) {
+				return errors.Wrapf(err, "failed to revoke lease %x in target", id)
+			}
+			c.leasesMu.Lock()
+			delete(c.leases, id)
+			c.leasesMu.Unlock()
+			continue
+		}
+		err = stream.Send(&pb.LeaseKeepAliveRequest{ID: id})
+		if err != nil {
+			return errors.Wrapf(err, "failed to keep alive lease %x in target", id)
+		}
+		_, err = stream.Recv()
+		if err != nil {
+			return errors.Wrapf(err, "failed to keep alive lease %x in target", id)
+		}
+	}
+	return nil
+}
+
+// verify compares the keys in the source at the copied revision with the keys in the target.
+func (c *rangeCopier) verify(ctx context.Context) error {
+	sourceKey, targetKey := c.keyRange.Key, c.keyRange.Key
+	for sourceKey != nil || targetKey != nil {
+		var sourceKvs, targetKvs []*mvccpb.KeyValue
+		var err error
+		sourceKvs, sourceKey, err = readBatch(ctx, c.source, sourceKey, c.keyRange.RangeEnd, c.revision)
+		if err != nil {
+			return errors.Wrap(err, "failed to read source")
+		}
+		targetKvs, targetKey, err = readBatch(ctx, c.target, targetKey, c.keyRange.RangeEnd, 0)
+		if err != nil {
+			return errors.Wrap(err, "failed to read target")
+		}
+		if len(sourceKvs) != len(targetKvs) {
+			return errors.Errorf("%d keys in source but %d in target", len(sourceKvs), len(targetKvs))
+		}
+		for i, kv := range sourceKvs {
+			other := targetKvs[i]
+			if !bytes.Equal(kv.Key, other.Key) || !bytes.Equal(kv.Value, other.Value) || kv.Lease != other.Lease {
+				return errors.Errorf("key [%s] in source differs from [%s] in target", kv.Key, other.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// readBatch reads a batch of keys from key at the revision, and returns the key to read
+// the next batch from, which is nil if there's no more. Key nil reads nothing.
+func readBatch(ctx context.Context, cli ShardClient, key, rangeEnd []byte, rev int64) ([]*mvccpb.KeyValue, []byte, error) {
+	if key == nil {
+		return nil, nil, nil
+	}
+	resp, err := cli.Range(ctx, &pb.RangeRequest{Key: key, RangeEnd: rangeEnd, Limit: copyBatchSize, Revision: rev})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !resp.More || len(resp.Kvs) == 0 {
+		return resp.Kvs, nil, nil
+	}
+	return resp.Kvs, append(append([]byte{}, resp.Kvs[len(resp.Kvs)-1].Key...), 0), nil
+}
+
+func isCompacted(err error) bool {
+	return status.Convert(err).Message() == rpctypes.ErrorDesc(rpctypes.ErrGRPCCompacted)
+}
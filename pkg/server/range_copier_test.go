@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// newMemEtcdWithKeys returns a memEtcd with the keys put, valued "v" + key
+func newMemEtcdWithKeys(keys ...string) *memEtcd {
+	ret := newMemEtcd(0)
+	for _, key := range keys {
+		_, _ = ret.Put(context.Background(), &pb.PutRequest{Key: []byte(key), Value: []byte("v" + key)})
+	}
+	return ret
+}
+
+func TestRangeCopier_snapshot(t *testing.T) {
+	source := newMemEtcdWithKeys("a", "m", "n", "o", "z")
+	source.leases[7] = 30
+	_, _ = source.Put(context.Background(), &pb.PutRequest{Key: []byte("p"), Value: []byte("vp"), Lease: 7})
+	target := newMemEtcdWithKeys("m", "x")
+	keyRange := KeyRange{Key: []byte("m"), RangeEnd: []byte("q")}
+
+	c := newRangeCopier(source, target, keyRange)
+	var batches int
+	c.progress = func() error {
+		batches++
+		return nil
+	}
+	assert.NoError(t, c.snapshot(context.Background()))
+	assert.Equal(t, 1, batches)
+	assert.Equal(t, int64(4), c.copied)
+	assert.Nil(t, c.nextKey)
+	assert.Equal(t, int64(30), target.leases[7])
+	assert.NoError(t, c.verify(context.Background()))
+
+	resp, _ := target.Range(context.Background(), &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd})
+	var keys []string
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	assert.Equal(t, []string{"m", "n", "o", "p", "x"}, keys)
+
+	// the source is verified at the copied revision, so a later change of it doesn't count
+	_, _ = source.Put(context.Background(), &pb.PutRequest{Key: []byte("n"), Value: []byte("changed")})
+	assert.NoError(t, c.verify(context.Background()))
+	_, _ = target.Put(context.Background(), &pb.PutRequest{Key: []byte("n"), Value: []byte("changed")})
+	assert.Error(t, c.verify(context.Background()))
+
+	resumed := newRangeCopier(source, target, keyRange)
+	assert.NoError(t, resumed.loadLeases(context.Background()))
+	assert.Contains(t, resumed.leases, int64(7))
+}
+
+func TestRangeCopier_copyLeases(t *testing.T) {
+	source, target := newMemEtcdWithKeys(), newMemEtcdWithKeys()
+	source.leases[7], source.leases[8] = 30, 60
+	target.leases[8] = 60
+
+	c := newRangeCopier(source, target, KeyRange{Key: []byte("m"), RangeEnd: noEnd})
+	assert.NoError(t, c.copyLeases(context.Background()))
+	// lease 8 exists in both
+	assert.Equal(t, map[int64]int64{7: 30, 8: 60}, target.leases)
+	assert.Len(t, c.leases, 2)
+
+	// lease 9 in the target is another lease of the same id
+	source.leases[9], target.leases[9] = 30, 10
+	c = newRangeCopier(source, target, KeyRange{Key: []byte("m"), RangeEnd: noEnd})
+	assert.Error(t, c.copyLeases(context.Background()))
+	assert.Equal(t, int64(10), target.leases[9])
+	assert.NotContains(t, c.leases, int64(9))
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RangeContinueKey is the gRPC metadata key of the continuation token of a paged Range.
+// A client starts paging by sending it with an empty value, the proxy returns the token of
+// the next page in the response header as long as keys remain. Sending the token back
+// resumes the range right after the last returned key, at the same revisions.
+const RangeContinueKey = "x-etcd-range-continue"
+
+// rangeCursor is the position of a paged range, encoded in the continuation token.
+type rangeCursor struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"rangeEnd"`
+	// ShardID is the id of the shard being read, the shards after it in key order are read next.
+	// It's not the index in the shards of the range, which changes when shards are merged.
+	ShardID int `json:"shardId"`
+	// Done is true once all shards are read.
+	Done bool `json:"done"`
+	// LastKey is the last key returned, nil if no key returned yet.
+	LastKey []byte         `json:"lastKey"`
+	Revs    RevisionVector `json:"revs"`
+	// Shards are the ids of the shards of the range when the cursor is opened.
+	Shards []int `json:"shards"`
+	// Count is the count of the whole range, counted once when the cursor is opened.
+	Count int64 `json:"count"`
+}
+
+func (c *rangeCursor) encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeRangeCursor(token string) (*rangeCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad continuation token: %v", err)
+	}
+	ret := new(rangeCursor)
+	err = json.Unmarshal(data, ret)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad continuation token: %v", err)
+	}
+	return ret, nil
+}
+
+// rangeContinueFromContext returns the continuation token in the incoming metadata.
+// ok is false if the range is not paged.
+func rangeContinueFromContext(ctx context.Context) (token string, ok bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(RangeContinueKey)
+	if len(values) < 1 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// rangeByCursor returns one page of the range, reading the shards one by one in key order.
+// At most limit keys are held by the proxy for a page.
+func (s *KVProxy) rangeByCursor(ctx context.Context, req *pb.RangeRequest, token string) (*pb.RangeResponse, error) {
+	if req.Limit <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "paged range requires a limit")
+	}
+	if req.SortTarget != pb.RangeRequest_KEY || req.SortOrder == pb.RangeRequest_DESCEND {
+		return nil, status.Error(codes.InvalidArgument, "paged range only supports ascending key order")
+	}
+	shardClis := s.configs.GetShardClis(req.Key, req.RangeEnd)
+	cursor, err := s.openRangeCursor(ctx, req, shardClis, token)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := s.rangePage(ctx, req, shardClis, cursor)
+	if err != nil {
+		return nil, err
+	}
+	ret.Header = s.headers.Stamp(ret.Header)
+
+	setRevisionVectorHeader(ctx, cursor.Revs)
+	if ret.More && grpc.ServerTransportStreamFromContext(ctx) != nil {
+		next, err := cursor.encode()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode continuation token")
+		}
+		_ = grpc.SetHeader(ctx, metadata.Pairs(RangeContinueKey, next))
+	}
+	return ret, nil
+}
+
+// rangePage reads the page at the cursor, and moves the cursor to the next page.
+func (s *KVProxy) rangePage(ctx context.Context, req *pb.RangeRequest, shardClis []ShardClient, cursor *rangeCursor) (*pb.RangeResponse, error) {
+	if !shardsInKeyOrder(s.configs) {
+		return s.rangePageMerged(ctx, req, shardClis, cursor)
+	}
+	var i int
+	if !cursor.Done {
+		i = shardIndex(shardClis, cursor.ShardID)
+		if i < 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "shard[%d] of the paged range is merged or moved, restart the range", cursor.ShardID)
+		}
+	}
+	var kvs []*mvccpb.KeyValue
+	var header *pb.ResponseHeader
+	var remaining = req.Limit
+	for !cursor.Done && remaining > 0 {
+		shardCli := shardClis[i]
+		shardReq := *rangeRequestAt(req, shardCli.GetShardID(), cursor.Revs)
+		shardReq.Limit = remaining
+		// the keys of the next shards are all after the last key in key order
+		if cursor.LastKey != nil {
+			shardReq.Key = append(append([]byte{}, cursor.LastKey...), 0)
+		}
+		resp, err := shardCli.Range(ctx, &shardReq)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to do range in shard[%d]", shardCli.GetShardID())
+		}
+		s.headers.Observe(shardCli.GetShardID(), resp.Header)
+		if header == nil {
+			header = resp.Header
+		}
+		kvs = append(kvs, resp.Kvs...)
+		remaining -= int64(len(resp.Kvs))
+		if len(resp.Kvs) > 0 {
+			cursor.LastKey = resp.Kvs[len(resp.Kvs)-1].Key
+		}
+		if !resp.More {
+			// the shard is done
+			i++
+			cursor.nextShard(shardClis, i)
+		}
+	}
+
+	ret := countPage(req, cursor, header, kvs)
+	ret.More = !cursor.Done
+	return ret, nil
+}
+
+// nextShard moves the cursor to the shard at index i of the shards of the range, or to the end.
+func (c *rangeCursor) nextShard(shardClis []ShardClient, i int) {
+	if i >= len(shardClis) {
+		c.Done = true
+		return
+	}
+	c.ShardID = shardClis[i].GetShardID()
+}
+
+// shardIndex returns the index of the shard in shardClis, -1 if not found.
+func shardIndex(shardClis []ShardClient, shardID int) int {
+	for i, shardCli := range shardClis {
+		if shardCli.GetShardID() == shardID {
+			return i
+		}
+	}
+	return -1
+}
+
+// rangePageMerged reads the page at the cursor from all shards at the same time,
+// for shards not in key order. Each shard returns at most limit keys after the last key,
+// and the first limit keys of them are the page.
+func (s *KVProxy) rangePageMerged(ctx context.Context, req *pb.RangeRequest, shardClis []ShardClient, cursor *rangeCursor) (*pb.RangeResponse, error) {
+	if cursor.Done {
+		return countPage(req, cursor, nil, nil), nil
+	}
+	pageReq := *req
+	if cursor.LastKey != nil {
+		pageReq.Key = append(append([]byte{}, cursor.LastKey...), 0)
+	}
+	resps, err := s.rangeInParallel(ctx, &pageReq, shardClis, cursor.Revs)
+	if err != nil {
+		return nil, err
+	}
+	lists := make([][]*mvccpb.KeyValue, len(resps))
+	var total int
+	var more bool
+	for i, resp := range resps {
+		s.headers.Observe(shardClis[i].GetShardID(), resp.Header)
+		lists[i] = resp.Kvs
+		total += len(resp.Kvs)
+		more = more || resp.More
+	}
+	kvs := mergeKvs(lists, kvLessFunc(req), req.Limit)
+	if len(kvs) > 0 {
+		cursor.LastKey = kvs[len(kvs)-1].Key
+	}
+	if !more && len(kvs) == total {
+		// all shards are done
+		cursor.Done = true
+	}
+	ret := countPage(req, cursor, resps[0].Header, kvs)
+	ret.More = !cursor.Done
+	return ret, nil
+}
+
+// countPage returns the page of kvs, with the count of the whole range.
+func countPage(req *pb.RangeRequest, cursor *rangeCursor, header *pb.ResponseHeader, kvs []*mvccpb.KeyValue) *pb.RangeResponse {
+	ret := &pb.RangeResponse{Header: header, Kvs: kvs, Count: cursor.Count}
+	if req.KeysOnly {
+		dropValues(ret.Kvs)
+	}
+	return ret
+}
+
+// openRangeCursor starts a new cursor if token is empty, or resumes the cursor of the token.
+// A new cursor reads all shards at the revisions in the revision vector of rangeRevisions,
+// at the revision of the request, or else at their current revisions.
+func (s *KVProxy) openRangeCursor(ctx context.Context, req *pb.RangeRequest, shardClis []ShardClient, token string) (*rangeCursor, error) {
+	if len(token) > 0 {
+		cursor, err := decodeRangeCursor(token)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(cursor.Key, req.Key) || !bytes.Equal(cursor.RangeEnd, req.RangeEnd) {
+			return nil, status.Error(codes.InvalidArgument, "continuation token doesn't match the range")
+		}
+		// the keys moved into the other shards since are after their pinned revisions
+		for _, shardID := range cursor.Shards {
+			if !cursor.Done && shardIndex(shardClis, shardID) < 0 {
+				return nil, status.Errorf(codes.FailedPrecondition, "shard[%d] of the paged range is merged or moved, restart the range", shardID)
+			}
+		}
+		return cursor, nil
+	}
+
+	revs, err := s.rangeRevisions(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if revs == nil {
+		revs = make(RevisionVector)
+	}
+	if req.Revision > 0 {
+		for _, shardCli := range shardClis {
+			if _, ok := revs[shardCli.GetShardID()]; !ok {
+				revs[shardCli.GetShardID()] = req.Revision
+			}
+		}
+	}
+	// count the whole range, and pin the rest shards at their current revisions
+	countReq := *req
+	countReq.Limit = 0
+	countReq.CountOnly = true
+	counts, err := s.rangeInParallel(ctx, &countReq, shardClis, revs)
+	if err != nil {
+		return nil, err
+	}
+	ret := &rangeCursor{
+		Key:      req.Key,
+		RangeEnd: req.RangeEnd,
+		Revs:     revs,
+	}
+	for i, shardCli := range shardClis {
+		if _, ok := revs[shardCli.GetShardID()]; !ok {
+			revs[shardCli.GetShardID()] = counts[i].Header.Revision
+		}
+		ret.Count += counts[i].Count
+		ret.Shards = append(ret.Shards, shardCli.GetShardID())
+	}
+	ret.nextShard(shardClis, 0)
+	return ret, nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newFakeShardingConfigs returns the configs of up to 3 shards of memEtcds split at "i" & "s",
+// with the keys of each shard put in it.
+func newFakeShardingConfigs(keys ...[]string) *DefaultShardingConfigs {
+	shards, clis := newMemShards([]string{"i", "s"}[:len(keys)-1]...)
+	for i, shardKeys := range keys {
+		for _, key := range shardKeys {
+			_, _ = clis[i].Put(context.Background(), &pb.PutRequest{Key: []byte(key)})
+		}
+	}
+	return NewDefaultShardingConfigs(shards)
+}
+
+func TestKVProxy_rangePage(t *testing.T) {
+	configs := newFakeShardingConfigs([]string{"a", "b", "c"}, []string{"j"}, []string{"x", "y"})
+	// counts are the count only ranges of shards
+	counts := make([]int, len(configs.shards))
+	for i, shard := range configs.shards {
+		index := i
+		cli := &hookedEtcd{memEtcd: shard.(*ShardImpl).cli.(*memEtcd)}
+		cli.hook(nil, func(in *pb.RangeRequest) error {
+			if in.CountOnly {
+				counts[index]++
+			}
+			return nil
+		})
+		shard.(*ShardImpl).cli = cli
+	}
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	req := &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd, Limit: 2}
+	shardClis := configs.GetShardClis(req.Key, req.RangeEnd)
+
+	ctx := context.Background()
+	cursor, err := proxy.openRangeCursor(ctx, req, shardClis, "")
+	assert.NoError(t, err)
+	assert.Equal(t, RevisionVector{0: 4, 1: 2, 2: 3}, cursor.Revs)
+
+	var pages [][]string
+	for {
+		token, err := cursor.encode()
+		assert.NoError(t, err)
+		cursor, err = proxy.openRangeCursor(ctx, req, shardClis, token)
+		assert.NoError(t, err)
+
+		resp, err := proxy.rangePage(ctx, req, shardClis, cursor)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6), resp.Count)
+		pages = append(pages, kvKeys(resp.Kvs))
+		if !resp.More {
+			break
+		}
+		if len(pages) > 5 {
+			t.Fatal("too many pages")
+		}
+	}
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "j"}, {"x", "y"}}, pages)
+	// the range is counted once, not on every page
+	assert.Equal(t, []int{1, 1, 1}, counts)
+}
+
+func TestKVProxy_rangePage_merged(t *testing.T) {
+	configs := newFakeShardingConfigs([]string{"a", "b", "c"}, []string{"j"}, []string{"x", "y"})
+	versioned := NewVersionedShardingConfigs(configs, 1)
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), versioned, new(DefaultResponseFilter))
+	req := &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd, Limit: 2}
+	ctx := context.Background()
+	page := func(token string) ([]string, string, error) {
+		shardClis := versioned.GetShardClis(req.Key, req.RangeEnd)
+		cursor, err := proxy.openRangeCursor(ctx, req, shardClis, token)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err := proxy.rangePage(ctx, req, shardClis, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		next, err := cursor.encode()
+		assert.NoError(t, err)
+		return kvKeys(resp.Kvs), next, nil
+	}
+	keys, token, err := page("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+	onShard1, err := (&rangeCursor{Key: req.Key, RangeEnd: req.RangeEnd, ShardID: 1, LastKey: []byte("c")}).encode()
+	assert.NoError(t, err)
+
+	// shard[1] is merged into shard[0], whose pinned revision is before the keys moved into it,
+	// so the cursor on shard[0] can't go on without skipping them
+	shard0 := configs.shards[0].(*ShardImpl).cli.(*memEtcd)
+	_, _ = shard0.Put(ctx, &pb.PutRequest{Key: []byte("j")})
+	versioned.Switch(NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("s"), cli: shard0},
+		retiredShard{},
+		configs.shards[2],
+	}), 2)
+	_, _, err = page(token)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// the range restarted reads the merged shards
+	var pages [][]string
+	for token = ""; ; {
+		keys, token, err = page(token)
+		assert.NoError(t, err)
+		pages = append(pages, keys)
+		if len(keys) < 2 || len(pages) > 5 {
+			break
+		}
+	}
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "j"}, {"x", "y"}, {}}, pages)
+
+	// the cursor on the retired shard can't go on
+	_, _, err = page(onShard1)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
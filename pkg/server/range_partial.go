@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RangePartialKey is the gRPC metadata key to enable partial range: "true" or "false".
+// A partial range returns the keys from the healthy shards instead of failing,
+// the ranges of failed shards are listed in the trailer RangeMissingKey.
+// It overrides the default of the proxy.
+const RangePartialKey = "x-etcd-range-partial"
+
+// RangeMissingKey is the gRPC trailer key of the missing ranges of a partial range.
+// Each value is "<shard id>:<start>:<end>:<error>", start & end are base64url encoded keys.
+const RangeMissingKey = "x-etcd-range-missing"
+
+// missingRange is the range of a failed shard in a partial range
+type missingRange struct {
+	shardID int
+	start   []byte
+	end     []byte
+	err     error
+}
+
+func (m missingRange) String() string {
+	return fmt.Sprintf("%d:%s:%s:%v", m.shardID,
+		base64.RawURLEncoding.EncodeToString(m.start), base64.RawURLEncoding.EncodeToString(m.end), m.err)
+}
+
+// isPartialRange returns true if the range accepts partial results, by metadata or by default.
+func (s *KVProxy) isPartialRange(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		if values := md.Get(RangePartialKey); len(values) > 0 {
+			partial, err := strconv.ParseBool(values[0])
+			if err == nil {
+				return partial
+			}
+		}
+	}
+	return s.partialRange
+}
+
+// rangeShard does the range in one shard with the shard timeout if any.
+func (s *KVProxy) rangeShard(ctx context.Context, shardCli ShardClient, req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	if s.shardTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.shardTimeout)
+		defer cancel()
+	}
+	return shardCli.Range(ctx, req)
+}
+
+// rangePartial does the range in all shards at the same time, tolerating failed shards.
+// The responses & clients of the healthy shards are returned, it fails only if all shards fail.
+func (s *KVProxy) rangePartial(ctx context.Context, req *pb.RangeRequest, shardClis []ShardClient, revs RevisionVector) ([]*pb.RangeResponse, []ShardClient, []missingRange, error) {
+	rets := make([]*pb.RangeResponse, len(shardClis))
+	errs := make([]error, len(shardClis))
+	groupRunner := s.groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			shardID := shardClis[index].GetShardID()
+			rets[index], errs[index] = s.rangeShard(ctx, shardClis[index], rangeRequestAt(req, shardID, revs))
+			return nil
+		})
+	}
+	_ = groupRunner.Wait()
+
+	var healthy []*pb.RangeResponse
+	var healthyClis []ShardClient
+	var missing []missingRange
+	for i, shardCli := range shardClis {
+		if errs[i] == nil {
+			healthy = append(healthy, rets[i])
+			healthyClis = append(healthyClis, shardCli)
+			continue
+		}
+		start, end := s.missingKeyRange(req, shardCli.GetShardID())
+		missing = append(missing, missingRange{shardID: shardCli.GetShardID(), start: start, end: end, err: errs[i]})
+	}
+	if len(healthy) == 0 {
+		// nothing to return, fail like a normal range
+		return nil, nil, nil, errs[0]
+	}
+	return healthy, healthyClis, missing, nil
+}
+
+// missingKeyRange returns the part of the range in the shard,
+// the whole range if the range of the shard is unknown.
+func (s *KVProxy) missingKeyRange(req *pb.RangeRequest, shardID int) (start, end []byte) {
+	start, end = req.Key, req.RangeEnd
+	ranger, ok := currentShardingConfigs(s.configs).(ShardRangeGetter)
+	if !ok || len(req.RangeEnd) == 0 {
+		return start, end
+	}
+	shardStart, shardEnd, ok := ranger.GetShardRange(shardID)
+	if !ok {
+		return start, end
+	}
+	if bytes.Compare(shardStart, start) > 0 {
+		start = shardStart
+	}
+	if bytes.Equal(end, noEnd) || !bytes.Equal(shardEnd, noEnd) && bytes.Compare(shardEnd, end) < 0 {
+		end = shardEnd
+	}
+	return start, end
+}
+
+// setMissingRangesTrailer sends the missing ranges in the response trailer of the gRPC call.
+func setMissingRangesTrailer(ctx context.Context, missing []missingRange) {
+	if len(missing) == 0 || grpc.ServerTransportStreamFromContext(ctx) == nil {
+		return
+	}
+	values := make([]string, len(missing))
+	for i, m := range missing {
+		values[i] = m.String()
+	}
+	_ = grpc.SetTrailer(ctx, metadata.MD{RangeMissingKey: values})
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestKVProxy_partialRange(t *testing.T) {
+	configs := newFakeShardingConfigs([]string{"a", "b"}, []string{"j", "k"}, []string{"x"})
+	configs.shards[1].(*ShardImpl).cli.(*memEtcd).failOn("Range", errors.New("shard down"))
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	req := &pb.RangeRequest{Key: []byte("b"), RangeEnd: []byte("y")}
+
+	_, err := proxy.Range(context.Background(), req)
+	assert.Error(t, err)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(RangePartialKey, "true"))
+	assert.True(t, proxy.isPartialRange(ctx))
+	result, err := proxy.doRange(ctx, req, nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "x"}, kvKeys(result.resp.Kvs))
+	assert.Equal(t, RevisionVector{0: 3, 2: 2}, result.readRevs)
+	assert.Len(t, result.missing, 1)
+	assert.Equal(t, 1, result.missing[0].shardID)
+	assert.Equal(t, []byte("i"), result.missing[0].start)
+	assert.Equal(t, []byte("s"), result.missing[0].end)
+	assert.Equal(t, "1:aQ:cw:shard down", result.missing[0].String())
+
+	// disabled by metadata
+	proxy = NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter), WithPartialRange())
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(RangePartialKey, "false"))
+	assert.False(t, proxy.isPartialRange(ctx))
+	assert.True(t, proxy.isPartialRange(context.Background()))
+}
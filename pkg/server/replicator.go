@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+)
+
+// replicaRepairInterval is how often the replicas failed to be written are repaired.
+const replicaRepairInterval = 10 * time.Second
+
+// Replicator writes replicated keys to all shards.
+// Writes are atomic by the txn coordinator if enabled. Otherwise they're sent to the
+// primary shards, then to the other shards in parallel, and the replicas failed to be
+// written are repaired later from the primary copies.
+type Replicator struct {
+	groupRunners GroupRunnerFactory
+	configs      ShardingConfigs
+	// coordinator is nil if txns across shards are not enabled
+	coordinator *TxnCoordinator
+	headers     *HeaderStamper
+	lg          *zap.Logger
+
+	mu sync.Mutex
+	// pending are the ranges to repair
+	pending map[string]KeyRange
+}
+
+// NewReplicator creates a Replicator of the replicated prefixes of the configs in use,
+// so the prefixes added by later versions of versioned configs are replicated too.
+func NewReplicator(groupRunners GroupRunnerFactory, configs ShardingConfigs, coordinator *TxnCoordinator, headers *HeaderStamper) *Replicator {
+	return &Replicator{
+		groupRunners: groupRunners,
+		configs:      configs,
+		coordinator:  coordinator,
+		headers:      headers,
+		lg:           zap.L().Named("Replicator"),
+		pending:      make(map[string]KeyRange),
+	}
+}
+
+// Put puts the replicated key in all shards.
+func (r *Replicator) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	if r.coordinator != nil {
+		resp, err := r.coordinator.Txn(ctx, &pb.TxnRequest{
+			Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: req}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &pb.PutResponse{Header: resp.Header, PrevKv: resp.Responses[0].GetResponsePut().GetPrevKv()}, nil
+	}
+	resp, err := r.writeAll(ctx, KeyRange{Key: req.Key}, func(ctx context.Context, shardCli ShardClient) (interface{}, *pb.ResponseHeader, error) {
+		resp, err := shardCli.Put(ctx, req)
+		return resp, resp.GetHeader(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := *resp.(*pb.PutResponse)
+	ret.Header = r.headers.Stamp(ret.Header)
+	return &ret, nil
+}
+
+// DeleteRange deletes the replicated range in all shards.
+func (r *Replicator) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	if r.coordinator != nil {
+		resp, err := r.coordinator.Txn(ctx, &pb.TxnRequest{
+			Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: req}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		deleteResp := resp.Responses[0].GetResponseDeleteRange()
+		return &pb.DeleteRangeResponse{Header: resp.Header, Deleted: deleteResp.GetDeleted(), PrevKvs: deleteResp.GetPrevKvs()}, nil
+	}
+	resp, err := r.writeAll(ctx, KeyRange{Key: req.Key, RangeEnd: req.RangeEnd}, func(ctx context.Context, shardCli ShardClient) (interface{}, *pb.ResponseHeader, error) {
+		resp, err := shardCli.DeleteRange(ctx, req)
+		return resp, resp.GetHeader(), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := *resp.(*pb.DeleteRangeResponse)
+	ret.Header = r.headers.Stamp(ret.Header)
+	return &ret, nil
+}
+
+// writeAll runs the write in the primary shards of the range, then in the other shards in
+// parallel, and returns the response of the first primary shard. So a replica is never
+// newer than its primary copy, which Repair relies on.
+// The write fails if it fails in any primary shard, the replicas are not written then.
+// If the write fails in some shards, the range is repaired later.
+func (r *Replicator) writeAll(ctx context.Context, keyRange KeyRange, write func(ctx context.Context, shardCli ShardClient) (interface{}, *pb.ResponseHeader, error)) (interface{}, error) {
+	primaryClis := r.primaryShardClis(keyRange)
+	primary := make(map[int]struct{}, len(primaryClis))
+	for _, shardCli := range primaryClis {
+		primary[shardCli.GetShardID()] = struct{}{}
+	}
+	var replicaClis []ShardClient
+	for _, shardCli := range r.configs.GetAllShardClis() {
+		if _, ok := primary[shardCli.GetShardID()]; !ok {
+			replicaClis = append(replicaClis, shardCli)
+		}
+	}
+
+	resps, errs := r.writeShards(ctx, keyRange, primaryClis, write)
+	for i, err := range errs {
+		if err != nil {
+			// the write may be applied in the shard even if it fails
+			r.schedule(keyRange)
+			return nil, errors.Wrapf(err, "failed to write in shard[%d]", primaryClis[i].GetShardID())
+		}
+	}
+	_, errs = r.writeShards(ctx, keyRange, replicaClis, write)
+	for _, err := range errs {
+		if err != nil {
+			r.schedule(keyRange)
+			break
+		}
+	}
+	return resps[0], nil
+}
+
+// writeShards runs the write in the shards in parallel, and returns their responses & errors.
+func (r *Replicator) writeShards(ctx context.Context, keyRange KeyRange, shardClis []ShardClient, write func(ctx context.Context, shardCli ShardClient) (interface{}, *pb.ResponseHeader, error)) ([]interface{}, []error) {
+	resps := make([]interface{}, len(shardClis))
+	errs := make([]error, len(shardClis))
+	groupRunner := r.groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			var header *pb.ResponseHeader
+			resps[index], header, errs[index] = write(ctx, shardClis[index])
+			if errs[index] != nil {
+				r.lg.Warn("failed to write replicated keys", zap.Int("shard", shardClis[index].GetShardID()),
+					zap.ByteString("key", keyRange.Key), zap.Error(errs[index]))
+			} else {
+				r.headers.Observe(shardClis[index].GetShardID(), header)
+			}
+			return nil
+		})
+	}
+	_ = groupRunner.Wait()
+	return resps, errs
+}
+
+// primaryShardClis returns the shards of the primary copies of the range.
+// Sharding configs switched to a version without replicated prefixes have no replicas,
+// so all copies are the primary ones.
+func (r *Replicator) primaryShardClis(keyRange KeyRange) []ShardClient {
+	if replicated, ok := currentShardingConfigs(r.configs).(ReplicatedSharding); ok {
+		return replicated.GetPrimaryShardClis(keyRange.Key, keyRange.RangeEnd)
+	}
+	return r.configs.GetShardClis(keyRange.Key, keyRange.RangeEnd)
+}
+
+func (r *Replicator) schedule(keyRange KeyRange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[string(keyRange.Key)+"\x00"+string(keyRange.RangeEnd)] = keyRange
+}
+
+// Run repairs the pending ranges periodically until ctx is done.
+func (r *Replicator) Run(ctx context.Context) {
+	ticker := time.NewTicker(replicaRepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		pending := r.pending
+		r.pending = make(map[string]KeyRange)
+		r.mu.Unlock()
+		for _, keyRange := range pending {
+			r.repairOrSchedule(ctx, keyRange)
+		}
+	}
+}
+
+// repairOrSchedule repairs the range now, or later if it fails.
+func (r *Replicator) repairOrSchedule(ctx context.Context, keyRange KeyRange) {
+	err := r.Repair(ctx, keyRange)
+	if err != nil {
+		r.lg.Warn("failed to repair replicas, retry later", zap.ByteString("key", keyRange.Key),
+			zap.ByteString("rangeEnd", keyRange.RangeEnd), zap.Error(err))
+		r.schedule(keyRange)
+	}
+}
+
+// Repair makes the replicas of the range in all shards the same as the primary copies.
+// The replicas are read before the primary copies, and each repair is guarded by the
+// mod revision of the replica read. As a replica is never newer than its primary copy,
+// a write landing between the reads either changes the replica after it's read, which fails
+// the guard and is left to the write, or is already in the primary copy read.
+func (r *Replicator) Repair(ctx context.Context, keyRange KeyRange) error {
+	shardClis := r.configs.GetAllShardClis()
+	replicas := make([][]*mvccpb.KeyValue, len(shardClis))
+	groupRunner := r.groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			resp, err := shardClis[index].Range(ctx, &pb.RangeRequest{Key: keyRange.Key, RangeEnd: keyRange.RangeEnd})
+			if err != nil {
+				return errors.Wrapf(err, "failed to read replicas in shard[%d]", shardClis[index].GetShardID())
+			}
+			replicas[index] = resp.Kvs
+			return nil
+		})
+	}
+	err := groupRunner.Wait()
+	if err != nil {
+		return err
+	}
+	var primary []*mvccpb.KeyValue
+	for _, shardCli := range r.primaryShardClis(keyRange) {
+		resp, err := shardCli.Range(ctx, &pb.RangeRequest{Key: keyRange.Key, RangeEnd: keyRange.RangeEnd})
+		if err != nil {
+			return errors.Wrapf(err, "failed to read primary copies in shard[%d]", shardCli.GetShardID())
+		}
+		primary = append(primary, resp.Kvs...)
+	}
+	groupRunner = r.groupRunners.GetGroupRunner()
+	for i := range shardClis {
+		index := i
+		groupRunner.Go(func() error {
+			return errors.Wrapf(repairShard(ctx, shardClis[index], primary, replicas[index]), "failed to repair shard[%d]", shardClis[index].GetShardID())
+		})
+	}
+	return groupRunner.Wait()
+}
+
+// repairShard writes the differences between the replicas read from the shard and the primary copies.
+func repairShard(ctx context.Context, shardCli ShardClient, primary, replicas []*mvccpb.KeyValue) error {
+	var ops []*pb.TxnRequest
+	for len(primary) > 0 || len(replicas) > 0 {
+		var cmp int
+		switch {
+		case len(primary) == 0:
+			cmp = 1
+		case len(replicas) == 0:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(primary[0].Key, replicas[0].Key)
+		}
+		switch {
+		case cmp < 0:
+			// missing replica
+			kv := primary[0]
+			ops = append(ops, &pb.TxnRequest{
+				Compare: []*pb.Compare{cmpModRevision(kv.Key, 0)},
+				Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: kv.Key, Value: kv.Value, Lease: kv.Lease}}}},
+			})
+			primary = primary[1:]
+		case cmp > 0:
+			// replica deleted in primary
+			kv := replicas[0]
+			ops = append(ops, &pb.TxnRequest{
+				Compare: []*pb.Compare{cmpModRevision(kv.Key, kv.ModRevision)},
+				Success: []*pb.RequestOp{opDelete(kv.Key)},
+			})
+			replicas = replicas[1:]
+		default:
+			kv, replica := primary[0], replicas[0]
+			if !bytes.Equal(kv.Value, replica.Value) || kv.Lease != replica.Lease {
+				ops = append(ops, &pb.TxnRequest{
+					Compare: []*pb.Compare{cmpModRevision(kv.Key, replica.ModRevision)},
+					Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: kv.Key, Value: kv.Value, Lease: kv.Lease}}}},
+				})
+			}
+			primary, replicas = primary[1:], replicas[1:]
+		}
+	}
+	for _, op := range ops {
+		_, err := shardCli.Txn(ctx, op)
+		if err != nil {
+			return errors.Wrapf(err, "failed to repair key [%s]", op.Compare[0].Key)
+		}
+	}
+	return nil
+}
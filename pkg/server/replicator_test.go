@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// newReplicatorTest returns a replicator of "m/" in shards ["", "j"), ["j", "s") & ["s", "") in memory,
+// the primary copies are in shard[1]
+func newReplicatorTest() (*Replicator, []*memEtcd) {
+	shards, clis := newMemShards("j", "s")
+	configs := NewDefaultShardingConfigs(shards, WithReplicatedPrefixes("m/"))
+	return NewReplicator(NewDefaultGroupRunnerFactory(), configs, nil, nil), clis
+}
+
+func pendingRanges(r *Replicator) []KeyRange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []KeyRange
+	for _, keyRange := range r.pending {
+		ret = append(ret, keyRange)
+	}
+	return ret
+}
+
+func TestReplicator_writeAll(t *testing.T) {
+	r, clis := newReplicatorTest()
+	ctx := context.Background()
+
+	// a replica failed to be written is repaired later
+	clis[2].failOn("Put", errors.New("shard down"))
+	_, err := r.Put(ctx, &pb.PutRequest{Key: []byte("m/a"), Value: []byte("1")})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"m/a"}, clis[0].keys())
+	assert.Empty(t, clis[2].keys())
+	assert.Equal(t, []KeyRange{{Key: []byte("m/a")}}, pendingRanges(r))
+
+	// the write fails if the primary copy fails to be written, and the replicas are not written
+	clis[1].failOn("DeleteRange", errors.New("shard down"))
+	_, err = r.DeleteRange(ctx, &pb.DeleteRangeRequest{Key: []byte("m/"), RangeEnd: []byte("m0")})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"m/a"}, clis[0].keys())
+	assert.Equal(t, []string{"m/a"}, clis[1].keys())
+	assert.Len(t, pendingRanges(r), 2)
+
+	clis[1].failOn("DeleteRange", nil)
+	clis[2].failOn("Put", nil)
+	for _, keyRange := range pendingRanges(r) {
+		assert.NoError(t, r.Repair(ctx, keyRange))
+	}
+	// the replicas are repaired to the primary copies, where the delete failed
+	for _, cli := range clis {
+		assert.Equal(t, []string{"m/a"}, cli.keys())
+		assert.Equal(t, []byte("1"), cli.get("m/a"))
+	}
+}
+
+func TestReplicator_Repair(t *testing.T) {
+	r, clis := newReplicatorTest()
+	ctx := context.Background()
+	put := func(cli *memEtcd, key, value string) {
+		_, err := cli.Put(ctx, &pb.PutRequest{Key: []byte(key), Value: []byte(value)})
+		assert.NoError(t, err)
+	}
+	put(clis[1], "m/a", "new")
+	put(clis[1], "m/b", "1")
+	// a stale replica, a replica deleted in the primary copies, and missing replicas
+	put(clis[0], "m/a", "old")
+	put(clis[0], "m/b", "1")
+	put(clis[0], "m/z", "1")
+	put(clis[2], "m/a", "new")
+	keyRange := KeyRange{Key: []byte("m/"), RangeEnd: []byte("m0")}
+
+	clis[2].failOn("Txn", errors.New("shard down"))
+	r.repairOrSchedule(ctx, keyRange)
+	assert.Equal(t, []KeyRange{keyRange}, pendingRanges(r))
+	assert.Equal(t, []string{"m/a", "m/b"}, clis[0].keys())
+	assert.Equal(t, []string{"m/a"}, clis[2].keys())
+
+	clis[2].failOn("Txn", nil)
+	assert.NoError(t, r.Repair(ctx, keyRange))
+	for _, cli := range clis {
+		assert.Equal(t, []string{"m/a", "m/b"}, cli.keys())
+		assert.Equal(t, []byte("new"), cli.get("m/a"))
+	}
+	// nothing to write once converged
+	rev := clis[0].revision
+	assert.NoError(t, r.Repair(ctx, keyRange))
+	assert.Equal(t, rev, clis[0].revision)
+}
+
+func TestReplicator_Repair_concurrentWrite(t *testing.T) {
+	shards, clis := newMemShards("j", "s")
+	primary := &hookedEtcd{memEtcd: clis[1]}
+	shards[1].(*ShardImpl).cli = primary
+	r := NewReplicator(NewDefaultGroupRunnerFactory(), NewDefaultShardingConfigs(shards, WithReplicatedPrefixes("m/")), nil, nil)
+	ctx := context.Background()
+	_, err := primary.Put(ctx, &pb.PutRequest{Key: []byte("m/a"), Value: []byte("1")})
+	assert.NoError(t, err)
+	_, err = clis[0].Put(ctx, &pb.PutRequest{Key: []byte("m/a"), Value: []byte("old")})
+	assert.NoError(t, err)
+
+	// a write lands after the replicas are read, before the primary copies are read
+	var ranges int
+	primary.hook(nil, func(in *pb.RangeRequest) error {
+		ranges++
+		if ranges == 2 {
+			_, err := r.Put(ctx, &pb.PutRequest{Key: []byte("m/a"), Value: []byte("2")})
+			assert.NoError(t, err)
+		}
+		return nil
+	})
+	keyRange := KeyRange{Key: []byte("m/"), RangeEnd: []byte("m0")}
+	assert.NoError(t, r.Repair(ctx, keyRange))
+	assert.Equal(t, 2, ranges)
+	for _, cli := range clis {
+		assert.Equal(t, []byte("2"), cli.get("m/a"))
+	}
+}
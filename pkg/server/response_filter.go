@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
+
 	"github.com/pkg/errors"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
 type ResponseFilter interface {
@@ -13,38 +16,164 @@ type ResponseFilter interface {
 type DefaultResponseFilter struct {
 }
 
+// RangeRequestForShards returns the request to send to each shard of a multi-shard range.
+// Shards responses must be mergeable by FilterRange:
+//   - CountOnly: only counts are needed, so limit & sort are dropped.
+//   - KeysOnly sorted by value: values are needed to merge, they're dropped by FilterRange after merge.
+//
+// Revision filters are applied by each shard as is.
+func RangeRequestForShards(req *pb.RangeRequest) *pb.RangeRequest {
+	switch {
+	case req.CountOnly:
+		ret := *req
+		ret.Limit = 0
+		ret.SortOrder = pb.RangeRequest_NONE
+		ret.SortTarget = pb.RangeRequest_KEY
+		ret.KeysOnly = false
+		return &ret
+	case req.KeysOnly && req.SortTarget == pb.RangeRequest_VALUE:
+		ret := *req
+		ret.KeysOnly = false
+		return &ret
+	}
+	return req
+}
+
+// FilterRange merges the range responses of shards, requested by RangeRequestForShards.
+// Each shard returns its kvs sorted as requested, so they're k-way merged
+// in the same order, then cut by the limit.
+// Count is the total count of all shards, and More is set only when keys remain.
+// A shard may only return its count, when enough keys are got from other shards.
+// Like etcd, count still counts the keys filtered out by revisions.
 func (DefaultResponseFilter) FilterRange(req *pb.RangeRequest, resps []*pb.RangeResponse) (*pb.RangeResponse, error) {
 	// assume len(resps) >= 1
 	if len(resps) < 2 {
 		return resps[0], nil
 	}
-	ret := resps[0]
-	for i := 1; i < len(resps); i++ {
-		if req.Limit > 0 && ret.Count >= req.Limit {
-			ret.More = true
-			break
-		}
-		if resps[i].Count > 0 {
-			if ret.Kvs == nil {
-				ret.Kvs = resps[i].Kvs
-			}
-			ret.Count += resps[i].Count
-			ret.Kvs = append(ret.Kvs, resps[i].Kvs...)
+	ret := &pb.RangeResponse{
+		Header: resps[0].Header,
+	}
+	if req.CountOnly {
+		for _, resp := range resps {
+			ret.Count += resp.Count
 		}
-		if resps[i].More {
+		return ret, nil
+	}
+	lists := make([][]*mvccpb.KeyValue, len(resps))
+	for i, resp := range resps {
+		ret.Count += resp.Count
+		if resp.More {
 			ret.More = true
 		}
+		lists[i] = resp.Kvs
+	}
+	ret.Kvs = mergeKvs(lists, kvLessFunc(req), req.Limit)
+	var total int
+	for _, list := range lists {
+		total += len(list)
+	}
+	if len(ret.Kvs) < total {
+		ret.More = true
+	}
+	// without revision filters, count is exactly the number of keys in range
+	if !req.CountOnly && !hasRevisionFilters(req) && ret.Count > int64(len(ret.Kvs)) {
+		ret.More = true
+	}
+	if req.KeysOnly {
+		dropValues(ret.Kvs)
 	}
 	return ret, nil
 }
 
+// dropValues replaces the kvs having values with copies without values.
+func dropValues(kvs []*mvccpb.KeyValue) {
+	for i, kv := range kvs {
+		if kv.Value != nil {
+			keyOnly := *kv
+			keyOnly.Value = nil
+			kvs[i] = &keyOnly
+		}
+	}
+}
+
+// hasRevisionFilters returns true if kvs in range response are filtered by revisions,
+// in which case the count of range response still counts all keys in range.
+func hasRevisionFilters(req *pb.RangeRequest) bool {
+	return req.MinModRevision != 0 || req.MaxModRevision != 0 ||
+		req.MinCreateRevision != 0 || req.MaxCreateRevision != 0
+}
+
+// kvLessFunc returns the order of kvs in range response of the request.
+// Like etcd, kvs are in ascending key order if not sorted,
+// and sorted ascending if only the target is given.
+func kvLessFunc(req *pb.RangeRequest) func(a, b *mvccpb.KeyValue) bool {
+	var less func(a, b *mvccpb.KeyValue) bool
+	switch req.SortTarget {
+	case pb.RangeRequest_VERSION:
+		less = func(a, b *mvccpb.KeyValue) bool { return a.Version < b.Version }
+	case pb.RangeRequest_CREATE:
+		less = func(a, b *mvccpb.KeyValue) bool { return a.CreateRevision < b.CreateRevision }
+	case pb.RangeRequest_MOD:
+		less = func(a, b *mvccpb.KeyValue) bool { return a.ModRevision < b.ModRevision }
+	case pb.RangeRequest_VALUE:
+		less = func(a, b *mvccpb.KeyValue) bool { return bytes.Compare(a.Value, b.Value) < 0 }
+	default:
+		less = func(a, b *mvccpb.KeyValue) bool { return bytes.Compare(a.Key, b.Key) < 0 }
+	}
+	if req.SortOrder == pb.RangeRequest_DESCEND {
+		return func(a, b *mvccpb.KeyValue) bool { return less(b, a) }
+	}
+	return less
+}
+
+// mergeKvs k-way merges sorted lists of kvs, up to limit kvs if limit > 0.
+// Equal kvs keep the order of lists.
+func mergeKvs(lists [][]*mvccpb.KeyValue, less func(a, b *mvccpb.KeyValue) bool, limit int64) []*mvccpb.KeyValue {
+	var total int
+	for _, list := range lists {
+		total += len(list)
+	}
+	if limit > 0 && int64(total) > limit {
+		total = int(limit)
+	}
+	if total == 0 {
+		return nil
+	}
+	ret := make([]*mvccpb.KeyValue, 0, total)
+	heads := make([]int, len(lists))
+	for len(ret) < total {
+		min := -1
+		for i, list := range lists {
+			if heads[i] >= len(list) {
+				continue
+			}
+			if min < 0 || less(list[heads[i]], lists[min][heads[min]]) {
+				min = i
+			}
+		}
+		ret = append(ret, lists[min][heads[min]])
+		heads[min]++
+	}
+	return ret
+}
+
+// FilterDeleteRange merges the delete range responses of shards.
+// Deleted is the total of all shards, and prev kvs are merged in key order.
 func (DefaultResponseFilter) FilterDeleteRange(resps []*pb.DeleteRangeResponse) (*pb.DeleteRangeResponse, error) {
 	if len(resps) == 0 {
 		return nil, errors.New("no response")
 	}
 	ret := resps[0]
-	for i := 1; i < len(resps); i++ {
-		ret.Deleted += resps[i].Deleted
+	if len(resps) < 2 {
+		return ret, nil
+	}
+	lists := make([][]*mvccpb.KeyValue, len(resps))
+	for i, resp := range resps {
+		lists[i] = resp.PrevKvs
+		if i > 0 {
+			ret.Deleted += resp.Deleted
+		}
 	}
+	ret.PrevKvs = mergeKvs(lists, kvLessFunc(&pb.RangeRequest{}), 0)
 	return ret, nil
 }
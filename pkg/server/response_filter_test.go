@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func testKv(key string, version, createRev, modRev int64, value string) *mvccpb.KeyValue {
+	return &mvccpb.KeyValue{Key: []byte(key), Version: version, CreateRevision: createRev, ModRevision: modRev, Value: []byte(value)}
+}
+
+func kvKeys(kvs []*mvccpb.KeyValue) []string {
+	ret := make([]string, len(kvs))
+	for i, kv := range kvs {
+		ret[i] = string(kv.Key)
+	}
+	return ret
+}
+
+func TestDefaultResponseFilter_FilterRange(t *testing.T) {
+	var filter DefaultResponseFilter
+	a := testKv("a", 3, 1, 9, "z")
+	b := testKv("b", 1, 4, 5, "y")
+	j := testKv("j", 2, 2, 7, "x")
+	k := testKv("k", 4, 3, 3, "w")
+	sortedResps := func(less func(x, y *mvccpb.KeyValue) bool) []*pb.RangeResponse {
+		shard0, shard1 := []*mvccpb.KeyValue{a, b}, []*mvccpb.KeyValue{j, k}
+		for _, list := range [][]*mvccpb.KeyValue{shard0, shard1} {
+			if less(list[1], list[0]) {
+				list[0], list[1] = list[1], list[0]
+			}
+		}
+		return []*pb.RangeResponse{
+			{Header: &pb.ResponseHeader{}, Kvs: shard0, Count: 2},
+			{Header: &pb.ResponseHeader{}, Kvs: shard1, Count: 2},
+		}
+	}
+
+	cases := []struct {
+		name   string
+		req    *pb.RangeRequest
+		expect []string
+	}{
+		{"key", &pb.RangeRequest{}, []string{"a", "b", "j", "k"}},
+		{"key descend", &pb.RangeRequest{SortOrder: pb.RangeRequest_DESCEND}, []string{"k", "j", "b", "a"}},
+		{"version", &pb.RangeRequest{SortTarget: pb.RangeRequest_VERSION}, []string{"b", "j", "a", "k"}},
+		{"create", &pb.RangeRequest{SortTarget: pb.RangeRequest_CREATE, SortOrder: pb.RangeRequest_ASCEND}, []string{"a", "j", "k", "b"}},
+		{"mod descend", &pb.RangeRequest{SortTarget: pb.RangeRequest_MOD, SortOrder: pb.RangeRequest_DESCEND}, []string{"a", "j", "b", "k"}},
+		{"value", &pb.RangeRequest{SortTarget: pb.RangeRequest_VALUE}, []string{"k", "j", "b", "a"}},
+		{"version limit", &pb.RangeRequest{SortTarget: pb.RangeRequest_VERSION, Limit: 2}, []string{"b", "j"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, err := filter.FilterRange(c.req, sortedResps(kvLessFunc(c.req)))
+			assert.NoError(t, err)
+			assert.Equal(t, c.expect, kvKeys(resp.Kvs))
+			assert.Equal(t, int64(4), resp.Count)
+			assert.Equal(t, c.req.Limit > 0, resp.More)
+		})
+	}
+}
+
+func TestDefaultResponseFilter_FilterRange_countOnlyShards(t *testing.T) {
+	var filter DefaultResponseFilter
+	resp, err := filter.FilterRange(&pb.RangeRequest{Limit: 2}, []*pb.RangeResponse{
+		{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("a", 1, 1, 1, ""), testKv("b", 1, 2, 2, "")}, Count: 2},
+		{Header: &pb.ResponseHeader{}, Count: 3},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, kvKeys(resp.Kvs))
+	assert.Equal(t, int64(5), resp.Count)
+	assert.True(t, resp.More)
+
+	resp, err = filter.FilterRange(&pb.RangeRequest{Limit: 2}, []*pb.RangeResponse{
+		{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("a", 1, 1, 1, "")}, Count: 1},
+		{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("j", 1, 2, 2, "")}, Count: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Count)
+	assert.False(t, resp.More)
+}
+
+func TestDefaultResponseFilter_FilterRange_modes(t *testing.T) {
+	var filter DefaultResponseFilter
+
+	t.Run("count only", func(t *testing.T) {
+		req := &pb.RangeRequest{CountOnly: true, Limit: 1, SortTarget: pb.RangeRequest_VALUE}
+		shardReq := RangeRequestForShards(req)
+		assert.Equal(t, int64(0), shardReq.Limit)
+		assert.Equal(t, pb.RangeRequest_KEY, shardReq.SortTarget)
+		resp, err := filter.FilterRange(req, []*pb.RangeResponse{
+			{Header: &pb.ResponseHeader{}, Count: 2},
+			{Header: &pb.ResponseHeader{}, Count: 3},
+		})
+		assert.NoError(t, err)
+		assert.Nil(t, resp.Kvs)
+		assert.Equal(t, int64(5), resp.Count)
+		assert.False(t, resp.More)
+	})
+
+	t.Run("keys only sorted by value", func(t *testing.T) {
+		req := &pb.RangeRequest{KeysOnly: true, SortTarget: pb.RangeRequest_VALUE, SortOrder: pb.RangeRequest_DESCEND}
+		assert.False(t, RangeRequestForShards(req).KeysOnly)
+		assert.True(t, req.KeysOnly)
+		resp, err := filter.FilterRange(req, []*pb.RangeResponse{
+			{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("a", 1, 1, 1, "3"), testKv("b", 1, 2, 2, "1")}, Count: 2},
+			{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("j", 1, 3, 3, "2")}, Count: 1},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "j", "b"}, kvKeys(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			assert.Nil(t, kv.Value)
+		}
+	})
+
+	t.Run("revision filters", func(t *testing.T) {
+		req := &pb.RangeRequest{MinModRevision: 2}
+		resp, err := filter.FilterRange(req, []*pb.RangeResponse{
+			{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("b", 1, 2, 2, "")}, Count: 2},
+			{Header: &pb.ResponseHeader{}, Kvs: []*mvccpb.KeyValue{testKv("j", 1, 3, 3, "")}, Count: 1},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b", "j"}, kvKeys(resp.Kvs))
+		assert.Equal(t, int64(3), resp.Count)
+		assert.False(t, resp.More)
+	})
+}
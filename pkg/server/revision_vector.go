@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RevisionVectorKey is the gRPC metadata key of the revision vector token.
+// The proxy sets it in the response header of Range. A client may send it back in the
+// metadata of a later Range or Watch to read every shard at the recorded revision.
+const RevisionVectorKey = "x-etcd-shard-revisions"
+
+// RevisionVector is the revisions of shards, by shard id.
+// Every shard has its own revision, so a point in time across shards is a vector.
+type RevisionVector map[int]int64
+
+// Encode encodes the vector into an opaque token
+func (v RevisionVector) Encode() string {
+	ids := make([]int, 0, len(v))
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = fmt.Sprintf("%d:%d", id, v[id])
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, ",")))
+}
+
+// DecodeRevisionVector decodes a token encoded by RevisionVector.Encode
+func DecodeRevisionVector(token string) (RevisionVector, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad revision vector: %v", err)
+	}
+	ret := make(RevisionVector)
+	if len(raw) == 0 {
+		return ret, nil
+	}
+	for _, part := range strings.Split(string(raw), ",") {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return nil, status.Errorf(codes.InvalidArgument, "bad revision vector: %q", part)
+		}
+		id, err := strconv.Atoi(kv[0])
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad revision vector: %v", err)
+		}
+		rev, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad revision vector: %v", err)
+		}
+		if rev < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "bad revision vector: negative revision of shard[%d]", id)
+		}
+		ret[id] = rev
+	}
+	return ret, nil
+}
+
+// RevisionVectorFromContext returns the revision vector in the incoming metadata, nil if not given.
+func RevisionVectorFromContext(ctx context.Context) (RevisionVector, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	values := md.Get(RevisionVectorKey)
+	if len(values) < 1 {
+		return nil, nil
+	}
+	return DecodeRevisionVector(values[0])
+}
+
+// Get returns the revision of the shard, 0 if unknown.
+func (v RevisionVector) Get(shardID int) int64 {
+	return v[shardID]
+}
+
+// Clone returns a copy of the vector
+func (v RevisionVector) Clone() RevisionVector {
+	ret := make(RevisionVector, len(v))
+	for id, rev := range v {
+		ret[id] = rev
+	}
+	return ret
+}
+
+// Sum returns the sum of the revisions of all shards.
+func (v RevisionVector) Sum() int64 {
+	var ret int64
+	for _, rev := range v {
+		ret += rev
+	}
+	return ret
+}
+
+// setRevisionVectorHeader sends the vector in the response header of the gRPC call.
+// It does nothing if ctx is not of a gRPC server call.
+func setRevisionVectorHeader(ctx context.Context, v RevisionVector) {
+	if grpc.ServerTransportStreamFromContext(ctx) == nil {
+		return
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(RevisionVectorKey, v.Encode()))
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRevisionVector_Encode(t *testing.T) {
+	for _, v := range []RevisionVector{{}, {0: 1}, {0: 100, 2: 300, 10: 0}} {
+		token := v.Encode()
+		decoded, err := DecodeRevisionVector(token)
+		assert.NoError(t, err)
+		assert.Equal(t, v, decoded)
+	}
+	// the token doesn't depend on the map order
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString([]byte("0:100,2:300")), RevisionVector{2: 300, 0: 100}.Encode())
+}
+
+func TestDecodeRevisionVector(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	for _, c := range []struct {
+		name  string
+		token string
+		want  RevisionVector
+	}{
+		{"empty", "", RevisionVector{}},
+		{"vector", encode("0:100,1:200"), RevisionVector{0: 100, 1: 200}},
+		{"zero revision", encode("1:0"), RevisionVector{1: 0}},
+		{"malformed base64", "!!", nil},
+		{"missing revision", encode("0"), nil},
+		{"bad shard id", encode("a:1"), nil},
+		{"bad revision", encode("0:b"), nil},
+		{"empty pair", encode("0:1,"), nil},
+		{"negative revision", encode("0:-1"), nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := DecodeRevisionVector(c.token)
+			if c.want == nil {
+				assert.Equal(t, codes.InvalidArgument, status.Code(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, v)
+		})
+	}
+}
+
+func TestRevisionVectorFromContext(t *testing.T) {
+	v, err := RevisionVectorFromContext(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("other", "1"))
+	v, err = RevisionVectorFromContext(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(RevisionVectorKey, RevisionVector{1: 5}.Encode()))
+	v, err = RevisionVectorFromContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, RevisionVector{1: 5}, v)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(RevisionVectorKey, "!!"))
+	_, err = RevisionVectorFromContext(ctx)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestReadRevisions(t *testing.T) {
+	shardClis := []ShardClient{newMemEtcd(0), newMemEtcd(2)}
+	rets := []*pb.RangeResponse{
+		{Header: &pb.ResponseHeader{Revision: 10}},
+		{Header: &pb.ResponseHeader{Revision: 30}},
+	}
+	req := &pb.RangeRequest{Key: []byte("a")}
+
+	// shards without a revision are read at their header revision
+	assert.Equal(t, RevisionVector{0: 10, 2: 30}, readRevisions(req, shardClis, rets, nil))
+	// shards in the vector are read at it, and shards not in the range are kept
+	revs := RevisionVector{0: 5, 1: 7}
+	assert.Equal(t, RevisionVector{0: 5, 1: 7, 2: 30}, readRevisions(req, shardClis, rets, revs))
+	assert.Equal(t, RevisionVector{0: 5, 1: 7}, revs)
+}
+
+// headerStream captures the headers set in a gRPC server call
+type headerStream struct {
+	header metadata.MD
+}
+
+func (s *headerStream) Method() string { return "/etcdserverpb.KV/Range" }
+
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *headerStream) SendHeader(md metadata.MD) error { return s.SetHeader(md) }
+
+func (s *headerStream) SetTrailer(md metadata.MD) error { return nil }
+
+func TestKVProxy_Range_revisionVector(t *testing.T) {
+	clis := []*memEtcd{newMemEtcd(0), newMemEtcd(1)}
+	configs := NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("m"), cli: clis[0]},
+		&ShardImpl{start: []byte("m"), end: noEnd, cli: clis[1]},
+	})
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	put := func(key, value string) {
+		_, err := proxy.Put(context.Background(), &pb.PutRequest{Key: []byte(key), Value: []byte(value)})
+		assert.NoError(t, err)
+	}
+	rangeAll := func(ctx context.Context) (*pb.RangeResponse, metadata.MD) {
+		stream := &headerStream{}
+		resp, err := proxy.Range(grpc.NewContextWithServerTransportStream(ctx, stream), &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd})
+		assert.NoError(t, err)
+		return resp, stream.header
+	}
+	put("a", "1")
+	put("n", "1")
+	put("n", "2")
+	_, header := rangeAll(context.Background())
+	tokens := header.Get(RevisionVectorKey)
+	assert.Len(t, tokens, 1)
+	v, err := DecodeRevisionVector(tokens[0])
+	assert.NoError(t, err)
+	assert.Equal(t, RevisionVector{0: 2, 1: 3}, v)
+
+	// writes in both shards after the first range
+	put("a", "2")
+	put("b", "1")
+	put("n", "3")
+
+	// a range at the returned vector reads the snapshot of every shard
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(RevisionVectorKey, tokens[0]))
+	resp, header := rangeAll(ctx)
+	assert.Equal(t, []string{"a", "n"}, kvKeys(resp.Kvs))
+	assert.Equal(t, []byte("1"), resp.Kvs[0].Value)
+	assert.Equal(t, []byte("2"), resp.Kvs[1].Value)
+	assert.Equal(t, []string{tokens[0]}, header.Get(RevisionVectorKey))
+
+	// a range without the vector reads the latest
+	resp, _ = rangeAll(context.Background())
+	assert.Equal(t, []string{"a", "b", "n"}, kvKeys(resp.Kvs))
+}
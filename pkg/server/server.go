@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 
@@ -17,9 +18,16 @@ type BackendServers struct {
 	KV    pb.KVServer
 	Watch pb.WatchServer
 	Lease pb.LeaseServer
+	// Configs is the sharding configs served by the servers if set,
+	// whose requests fail while it's suspended, see VersionedShardingConfigs.Suspend.
+	Configs ShardingConfigs
 }
 
 func NewGrpcServer(servers BackendServers, opts ...grpc.ServerOption) (*GrpcServer, error) {
+	if servers.Configs != nil {
+		opts = append(opts, grpc.ChainUnaryInterceptor(suspendedUnaryInterceptor(servers.Configs)),
+			grpc.ChainStreamInterceptor(suspendedStreamInterceptor(servers.Configs)))
+	}
 	server := grpc.NewServer(opts...)
 	ret := &GrpcServer{
 		server: server,
@@ -41,3 +49,24 @@ func (s *GrpcServer) Serve(addr string, port int) error {
 	}
 	return nil
 }
+
+// suspendedUnaryInterceptor fails the requests while the configs is suspended.
+func suspendedUnaryInterceptor(configs ShardingConfigs) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := suspendedErr(configs); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// suspendedStreamInterceptor fails the streams opened while the configs is suspended,
+// the streams opened before are closed by the proxies of them.
+func suspendedStreamInterceptor(configs ShardingConfigs) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := suspendedErr(configs); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
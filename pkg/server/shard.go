@@ -19,18 +19,30 @@ type ShardImpl struct {
 	// end key of the range, exclusive.
 	end []byte
 	cli ShardClient
+	// cutoverRevision is the revision when keys were last moved into the shard, see config.Shard
+	cutoverRevision int64
 }
 
 var noEnd = []byte{0}
 
 func NewShardImpl(shardID int, totalShards int, conf config.Shard) (*ShardImpl, error) {
-	ret := new(ShardImpl)
+	cli, err := NewShardClientImpl(shardID, conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create shard client to %v", conf.DefaultEndpoints())
+	}
+	return newShardImpl(shardID == 0, shardID == totalShards-1, conf, cli), nil
+}
+
+// newShardImpl creates the shard with the client. The start key of the first shard
+// & the end key of the last shard are ignored.
+func newShardImpl(first, last bool, conf config.Shard, cli ShardClient) *ShardImpl {
+	ret := &ShardImpl{cli: cli, cutoverRevision: conf.CutoverRevision}
 	if len(conf.Start) > 0 {
 		ret.start = []byte(conf.Start)
 	} else {
 		ret.start = conf.StartBytes
 	}
-	if shardID == 0 {
+	if first {
 		ret.start = []byte{}
 	}
 
@@ -39,16 +51,10 @@ func NewShardImpl(shardID int, totalShards int, conf config.Shard) (*ShardImpl,
 	} else {
 		ret.end = conf.EndBytes
 	}
-	if shardID == totalShards-1 {
+	if last {
 		ret.end = noEnd
 	}
-
-	var err error
-	ret.cli, err = NewShardClientImpl(shardID, conf.Address)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create shard client to [%s]", conf.Address)
-	}
-	return ret, nil
+	return ret
 }
 
 // Contains returns true if the key is in the range of the shard.
@@ -73,7 +79,42 @@ func (s *ShardImpl) Contains(key []byte, rangeEnd []byte) bool {
 	return false
 }
 
+// KeyRange returns the range of keys in the shard, end is noEnd for the last shard.
+func (s *ShardImpl) KeyRange() (start, end []byte) {
+	return s.start, s.end
+}
+
 // GetClient returns the client of the shard.
 func (s *ShardImpl) GetClient() ShardClient {
 	return s.cli
 }
+
+// retiredShard is a shard merged into another one, it owns no keys & has no client.
+type retiredShard struct{}
+
+func (retiredShard) Contains(key []byte, rangeEnd []byte) bool {
+	return false
+}
+
+func (retiredShard) GetClient() ShardClient {
+	return nil
+}
+
+func isRetired(shard Shard) bool {
+	_, ok := shard.(retiredShard)
+	return ok
+}
+
+// prefixEnd returns the range end of all keys with the given prefix.
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// prefix is all 0xff, range to the end
+	return noEnd
+}
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 )
 
 type EtcdGrpcClient interface {
@@ -23,29 +30,114 @@ type EtcdGrpcClientImpl struct {
 	pb.LeaseClient
 }
 
+// ShardClientImpl is the client of a shard.
+// Linearizable reads & writes are balanced among the default endpoints,
+// serializable ranges are sent to the read endpoints if any.
+// Ranges are hedged among the endpoints if hedging is enabled.
 type ShardClientImpl struct {
 	shardID int
+	conn    *grpc.ClientConn
 	EtcdGrpcClient
+
+	readEndpoints []*endpoint
+	readPicker    endpointPicker
+
+	// defaultEndpoints are the default endpoints dialed one by one for hedged ranges,
+	// nil if hedging is not enabled.
+	defaultEndpoints []*endpoint
+	// hedger is nil if hedging is not enabled
+	hedger *hedger
 }
 
-func NewShardClientImpl(shardID int, address string) (*ShardClientImpl, error) {
-	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+func NewShardClientImpl(shardID int, conf config.Shard) (*ShardClientImpl, error) {
+	addresses := conf.DefaultEndpoints()
+	if len(addresses) == 0 {
+		return nil, errors.New("no endpoint")
+	}
+	conn, err := dialEndpoints(fmt.Sprintf("shard%d", shardID), addresses)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to dial etcd server")
 	}
-	kvCli := pb.NewKVClient(conn)
-	watchCli := pb.NewWatchClient(conn)
-	LeaseCli := pb.NewLeaseClient(conn)
-	return &ShardClientImpl{
-		shardID: shardID,
-		EtcdGrpcClient: EtcdGrpcClientImpl{
-			KVClient:    kvCli,
-			WatchClient: watchCli,
-			LeaseClient: LeaseCli,
-		},
-	}, nil
+	ret := &ShardClientImpl{
+		shardID:        shardID,
+		conn:           conn,
+		EtcdGrpcClient: newEtcdGrpcClient(conn),
+	}
+	ret.readPicker, err = newEndpointPicker(conf.ReadBalancer)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range conf.ReadEndpoints {
+		e, err := newEndpoint(address)
+		if err != nil {
+			return nil, err
+		}
+		ret.readEndpoints = append(ret.readEndpoints, e)
+	}
+	if conf.HedgePercentile > 0 {
+		if conf.HedgePercentile >= 100 {
+			return nil, errors.Errorf("bad hedge percentile [%v]", conf.HedgePercentile)
+		}
+		ret.hedger = &hedger{percentile: conf.HedgePercentile, picker: ret.readPicker}
+		for _, address := range addresses {
+			e, err := newEndpoint(address)
+			if err != nil {
+				return nil, err
+			}
+			ret.defaultEndpoints = append(ret.defaultEndpoints, e)
+		}
+	}
+	return ret, nil
+}
+
+// dialEndpoints dials a connection balanced among the addresses by round robin.
+// The name is the resolver scheme of the addresses.
+func dialEndpoints(name string, addresses []string) (*grpc.ClientConn, error) {
+	if len(addresses) == 1 {
+		return grpc.Dial(addresses[0], grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	r := manual.NewBuilderWithScheme(name)
+	state := resolver.State{}
+	for _, address := range addresses {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: address})
+	}
+	r.InitialState(state)
+	return grpc.Dial(r.Scheme()+":///endpoints",
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{"%s":{}}]}`, roundrobin.Name)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
 }
 
 func (s *ShardClientImpl) GetShardID() int {
 	return s.shardID
 }
+
+// Status returns the status of the member serving the request, like the db size of the shard.
+func (s *ShardClientImpl) Status(ctx context.Context) (*pb.StatusResponse, error) {
+	return pb.NewMaintenanceClient(s.conn).Status(ctx, &pb.StatusRequest{})
+}
+
+// Close closes the connections to all endpoints of the shard.
+func (s *ShardClientImpl) Close() error {
+	err := s.conn.Close()
+	for _, e := range append(s.readEndpoints, s.defaultEndpoints...) {
+		if closeErr := e.conn.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Range sends serializable ranges to read endpoints if any.
+func (s *ShardClientImpl) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	if in.Serializable && len(s.readEndpoints) > 0 {
+		if s.hedger != nil {
+			return s.hedger.Range(ctx, s.readEndpoints, in, opts...)
+		}
+		return s.readPicker.Pick(s.readEndpoints).Range(ctx, in, opts...)
+	}
+	if s.hedger != nil {
+		return s.hedger.Range(ctx, s.defaultEndpoints, in, opts...)
+	}
+	return s.EtcdGrpcClient.Range(ctx, in, opts...)
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// shardMapRetryInterval is how long to wait before reloading the shard map after its watch fails.
+	shardMapRetryInterval = time.Second
+	// shardMapMemberTTL is the TTL in seconds of the member keys of proxies.
+	shardMapMemberTTL = 10
+	// shardMapPollInterval is how often the epochs of members are checked while waiting for them.
+	shardMapPollInterval = 100 * time.Millisecond
+)
+
+// ErrShardMapChanged is returned by publishing a layout when the shard map
+// is changed by others since it's last seen.
+var ErrShardMapChanged = status.Error(codes.Aborted, "shard map changed")
+
+// ShardMap is the layout of shards stored in etcd, shared by all proxies.
+// It switches the sharding configs to every new version of the layout.
+// Each proxy registers itself under the members prefix of the shard map,
+// with the epoch it's switched to, so the proxy changing the layout can wait
+// for all proxies to switch before going on. A proxy only serves while it's a member.
+type ShardMap struct {
+	cli EtcdGrpcClient
+	key []byte
+	// conf is the configurations of the proxy, whose layout is replaced by the shard map
+	conf    *config.Configurations
+	builder *ShardingBuilder
+	configs *VersionedShardingConfigs
+	member  string
+	// memberTTL is the TTL in seconds of the member key
+	memberTTL int64
+	lg        *zap.Logger
+
+	// applyMu serializes apply
+	applyMu sync.Mutex
+
+	mu sync.Mutex
+	// layout is the last version seen, at modRevision of the key
+	layout      config.Layout
+	modRevision int64
+}
+
+// NewShardMap creates the shard map in the metadata etcd of the configurations.
+func NewShardMap(conf *config.Configurations, builder *ShardingBuilder) (*ShardMap, error) {
+	endpoints := conf.ShardMap.Endpoints
+	if len(endpoints) == 0 && len(conf.Shards) > 0 {
+		endpoints = conf.Shards[0].DefaultEndpoints()
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoint of shard map")
+	}
+	conn, err := dialEndpoints("metadata", endpoints)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial metadata etcd")
+	}
+	return newShardMap(newEtcdGrpcClient(conn), conf, builder), nil
+}
+
+func newShardMap(cli EtcdGrpcClient, conf *config.Configurations, builder *ShardingBuilder) *ShardMap {
+	hostname, _ := os.Hostname()
+	return &ShardMap{
+		cli:       cli,
+		key:       []byte(conf.ShardMap.Key),
+		conf:      conf,
+		builder:   builder,
+		member:    fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		memberTTL: shardMapMemberTTL,
+		lg:        zap.L().Named("ShardMap"),
+	}
+}
+
+// membersPrefix is the prefix of the member keys of proxies, whose values are their epochs.
+func (m *ShardMap) membersPrefix() []byte {
+	return append(append([]byte{}, m.key...), "/members/"...)
+}
+
+// Load loads the layout in the shard map, or publishes the layout of the configurations
+// as the first version if there's none. It returns the sharding configs switched by Run,
+// which is suspended until Run registers the proxy as a member.
+func (m *ShardMap) Load(ctx context.Context) (*VersionedShardingConfigs, error) {
+	resp, err := m.cli.Range(ctx, &pb.RangeRequest{Key: m.key})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load shard map")
+	}
+	if len(resp.Kvs) == 0 {
+		layout := m.conf.Layout(1)
+		value, err := json.Marshal(layout)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode layout")
+		}
+		txnResp, err := m.cli.Txn(ctx, &pb.TxnRequest{
+			Compare: []*pb.Compare{{Target: pb.Compare_CREATE, Key: m.key, Result: pb.Compare_EQUAL}},
+			Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: m.key, Value: value}}}},
+			Failure: []*pb.RequestOp{{Request: &pb.RequestOp_RequestRange{RequestRange: &pb.RangeRequest{Key: m.key}}}},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to publish the first shard map")
+		}
+		if txnResp.Succeeded {
+			m.lg.Info("published the first shard map", zap.ByteString("key", m.key))
+			resp = &pb.RangeResponse{Kvs: []*mvccpb.KeyValue{{Key: m.key, Value: value, ModRevision: txnResp.Header.Revision}}}
+		} else {
+			// published by another proxy at the same time
+			resp = txnResp.Responses[0].GetResponseRange()
+		}
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.New("shard map deleted while loading")
+	}
+	layout, err := m.decode(resp.Kvs[0])
+	if err != nil {
+		return nil, err
+	}
+	configs, err := m.builder.Build(m.conf.WithLayout(layout))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build layout at epoch %d", layout.Epoch)
+	}
+	m.configs = NewVersionedShardingConfigs(configs, layout.Epoch)
+	m.configs.Suspend(errors.New("not a member of the shard map yet"))
+	m.lg.Info("loaded shard map", zap.Int64("epoch", layout.Epoch))
+	return m.configs, nil
+}
+
+// decode decodes the layout in the kv, and records it as the last version seen.
+func (m *ShardMap) decode(kv *mvccpb.KeyValue) (config.Layout, error) {
+	var layout config.Layout
+	err := json.Unmarshal(kv.Value, &layout)
+	if err != nil {
+		return layout, errors.Wrapf(err, "bad shard map at revision %d", kv.ModRevision)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kv.ModRevision > m.modRevision {
+		m.layout, m.modRevision = layout, kv.ModRevision
+	}
+	return layout, nil
+}
+
+// Reload reads the shard map, for the processes not running Run to see the versions
+// published by others.
+func (m *ShardMap) Reload(ctx context.Context) error {
+	resp, err := m.cli.Range(ctx, &pb.RangeRequest{Key: m.key})
+	if err != nil {
+		return errors.Wrap(err, "failed to reload shard map")
+	}
+	for _, kv := range resp.Kvs {
+		_, err = m.decode(kv)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Layout returns the last version of the layout seen.
+func (m *ShardMap) Layout() config.Layout {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.layout
+}
+
+// Run watches the shard map and switches to its new versions until ctx is done.
+// It also keeps the member key of the proxy.
+func (m *ShardMap) Run(ctx context.Context) {
+	go m.runMember(ctx)
+	for {
+		err := m.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		m.lg.Warn("shard map watch failed, reloading", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(shardMapRetryInterval):
+		}
+	}
+}
+
+// sync reloads the shard map, then applies the watched versions until an error.
+func (m *ShardMap) sync(ctx context.Context) error {
+	resp, err := m.reapply(ctx)
+	if err != nil {
+		return err
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := m.cli.Watch(watchCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to watch")
+	}
+	err = stream.Send(&pb.WatchRequest{RequestUnion: &pb.WatchRequest_CreateRequest{CreateRequest: &pb.WatchCreateRequest{
+		Key:           m.key,
+		StartRevision: resp.Header.Revision + 1,
+	}}})
+	if err != nil {
+		return errors.Wrap(err, "failed to create watch")
+	}
+	for {
+		watchResp, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("watch closed")
+			}
+			return errors.Wrap(err, "failed to receive watch response")
+		}
+		if watchResp.CompactRevision > 0 {
+			return errors.Errorf("watch compacted at %d", watchResp.CompactRevision)
+		}
+		if watchResp.Canceled {
+			return errors.Errorf("watch canceled: %s", watchResp.CancelReason)
+		}
+		for _, ev := range watchResp.Events {
+			if ev.Type == mvccpb.PUT {
+				m.apply(ev.Kv)
+			}
+		}
+	}
+}
+
+// reapply reads the shard map and applies it.
+func (m *ShardMap) reapply(ctx context.Context) (*pb.RangeResponse, error) {
+	resp, err := m.cli.Range(ctx, &pb.RangeRequest{Key: m.key})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load")
+	}
+	for _, kv := range resp.Kvs {
+		m.apply(kv)
+	}
+	return resp, nil
+}
+
+// apply switches to the layout in the kv if it's newer.
+// A layout failed to build is skipped, so the proxy stays at the previous epoch,
+// and the change waiting for all proxies to switch fails.
+func (m *ShardMap) apply(kv *mvccpb.KeyValue) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	layout, err := m.decode(kv)
+	if err != nil {
+		m.lg.Error("failed to decode shard map", zap.Error(err))
+		return
+	}
+	current := m.configs.Current().Epoch
+	if layout.Epoch <= current {
+		return
+	}
+	prepared, err := m.builder.Prepare(m.conf.WithLayout(layout))
+	if err != nil {
+		m.lg.Error("failed to build shard map, stay at the current epoch", zap.Int64("epoch", layout.Epoch),
+			zap.Int64("current", current), zap.Error(err))
+		return
+	}
+	if !m.configs.Switch(prepared.Configs, layout.Epoch) {
+		prepared.Discard()
+		return
+	}
+	prepared.Commit()
+	m.lg.Info("switched to new shard map", zap.Int64("epoch", layout.Epoch), zap.Int64("previous", current))
+}
+
+// Publish stores the layout as the next version after the last one seen, and returns its epoch.
+// It fails with ErrShardMapChanged if the shard map is changed by others since then.
+func (m *ShardMap) Publish(ctx context.Context, layout config.Layout) (int64, error) {
+	m.mu.Lock()
+	layout.Epoch = m.layout.Epoch + 1
+	modRevision := m.modRevision
+	m.mu.Unlock()
+	value, err := json.Marshal(layout)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to encode layout")
+	}
+	resp, err := m.cli.Txn(ctx, &pb.TxnRequest{
+		Compare: []*pb.Compare{{
+			Target:      pb.Compare_MOD,
+			Key:         m.key,
+			Result:      pb.Compare_EQUAL,
+			TargetUnion: &pb.Compare_ModRevision{ModRevision: modRevision},
+		}},
+		Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: m.key, Value: value}}}},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to publish shard map")
+	}
+	if !resp.Succeeded {
+		return 0, ErrShardMapChanged
+	}
+	_, _ = m.decode(&mvccpb.KeyValue{Key: m.key, Value: value, ModRevision: resp.Header.Revision})
+	m.lg.Info("published shard map", zap.Int64("epoch", layout.Epoch))
+	return layout.Epoch, nil
+}
+
+// WaitEpoch waits until all proxies registered in the shard map are switched to the epoch or later.
+// The proxies not registered, like those whose member leases expired, are suspended, see keepMember.
+func (m *ShardMap) WaitEpoch(ctx context.Context, epoch int64) error {
+	prefix := m.membersPrefix()
+	ticker := time.NewTicker(shardMapPollInterval)
+	defer ticker.Stop()
+	for {
+		resp, err := m.cli.Range(ctx, &pb.RangeRequest{Key: prefix, RangeEnd: prefixEnd(prefix)})
+		if err != nil {
+			return errors.Wrap(err, "failed to read members of shard map")
+		}
+		var behind []string
+		for _, kv := range resp.Kvs {
+			memberEpoch, err := strconv.ParseInt(string(kv.Value), 10, 64)
+			if err != nil || memberEpoch < epoch {
+				behind = append(behind, string(kv.Key[len(prefix):]))
+			}
+		}
+		if len(behind) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			sort.Strings(behind)
+			return errors.Wrapf(ctx.Err(), "proxies %v not switched to epoch %d", behind, epoch)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *ShardMap) runMember(ctx context.Context) {
+	for {
+		err := m.keepMember(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		m.lg.Warn("failed to keep member of shard map, retrying", zap.String("member", m.member), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(shardMapRetryInterval):
+		}
+	}
+}
+
+// keepMember keeps the member key of the proxy with its epoch, under a lease revoked on exit.
+// Changes of the shard map only wait for members to switch, so the proxy serves only while
+// it's a member: it's suspended before its lease may expire without being kept alive, and on exit,
+// and it's resumed once registered & switched to the latest version, or kept alive again.
+func (m *ShardMap) keepMember(ctx context.Context) (err error) {
+	granted := time.Now()
+	lease, err := m.cli.LeaseGrant(ctx, &pb.LeaseGrantRequest{TTL: m.memberTTL})
+	if err != nil {
+		return errors.Wrap(err, "failed to grant lease")
+	}
+	suspend := time.AfterFunc(memberSuspendAfter(granted, lease.TTL), func() {
+		m.lg.Warn("member lease not kept alive in time, suspended", zap.String("member", m.member))
+		m.configs.Suspend(errors.New("member lease of the shard map not kept alive"))
+	})
+	defer func() {
+		suspend.Stop()
+		m.configs.Suspend(errors.Wrap(err, "not a member of the shard map"))
+		revokeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = m.cli.LeaseRevoke(revokeCtx, &pb.LeaseRevokeRequest{ID: lease.ID})
+	}()
+	keepAliveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := m.cli.LeaseKeepAlive(keepAliveCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to keep alive lease")
+	}
+	key := append(m.membersPrefix(), m.member...)
+	putMember := func(epoch int64) error {
+		_, err := m.cli.Put(ctx, &pb.PutRequest{Key: key, Value: []byte(strconv.FormatInt(epoch, 10)), Lease: lease.ID})
+		return errors.Wrap(err, "failed to put member")
+	}
+	// registered before reloading the shard map, so the versions published after it wait for the proxy
+	putEpoch := m.configs.Epoch()
+	err = putMember(putEpoch)
+	if err != nil {
+		return err
+	}
+	_, err = m.reapply(ctx)
+	if err != nil {
+		return err
+	}
+	resumed := false
+	ticker := time.NewTicker(time.Duration(m.memberTTL) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		changed := m.configs.Changed()
+		if epoch := m.configs.Epoch(); epoch != putEpoch {
+			err = putMember(epoch)
+			if err != nil {
+				return err
+			}
+			putEpoch = epoch
+		}
+		if !resumed {
+			m.configs.Resume()
+			resumed = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-ticker.C:
+			sent := time.Now()
+			err = stream.Send(&pb.LeaseKeepAliveRequest{ID: lease.ID})
+			if err != nil {
+				return errors.Wrap(err, "failed to send keep alive")
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				return errors.Wrap(err, "failed to receive keep alive")
+			}
+			if resp.TTL <= 0 {
+				return errors.New("lease expired")
+			}
+			suspend.Reset(memberSuspendAfter(sent, resp.TTL))
+			// resumed if suspended by the timer before
+			resumed = false
+		}
+	}
+}
+
+// memberSuspendAfter returns how long to suspend the proxy after, if its member lease
+// of the TTL is not kept alive since the time: at 4/5 of the TTL, before the lease may expire.
+func memberSuspendAfter(since time.Time, ttl int64) time.Duration {
+	return time.Until(since.Add(time.Duration(ttl) * time.Second * 4 / 5))
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func testConfigurations() *config.Configurations {
+	return &config.Configurations{
+		Shards: []config.Shard{
+			{End: "i", Address: "127.0.0.1:12379"},
+			{Start: "i", End: "s", Address: "127.0.0.1:22379"},
+			{Start: "s", Address: "127.0.0.1:32379"},
+		},
+		InternalPrefix: config.DefaultInternalPrefix,
+		ShardMap:       config.ShardMap{Key: config.DefaultInternalPrefix + config.DefaultShardMapKey},
+	}
+}
+
+func TestShardingBuilder_Build(t *testing.T) {
+	conf := testConfigurations()
+	builder := NewShardingBuilder()
+	configs, err := builder.Build(conf)
+	assert.NoError(t, err)
+
+	layout := conf.Layout(1)
+	layout.Shards = append([]config.Shard{}, layout.Shards...)
+	layout.Shards[1].End = "p"
+	layout.Shards[2].Start = "p"
+	layout.Shards[2].Address = "127.0.0.1:42379"
+	rebuilt, err := builder.Build(conf.WithLayout(layout))
+	assert.NoError(t, err)
+	assert.Same(t, configs.GetShardCli(0), rebuilt.GetShardCli(0))
+	assert.Same(t, configs.GetShardCli(1), rebuilt.GetShardCli(1))
+	assert.NotSame(t, configs.GetShardCli(2), rebuilt.GetShardCli(2))
+	assert.Equal(t, 2, rebuilt.GetShardClis([]byte("q"), nil)[0].GetShardID())
+}
+
+func TestShardMap_apply(t *testing.T) {
+	conf := testConfigurations()
+	builder := NewShardingBuilder()
+	configs, err := builder.Build(conf)
+	assert.NoError(t, err)
+	m := newShardMap(nil, conf, builder)
+	m.configs = NewVersionedShardingConfigs(configs, 1)
+	changed := m.configs.Changed()
+
+	layout := conf.Layout(2)
+	layout.Sharding.Strategy = ShardingStrategyHash
+	value, err := json.Marshal(layout)
+	assert.NoError(t, err)
+	m.apply(&mvccpb.KeyValue{Key: m.key, Value: value, ModRevision: 10})
+	assert.Equal(t, int64(2), m.configs.Current().Epoch)
+	assert.IsType(t, new(HashShardingConfigs), m.configs.Current().Configs)
+	assert.Equal(t, int64(2), m.Layout().Epoch)
+	<-changed
+
+	// stale versions are skipped
+	value, err = json.Marshal(conf.Layout(1))
+	assert.NoError(t, err)
+	m.apply(&mvccpb.KeyValue{Key: m.key, Value: value, ModRevision: 11})
+	assert.Equal(t, int64(2), m.configs.Current().Epoch)
+
+	// so are layouts failed to build
+	layout = conf.Layout(3)
+	layout.Sharding.Strategy = "unknown"
+	value, err = json.Marshal(layout)
+	assert.NoError(t, err)
+	m.apply(&mvccpb.KeyValue{Key: m.key, Value: value, ModRevision: 12})
+	assert.Equal(t, int64(2), m.configs.Current().Epoch)
+	assert.False(t, shardsInKeyOrder(m.configs))
+}
+
+func TestShardMap_WaitEpoch(t *testing.T) {
+	conf := testConfigurations()
+	builder := NewShardingBuilder()
+	configs, err := builder.Build(conf)
+	assert.NoError(t, err)
+	etcd := newMemEtcd(0)
+	m := newShardMap(etcd, conf, builder)
+	m.configs = NewVersionedShardingConfigs(configs, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.runMember(ctx)
+	member := string(append(m.membersPrefix(), m.member...))
+	assert.Eventually(t, func() bool { return string(etcd.get(member)) == "1" }, time.Second, 10*time.Millisecond)
+
+	// a write routed by epoch 1 is in flight across the switch
+	_, done := m.configs.BeginWrite()
+	switched := make(chan struct{})
+	go func() {
+		m.configs.Switch(configs, 2)
+		close(switched)
+	}()
+	waited := make(chan error, 1)
+	go func() {
+		waited <- m.WaitEpoch(ctx, 2)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("epoch 2 waited with a write of epoch 1 in flight")
+	case <-switched:
+		t.Fatal("switched with a write of the previous version in flight")
+	case <-time.After(3 * shardMapPollInterval):
+	}
+	assert.Equal(t, "1", string(etcd.get(member)))
+
+	done()
+	<-switched
+	select {
+	case err = <-waited:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("epoch 2 not waited after the write is done")
+	}
+}
+
+func TestShardingBuilder_Discard(t *testing.T) {
+	conf := testConfigurations()
+	builder := NewShardingBuilder()
+	configs, err := builder.Build(conf)
+	assert.NoError(t, err)
+
+	layout := conf.Layout(1)
+	layout.Shards = append([]config.Shard{}, layout.Shards...)
+	layout.Shards[2].Address = "127.0.0.1:42379"
+	prepared, err := builder.Prepare(conf.WithLayout(layout))
+	assert.NoError(t, err)
+	assert.NotSame(t, configs.GetShardCli(2), prepared.Configs.GetShardCli(2))
+	prepared.Discard()
+
+	// the clients in use are still reused
+	rebuilt, err := builder.Build(conf)
+	assert.NoError(t, err)
+	assert.Same(t, configs.GetShardCli(2), rebuilt.GetShardCli(2))
+}
+
+func TestShardMap_keepMember(t *testing.T) {
+	conf := testConfigurations()
+	etcd := newMemEtcd(0)
+	m := newShardMap(etcd, conf, NewShardingBuilder())
+	m.memberTTL = 1
+	configs, err := m.Load(context.Background())
+	assert.NoError(t, err)
+	assert.Error(t, configs.Current().Suspended())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.runMember(ctx)
+	assert.Eventually(t, func() bool { return configs.Current().Suspended() == nil }, time.Second, 10*time.Millisecond)
+
+	// a version published while the proxy isn't a member is loaded before it serves again
+	etcd.failOn("LeaseKeepAlive", errors.New("partitioned"))
+	assert.Eventually(t, func() bool { return configs.Current().Suspended() != nil }, 2*time.Second, 10*time.Millisecond)
+	member := string(append(m.membersPrefix(), m.member...))
+	assert.Nil(t, etcd.get(member))
+	layout := m.Layout()
+	layout.Sharding.Strategy = ShardingStrategyHash
+	_, err = m.Publish(ctx, layout)
+	assert.NoError(t, err)
+	etcd.failOn("LeaseKeepAlive", nil)
+	assert.Eventually(t, func() bool { return configs.Current().Suspended() == nil }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), configs.Current().Epoch)
+	assert.Equal(t, "2", string(etcd.get(member)))
+}
@@ -1,6 +1,12 @@
 package server
 
 import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
 )
 
@@ -17,20 +23,141 @@ type ShardingConfigs interface {
 	GetAllShardClis() []ShardClient
 }
 
+const (
+	// ShardingStrategyRange assigns a continuous key range to each shard
+	ShardingStrategyRange = "range"
+	// ShardingStrategyHash assigns keys to shards by the hash of keys
+	ShardingStrategyHash = "hash"
+	// ShardingStrategyHashTag assigns keys to shards by the hash of their hash tags
+	ShardingStrategyHashTag = "hash-tag"
+	// ShardingStrategyPrefix assigns keys to shards by a routing table of prefixes
+	ShardingStrategyPrefix = "prefix"
+	// ShardingStrategyConsistentHash assigns keys to shards by a consistent hash ring
+	ShardingStrategyConsistentHash = "consistent-hash"
+)
+
+// NewShardingConfigs creates the ShardingConfigs of the sharding strategy in conf.
+// The options are only supported by range sharding.
+func NewShardingConfigs(conf *config.Configurations, shards []Shard, opts ...ShardingOption) (ShardingConfigs, error) {
+	strategy := conf.Sharding.Strategy
+	if !isRangeSharding(strategy) && len(conf.ReplicatedPrefixes) > 0 {
+		return nil, errors.Errorf("replicated prefixes are not supported by %s sharding", strategy)
+	}
+	if !isRangeSharding(strategy) && len(opts) > 0 {
+		return nil, errors.Errorf("migrations are not supported by %s sharding", strategy)
+	}
+	for i, shard := range conf.Shards {
+		if shard.Retired && (!isRangeSharding(strategy) || i == 0) {
+			return nil, errors.Errorf("shard[%d] can't be retired in %s sharding", i, strategy)
+		}
+	}
+	switch strategy {
+	case "", ShardingStrategyRange:
+		opts = append([]ShardingOption{WithReplicatedPrefixes(conf.ReplicatedPrefixes...)}, opts...)
+		return NewDefaultShardingConfigs(shards, opts...), nil
+	case ShardingStrategyHash:
+		return NewHashShardingConfigs(shards), nil
+	case ShardingStrategyHashTag:
+		return NewHashTagShardingConfigs(shards, conf.Sharding.HashTagPattern)
+	case ShardingStrategyPrefix:
+		return NewPrefixShardingConfigs(shards, conf.Sharding.Routes, conf.Sharding.DefaultShard)
+	case ShardingStrategyConsistentHash:
+		ring, err := NewHashRing(conf.Shards, conf.Sharding.VirtualNodes)
+		if err != nil {
+			return nil, err
+		}
+		return NewRingShardingConfigs(shards, ring), nil
+	}
+	return nil, errors.Errorf("unknown sharding strategy [%s]", strategy)
+}
+
+func isRangeSharding(strategy string) bool {
+	return strategy == "" || strategy == ShardingStrategyRange
+}
+
 type DefaultShardingConfigs struct {
+	// shards are by shard id
 	shards []Shard
+	// ordered are the shards in key order, without retired shards
+	ordered []Shard
+	// migrations are the key ranges being moved, see MigratingSharding
+	migrations []RangeMigration
+	// replicated are the ranges of replicated prefixes, see ReplicatedSharding
+	replicated []KeyRange
+	// nextReadShard picks the shard to read replicated keys by round robin
+	nextReadShard uint64
 }
 
-func NewDefaultShardingConfigs(shards []Shard) *DefaultShardingConfigs {
-	return &DefaultShardingConfigs{
-		shards: shards,
+// ShardingOption is the option to create DefaultShardingConfigs
+type ShardingOption func(*DefaultShardingConfigs)
+
+func NewDefaultShardingConfigs(shards []Shard, opts ...ShardingOption) *DefaultShardingConfigs {
+	ret := &DefaultShardingConfigs{shards: shards}
+	for _, shard := range shards {
+		if !isRetired(shard) {
+			ret.ordered = append(ret.ordered, shard)
+		}
 	}
+	// shards split later are added after the others, so sort them by their key ranges
+	sort.SliceStable(ret.ordered, func(i, j int) bool {
+		a, aOK := ret.ordered[i].(interface{ KeyRange() (start, end []byte) })
+		b, bOK := ret.ordered[j].(interface{ KeyRange() (start, end []byte) })
+		if !aOK || !bOK {
+			return false
+		}
+		aStart, _ := a.KeyRange()
+		bStart, _ := b.KeyRange()
+		return bytes.Compare(aStart, bStart) < 0
+	})
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
 }
 
+// CutoverRevisionGetter is implemented by ShardingConfigs knowing the revisions of shards
+// when keys were last moved into them, see config.Shard.CutoverRevision.
+type CutoverRevisionGetter interface {
+	// GetCutoverRevision returns the revision of the shard when keys were last moved into it, 0 if none.
+	GetCutoverRevision(shard int) int64
+}
+
+func (d *DefaultShardingConfigs) GetCutoverRevision(shard int) int64 {
+	if shard < 0 || shard >= len(d.shards) {
+		return 0
+	}
+	if impl, ok := d.shards[shard].(*ShardImpl); ok {
+		return impl.cutoverRevision
+	}
+	return 0
+}
+
+// GetShardClis returns the shards of the range in key order.
+// A range in replicated prefixes is read from any single shard, and a range partly
+// in replicated prefixes is read from each shard within its own key range,
+// so is a range in a shard holding keys of a migration range it doesn't own.
 func (d *DefaultShardingConfigs) GetShardClis(key []byte, rangeEnd []byte) []ShardClient {
+	if len(d.replicated) > 0 {
+		parts, whole := d.ReplicatedRanges(key, rangeEnd)
+		if whole {
+			next := atomic.AddUint64(&d.nextReadShard, 1)
+			return []ShardClient{d.ordered[next%uint64(len(d.ordered))].GetClient()}
+		}
+		if len(parts) > 0 {
+			return d.GetPrimaryShardClis(key, rangeEnd)
+		}
+	}
+	if len(d.migrations) > 0 && len(rangeEnd) > 0 {
+		return d.clipNotOwned(d.shardClis(key, rangeEnd))
+	}
+	return d.shardClis(key, rangeEnd)
+}
+
+// shardClis returns the shards whose key ranges overlap the range, in key order.
+func (d *DefaultShardingConfigs) shardClis(key []byte, rangeEnd []byte) []ShardClient {
 	var ret = make([]ShardClient, 0, len(d.shards))
 	var findStart bool
-	for _, shard := range d.shards {
+	for _, shard := range d.ordered {
 		if shard.Contains(key, rangeEnd) {
 			ret = append(ret, shard.GetClient())
 			findStart = true
@@ -48,10 +175,30 @@ func (d *DefaultShardingConfigs) GetShardCli(shard int) ShardClient {
 	return d.shards[shard].GetClient()
 }
 
+// GetAllShardClis returns the shards by shard id, without retired shards.
 func (d *DefaultShardingConfigs) GetAllShardClis() []ShardClient {
 	var ret = make([]ShardClient, 0, len(d.shards))
 	for _, shard := range d.shards {
+		if isRetired(shard) {
+			continue
+		}
 		ret = append(ret, shard.GetClient())
 	}
 	return ret
 }
+
+// ShardRangeGetter is implemented by ShardingConfigs assigning a continuous key range to each shard
+type ShardRangeGetter interface {
+	// GetShardRange returns the key range of the shard, ok is false if unknown.
+	GetShardRange(shard int) (start, end []byte, ok bool)
+}
+
+// GetShardRange returns the key range of the shard if the shard knows it.
+func (d *DefaultShardingConfigs) GetShardRange(shard int) (start, end []byte, ok bool) {
+	ranged, ok := d.shards[shard].(interface{ KeyRange() (start, end []byte) })
+	if !ok {
+		return nil, nil, false
+	}
+	start, end = ranged.KeyRange()
+	return start, end, true
+}
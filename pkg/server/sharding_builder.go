@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"go.uber.org/zap"
+)
+
+// shardClientCloseDelay is how long the clients of removed or changed shards are kept
+// for the requests in flight after they're replaced.
+const shardClientCloseDelay = time.Minute
+
+// ShardingBuilder builds the ShardingConfigs of layouts.
+// The clients of shards unchanged since the last build are reused, so that switching
+// to a new layout keeps their connections, and the streams on them.
+type ShardingBuilder struct {
+	lg *zap.Logger
+
+	mu sync.Mutex
+	// clients are the clients of the last build, by shard id
+	clients map[int]builtShardClient
+}
+
+type builtShardClient struct {
+	// conf is the client part of the shard configuration
+	conf config.Shard
+	cli  *ShardClientImpl
+}
+
+func NewShardingBuilder() *ShardingBuilder {
+	return &ShardingBuilder{
+		lg:      zap.L().Named("ShardingBuilder"),
+		clients: make(map[int]builtShardClient),
+	}
+}
+
+// PreparedSharding is the ShardingConfigs created by ShardingBuilder.Prepare, which is committed
+// once switched to, or discarded if not.
+type PreparedSharding struct {
+	Configs ShardingConfigs
+	builder *ShardingBuilder
+	clients map[int]builtShardClient
+}
+
+// Build creates the ShardingConfigs of the configurations, and commits it at once.
+func (b *ShardingBuilder) Build(conf *config.Configurations) (ShardingConfigs, error) {
+	prepared, err := b.Prepare(conf)
+	if err != nil {
+		return nil, err
+	}
+	prepared.Commit()
+	return prepared.Configs, nil
+}
+
+// Prepare creates the ShardingConfigs of the configurations, reusing the clients of the last commit.
+func (b *ShardingBuilder) Prepare(conf *config.Configurations) (*PreparedSharding, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clients := make(map[int]builtShardClient, len(conf.Shards))
+	client := func(id int, shardConf config.Shard) (*ShardClientImpl, error) {
+		built, ok := b.clients[id]
+		if !ok || !reflect.DeepEqual(built.conf, clientConfig(shardConf)) {
+			cli, err := NewShardClientImpl(id, shardConf)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to create shard[%d] client to %v", id, shardConf.DefaultEndpoints())
+			}
+			built = builtShardClient{conf: clientConfig(shardConf), cli: cli}
+		}
+		clients[id] = built
+		return built.cli, nil
+	}
+
+	last := len(conf.Shards) - 1
+	if isRangeSharding(conf.Sharding.Strategy) {
+		last = lastShardInKeyOrder(conf.Shards)
+	}
+	shards := make([]Shard, len(conf.Shards))
+	for i, shardConf := range conf.Shards {
+		if shardConf.Retired {
+			// its client is closed like the ones of removed shards
+			shards[i] = retiredShard{}
+			continue
+		}
+		cli, err := client(i, shardConf)
+		if err != nil {
+			closeBuiltClients(clients, b.clients)
+			return nil, err
+		}
+		shards[i] = newShardImpl(i == 0, i == last, shardConf, cli)
+	}
+	var opts []ShardingOption
+	for _, m := range conf.Migrations {
+		var target ShardClient
+		switch {
+		case m.TargetShard != nil:
+			cli, err := client(m.Target, *m.TargetShard)
+			if err != nil {
+				closeBuiltClients(clients, b.clients)
+				return nil, err
+			}
+			target = cli
+		case m.Target >= 0 && m.Target < len(shards) && !isRetired(shards[m.Target]):
+			target = shards[m.Target].GetClient()
+		default:
+			closeBuiltClients(clients, b.clients)
+			return nil, errors.Errorf("unknown target shard[%d] of migration", m.Target)
+		}
+		opts = append(opts, WithMigrations(newRangeMigration(m, target)))
+	}
+	ret, err := NewShardingConfigs(conf, shards, opts...)
+	if err != nil {
+		closeBuiltClients(clients, b.clients)
+		return nil, err
+	}
+	return &PreparedSharding{Configs: ret, builder: b, clients: clients}, nil
+}
+
+// Commit makes the clients of the configs the ones reused by later builds,
+// and closes the clients replaced after a while.
+func (p *PreparedSharding) Commit() {
+	b := p.builder
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	replaced := b.clients
+	b.clients = p.clients
+	if len(replaced) > 0 {
+		time.AfterFunc(shardClientCloseDelay, func() {
+			closeBuiltClients(replaced, p.clients)
+		})
+	}
+}
+
+// Discard closes the clients created for the configs, which is not used.
+func (p *PreparedSharding) Discard() {
+	b := p.builder
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	closeBuiltClients(p.clients, b.clients)
+}
+
+// lastShardInKeyOrder returns the index of the shard with the greatest start key, whose end key is ignored.
+// The first shard is always shard 0, whose start key is ignored.
+// Shards split later are added after the others, so the last one in key order may not be the last in index.
+// Retired shards are skipped.
+func lastShardInKeyOrder(shards []config.Shard) int {
+	var ret int
+	for i := 1; i < len(shards); i++ {
+		if shards[i].Retired {
+			continue
+		}
+		if ret == 0 || bytes.Compare(shardStart(shards[i]), shardStart(shards[ret])) > 0 {
+			ret = i
+		}
+	}
+	return ret
+}
+
+func shardStart(conf config.Shard) []byte {
+	if len(conf.Start) > 0 {
+		return []byte(conf.Start)
+	}
+	return conf.StartBytes
+}
+
+// closeBuiltClients closes the clients not in keep.
+func closeBuiltClients(clients map[int]builtShardClient, keep map[int]builtShardClient) {
+	for id, built := range clients {
+		if kept, ok := keep[id]; ok && kept.cli == built.cli {
+			continue
+		}
+		_ = built.cli.Close()
+	}
+}
+
+// clientConfig returns the part of the shard configuration used by its client.
+func clientConfig(conf config.Shard) config.Shard {
+	return config.Shard{
+		Address:         conf.Address,
+		Endpoints:       conf.Endpoints,
+		ReadEndpoints:   conf.ReadEndpoints,
+		ReadBalancer:    conf.ReadBalancer,
+		HedgePercentile: conf.HedgePercentile,
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"hash/fnv"
+)
+
+// HashShardingConfigs routes keys to shards by the hash of keys,
+// so that keys written in order, like timestamps, are spread among all shards.
+// A range may have keys in any shard, so it's sent to all shards.
+type HashShardingConfigs struct {
+	shards []Shard
+}
+
+func NewHashShardingConfigs(shards []Shard) *HashShardingConfigs {
+	return &HashShardingConfigs{
+		shards: shards,
+	}
+}
+
+// GetShardClis returns the shard of the key by hash, or all shards for a range.
+func (h *HashShardingConfigs) GetShardClis(key []byte, rangeEnd []byte) []ShardClient {
+	if len(rangeEnd) == 0 {
+		return []ShardClient{h.shards[hashShard(key, len(h.shards))].GetClient()}
+	}
+	return h.GetAllShardClis()
+}
+
+func (h *HashShardingConfigs) GetShardCli(shard int) ShardClient {
+	return h.shards[shard].GetClient()
+}
+
+func (h *HashShardingConfigs) GetAllShardClis() []ShardClient {
+	var ret = make([]ShardClient, 0, len(h.shards))
+	for _, shard := range h.shards {
+		ret = append(ret, shard.GetClient())
+	}
+	return ret
+}
+
+// hashShard returns the shard of the key among n shards.
+func hashShard(key []byte, n int) int {
+	return int(keyHash(key) % uint64(n))
+}
+
+// keyHash is the FNV-1a hash of the key
+func keyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64()
+}
+
+// shardsInKeyOrder returns true if each shard of configs owns a continuous key range,
+// in which case the shards of a range are in key order, and can be read one by one.
+func shardsInKeyOrder(configs ShardingConfigs) bool {
+	_, ok := currentShardingConfigs(configs).(ShardRangeGetter)
+	return ok
+}
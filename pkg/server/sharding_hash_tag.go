@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// HashTagShardingConfigs routes keys by the hash of their hash tags like Redis,
+// so that the keys of one entity, e.g. "user:{42}:name" & "user:{42}:email", are in the same shard
+// and txns over them stay in one shard. Keys without tag are routed by the hash of the whole key.
+// The tag is the text between the first "{" and the next "}", or the first capture group of a pattern.
+type HashTagShardingConfigs struct {
+	*HashShardingConfigs
+	// pattern extracts the tag by its first capture group, nil for braces
+	pattern *regexp.Regexp
+}
+
+// NewHashTagShardingConfigs creates a HashTagShardingConfigs, tags are in braces if pattern is empty.
+func NewHashTagShardingConfigs(shards []Shard, pattern string) (*HashTagShardingConfigs, error) {
+	ret := &HashTagShardingConfigs{HashShardingConfigs: NewHashShardingConfigs(shards)}
+	if len(pattern) > 0 {
+		var err error
+		ret.pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad hash tag pattern [%s]", pattern)
+		}
+		if ret.pattern.NumSubexp() < 1 {
+			return nil, errors.Errorf("hash tag pattern [%s] has no capture group", pattern)
+		}
+	}
+	return ret, nil
+}
+
+// GetShardClis returns the shard of the key by its tag.
+// A range is in one shard if all keys in it have the same tag, e.g. the prefix "user:{42}:",
+// otherwise it's sent to all shards.
+func (h *HashTagShardingConfigs) GetShardClis(key []byte, rangeEnd []byte) []ShardClient {
+	if len(rangeEnd) == 0 {
+		return []ShardClient{h.shards[hashShard(h.hashKey(key), len(h.shards))].GetClient()}
+	}
+	// all keys in the range start with the common prefix of key & range end,
+	// so they share the tag if the prefix has a whole tag in braces.
+	if h.pattern == nil && !bytes.Equal(rangeEnd, noEnd) {
+		if tag := braceTag(commonPrefix(key, rangeEnd)); tag != nil {
+			return []ShardClient{h.shards[hashShard(tag, len(h.shards))].GetClient()}
+		}
+	}
+	return h.GetAllShardClis()
+}
+
+// hashKey returns the part of the key to hash: the tag if any, or the whole key.
+func (h *HashTagShardingConfigs) hashKey(key []byte) []byte {
+	var tag []byte
+	if h.pattern == nil {
+		tag = braceTag(key)
+	} else if match := h.pattern.FindSubmatch(key); match != nil && len(match[1]) > 0 {
+		tag = match[1]
+	}
+	if tag == nil {
+		return key
+	}
+	return tag
+}
+
+// braceTag returns the text between the first "{" and the next "}", nil if none or empty.
+func braceTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return nil
+	}
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return nil
+	}
+	return key[start+1 : start+1+end]
+}
+
+func commonPrefix(a, b []byte) []byte {
+	var i int
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return a[:i]
+}
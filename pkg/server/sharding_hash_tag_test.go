@@ -0,0 +1,38 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+func TestHashTagShardingConfigs_GetShardClis(t *testing.T) {
+	shards := newFakeShardingConfigs(nil, nil, nil).shards
+	shardOf := func(configs ShardingConfigs, key string) int {
+		return configs.GetShardClis([]byte(key), nil)[0].GetShardID()
+	}
+
+	braces, err := NewHashTagShardingConfigs(shards, "")
+	assert.NoError(t, err)
+	assert.Equal(t, hashShard([]byte("42"), 3), shardOf(braces, "user:{42}:name"))
+	assert.Equal(t, hashShard([]byte("42"), 3), shardOf(braces, "user:{42}:email"))
+	assert.Equal(t, hashShard([]byte("user:{}:name"), 3), shardOf(braces, "user:{}:name"))
+	assert.Len(t, braces.GetShardClis([]byte("user:{42}:"), prefixEnd([]byte("user:{42}:"))), 1)
+	assert.Len(t, braces.GetShardClis([]byte("user:{4"), prefixEnd([]byte("user:{4"))), 3)
+
+	validator := NewTxnValidator(braces)
+	_, err = validator.Validate(&pb.TxnRequest{
+		Compare: []*pb.Compare{cmpExists([]byte("user:{42}:name"))},
+		Success: []*pb.RequestOp{opPut([]byte("user:{42}:email"), nil), opDelete([]byte("order:{42}:1"))},
+	})
+	assert.NoError(t, err)
+
+	pattern, err := NewHashTagShardingConfigs(shards, "^/tenants/([^/]+)/")
+	assert.NoError(t, err)
+	assert.Equal(t, hashShard([]byte("acme"), 3), shardOf(pattern, "/tenants/acme/users/1"))
+	assert.Equal(t, hashShard([]byte("/other"), 3), shardOf(pattern, "/other"))
+
+	_, err = NewHashTagShardingConfigs(shards, "^/tenants/")
+	assert.Error(t, err)
+}
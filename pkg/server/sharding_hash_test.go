@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+func TestHashShardingConfigs_GetShardClis(t *testing.T) {
+	configs := NewHashShardingConfigs(newFakeShardingConfigs(nil, nil, nil).shards)
+	clis := configs.GetShardClis([]byte("a"), nil)
+	assert.Len(t, clis, 1)
+	assert.Equal(t, hashShard([]byte("a"), 3), clis[0].GetShardID())
+	assert.Len(t, configs.GetShardClis([]byte("a"), []byte("b")), 3)
+	assert.False(t, shardsInKeyOrder(configs))
+}
+
+func TestKVProxy_rangeHashSharding(t *testing.T) {
+	configs := NewHashShardingConfigs(newFakeShardingConfigs([]string{"b", "y"}, []string{"a", "j"}, []string{"c", "x"}).shards)
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	req := &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd, Limit: 4}
+
+	resp, err := proxy.Range(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "j"}, kvKeys(resp.Kvs))
+	assert.True(t, resp.More)
+
+	ctx := context.Background()
+	shardClis := configs.GetShardClis(req.Key, req.RangeEnd)
+	cursor, err := proxy.openRangeCursor(ctx, req, shardClis, "")
+	assert.NoError(t, err)
+	var pages [][]string
+	for len(pages) < 5 {
+		resp, err := proxy.rangePage(ctx, req, shardClis, cursor)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6), resp.Count)
+		pages = append(pages, kvKeys(resp.Kvs))
+		if !resp.More {
+			break
+		}
+	}
+	assert.Equal(t, [][]string{{"a", "b", "c", "j"}, {"x", "y"}}, pages)
+}
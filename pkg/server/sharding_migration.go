@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+)
+
+// RangeMigration is a key range being moved from a shard to another, see config.Migration
+type RangeMigration struct {
+	KeyRange
+	ID     string
+	Source int
+	// Target is the client of the target shard, which may not be in the sharding configs yet
+	Target ShardClient
+	State  string
+	// ShadowRead is true if the reads in config.MigrationDualWrite are shadow-read from the target
+	ShadowRead bool
+}
+
+// MigratingSharding is implemented by ShardingConfigs moving key ranges between shards
+type MigratingSharding interface {
+	// GetMigrations returns the migrations of the key ranges overlapping the range.
+	GetMigrations(key, rangeEnd []byte) []RangeMigration
+}
+
+// rangeMigrations returns the migrations overlapping the range if configs has any.
+func rangeMigrations(configs ShardingConfigs, key, rangeEnd []byte) []RangeMigration {
+	migrating, ok := currentShardingConfigs(configs).(MigratingSharding)
+	if !ok {
+		return nil
+	}
+	return migrating.GetMigrations(key, rangeEnd)
+}
+
+// WithMigrations sets the key ranges being moved between shards.
+func WithMigrations(migrations ...RangeMigration) ShardingOption {
+	return func(d *DefaultShardingConfigs) {
+		d.migrations = append(d.migrations, migrations...)
+	}
+}
+
+// newRangeMigration returns the migration of the configuration with the client of its target.
+func newRangeMigration(conf config.Migration, target ShardClient) RangeMigration {
+	return RangeMigration{
+		KeyRange:   KeyRange{Key: conf.Start, RangeEnd: conf.End},
+		ID:         conf.ID,
+		Source:     conf.Source,
+		Target:     target,
+		State:      conf.State,
+		ShadowRead: conf.ShadowRead,
+	}
+}
+
+func (d *DefaultShardingConfigs) GetMigrations(key, rangeEnd []byte) []RangeMigration {
+	var ret []RangeMigration
+	for _, m := range d.migrations {
+		if m.overlaps(key, rangeEnd) {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// overlaps returns true if the key, or the range if rangeEnd is given, overlaps the migration.
+func (m RangeMigration) overlaps(key, rangeEnd []byte) bool {
+	if len(rangeEnd) == 0 {
+		return bytes.Compare(key, m.Key) >= 0 && rangeEndBefore(key, m.RangeEnd)
+	}
+	_, ok := intersectRange(KeyRange{Key: key, RangeEnd: rangeEnd}, m.KeyRange)
+	return ok
+}
+
+// notOwnedBy returns true if the shard holds keys of the migration range it doesn't own:
+// the source after the range is moved, or the target before.
+func (m RangeMigration) notOwnedBy(shardID int) bool {
+	if m.State == config.MigrationCleanup {
+		return m.Source == shardID
+	}
+	return m.Target.GetShardID() == shardID
+}
+
+// clipNotOwned clips the shards holding keys of migration ranges they don't own
+// to their own key ranges, so that those keys are not read or deleted.
+func (d *DefaultShardingConfigs) clipNotOwned(clis []ShardClient) []ShardClient {
+	for _, m := range d.migrations {
+		for i, cli := range clis {
+			if !m.notOwnedBy(cli.GetShardID()) {
+				continue
+			}
+			if start, end, ok := d.GetShardRange(cli.GetShardID()); ok {
+				clis[i] = &clippedShardClient{ShardClient: cli, keyRange: KeyRange{Key: start, RangeEnd: end}}
+			}
+		}
+	}
+	return clis
+}
+
+// fencedMigration returns a migration in MigrationFenced overlapping the range, ok is false if none.
+func fencedMigration(configs ShardingConfigs, key, rangeEnd []byte) (ret RangeMigration, ok bool) {
+	for _, m := range rangeMigrations(configs, key, rangeEnd) {
+		if m.State == config.MigrationFenced {
+			return m, true
+		}
+	}
+	return ret, false
+}
+
+// dualWriteMigrations returns the migrations in config.MigrationDualWrite overlapping the range.
+func dualWriteMigrations(configs ShardingConfigs, key, rangeEnd []byte) []RangeMigration {
+	var ret []RangeMigration
+	for _, m := range rangeMigrations(configs, key, rangeEnd) {
+		if m.State == config.MigrationDualWrite {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
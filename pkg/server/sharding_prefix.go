@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+)
+
+// PrefixShardingConfigs routes keys to shards by a routing table of prefixes.
+// A key belongs to the shard of the longest prefix it matches, or the default shard.
+// Unlike key ranges, any prefix may map to any shard.
+type PrefixShardingConfigs struct {
+	shards []Shard
+	// routes are sorted by the length of prefixes, longest first
+	routes       []prefixRoute
+	defaultShard int
+}
+
+type prefixRoute struct {
+	keyRange KeyRange
+	shard    int
+}
+
+func NewPrefixShardingConfigs(shards []Shard, routes []config.Route, defaultShard int) (*PrefixShardingConfigs, error) {
+	if defaultShard < 0 || defaultShard >= len(shards) {
+		return nil, errors.Errorf("default shard [%d] out of range", defaultShard)
+	}
+	ret := &PrefixShardingConfigs{
+		shards:       shards,
+		defaultShard: defaultShard,
+	}
+	seen := make(map[string]struct{}, len(routes))
+	for _, route := range routes {
+		if route.Shard < 0 || route.Shard >= len(shards) {
+			return nil, errors.Errorf("shard [%d] of prefix [%s] out of range", route.Shard, route.Prefix)
+		}
+		if len(route.Prefix) == 0 {
+			return nil, errors.New("empty prefix in routes, use the default shard instead")
+		}
+		if _, ok := seen[route.Prefix]; ok {
+			return nil, errors.Errorf("duplicated prefix [%s] in routes", route.Prefix)
+		}
+		seen[route.Prefix] = struct{}{}
+		ret.routes = append(ret.routes, prefixRoute{
+			keyRange: KeyRange{Key: []byte(route.Prefix), RangeEnd: prefixEnd([]byte(route.Prefix))},
+			shard:    route.Shard,
+		})
+	}
+	sort.SliceStable(ret.routes, func(i, j int) bool {
+		return len(ret.routes[i].keyRange.Key) > len(ret.routes[j].keyRange.Key)
+	})
+	return ret, nil
+}
+
+// GetShardClis returns the shard of the longest matching prefix of the key.
+// A range is sent to the shard owning the range as a whole, and the shards of
+// the prefixes inside or crossing the range, in the order of shard ids.
+func (p *PrefixShardingConfigs) GetShardClis(key []byte, rangeEnd []byte) []ShardClient {
+	if len(rangeEnd) == 0 {
+		return []ShardClient{p.shards[p.matchShard(key)].GetClient()}
+	}
+	r := KeyRange{Key: key, RangeEnd: rangeEnd}
+	set := make(map[int]struct{})
+	owner := p.defaultShard
+	var ownerFound bool
+	for _, route := range p.routes {
+		if _, ok := intersectRange(r, route.keyRange); !ok {
+			continue
+		}
+		if bytes.Compare(key, route.keyRange.Key) >= 0 && !rangeEndBefore(route.keyRange.RangeEnd, rangeEnd) {
+			// the route contains the whole range, only the longest one owns it
+			if !ownerFound {
+				owner, ownerFound = route.shard, true
+			}
+			continue
+		}
+		set[route.shard] = struct{}{}
+	}
+	set[owner] = struct{}{}
+	ids := make([]int, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	ret := make([]ShardClient, len(ids))
+	for i, id := range ids {
+		ret[i] = p.shards[id].GetClient()
+	}
+	return ret
+}
+
+// matchShard returns the shard of the longest prefix the key matches.
+func (p *PrefixShardingConfigs) matchShard(key []byte) int {
+	for _, route := range p.routes {
+		if bytes.HasPrefix(key, route.keyRange.Key) {
+			return route.shard
+		}
+	}
+	return p.defaultShard
+}
+
+func (p *PrefixShardingConfigs) GetShardCli(shard int) ShardClient {
+	return p.shards[shard].GetClient()
+}
+
+func (p *PrefixShardingConfigs) GetAllShardClis() []ShardClient {
+	var ret = make([]ShardClient, 0, len(p.shards))
+	for _, shard := range p.shards {
+		ret = append(ret, shard.GetClient())
+	}
+	return ret
+}
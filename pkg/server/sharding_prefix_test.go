@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixShardingConfigs_GetShardClis(t *testing.T) {
+	shards := newFakeShardingConfigs(nil, nil, nil).shards
+	configs, err := NewPrefixShardingConfigs(shards, []config.Route{
+		{Prefix: "/registry/", Shard: 1},
+		{Prefix: "/registry/pods/", Shard: 2},
+		{Prefix: "/tenant-a/", Shard: 2},
+	}, 0)
+	assert.NoError(t, err)
+	shardIDs := func(key, rangeEnd string) []int {
+		var end []byte
+		if len(rangeEnd) > 0 {
+			end = []byte(rangeEnd)
+		}
+		var ret []int
+		for _, cli := range configs.GetShardClis([]byte(key), end) {
+			ret = append(ret, cli.GetShardID())
+		}
+		return ret
+	}
+
+	assert.Equal(t, []int{2}, shardIDs("/registry/pods/a", ""))
+	assert.Equal(t, []int{1}, shardIDs("/registry/services/a", ""))
+	assert.Equal(t, []int{0}, shardIDs("/other", ""))
+
+	assert.Equal(t, []int{2}, shardIDs("/registry/pods/", "/registry/pods0"))
+	assert.Equal(t, []int{1}, shardIDs("/registry/services/", "/registry/services0"))
+	assert.Equal(t, []int{1, 2}, shardIDs("/registry/", "/registry0"))
+	assert.Equal(t, []int{0, 1, 2}, shardIDs("/", "/z"))
+	assert.Equal(t, []int{0}, shardIDs("/a", "/b"))
+
+	_, err = NewPrefixShardingConfigs(shards, []config.Route{{Prefix: "/a/", Shard: 3}}, 0)
+	assert.Error(t, err)
+}
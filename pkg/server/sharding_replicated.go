@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+// KeyRange is a range of keys like the key & range end of etcd requests.
+// RangeEnd is empty for a single key, noEnd for all keys from Key.
+type KeyRange struct {
+	Key      []byte
+	RangeEnd []byte
+}
+
+// ReplicatedSharding is implemented by ShardingConfigs with replicated prefixes,
+// whose keys are stored in every shard. The copies in the shards owning the keys
+// by the sharding rules are the primary copies, others are replicas.
+type ReplicatedSharding interface {
+	// ReplicatedRanges returns the parts of the range in replicated prefixes,
+	// whole is true if the whole range is in a replicated prefix.
+	ReplicatedRanges(key, rangeEnd []byte) (parts []KeyRange, whole bool)
+	// GetPrimaryShardClis returns the shards holding the primary copies of the range,
+	// whose ranges & delete ranges are clipped to their own key ranges.
+	GetPrimaryShardClis(key, rangeEnd []byte) []ShardClient
+}
+
+// replicatedRanges returns the replicated parts of the range if configs has replicated prefixes.
+func replicatedRanges(configs ShardingConfigs, key, rangeEnd []byte) (parts []KeyRange, whole bool) {
+	replicated, ok := currentShardingConfigs(configs).(ReplicatedSharding)
+	if !ok {
+		return nil, false
+	}
+	return replicated.ReplicatedRanges(key, rangeEnd)
+}
+
+// WithReplicatedPrefixes makes the keys with the prefixes stored in every shard.
+func WithReplicatedPrefixes(prefixes ...string) ShardingOption {
+	return func(d *DefaultShardingConfigs) {
+		for _, prefix := range prefixes {
+			d.replicated = append(d.replicated, KeyRange{Key: []byte(prefix), RangeEnd: prefixEnd([]byte(prefix))})
+		}
+	}
+}
+
+func (d *DefaultShardingConfigs) ReplicatedRanges(key, rangeEnd []byte) (parts []KeyRange, whole bool) {
+	for _, r := range d.replicated {
+		if len(rangeEnd) == 0 {
+			if bytes.Compare(key, r.Key) >= 0 && rangeEndBefore(key, r.RangeEnd) {
+				return []KeyRange{{Key: key}}, true
+			}
+			continue
+		}
+		part, ok := intersectRange(KeyRange{Key: key, RangeEnd: rangeEnd}, r)
+		if !ok {
+			continue
+		}
+		if bytes.Equal(part.Key, key) && bytes.Equal(part.RangeEnd, rangeEnd) {
+			return []KeyRange{part}, true
+		}
+		parts = append(parts, part)
+	}
+	return parts, false
+}
+
+func (d *DefaultShardingConfigs) GetPrimaryShardClis(key, rangeEnd []byte) []ShardClient {
+	ret := d.shardClis(key, rangeEnd)
+	if len(rangeEnd) == 0 {
+		return ret
+	}
+	for i, cli := range ret {
+		start, end, ok := d.GetShardRange(cli.GetShardID())
+		if ok {
+			ret[i] = &clippedShardClient{ShardClient: cli, keyRange: KeyRange{Key: start, RangeEnd: end}}
+		}
+	}
+	return ret
+}
+
+// clippedShardClient clips ranges & delete ranges to the key range of its shard,
+// so that the replicas of keys of other shards are not touched.
+type clippedShardClient struct {
+	ShardClient
+	keyRange KeyRange
+}
+
+func (c *clippedShardClient) clip(key, rangeEnd []byte) (clippedKey, clippedEnd []byte) {
+	if len(rangeEnd) == 0 {
+		return key, rangeEnd
+	}
+	clipped, ok := intersectRange(KeyRange{Key: key, RangeEnd: rangeEnd}, c.keyRange)
+	if !ok {
+		// an empty range
+		return key, key
+	}
+	return clipped.Key, clipped.RangeEnd
+}
+
+func (c *clippedShardClient) Range(ctx context.Context, in *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	req := *in
+	req.Key, req.RangeEnd = c.clip(in.Key, in.RangeEnd)
+	return c.ShardClient.Range(ctx, &req, opts...)
+}
+
+func (c *clippedShardClient) DeleteRange(ctx context.Context, in *pb.DeleteRangeRequest, opts ...grpc.CallOption) (*pb.DeleteRangeResponse, error) {
+	req := *in
+	req.Key, req.RangeEnd = c.clip(in.Key, in.RangeEnd)
+	return c.ShardClient.DeleteRange(ctx, &req, opts...)
+}
+
+// rangeEndBefore returns true if key or range end a is before range end b, noEnd is after all keys.
+func rangeEndBefore(a, b []byte) bool {
+	if bytes.Equal(b, noEnd) {
+		return !bytes.Equal(a, noEnd)
+	}
+	if bytes.Equal(a, noEnd) {
+		return false
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// intersectRange returns the intersection of two ranges, ok is false if they don't overlap.
+// Both ranges must have range ends.
+func intersectRange(a, b KeyRange) (ret KeyRange, ok bool) {
+	ret.Key = a.Key
+	if bytes.Compare(b.Key, a.Key) > 0 {
+		ret.Key = b.Key
+	}
+	ret.RangeEnd = a.RangeEnd
+	if rangeEndBefore(b.RangeEnd, a.RangeEnd) {
+		ret.RangeEnd = b.RangeEnd
+	}
+	if !rangeEndBefore(ret.Key, ret.RangeEnd) {
+		return KeyRange{}, false
+	}
+	return ret, true
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+func TestDefaultShardingConfigs_ReplicatedRanges(t *testing.T) {
+	// replicas of m/x are in every shard, its primary copy is in shard 1
+	configs := newFakeShardingConfigs([]string{"a", "m/x"}, []string{"j", "m/x"}, []string{"m/x", "x"})
+	WithReplicatedPrefixes("m/")(configs)
+
+	parts, whole := configs.ReplicatedRanges([]byte("m/x"), nil)
+	assert.True(t, whole)
+	assert.Equal(t, []KeyRange{{Key: []byte("m/x")}}, parts)
+	parts, whole = configs.ReplicatedRanges([]byte("a"), noEnd)
+	assert.False(t, whole)
+	assert.Equal(t, []KeyRange{{Key: []byte("m/"), RangeEnd: []byte("m0")}}, parts)
+	parts, _ = configs.ReplicatedRanges([]byte("a"), []byte("b"))
+	assert.Empty(t, parts)
+
+	assert.Len(t, configs.GetShardClis([]byte("m/"), []byte("m0")), 1)
+
+	proxy := NewKVProxy(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter))
+	resp, err := proxy.Range(context.Background(), &pb.RangeRequest{Key: []byte("a"), RangeEnd: noEnd})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "j", "m/x", "x"}, kvKeys(resp.Kvs))
+	assert.Equal(t, int64(4), resp.Count)
+
+	primary := configs.GetPrimaryShardClis([]byte("m/x"), nil)
+	assert.Equal(t, 1, primary[0].GetShardID())
+}
+
+func TestTxnValidator_replicated(t *testing.T) {
+	configs := newFakeShardingConfigs([]string{}, []string{}, []string{})
+	WithReplicatedPrefixes("m/")(configs)
+	validator := NewTxnValidator(configs)
+
+	shardID, err := validator.Validate(&pb.TxnRequest{
+		Compare: []*pb.Compare{cmpExists([]byte("m/flag"))},
+		Success: []*pb.RequestOp{opPut([]byte("x"), nil)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, shardID)
+
+	_, err = validator.Validate(&pb.TxnRequest{
+		Success: []*pb.RequestOp{opPut([]byte("m/flag"), nil)},
+	})
+	assert.ErrorIs(t, err, ErrTxnDifferentShard)
+}
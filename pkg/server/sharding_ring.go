@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+)
+
+// DefaultVirtualNodes is the default number of virtual nodes of a shard with weight 1
+const DefaultVirtualNodes = 100
+
+// HashRing is a consistent hash ring of shards with virtual nodes.
+// A key belongs to the first virtual node at or after the hash of the key on the ring.
+// Virtual nodes are placed by the names of shards, so adding or removing a shard
+// only moves the keys of its own virtual nodes, about 1/N of all keys.
+type HashRing struct {
+	// points are sorted by hash
+	points []ringPoint
+	names  []string
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+}
+
+// NewHashRing creates the ring of the shards. The name of a shard is its Name, or its first endpoint.
+// A shard has virtualNodes * Weight virtual nodes, Weight is 1 if not set.
+func NewHashRing(shards []config.Shard, virtualNodes int) (*HashRing, error) {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	ret := &HashRing{names: make([]string, len(shards))}
+	seen := make(map[string]struct{}, len(shards))
+	for i, shard := range shards {
+		name := ringName(shard)
+		if len(name) == 0 {
+			return nil, errors.Errorf("shard[%d] has no name", i)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, errors.Errorf("duplicated shard name [%s]", name)
+		}
+		seen[name] = struct{}{}
+		ret.names[i] = name
+
+		weight := shard.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if weight < 0 {
+			return nil, errors.Errorf("negative weight of shard [%s]", name)
+		}
+		nodes := int(math.Round(float64(virtualNodes) * weight))
+		if nodes < 1 {
+			nodes = 1
+		}
+		for v := 0; v < nodes; v++ {
+			ret.points = append(ret.points, ringPoint{hash: ringHash([]byte(fmt.Sprintf("%s#%d", name, v))), shard: i})
+		}
+	}
+	if len(ret.points) == 0 {
+		return nil, errors.New("no shard")
+	}
+	sort.Slice(ret.points, func(i, j int) bool {
+		a, b := ret.points[i], ret.points[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		return ret.names[a.shard] < ret.names[b.shard]
+	})
+	return ret, nil
+}
+
+func ringName(shard config.Shard) string {
+	if len(shard.Name) > 0 {
+		return shard.Name
+	}
+	if endpoints := shard.DefaultEndpoints(); len(endpoints) > 0 {
+		return endpoints[0]
+	}
+	return ""
+}
+
+// locate returns the shard of the first virtual node at or after the hash.
+func (r *HashRing) locate(hash uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// Shard returns the index of the shard of the key.
+func (r *HashRing) Shard(key []byte) int {
+	return r.locate(ringHash(key))
+}
+
+// ringHash is the position of the key on the ring.
+// FNV-1a barely changes the high bits for short keys differing in the last bytes,
+// like the names of virtual nodes, so it's mixed by the finalizer of MurmurHash3.
+func ringHash(key []byte) uint64 {
+	h := keyHash(key)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// RingMove is the range of ring hashes (Start, End] of keys moved from one shard to another
+// when the ring changes. The range wraps around zero if Start >= End.
+type RingMove struct {
+	Start uint64
+	End   uint64
+	From  string
+	To    string
+}
+
+// Fraction returns the fraction of the hash space of the move.
+func (m RingMove) Fraction() float64 {
+	if m.Start == m.End {
+		// the whole ring
+		return 1
+	}
+	return float64(m.End-m.Start) / math.Exp2(64)
+}
+
+func (m RingMove) String() string {
+	return fmt.Sprintf("(%016x, %016x] %s -> %s (%.4f%%)", m.Start, m.End, m.From, m.To, m.Fraction()*100)
+}
+
+// DiffHashRings returns the ranges of hashes whose shards change from ring a to ring b.
+// Shards are identified by names, so the moves are the same even if shards are reordered.
+func DiffHashRings(a, b *HashRing) []RingMove {
+	bounds := make([]uint64, 0, len(a.points)+len(b.points))
+	for _, p := range a.points {
+		bounds = append(bounds, p.hash)
+	}
+	for _, p := range b.points {
+		bounds = append(bounds, p.hash)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	var ret []RingMove
+	for i, end := range bounds {
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		if start == end && len(bounds) > 1 && i > 0 {
+			// duplicated bound, empty range
+			continue
+		}
+		from, to := a.names[a.locate(end)], b.names[b.locate(end)]
+		if from == to {
+			continue
+		}
+		if n := len(ret); n > 0 && ret[n-1].End == start && ret[n-1].From == from && ret[n-1].To == to {
+			ret[n-1].End = end
+			continue
+		}
+		ret = append(ret, RingMove{Start: start, End: end, From: from, To: to})
+	}
+	// the first range may continue the last one around zero
+	if n := len(ret); n > 1 && ret[n-1].End == ret[0].Start && ret[n-1].From == ret[0].From && ret[n-1].To == ret[0].To {
+		ret[0].Start = ret[n-1].Start
+		ret = ret[:n-1]
+	}
+	return ret
+}
+
+// RingShardingConfigs routes keys to shards by a consistent hash ring.
+// A range may have keys in any shard, so it's sent to all shards.
+type RingShardingConfigs struct {
+	*HashShardingConfigs
+	ring *HashRing
+}
+
+func NewRingShardingConfigs(shards []Shard, ring *HashRing) *RingShardingConfigs {
+	return &RingShardingConfigs{
+		HashShardingConfigs: NewHashShardingConfigs(shards),
+		ring:                ring,
+	}
+}
+
+// GetShardClis returns the shard of the key on the ring, or all shards for a range.
+func (r *RingShardingConfigs) GetShardClis(key []byte, rangeEnd []byte) []ShardClient {
+	if len(rangeEnd) == 0 {
+		return []ShardClient{r.shards[r.ring.Shard(key)].GetClient()}
+	}
+	return r.GetAllShardClis()
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func ringShards(names ...string) []config.Shard {
+	ret := make([]config.Shard, len(names))
+	for i, name := range names {
+		ret[i] = config.Shard{Name: name}
+	}
+	return ret
+}
+
+func TestDiffHashRings(t *testing.T) {
+	a, err := NewHashRing(ringShards("s0", "s1", "s2"), 0)
+	assert.NoError(t, err)
+	// reordered shards don't move keys
+	reordered, err := NewHashRing(ringShards("s2", "s0", "s1"), 0)
+	assert.NoError(t, err)
+	assert.Empty(t, DiffHashRings(a, reordered))
+
+	b, err := NewHashRing(ringShards("s0", "s1", "s2", "s3"), 0)
+	assert.NoError(t, err)
+	moves := DiffHashRings(a, b)
+	assert.NotEmpty(t, moves)
+	var total float64
+	for _, move := range moves {
+		assert.Equal(t, "s3", move.To)
+		total += move.Fraction()
+	}
+	assert.InDelta(t, 0.25, total, 0.08)
+
+	// keys move exactly as reported
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		from, to := a.names[a.Shard(key)], b.names[b.Shard(key)]
+		var moved bool
+		h := ringHash(key)
+		for _, move := range moves {
+			if move.Start < move.End && h > move.Start && h <= move.End ||
+				move.Start >= move.End && (h > move.Start || h <= move.End) {
+				moved = true
+				assert.Equal(t, move.From, from)
+			}
+		}
+		assert.Equal(t, from != to, moved)
+	}
+}
+
+func TestNewHashRing(t *testing.T) {
+	_, err := NewHashRing(ringShards("s0", "s0"), 0)
+	assert.Error(t, err)
+	_, err = NewHashRing(ringShards(""), 0)
+	assert.Error(t, err)
+
+	shards := ringShards("s0", "s1")
+	shards[1].Weight = 3
+	ring, err := NewHashRing(shards, 0)
+	assert.NoError(t, err)
+	assert.Len(t, ring.points, 4*DefaultVirtualNodes)
+
+	var heavy int
+	for i := 0; i < 1000; i++ {
+		heavy += ring.Shard([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	assert.Greater(t, heavy, 600)
+}
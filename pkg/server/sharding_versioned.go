@@ -0,0 +1,173 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// VersionedShardingConfigs is the ShardingConfigs switched to new versions at runtime.
+// Every version has an epoch, and it only switches to greater epochs,
+// so that proxies switching by the same shard map end up at the same version.
+type VersionedShardingConfigs struct {
+	// current is the *ShardingVersion in use
+	current atomic.Value
+	// switching serializes Switch, so a switch is signalled after the writes of all older versions are done
+	switching sync.Mutex
+
+	mu sync.Mutex
+	// changed is closed when switched to a new version
+	changed chan struct{}
+	// epoch is the epoch of the last switch signalled
+	epoch int64
+}
+
+// ShardingVersion is a version of VersionedShardingConfigs
+type ShardingVersion struct {
+	Epoch   int64
+	Configs ShardingConfigs
+	// suspended is the error of the requests while the proxy is suspended, see Suspend
+	suspended error
+	// writes is read locked by the writes routed by the version, see BeginWrite
+	writes sync.RWMutex
+}
+
+// Suspended returns the error to fail requests with if the proxy is suspended, or nil.
+func (s *ShardingVersion) Suspended() error {
+	return s.suspended
+}
+
+func NewVersionedShardingConfigs(configs ShardingConfigs, epoch int64) *VersionedShardingConfigs {
+	ret := &VersionedShardingConfigs{
+		changed: make(chan struct{}),
+		epoch:   epoch,
+	}
+	ret.current.Store(&ShardingVersion{Epoch: epoch, Configs: configs})
+	return ret
+}
+
+// Current returns the version in use.
+func (v *VersionedShardingConfigs) Current() *ShardingVersion {
+	return v.current.Load().(*ShardingVersion)
+}
+
+// Switch switches to the configs at the epoch. It returns false if the epoch is not
+// greater than the one in use, in which case the configs is dropped.
+// It returns after the writes routed by the previous version are done, and only then
+// signals the switch by Changed, so whoever sees the new version, like the member key
+// of the proxy in the shard map, knows no write is in flight routed by an older version.
+func (v *VersionedShardingConfigs) Switch(configs ShardingConfigs, epoch int64) bool {
+	v.switching.Lock()
+	defer v.switching.Unlock()
+	previous := v.Current()
+	if epoch <= previous.Epoch {
+		return false
+	}
+	v.replace(previous, &ShardingVersion{Epoch: epoch, Configs: configs, suspended: previous.suspended})
+	return true
+}
+
+// Suspend makes the proxy stop serving, failing requests with reason as Unavailable,
+// like when it may be no more a member of the shard map, whose changes don't wait for it to switch.
+// It returns after the writes in flight are done, and the streams are notified by Changed.
+func (v *VersionedShardingConfigs) Suspend(reason error) {
+	v.switching.Lock()
+	defer v.switching.Unlock()
+	previous := v.Current()
+	if previous.suspended != nil {
+		return
+	}
+	suspended := status.Errorf(codes.Unavailable, "proxy suspended: %v", reason)
+	v.replace(previous, &ShardingVersion{Epoch: previous.Epoch, Configs: previous.Configs, suspended: suspended})
+}
+
+// Resume makes the suspended proxy serve again.
+func (v *VersionedShardingConfigs) Resume() {
+	v.switching.Lock()
+	defer v.switching.Unlock()
+	previous := v.Current()
+	if previous.suspended == nil {
+		return
+	}
+	v.replace(previous, &ShardingVersion{Epoch: previous.Epoch, Configs: previous.Configs})
+}
+
+// replace stores the version in place of previous, and signals the change after
+// the writes routed by previous are done.
+func (v *VersionedShardingConfigs) replace(previous, version *ShardingVersion) {
+	v.current.Store(version)
+
+	// wait for the writes in flight
+	previous.writes.Lock()
+	previous.writes.Unlock()
+
+	v.mu.Lock()
+	close(v.changed)
+	v.changed = make(chan struct{})
+	v.epoch = version.Epoch
+	v.mu.Unlock()
+}
+
+// Epoch returns the epoch of the last switch done, that is no write is in flight routed
+// by an older version. It may be behind Current while switching.
+func (v *VersionedShardingConfigs) Epoch() int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.epoch
+}
+
+// BeginWrite returns the version in use to route a write, and the function to call when
+// the write is done. Switch waits for the writes of the previous version, so that once
+// switched, there's no write in flight routed by an older version.
+// The write must fail if the version is suspended, so is none once suspended.
+func (v *VersionedShardingConfigs) BeginWrite() (*ShardingVersion, func()) {
+	for {
+		version := v.Current()
+		version.writes.RLock()
+		if v.Current() == version {
+			return version, version.writes.RUnlock
+		}
+		// switched in between, the write may be missed by Switch
+		version.writes.RUnlock()
+	}
+}
+
+// Changed returns a channel closed when switched to a version after the current one,
+// or when suspended or resumed.
+// Get it before Current to not miss a switch in between.
+func (v *VersionedShardingConfigs) Changed() <-chan struct{} {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.changed
+}
+
+func (v *VersionedShardingConfigs) GetShardClis(key []byte, rangeEnd []byte) []ShardClient {
+	return v.Current().Configs.GetShardClis(key, rangeEnd)
+}
+
+func (v *VersionedShardingConfigs) GetShardCli(shard int) ShardClient {
+	return v.Current().Configs.GetShardCli(shard)
+}
+
+func (v *VersionedShardingConfigs) GetAllShardClis() []ShardClient {
+	return v.Current().Configs.GetAllShardClis()
+}
+
+// currentShardingConfigs returns the version in use if configs is versioned,
+// whose optional interfaces like ShardRangeGetter are checked instead of the wrapper's.
+func currentShardingConfigs(configs ShardingConfigs) ShardingConfigs {
+	if versioned, ok := configs.(*VersionedShardingConfigs); ok {
+		return versioned.Current().Configs
+	}
+	return configs
+}
+
+// suspendedErr returns the error to fail requests with if configs is versioned & suspended, or nil.
+func suspendedErr(configs ShardingConfigs) error {
+	if versioned, ok := configs.(*VersionedShardingConfigs); ok {
+		return versioned.Current().Suspended()
+	}
+	return nil
+}
@@ -0,0 +1,1061 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// txnLogShard is the shard holding the coordinator log.
+const txnLogShard = 0
+
+// DefaultTxnRecoverAfter is the default age of an unfinished txn before Recover finishes it.
+const DefaultTxnRecoverAfter = time.Minute
+
+var errTxnConflict = status.Error(codes.Aborted, "cross-shard txn conflicts with another txn, retry later")
+
+// TxnCoordinator runs transactions spanning multiple shards with a two-phase commit.
+//
+// Prepare: every participant shard evaluates its own part of the compares, and in the
+// same etcd txn takes a lock for each key or range the txn touches and writes an intent
+// holding the ops it will apply.
+//
+// Commit: once every shard is prepared, the decision is written to the coordinator log
+// on the log shard. Then every shard applies the ops of the decided branch and drops its
+// locks & intent. A txn found in the log by Recover is committed or aborted according to
+// its state, so a crashed proxy never leaves a txn half applied.
+//
+// Locks exclude other cross-shard txns and the writes served by a single shard through
+// the coordinator, which fail with an Aborted status on locked keys, so the keys compared
+// at prepare can't be changed before commit.
+type TxnCoordinator struct {
+	configs      ShardingConfigs
+	groupRunners GroupRunnerFactory
+	respFilter   ResponseFilter
+	validator    *TxnValidator
+	headers      *HeaderStamper
+	lg           *zap.Logger
+
+	logPrefix    []byte
+	intentPrefix []byte
+	// keyLockPrefix & rangeLockPrefix are the prefixes of the locks of keys & ranges
+	keyLockPrefix   []byte
+	rangeLockPrefix []byte
+	recoverAfter    time.Duration
+}
+
+// NewTxnCoordinator creates a TxnCoordinator keeping its keys under internalPrefix.
+// headers may be nil if proxy-level headers are not enabled.
+func NewTxnCoordinator(groupRunners GroupRunnerFactory, configs ShardingConfigs, respFilter ResponseFilter, headers *HeaderStamper, internalPrefix string, recoverAfter time.Duration) *TxnCoordinator {
+	if recoverAfter <= 0 {
+		recoverAfter = DefaultTxnRecoverAfter
+	}
+	return &TxnCoordinator{
+		configs:         configs,
+		groupRunners:    groupRunners,
+		respFilter:      respFilter,
+		validator:       NewTxnValidator(configs),
+		headers:         headers,
+		lg:              zap.L().Named("TxnCoordinator"),
+		logPrefix:       []byte(internalPrefix + "txn/log/"),
+		intentPrefix:    txnIntentPrefix(internalPrefix),
+		keyLockPrefix:   append(txnLockPrefix(internalPrefix), "key/"...),
+		rangeLockPrefix: append(txnLockPrefix(internalPrefix), "range/"...),
+		recoverAfter:    recoverAfter,
+	}
+}
+
+// txnIntentPrefix returns the prefix of the txn intents in each shard.
+func txnIntentPrefix(internalPrefix string) []byte {
+	return []byte(internalPrefix + "txn/intent/")
+}
+
+// txnLockPrefix returns the prefix of the txn locks in each shard.
+func txnLockPrefix(internalPrefix string) []byte {
+	return []byte(internalPrefix + "txn/lock/")
+}
+
+type txnState string
+
+const (
+	txnStatePreparing txnState = "preparing"
+	txnStateCommitted txnState = "committed"
+	txnStateAborted   txnState = "aborted"
+)
+
+// txnLogRecord is the value of a txn in the coordinator log
+type txnLogRecord struct {
+	ID     string   `json:"id"`
+	State  txnState `json:"state"`
+	Shards []int    `json:"shards"`
+	// Succeeded is the result of all compares, only valid when committed.
+	Succeeded bool      `json:"succeeded"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// txnIntent is the value of the intent key of a txn in a participant shard
+type txnIntent struct {
+	ID string `json:"id"`
+	// Request is the marshaled ops of the shard, compares excluded.
+	Request []byte `json:"request"`
+	// Locks are the locked keys, and RangeLocks are the locked ranges
+	Locks      [][]byte   `json:"locks"`
+	RangeLocks []KeyRange `json:"rangeLocks,omitempty"`
+}
+
+// txnRangeLock is the value of the lock of a range, keyed by its start.
+type txnRangeLock struct {
+	ID       string `json:"id"`
+	RangeEnd []byte `json:"rangeEnd"`
+}
+
+// shardTxn is the part of a txn to be run in one shard.
+type shardTxn struct {
+	shardID    int
+	req        *pb.TxnRequest
+	locks      [][]byte
+	lockSet    map[string]struct{}
+	rangeLocks []KeyRange
+	// successIdx & failureIdx are the indexes of req's ops in the original txn.
+	successIdx []int
+	failureIdx []int
+	// cmpReads read the parts in the shard of the compares over multiple shards, and
+	// cmpIdx are the indexes of the compares in the original txn. Such compares are
+	// evaluated by the coordinator on the keys read from all shards.
+	cmpReads []*pb.RequestOp
+	cmpIdx   []int
+}
+
+// lock locks the key, or the range if rangeEnd isn't empty.
+// Ranges starting at the same key are locked as the widest one.
+func (t *shardTxn) lock(key, rangeEnd []byte) {
+	if len(rangeEnd) > 0 {
+		for i, locked := range t.rangeLocks {
+			if bytes.Equal(locked.Key, key) {
+				if rangeEndBefore(locked.RangeEnd, rangeEnd) {
+					t.rangeLocks[i].RangeEnd = rangeEnd
+				}
+				return
+			}
+		}
+		t.rangeLocks = append(t.rangeLocks, KeyRange{Key: key, RangeEnd: rangeEnd})
+		return
+	}
+	if _, ok := t.lockSet[string(key)]; ok {
+		return
+	}
+	t.lockSet[string(key)] = struct{}{}
+	t.locks = append(t.locks, key)
+}
+
+// lockedRanges returns the locked keys & ranges.
+func (t *shardTxn) lockedRanges() []KeyRange {
+	ret := make([]KeyRange, 0, len(t.locks)+len(t.rangeLocks))
+	for _, key := range t.locks {
+		ret = append(ret, KeyRange{Key: key})
+	}
+	return append(ret, t.rangeLocks...)
+}
+
+// txnSplit is a txn split by shards
+type txnSplit struct {
+	shards map[int]*shardTxn
+	// order is the sorted ids of the participant shards.
+	order []int
+}
+
+func (s *txnSplit) get(shardID int) *shardTxn {
+	ret, ok := s.shards[shardID]
+	if !ok {
+		ret = &shardTxn{
+			shardID: shardID,
+			req:     new(pb.TxnRequest),
+			lockSet: make(map[string]struct{}),
+		}
+		s.shards[shardID] = ret
+		s.order = append(s.order, shardID)
+		sort.Ints(s.order)
+	}
+	return ret
+}
+
+// Txn runs the txn in its only shard, or with a two-phase commit if it spans multiple shards.
+// A txn in one shard fails if it writes keys locked by a txn across shards.
+func (c *TxnCoordinator) Txn(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	split, err := c.split(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(split.order) > 1 {
+		return c.twoPhaseCommit(ctx, req, split)
+	}
+	// empty txn uses first shard
+	var shardID int
+	if len(split.order) == 1 {
+		shardID = split.order[0]
+	}
+	ret, err := c.singleShardTxn(ctx, c.configs.GetShardCli(shardID), req)
+	if err != nil {
+		return nil, err
+	}
+	c.headers.Observe(shardID, ret.Header)
+	ret.Header = c.headers.Stamp(ret.Header)
+	return ret, nil
+}
+
+func (c *TxnCoordinator) shardIDs(key, rangeEnd []byte) []int {
+	clis := c.configs.GetShardClis(key, rangeEnd)
+	ret := make([]int, len(clis))
+	for i, cli := range clis {
+		ret[i] = cli.GetShardID()
+	}
+	return ret
+}
+
+// readShardIDs returns the shards a read touches.
+// Replicated keys are read in the home shard of the txn.
+func (c *TxnCoordinator) readShardIDs(key, rangeEnd []byte, home int) []int {
+	if _, whole := replicatedRanges(c.configs, key, rangeEnd); whole {
+		return []int{home}
+	}
+	return c.shardIDs(key, rangeEnd)
+}
+
+// writeShardIDs returns the shards a write touches.
+// Replicated keys are written in all shards.
+func (c *TxnCoordinator) writeShardIDs(key, rangeEnd []byte) []int {
+	if parts, _ := replicatedRanges(c.configs, key, rangeEnd); len(parts) > 0 {
+		clis := c.configs.GetAllShardClis()
+		ret := make([]int, len(clis))
+		for i, cli := range clis {
+			ret[i] = cli.GetShardID()
+		}
+		return ret
+	}
+	return c.shardIDs(key, rangeEnd)
+}
+
+// opShardIDs returns the shards an op touches.
+// A nested txn is passed to a shard as a whole, so it must stay in one shard.
+func (c *TxnCoordinator) opShardIDs(op *pb.RequestOp, home int) ([]int, error) {
+	switch r := op.Request.(type) {
+	case *pb.RequestOp_RequestRange:
+		return c.readShardIDs(r.RequestRange.Key, r.RequestRange.RangeEnd, home), nil
+	case *pb.RequestOp_RequestPut:
+		return c.writeShardIDs(r.RequestPut.Key, nil), nil
+	case *pb.RequestOp_RequestDeleteRange:
+		return c.writeShardIDs(r.RequestDeleteRange.Key, r.RequestDeleteRange.RangeEnd), nil
+	case *pb.RequestOp_RequestTxn:
+		// the error is returned as is to keep its grpc status
+		shardID, err := c.validator.Validate(r.RequestTxn)
+		if err != nil {
+			return nil, err
+		}
+		return []int{shardID}, nil
+	}
+	return nil, errors.Wrap(ErrNotSupported, "unknown request op")
+}
+
+func opKey(op *pb.RequestOp) []byte {
+	switch r := op.Request.(type) {
+	case *pb.RequestOp_RequestRange:
+		return r.RequestRange.Key
+	case *pb.RequestOp_RequestPut:
+		return r.RequestPut.Key
+	case *pb.RequestOp_RequestDeleteRange:
+		return r.RequestDeleteRange.Key
+	}
+	return nil
+}
+
+func opRangeEnd(op *pb.RequestOp) []byte {
+	switch r := op.Request.(type) {
+	case *pb.RequestOp_RequestRange:
+		return r.RequestRange.RangeEnd
+	case *pb.RequestOp_RequestDeleteRange:
+		return r.RequestDeleteRange.RangeEnd
+	}
+	return nil
+}
+
+// split splits the compares & ops of req by shards.
+// Ops over a range are sent to every shard of the range, whose results are merged
+// as etcd does them on the whole range. Compares over a range of multiple shards are
+// evaluated on the keys read from the part of the range in every shard, as etcd evaluates
+// them on the whole range: a part without keys doesn't fail the compare.
+// Reads of replicated keys are sent to the home shard, the first shard the txn
+// touches otherwise, and writes of them are sent to all shards.
+func (c *TxnCoordinator) split(req *pb.TxnRequest) (*txnSplit, error) {
+	ret := &txnSplit{shards: make(map[int]*shardTxn)}
+	var home int
+	if ids := c.validator.ShardIDs(req); len(ids) > 0 {
+		home = ids[0]
+	}
+	for i, cmp := range req.Compare {
+		ids := c.readShardIDs(cmp.Key, cmp.RangeEnd, home)
+		for _, id := range ids {
+			t := ret.get(id)
+			t.lock(cmp.Key, cmp.RangeEnd)
+			if len(ids) == 1 {
+				t.req.Compare = append(t.req.Compare, cmp)
+				continue
+			}
+			key, rangeEnd := c.shardPart(id, cmp.Key, cmp.RangeEnd)
+			t.cmpReads = append(t.cmpReads, &pb.RequestOp{Request: &pb.RequestOp_RequestRange{RequestRange: &pb.RangeRequest{
+				Key:      key,
+				RangeEnd: rangeEnd,
+				KeysOnly: cmp.Target != pb.Compare_VALUE,
+			}}})
+			t.cmpIdx = append(t.cmpIdx, i)
+		}
+	}
+	var splitOps = func(ops []*pb.RequestOp, isSuccess bool) error {
+		for i, op := range ops {
+			ids, err := c.opShardIDs(op, home)
+			if err != nil {
+				return err
+			}
+			if rangeOp := op.GetRequestRange(); rangeOp != nil && len(ids) > 1 {
+				op = &pb.RequestOp{Request: &pb.RequestOp_RequestRange{RequestRange: RangeRequestForShards(rangeOp)}}
+			}
+			if deleteOp := op.GetRequestDeleteRange(); deleteOp != nil && len(ids) > 1 && !deleteOp.PrevKv {
+				// the deleted keys tell the primary copies from the replicas, see mergeResponses
+				if parts, _ := replicatedRanges(c.configs, deleteOp.Key, deleteOp.RangeEnd); len(parts) > 0 {
+					shardOp := *deleteOp
+					shardOp.PrevKv = true
+					op = &pb.RequestOp{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &shardOp}}
+				}
+			}
+			for _, id := range ids {
+				t := ret.get(id)
+				if isSuccess {
+					t.req.Success = append(t.req.Success, op)
+					t.successIdx = append(t.successIdx, i)
+				} else {
+					t.req.Failure = append(t.req.Failure, op)
+					t.failureIdx = append(t.failureIdx, i)
+				}
+				if key := opKey(op); key != nil {
+					t.lock(key, opRangeEnd(op))
+				}
+			}
+		}
+		return nil
+	}
+	if err := splitOps(req.Success, true); err != nil {
+		return nil, err
+	}
+	if err := splitOps(req.Failure, false); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// shardPart returns the part of the range in the shard, the whole range if the range of the shard is unknown.
+func (c *TxnCoordinator) shardPart(shardID int, key, rangeEnd []byte) ([]byte, []byte) {
+	ranger, ok := currentShardingConfigs(c.configs).(ShardRangeGetter)
+	if !ok {
+		return key, rangeEnd
+	}
+	start, end, ok := ranger.GetShardRange(shardID)
+	if !ok {
+		return key, rangeEnd
+	}
+	part, ok := intersectRange(KeyRange{Key: key, RangeEnd: rangeEnd}, KeyRange{Key: start, RangeEnd: end})
+	if !ok {
+		return key, key
+	}
+	return part.Key, part.RangeEnd
+}
+
+// ownsKey returns true if the key is in the range of the shard, or the range of the shard is unknown.
+func (c *TxnCoordinator) ownsKey(shardID int, key []byte) bool {
+	ranger, ok := currentShardingConfigs(c.configs).(ShardRangeGetter)
+	if !ok {
+		return true
+	}
+	start, end, ok := ranger.GetShardRange(shardID)
+	return !ok || bytes.Compare(key, start) >= 0 && rangeEndBefore(key, end)
+}
+
+// compareKvs evaluates the compare on the keys in its range like etcd does:
+// it succeeds if every key meets it, and a range without keys is compared as an empty key,
+// except that a value compare on it always fails.
+func compareKvs(cmp *pb.Compare, kvs []*mvccpb.KeyValue) bool {
+	if len(kvs) == 0 {
+		if cmp.Target == pb.Compare_VALUE {
+			return false
+		}
+		kvs = []*mvccpb.KeyValue{{}}
+	}
+	for _, kv := range kvs {
+		var result int
+		switch cmp.Target {
+		case pb.Compare_VALUE:
+			result = bytes.Compare(kv.Value, cmp.GetValue())
+		case pb.Compare_CREATE:
+			result = compareInt64(kv.CreateRevision, cmp.GetCreateRevision())
+		case pb.Compare_MOD:
+			result = compareInt64(kv.ModRevision, cmp.GetModRevision())
+		case pb.Compare_VERSION:
+			result = compareInt64(kv.Version, cmp.GetVersion())
+		case pb.Compare_LEASE:
+			result = compareInt64(kv.Lease, cmp.GetLease())
+		}
+		var ok bool
+		switch cmp.Result {
+		case pb.Compare_EQUAL:
+			ok = result == 0
+		case pb.Compare_NOT_EQUAL:
+			ok = result != 0
+		case pb.Compare_GREATER:
+			ok = result > 0
+		case pb.Compare_LESS:
+			ok = result < 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func newTxnID() (string, error) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+func (c *TxnCoordinator) logKey(id string) []byte {
+	return append(append([]byte{}, c.logPrefix...), id...)
+}
+
+func (c *TxnCoordinator) intentKey(id string) []byte {
+	return append(append([]byte{}, c.intentPrefix...), id...)
+}
+
+func (c *TxnCoordinator) lockKey(key []byte) []byte {
+	return append(append([]byte{}, c.keyLockPrefix...), key...)
+}
+
+func (c *TxnCoordinator) rangeLockKey(key []byte) []byte {
+	return append(append([]byte{}, c.rangeLockPrefix...), key...)
+}
+
+// lockFree returns the compares that no key in the ranges is locked, and no range is locked,
+// or the range locks are not changed since the revision rangeLocksRev if it's not 0.
+func (c *TxnCoordinator) lockFree(ranges []KeyRange, rangeLocksRev int64) []*pb.Compare {
+	ret := make([]*pb.Compare, 0, len(ranges)+1)
+	for _, r := range ranges {
+		cmp := cmpNotExists(c.lockKey(r.Key))
+		if len(r.RangeEnd) > 0 {
+			cmp.RangeEnd = c.lockKey(r.RangeEnd)
+			if bytes.Equal(r.RangeEnd, noEnd) {
+				cmp.RangeEnd = prefixEnd(c.keyLockPrefix)
+			}
+		}
+		ret = append(ret, cmp)
+	}
+	rangeLocks := cmpNotExists(c.rangeLockPrefix)
+	if rangeLocksRev > 0 {
+		rangeLocks = &pb.Compare{Key: c.rangeLockPrefix, Target: pb.Compare_MOD, Result: pb.Compare_LESS,
+			TargetUnion: &pb.Compare_ModRevision{ModRevision: rangeLocksRev + 1}}
+	}
+	rangeLocks.RangeEnd = prefixEnd(c.rangeLockPrefix)
+	return append(ret, rangeLocks)
+}
+
+// unlockedTxn does the ops in the shard if no key in the ranges is locked by a txn,
+// or returns errTxnConflict. The range locks are only read if any exists.
+func (c *TxnCoordinator) unlockedTxn(ctx context.Context, cli ShardClient, ranges []KeyRange, ops []*pb.RequestOp) (*pb.TxnResponse, error) {
+	resp, err := cli.Txn(ctx, &pb.TxnRequest{Compare: c.lockFree(ranges, 0), Success: ops})
+	if err != nil || resp.Succeeded {
+		return resp, err
+	}
+	locks, err := cli.Range(ctx, &pb.RangeRequest{Key: c.rangeLockPrefix, RangeEnd: prefixEnd(c.rangeLockPrefix)})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get range locks")
+	}
+	if len(locks.Kvs) == 0 {
+		// a key is locked
+		return nil, errTxnConflict
+	}
+	for _, kv := range locks.Kvs {
+		var lock txnRangeLock
+		err = json.Unmarshal(kv.Value, &lock)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad range lock %q", kv.Key)
+		}
+		locked := KeyRange{Key: kv.Key[len(c.rangeLockPrefix):], RangeEnd: lock.RangeEnd}
+		for _, r := range ranges {
+			if len(r.RangeEnd) == 0 {
+				r.RangeEnd = append(append([]byte{}, r.Key...), 0)
+			}
+			if _, ok := intersectRange(locked, r); ok {
+				return nil, errTxnConflict
+			}
+		}
+	}
+	resp, err = cli.Txn(ctx, &pb.TxnRequest{Compare: c.lockFree(ranges, locks.Header.Revision), Success: ops})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, errTxnConflict
+	}
+	return resp, nil
+}
+
+// singleShardTxn does the txn in one shard unless it writes locked keys.
+func (c *TxnCoordinator) singleShardTxn(ctx context.Context, cli ShardClient, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	ranges := txnWriteRanges(req)
+	if len(ranges) == 0 {
+		return cli.Txn(ctx, req)
+	}
+	resp, err := c.unlockedTxn(ctx, cli, ranges, []*pb.RequestOp{{Request: &pb.RequestOp_RequestTxn{RequestTxn: req}}})
+	if err != nil {
+		return nil, err
+	}
+	ret := resp.Responses[0].GetResponseTxn()
+	ret.Header = resp.Header
+	return ret, nil
+}
+
+// putShard does the put in one shard unless the key is locked by a txn,
+// it's done without checking locks if c is nil.
+func (c *TxnCoordinator) putShard(ctx context.Context, cli ShardClient, req *pb.PutRequest) (*pb.PutResponse, error) {
+	if c == nil {
+		return cli.Put(ctx, req)
+	}
+	resp, err := c.unlockedTxn(ctx, cli, []KeyRange{{Key: req.Key}}, []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{RequestPut: req}}})
+	if err != nil {
+		return nil, err
+	}
+	ret := resp.Responses[0].GetResponsePut()
+	ret.Header = resp.Header
+	return ret, nil
+}
+
+// deleteRangeShard does the delete in one shard unless any key in the range is locked by a txn,
+// it's done without checking locks if c is nil.
+func (c *TxnCoordinator) deleteRangeShard(ctx context.Context, cli ShardClient, req *pb.DeleteRangeRequest) (*pb.DeleteRangeResponse, error) {
+	if c == nil {
+		return cli.DeleteRange(ctx, req)
+	}
+	resp, err := c.unlockedTxn(ctx, cli, []KeyRange{{Key: req.Key, RangeEnd: req.RangeEnd}},
+		[]*pb.RequestOp{{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: req}}})
+	if err != nil {
+		return nil, err
+	}
+	ret := resp.Responses[0].GetResponseDeleteRange()
+	ret.Header = resp.Header
+	return ret, nil
+}
+
+func opPut(key, value []byte) *pb.RequestOp {
+	return &pb.RequestOp{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: key, Value: value}}}
+}
+
+func opDelete(key []byte) *pb.RequestOp {
+	return &pb.RequestOp{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: key}}}
+}
+
+func cmpExists(key []byte) *pb.Compare {
+	return &pb.Compare{Key: key, Target: pb.Compare_VERSION, Result: pb.Compare_GREATER, TargetUnion: &pb.Compare_Version{Version: 0}}
+}
+
+func cmpNotExists(key []byte) *pb.Compare {
+	return &pb.Compare{Key: key, Target: pb.Compare_VERSION, Result: pb.Compare_EQUAL, TargetUnion: &pb.Compare_Version{Version: 0}}
+}
+
+func cmpValue(key, value []byte) *pb.Compare {
+	return &pb.Compare{Key: key, Target: pb.Compare_VALUE, Result: pb.Compare_EQUAL, TargetUnion: &pb.Compare_Value{Value: value}}
+}
+
+func cmpModRevision(key []byte, rev int64) *pb.Compare {
+	return &pb.Compare{Key: key, Target: pb.Compare_MOD, Result: pb.Compare_EQUAL, TargetUnion: &pb.Compare_ModRevision{ModRevision: rev}}
+}
+
+func (c *TxnCoordinator) twoPhaseCommit(ctx context.Context, req *pb.TxnRequest, split *txnSplit) (*pb.TxnResponse, error) {
+	id, err := newTxnID()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate txn id")
+	}
+	rec := &txnLogRecord{
+		ID:        id,
+		State:     txnStatePreparing,
+		Shards:    split.order,
+		StartTime: time.Now(),
+	}
+	logRev, err := c.putLog(ctx, rec, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write txn log")
+	}
+
+	intents := make(map[int]*txnIntent, len(split.order))
+	for _, shardID := range split.order {
+		t := split.shards[shardID]
+		ops, err := t.req.Marshal()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal txn ops")
+		}
+		intents[shardID] = &txnIntent{ID: id, Request: ops, Locks: t.locks, RangeLocks: t.rangeLocks}
+	}
+
+	// phase 1: prepare
+	var prepared = make([]bool, len(split.order))
+	var cmpSucceeded = make([]bool, len(split.order))
+	var cmpKvs = make([][][]*mvccpb.KeyValue, len(split.order))
+	groupRunner := c.groupRunners.GetGroupRunner()
+	for i := range split.order {
+		index := i
+		groupRunner.Go(func() error {
+			t := split.shards[split.order[index]]
+			var err error
+			prepared[index], cmpSucceeded[index], cmpKvs[index], err = c.prepare(ctx, t, intents[t.shardID])
+			return errors.Wrapf(err, "failed to prepare txn in shard[%d]", t.shardID)
+		})
+	}
+	err = groupRunner.Wait()
+	succeeded := true
+	// the keys of the compares over multiple shards by their indexes
+	rangeCmpKvs := make(map[int][]*mvccpb.KeyValue)
+	for i, shardID := range split.order {
+		if !prepared[i] && err == nil {
+			err = errTxnConflict
+		}
+		succeeded = succeeded && cmpSucceeded[i]
+		for j, idx := range split.shards[shardID].cmpIdx {
+			if cmpKvs[i] != nil {
+				rangeCmpKvs[idx] = append(rangeCmpKvs[idx], cmpKvs[i][j]...)
+			}
+		}
+	}
+	for idx, kvs := range rangeCmpKvs {
+		succeeded = succeeded && compareKvs(req.Compare[idx], kvs)
+	}
+	if err != nil {
+		c.abort(ctx, rec, logRev, intents)
+		return nil, err
+	}
+
+	// commit point
+	rec.State = txnStateCommitted
+	rec.Succeeded = succeeded
+	_, err = c.putLog(ctx, rec, logRev)
+	if err != nil {
+		// the log may be written or aborted by Recover of another proxy, the txn is only
+		// aborted if it's known not committed
+		logged, getErr := c.getLog(ctx, id)
+		if getErr != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to commit txn log, it will be recovered later: %v", err)
+		}
+		if logged == nil || logged.State != txnStateCommitted {
+			rec.State = txnStatePreparing
+			c.abort(ctx, rec, logRev, intents)
+			return nil, errors.Wrap(err, "failed to commit txn log")
+		}
+	}
+
+	// phase 2: commit
+	var resps = make(map[int]*pb.TxnResponse, len(split.order))
+	var commitResps = make([]*pb.TxnResponse, len(split.order))
+	groupRunner = c.groupRunners.GetGroupRunner()
+	for i := range split.order {
+		index := i
+		groupRunner.Go(func() error {
+			shardID := split.order[index]
+			var err error
+			commitResps[index], err = c.commitShard(ctx, shardID, intents[shardID], succeeded)
+			return errors.Wrapf(err, "failed to commit txn in shard[%d], it will be recovered later", shardID)
+		})
+	}
+	err = groupRunner.Wait()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	for i, shardID := range split.order {
+		resps[shardID] = commitResps[i]
+	}
+	c.deleteLog(ctx, id)
+	return c.mergeResponses(req, split, succeeded, resps)
+}
+
+// putLog writes the log record, only if the record is not changed since revision prevRev.
+// prevRev is 0 for a new record. It returns the revision of the new record.
+func (c *TxnCoordinator) putLog(ctx context.Context, rec *txnLogRecord, prevRev int64) (int64, error) {
+	val, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	key := c.logKey(rec.ID)
+	cmp := cmpNotExists(key)
+	if prevRev > 0 {
+		cmp = cmpModRevision(key, prevRev)
+	}
+	resp, err := c.configs.GetShardCli(txnLogShard).Txn(ctx, &pb.TxnRequest{
+		Compare: []*pb.Compare{cmp},
+		Success: []*pb.RequestOp{opPut(key, val)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, errors.Errorf("txn log [%s] changed by others", rec.ID)
+	}
+	return resp.Header.Revision, nil
+}
+
+// getLog returns the log record of the txn, nil if it's not found.
+func (c *TxnCoordinator) getLog(ctx context.Context, id string) (*txnLogRecord, error) {
+	resp, err := c.configs.GetShardCli(txnLogShard).Range(ctx, &pb.RangeRequest{Key: c.logKey(id)})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	rec := new(txnLogRecord)
+	err = json.Unmarshal(resp.Kvs[0].Value, rec)
+	return rec, errors.Wrapf(err, "bad txn log [%s]", id)
+}
+
+func (c *TxnCoordinator) deleteLog(ctx context.Context, id string) {
+	_, err := c.configs.GetShardCli(txnLogShard).DeleteRange(ctx, &pb.DeleteRangeRequest{Key: c.logKey(id)})
+	if err != nil {
+		c.lg.Warn("failed to delete txn log, it will be recovered later", zap.String("txn", id), zap.Error(err))
+	}
+}
+
+// prepare takes the locks & writes the intent in one shard, evaluating the compares & reading
+// the parts of the compares over multiple shards in the meantime, which are returned in cmpKvs.
+// prepared is false if any key or range is locked by another txn.
+func (c *TxnCoordinator) prepare(ctx context.Context, t *shardTxn, intent *txnIntent) (prepared bool, cmpSucceeded bool, cmpKvs [][]*mvccpb.KeyValue, err error) {
+	val, err := json.Marshal(intent)
+	if err != nil {
+		return false, false, nil, err
+	}
+	// the compared keys are read before the locks are put
+	puts := make([]*pb.RequestOp, 0, len(t.cmpReads)+len(t.locks)+len(t.rangeLocks)+1)
+	puts = append(puts, t.cmpReads...)
+	for _, key := range t.locks {
+		puts = append(puts, opPut(c.lockKey(key), []byte(intent.ID)))
+	}
+	for _, r := range t.rangeLocks {
+		lock, err := json.Marshal(&txnRangeLock{ID: intent.ID, RangeEnd: r.RangeEnd})
+		if err != nil {
+			return false, false, nil, err
+		}
+		puts = append(puts, opPut(c.rangeLockKey(r.Key), lock))
+	}
+	puts = append(puts, opPut(c.intentKey(intent.ID), val))
+	resp, err := c.unlockedTxn(ctx, c.configs.GetShardCli(t.shardID), t.lockedRanges(), []*pb.RequestOp{{Request: &pb.RequestOp_RequestTxn{RequestTxn: &pb.TxnRequest{
+		Compare: t.req.Compare,
+		Success: puts,
+		Failure: puts,
+	}}}})
+	if err == errTxnConflict {
+		return false, false, nil, nil
+	}
+	if err != nil {
+		return false, false, nil, err
+	}
+	prepareResp := resp.Responses[0].GetResponseTxn()
+	cmpKvs = make([][]*mvccpb.KeyValue, len(t.cmpReads))
+	for i := range t.cmpReads {
+		cmpKvs[i] = prepareResp.Responses[i].GetResponseRange().GetKvs()
+	}
+	return true, prepareResp.Succeeded, cmpKvs, nil
+}
+
+// commitShard applies the ops of the decided branch & releases the locks in one shard,
+// if the intent & the locks are still held by the txn. The compares aren't evaluated again,
+// the keys they read are locked since prepare, so they can't be changed by others.
+func (c *TxnCoordinator) commitShard(ctx context.Context, shardID int, intent *txnIntent, succeeded bool) (*pb.TxnResponse, error) {
+	var ops = new(pb.TxnRequest)
+	err := ops.Unmarshal(intent.Request)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal txn intent")
+	}
+	branch := ops.Failure
+	if succeeded {
+		branch = ops.Success
+	}
+	held, err := c.locksHeld(intent)
+	if err != nil {
+		return nil, err
+	}
+	commitOps := make([]*pb.RequestOp, 0, len(branch)+len(intent.Locks)+len(intent.RangeLocks)+1)
+	commitOps = append(commitOps, branch...)
+	commitOps = append(commitOps, c.releaseOps(intent)...)
+	resp, err := c.configs.GetShardCli(shardID).Txn(ctx, &pb.TxnRequest{
+		Compare: held,
+		Success: commitOps,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, errors.Errorf("txn intent [%s] or its locks not found", intent.ID)
+	}
+	resp.Responses = resp.Responses[:len(branch)]
+	resp.Succeeded = succeeded
+	return resp, nil
+}
+
+// locksHeld returns the compares that the intent & the locks are held by the txn.
+func (c *TxnCoordinator) locksHeld(intent *txnIntent) ([]*pb.Compare, error) {
+	ret := make([]*pb.Compare, 0, len(intent.Locks)+len(intent.RangeLocks)+1)
+	ret = append(ret, cmpExists(c.intentKey(intent.ID)))
+	for _, key := range intent.Locks {
+		ret = append(ret, cmpValue(c.lockKey(key), []byte(intent.ID)))
+	}
+	for _, r := range intent.RangeLocks {
+		lock, err := json.Marshal(&txnRangeLock{ID: intent.ID, RangeEnd: r.RangeEnd})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cmpValue(c.rangeLockKey(r.Key), lock))
+	}
+	return ret, nil
+}
+
+func (c *TxnCoordinator) releaseOps(intent *txnIntent) []*pb.RequestOp {
+	ret := make([]*pb.RequestOp, 0, len(intent.Locks)+len(intent.RangeLocks)+1)
+	for _, key := range intent.Locks {
+		ret = append(ret, opDelete(c.lockKey(key)))
+	}
+	for _, r := range intent.RangeLocks {
+		ret = append(ret, opDelete(c.rangeLockKey(r.Key)))
+	}
+	return append(ret, opDelete(c.intentKey(intent.ID)))
+}
+
+// abortShard releases the locks in one shard if it's prepared.
+func (c *TxnCoordinator) abortShard(ctx context.Context, shardID int, intent *txnIntent) error {
+	_, err := c.configs.GetShardCli(shardID).Txn(ctx, &pb.TxnRequest{
+		Compare: []*pb.Compare{cmpExists(c.intentKey(intent.ID))},
+		Success: c.releaseOps(intent),
+	})
+	return err
+}
+
+// abort marks the txn aborted & releases the locks in all shards, which must be known not committed.
+// The locks are released even if the log isn't written, as the txn is never committed by others.
+// Errors are only logged, the txn left is aborted by Recover later.
+func (c *TxnCoordinator) abort(ctx context.Context, rec *txnLogRecord, logRev int64, intents map[int]*txnIntent) {
+	rec.State = txnStateAborted
+	_, logErr := c.putLog(ctx, rec, logRev)
+	if logErr != nil {
+		c.lg.Warn("failed to abort txn log", zap.String("txn", rec.ID), zap.Error(logErr))
+	}
+	var failed bool
+	for shardID, intent := range intents {
+		err := c.abortShard(ctx, shardID, intent)
+		if err != nil {
+			failed = true
+			c.lg.Warn("failed to abort txn in shard", zap.String("txn", rec.ID), zap.Int("shard", shardID), zap.Error(err))
+		}
+	}
+	if logErr == nil && !failed {
+		c.deleteLog(ctx, rec.ID)
+	}
+}
+
+func (c *TxnCoordinator) mergeResponses(req *pb.TxnRequest, split *txnSplit, succeeded bool, resps map[int]*pb.TxnResponse) (*pb.TxnResponse, error) {
+	ops := req.Failure
+	if succeeded {
+		ops = req.Success
+	}
+	parts := make([][]*pb.ResponseOp, len(ops))
+	// partShards are the shards of parts
+	partShards := make([][]int, len(ops))
+	for _, shardID := range split.order {
+		t := split.shards[shardID]
+		idx := t.failureIdx
+		if succeeded {
+			idx = t.successIdx
+		}
+		for i, respOp := range resps[shardID].Responses {
+			parts[idx[i]] = append(parts[idx[i]], respOp)
+			partShards[idx[i]] = append(partShards[idx[i]], shardID)
+		}
+	}
+	for _, shardID := range split.order {
+		c.headers.Observe(shardID, resps[shardID].Header)
+	}
+	ret := &pb.TxnResponse{
+		Header:    c.headers.Stamp(resps[split.order[0]].Header),
+		Succeeded: succeeded,
+		Responses: make([]*pb.ResponseOp, len(ops)),
+	}
+	for i, op := range ops {
+		if len(parts[i]) == 1 {
+			ret.Responses[i] = parts[i][0]
+			continue
+		}
+		if _, whole := replicatedRanges(c.configs, opKey(op), opRangeEnd(op)); whole {
+			// the same write of replicated keys in all shards
+			ret.Responses[i] = parts[i][0]
+			continue
+		}
+		switch r := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			rangeResps := make([]*pb.RangeResponse, len(parts[i]))
+			for j, part := range parts[i] {
+				rangeResps[j] = part.GetResponseRange()
+			}
+			merged, err := c.respFilter.FilterRange(r.RequestRange, rangeResps)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to filter range response")
+			}
+			ret.Responses[i] = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: merged}}
+		case *pb.RequestOp_RequestDeleteRange:
+			deleteResps := make([]*pb.DeleteRangeResponse, len(parts[i]))
+			replicatedParts, _ := replicatedRanges(c.configs, opKey(op), opRangeEnd(op))
+			for j, part := range parts[i] {
+				deleteResps[j] = part.GetResponseDeleteRange()
+				if len(replicatedParts) > 0 {
+					// the replicas are deleted in all shards, only the primary copies count
+					deleteResps[j] = c.primaryDeletes(partShards[i][j], deleteResps[j], r.RequestDeleteRange.PrevKv)
+				}
+			}
+			merged, err := c.respFilter.FilterDeleteRange(deleteResps)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to filter delete range response")
+			}
+			ret.Responses[i] = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: merged}}
+		default:
+			return nil, errors.Errorf("unexpected responses of op[%d] from %d shards", i, len(parts[i]))
+		}
+	}
+	return ret, nil
+}
+
+// primaryDeletes returns the delete response of the primary copies in the shard,
+// by the deleted keys in the response. prevKv is whether the deleted keys are returned.
+func (c *TxnCoordinator) primaryDeletes(shardID int, resp *pb.DeleteRangeResponse, prevKv bool) *pb.DeleteRangeResponse {
+	ret := &pb.DeleteRangeResponse{Header: resp.Header}
+	for _, kv := range resp.PrevKvs {
+		if !c.ownsKey(shardID, kv.Key) {
+			continue
+		}
+		ret.Deleted++
+		if prevKv {
+			ret.PrevKvs = append(ret.PrevKvs, kv)
+		}
+	}
+	return ret
+}
+
+// Run recovers unfinished txns once, then periodically until ctx is done.
+func (c *TxnCoordinator) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.recoverAfter)
+	defer ticker.Stop()
+	for {
+		err := c.Recover(ctx)
+		if err != nil {
+			c.lg.Warn("failed to recover txns", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Recover finishes the txns in the coordinator log older than recoverAfter, which are
+// most likely left by a crashed proxy. Committed txns are committed in every shard still
+// holding their intents, others are aborted.
+func (c *TxnCoordinator) Recover(ctx context.Context) error {
+	resp, err := c.configs.GetShardCli(txnLogShard).Range(ctx, &pb.RangeRequest{
+		Key:      c.logPrefix,
+		RangeEnd: prefixEnd(c.logPrefix),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list txn log")
+	}
+	for _, kv := range resp.Kvs {
+		rec := new(txnLogRecord)
+		err = json.Unmarshal(kv.Value, rec)
+		if err != nil {
+			c.lg.Warn("skip bad txn log", zap.ByteString("key", kv.Key), zap.Error(err))
+			continue
+		}
+		if time.Since(rec.StartTime) < c.recoverAfter {
+			continue
+		}
+		err = c.recoverTxn(ctx, rec, kv.ModRevision)
+		if err != nil {
+			return errors.Wrapf(err, "failed to recover txn [%s]", rec.ID)
+		}
+	}
+	return nil
+}
+
+func (c *TxnCoordinator) recoverTxn(ctx context.Context, rec *txnLogRecord, logRev int64) error {
+	c.lg.Info("recovering txn", zap.String("txn", rec.ID), zap.String("state", string(rec.State)))
+	if rec.State == txnStatePreparing {
+		rec.State = txnStateAborted
+		_, err := c.putLog(ctx, rec, logRev)
+		if err != nil {
+			return err
+		}
+	}
+	for _, shardID := range rec.Shards {
+		shardCli := c.configs.GetShardCli(shardID)
+		if shardCli == nil {
+			// the shard is retired by a merge, which is refused while it holds intents,
+			// so its part of the txn is already finished
+			continue
+		}
+		resp, err := shardCli.Range(ctx, &pb.RangeRequest{Key: c.intentKey(rec.ID)})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get intent in shard[%d]", shardID)
+		}
+		if len(resp.Kvs) < 1 {
+			// not prepared or already finished
+			continue
+		}
+		intent := new(txnIntent)
+		err = json.Unmarshal(resp.Kvs[0].Value, intent)
+		if err != nil {
+			return errors.Wrapf(err, "failed to unmarshal intent in shard[%d]", shardID)
+		}
+		if rec.State == txnStateCommitted {
+			_, err = c.commitShard(ctx, shardID, intent, rec.Succeeded)
+		} else {
+			err = c.abortShard(ctx, shardID, intent)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to finish txn in shard[%d]", shardID)
+		}
+	}
+	c.deleteLog(ctx, rec.ID)
+	return nil
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sharding-db/etcd-sharding-proxy/pkg/config"
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestShardingConfigs(t *testing.T) *DefaultShardingConfigs {
+	confs := []config.Shard{
+		{End: "i", Address: "127.0.0.1:12379"},
+		{Start: "i", End: "s", Address: "127.0.0.1:22379"},
+		{Start: "s", Address: "127.0.0.1:32379"},
+	}
+	shards := make([]Shard, len(confs))
+	for i, conf := range confs {
+		shard, err := NewShardImpl(i, len(confs), conf)
+		assert.NoError(t, err)
+		shards[i] = shard
+	}
+	return NewDefaultShardingConfigs(shards)
+}
+
+func TestTxnCoordinator_split(t *testing.T) {
+	c := NewTxnCoordinator(NewDefaultGroupRunnerFactory(), newTestShardingConfigs(t), new(DefaultResponseFilter), nil, config.DefaultInternalPrefix, 0)
+
+	t.Run("single shard", func(t *testing.T) {
+		split, err := c.split(&pb.TxnRequest{
+			Compare: []*pb.Compare{cmpExists([]byte("a"))},
+			Success: []*pb.RequestOp{opPut([]byte("b"), nil)},
+			Failure: []*pb.RequestOp{opDelete([]byte("c"))},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{0}, split.order)
+		assert.Len(t, split.shards[0].locks, 3)
+	})
+
+	t.Run("cross shards", func(t *testing.T) {
+		split, err := c.split(&pb.TxnRequest{
+			Compare: []*pb.Compare{cmpExists([]byte("z"))},
+			Success: []*pb.RequestOp{
+				opPut([]byte("a"), nil),
+				{Request: &pb.RequestOp_RequestRange{RequestRange: &pb.RangeRequest{Key: []byte("h"), RangeEnd: []byte("t")}}},
+			},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{0, 1, 2}, split.order)
+		assert.Equal(t, []int{0, 1}, split.shards[0].successIdx)
+		assert.Equal(t, []int{1}, split.shards[1].successIdx)
+		assert.Equal(t, []int{1}, split.shards[2].successIdx)
+		assert.Len(t, split.shards[2].req.Compare, 1)
+	})
+
+	t.Run("nested txn across shards", func(t *testing.T) {
+		_, err := c.split(&pb.TxnRequest{
+			Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestTxn{RequestTxn: &pb.TxnRequest{
+				Success: []*pb.RequestOp{opPut([]byte("a"), nil), opPut([]byte("z"), nil)},
+			}}}},
+		})
+		assert.ErrorIs(t, err, ErrTxnDifferentShard)
+	})
+}
+
+func TestTxnCoordinator_mergeResponses(t *testing.T) {
+	c := NewTxnCoordinator(NewDefaultGroupRunnerFactory(), newTestShardingConfigs(t), new(DefaultResponseFilter), nil, config.DefaultInternalPrefix, 0)
+	req := &pb.TxnRequest{
+		Success: []*pb.RequestOp{
+			opPut([]byte("z"), nil),
+			{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: []byte("a"), RangeEnd: []byte("t")}}},
+		},
+	}
+	split, err := c.split(req)
+	assert.NoError(t, err)
+	deleted := func(n int64) *pb.ResponseOp {
+		return &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: &pb.DeleteRangeResponse{Deleted: n}}}
+	}
+	put := &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: &pb.PutResponse{}}}
+	resp, err := c.mergeResponses(req, split, true, map[int]*pb.TxnResponse{
+		0: {Responses: []*pb.ResponseOp{deleted(1)}},
+		1: {Responses: []*pb.ResponseOp{deleted(2)}},
+		2: {Responses: []*pb.ResponseOp{put, deleted(3)}},
+	})
+	assert.NoError(t, err)
+	assert.True(t, resp.Succeeded)
+	assert.Equal(t, put, resp.Responses[0])
+	assert.Equal(t, int64(6), resp.Responses[1].GetResponseDeleteRange().Deleted)
+}
+
+func TestTxnCoordinator_mergeResponses_replicated(t *testing.T) {
+	shards, clis := newMemShards("i", "s")
+	configs := NewDefaultShardingConfigs(shards, WithReplicatedPrefixes("m/"))
+	c := NewTxnCoordinator(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter), nil, config.DefaultInternalPrefix, 0)
+	ctx := context.Background()
+	for _, prevKv := range []bool{false, true} {
+		_, err := c.Txn(ctx, &pb.TxnRequest{Success: []*pb.RequestOp{
+			opPut([]byte("b"), nil), opPut([]byte("m/a"), nil), opPut([]byte("t"), nil),
+		}})
+		assert.NoError(t, err)
+		for _, cli := range clis {
+			assert.Contains(t, cli.keys(), "m/a")
+		}
+
+		// the replicated key deleted in all shards is counted once
+		resp, err := c.Txn(ctx, &pb.TxnRequest{Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestDeleteRange{
+			RequestDeleteRange: &pb.DeleteRangeRequest{Key: []byte("a"), RangeEnd: []byte("z"), PrevKv: prevKv},
+		}}}})
+		assert.NoError(t, err)
+		deleted := resp.Responses[0].GetResponseDeleteRange()
+		assert.Equal(t, int64(3), deleted.Deleted)
+		if prevKv {
+			assert.Equal(t, []string{"b", "m/a", "t"}, kvKeys(deleted.PrevKvs))
+		} else {
+			assert.Empty(t, deleted.PrevKvs)
+		}
+		for _, cli := range clis {
+			assert.Empty(t, cli.keys())
+		}
+	}
+}
+
+func TestTxnCoordinator_Recover_retiredShard(t *testing.T) {
+	clis := []*memEtcd{newMemEtcd(0), nil, newMemEtcd(2)}
+	// shard[1] is merged into shard[0] after the txn is committed in it
+	configs := NewDefaultShardingConfigs([]Shard{
+		&ShardImpl{start: []byte{}, end: []byte("s"), cli: clis[0]},
+		retiredShard{},
+		&ShardImpl{start: []byte("s"), end: noEnd, cli: clis[2]},
+	})
+	c := NewTxnCoordinator(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter), nil, config.DefaultInternalPrefix, time.Millisecond)
+	ctx := context.Background()
+	rec := &txnLogRecord{ID: "t1", State: txnStateCommitted, Shards: []int{0, 1, 2}, Succeeded: true, StartTime: time.Now().Add(-time.Minute)}
+	_, err := c.putLog(ctx, rec, 0)
+	assert.NoError(t, err)
+	for _, key := range []string{"a", "x"} {
+		cli := clis[0]
+		if key == "x" {
+			cli = clis[2]
+		}
+		ops, err := (&pb.TxnRequest{Success: []*pb.RequestOp{opPut([]byte(key), []byte("v"))}}).Marshal()
+		assert.NoError(t, err)
+		intent, err := json.Marshal(&txnIntent{ID: rec.ID, Request: ops, Locks: [][]byte{[]byte(key)}})
+		assert.NoError(t, err)
+		_, err = cli.Put(ctx, &pb.PutRequest{Key: c.intentKey(rec.ID), Value: intent})
+		assert.NoError(t, err)
+		_, err = cli.Put(ctx, &pb.PutRequest{Key: c.lockKey([]byte(key)), Value: []byte(rec.ID)})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, c.Recover(ctx))
+	assert.Equal(t, []string{"a"}, clis[0].keys())
+	assert.Equal(t, []string{"x"}, clis[2].keys())
+}
+
+// txnFailingEtcd is a shard whose failAt-th txn fails, after it's applied if applied is true
+type txnFailingEtcd struct {
+	*memEtcd
+	mu      sync.Mutex
+	txns    int
+	failAt  int
+	applied bool
+}
+
+func (e *txnFailingEtcd) failTxn(failAt int, applied bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.txns, e.failAt, e.applied = 0, failAt, applied
+}
+
+func (e *txnFailingEtcd) Txn(ctx context.Context, in *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	e.mu.Lock()
+	e.txns++
+	fail, applied := e.txns == e.failAt, e.applied
+	e.mu.Unlock()
+	if fail && !applied {
+		return nil, errors.New("connection reset")
+	}
+	resp, err := e.memEtcd.Txn(ctx, in, opts...)
+	if fail {
+		return nil, errors.New("connection reset")
+	}
+	return resp, err
+}
+
+// newTxnTest returns a coordinator recovering all txns, of shards ["", "i"), ["i", "s") & ["s", "") in memory
+func newTxnTest() (*TxnCoordinator, []*txnFailingEtcd) {
+	shards, mems := newMemShards("i", "s")
+	clis := make([]*txnFailingEtcd, len(mems))
+	for i, mem := range mems {
+		clis[i] = &txnFailingEtcd{memEtcd: mem}
+		shards[i].(*ShardImpl).cli = clis[i]
+	}
+	configs := NewDefaultShardingConfigs(shards)
+	c := NewTxnCoordinator(NewDefaultGroupRunnerFactory(), configs, new(DefaultResponseFilter), nil, config.DefaultInternalPrefix, time.Nanosecond)
+	return c, clis
+}
+
+// assertTxnKeys asserts the keys in the shards, with the internal keys shortened to their kinds
+func assertTxnKeys(t *testing.T, clis []*txnFailingEtcd, expected ...[]string) {
+	for i, cli := range clis {
+		var keys []string
+		for _, key := range cli.keys() {
+			if strings.HasPrefix(key, config.DefaultInternalPrefix) {
+				parts := strings.Split(strings.TrimPrefix(key, config.DefaultInternalPrefix+"txn/"), "/")
+				key = parts[0]
+				if key == "lock" {
+					key += "/" + parts[1]
+				}
+			}
+			keys = append(keys, key)
+		}
+		assert.Equal(t, expected[i], keys, "keys in shard[%d]", i)
+	}
+}
+
+func crossShardTxn() *pb.TxnRequest {
+	return &pb.TxnRequest{
+		Compare: []*pb.Compare{cmpNotExists([]byte("j"))},
+		Success: []*pb.RequestOp{opPut([]byte("j"), []byte("1")), opPut([]byte("t"), []byte("2"))},
+	}
+}
+
+func TestTxnCoordinator_twoPhaseCommit(t *testing.T) {
+	c, clis := newTxnTest()
+	ctx := context.Background()
+
+	resp, err := c.Txn(ctx, crossShardTxn())
+	assert.NoError(t, err)
+	assert.True(t, resp.Succeeded)
+	assert.Len(t, resp.Responses, 2)
+	assertTxnKeys(t, clis, nil, []string{"j"}, []string{"t"})
+
+	resp, err = c.Txn(ctx, crossShardTxn())
+	assert.NoError(t, err)
+	assert.False(t, resp.Succeeded)
+	assertTxnKeys(t, clis, nil, []string{"j"}, []string{"t"})
+}
+
+func TestTxnCoordinator_twoPhaseCommit_rangeCompare(t *testing.T) {
+	c, clis := newTxnTest()
+	ctx := context.Background()
+	// keys out of the range of shard[0] in it, like the ones moved away but not deleted yet
+	for _, key := range []string{"j", "t"} {
+		_, err := clis[0].Put(ctx, &pb.PutRequest{Key: []byte(key), Value: []byte("2")})
+		assert.NoError(t, err)
+	}
+	_, err := c.Txn(ctx, &pb.TxnRequest{Success: []*pb.RequestOp{opPut([]byte("j"), []byte("1")), opPut([]byte("t"), []byte("1"))}})
+	assert.NoError(t, err)
+	compare := func(cmp *pb.Compare) bool {
+		resp, err := c.Txn(ctx, &pb.TxnRequest{Compare: []*pb.Compare{cmp}})
+		assert.NoError(t, err)
+		return resp.Succeeded
+	}
+	value := func(key, rangeEnd, value string) *pb.Compare {
+		return &pb.Compare{Key: []byte(key), RangeEnd: []byte(rangeEnd), Target: pb.Compare_VALUE,
+			Result: pb.Compare_EQUAL, TargetUnion: &pb.Compare_Value{Value: []byte(value)}}
+	}
+	version := func(key, rangeEnd string, version int64) *pb.Compare {
+		return &pb.Compare{Key: []byte(key), RangeEnd: []byte(rangeEnd), Target: pb.Compare_VERSION,
+			Result: pb.Compare_EQUAL, TargetUnion: &pb.Compare_Version{Version: version}}
+	}
+
+	// shard[0] has no keys in its part of the range, which doesn't fail the compare
+	assert.True(t, compare(value("a", "\x00", "1")))
+	assert.True(t, compare(version("a", "z", 1)))
+	// compared on the keys of all shards
+	assert.False(t, compare(value("a", "\x00", "2")))
+	assert.False(t, compare(version("a", "z", 2)))
+	// a range without keys in all shards is compared as an empty key
+	assert.False(t, compare(value("a", "j", "")))
+	assert.True(t, compare(version("a", "j", 0)))
+}
+
+func TestTxnCoordinator_twoPhaseCommit_failures(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("prepare failed", func(t *testing.T) {
+		c, clis := newTxnTest()
+		clis[2].failTxn(1, false)
+		_, err := c.Txn(ctx, crossShardTxn())
+		assert.Error(t, err)
+		assertTxnKeys(t, clis, nil, nil, nil)
+	})
+
+	t.Run("abort not logged", func(t *testing.T) {
+		c, clis := newTxnTest()
+		clis[2].failTxn(1, false)
+		clis[0].failTxn(2, false)
+		_, err := c.Txn(ctx, crossShardTxn())
+		assert.Error(t, err)
+		// the locks are released anyway
+		assertTxnKeys(t, clis, []string{"log"}, nil, nil)
+		assert.NoError(t, c.Recover(ctx))
+		assertTxnKeys(t, clis, nil, nil, nil)
+	})
+
+	t.Run("commit not logged", func(t *testing.T) {
+		c, clis := newTxnTest()
+		clis[0].failTxn(2, false)
+		_, err := c.Txn(ctx, crossShardTxn())
+		assert.Error(t, err)
+		assertTxnKeys(t, clis, nil, nil, nil)
+	})
+
+	t.Run("commit logged but failed", func(t *testing.T) {
+		c, clis := newTxnTest()
+		clis[0].failTxn(2, true)
+		resp, err := c.Txn(ctx, crossShardTxn())
+		assert.NoError(t, err)
+		assert.True(t, resp.Succeeded)
+		assertTxnKeys(t, clis, nil, []string{"j"}, []string{"t"})
+	})
+
+	t.Run("commit failed in shard", func(t *testing.T) {
+		c, clis := newTxnTest()
+		clis[2].failTxn(2, false)
+		_, err := c.Txn(ctx, crossShardTxn())
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assertTxnKeys(t, clis, []string{"log"}, []string{"j"}, []string{"intent", "lock/key"})
+		assert.NoError(t, c.Recover(ctx))
+		assertTxnKeys(t, clis, nil, []string{"j"}, []string{"t"})
+	})
+}
+
+func TestTxnCoordinator_locks(t *testing.T) {
+	c, clis := newTxnTest()
+	ctx := context.Background()
+	prepare := func(req *pb.TxnRequest) (*txnIntent, bool) {
+		split, err := c.split(req)
+		assert.NoError(t, err)
+		shard := split.shards[1]
+		ops, err := shard.req.Marshal()
+		assert.NoError(t, err)
+		intent := &txnIntent{ID: req.String(), Request: ops, Locks: shard.locks, RangeLocks: shard.rangeLocks}
+		prepared, _, _, err := c.prepare(ctx, shard, intent)
+		assert.NoError(t, err)
+		return intent, prepared
+	}
+	put := func(key string) error {
+		_, err := c.putShard(ctx, clis[1], &pb.PutRequest{Key: []byte(key)})
+		return err
+	}
+	deleteRange := func(key, rangeEnd string) error {
+		_, err := c.deleteRangeShard(ctx, clis[1], &pb.DeleteRangeRequest{Key: []byte(key), RangeEnd: []byte(rangeEnd)})
+		return err
+	}
+
+	// ["j", "m") is locked by a delete, and "p" by a put
+	deleting, prepared := prepare(&pb.TxnRequest{Success: []*pb.RequestOp{
+		{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: []byte("j"), RangeEnd: []byte("m")}}},
+		opPut([]byte("t"), nil),
+	}})
+	assert.True(t, prepared)
+	putting, prepared := prepare(&pb.TxnRequest{Success: []*pb.RequestOp{opPut([]byte("p"), nil), opPut([]byte("t"), nil)}})
+	assert.True(t, prepared)
+	_, prepared = prepare(&pb.TxnRequest{
+		Compare: []*pb.Compare{{Key: []byte("a"), RangeEnd: []byte("k"), Target: pb.Compare_VERSION, Result: pb.Compare_EQUAL}},
+		Success: []*pb.RequestOp{opPut([]byte("t"), nil)},
+	})
+	assert.False(t, prepared)
+
+	assert.ErrorIs(t, put("k"), errTxnConflict)
+	assert.ErrorIs(t, put("p"), errTxnConflict)
+	assert.NoError(t, put("n"))
+	assert.ErrorIs(t, deleteRange("i", "k"), errTxnConflict)
+	assert.ErrorIs(t, deleteRange("o", "r"), errTxnConflict)
+	assert.NoError(t, deleteRange("m", "o"))
+	_, err := c.Txn(ctx, &pb.TxnRequest{Success: []*pb.RequestOp{opPut([]byte("l"), nil)}})
+	assert.ErrorIs(t, err, errTxnConflict)
+
+	_, err = c.commitShard(ctx, 1, deleting, true)
+	assert.NoError(t, err)
+	assert.NoError(t, put("k"))
+	// the lock of "p" is taken by another txn
+	_, err = clis[1].Put(ctx, &pb.PutRequest{Key: c.lockKey([]byte("p")), Value: []byte("other")})
+	assert.NoError(t, err)
+	_, err = c.commitShard(ctx, 1, putting, true)
+	assert.Error(t, err)
+	assert.Nil(t, clis[1].get("p"))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TxnDifferentShardError is returned when a txn spans multiple shards.
+// It's a FailedPrecondition status to gRPC clients.
+type TxnDifferentShardError struct {
+	ShardIDs []int
+}
+
+func (e *TxnDifferentShardError) Error() string {
+	return fmt.Sprintf("%s: touches shards %v", ErrTxnDifferentShard, e.ShardIDs)
+}
+
+func (e *TxnDifferentShardError) Unwrap() error {
+	return ErrTxnDifferentShard
+}
+
+// GRPCStatus implements interface used by status.FromError
+func (e *TxnDifferentShardError) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, e.Error())
+}
+
+// TxnValidator finds the shards a txn touches
+type TxnValidator struct {
+	configs ShardingConfigs
+}
+
+func NewTxnValidator(configs ShardingConfigs) *TxnValidator {
+	return &TxnValidator{
+		configs: configs,
+	}
+}
+
+// Validate returns the only shard the txn touches.
+// If the txn spans multiple shards, it returns a *TxnDifferentShardError.
+func (v *TxnValidator) Validate(req *pb.TxnRequest) (int, error) {
+	shardIDs := v.ShardIDs(req)
+	switch len(shardIDs) {
+	case 0:
+		// empty txn, use first shard
+		return 0, nil
+	case 1:
+		return shardIDs[0], nil
+	}
+	return 0, &TxnDifferentShardError{ShardIDs: shardIDs}
+}
+
+// ShardIDs walks the whole txn, including compares, nested txns and the range of ops,
+// and returns the sorted ids of all shards it touches.
+func (v *TxnValidator) ShardIDs(req *pb.TxnRequest) []int {
+	set := make(map[int]struct{})
+	v.collectTxn(req, set)
+	ret := make([]int, 0, len(set))
+	for id := range set {
+		ret = append(ret, id)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+func (v *TxnValidator) collectTxn(req *pb.TxnRequest, set map[int]struct{}) {
+	for _, cmp := range req.Compare {
+		v.collectRead(cmp.Key, cmp.RangeEnd, set)
+	}
+	for _, op := range req.Success {
+		v.collectOp(op, set)
+	}
+	for _, op := range req.Failure {
+		v.collectOp(op, set)
+	}
+}
+
+func (v *TxnValidator) collectOp(op *pb.RequestOp, set map[int]struct{}) {
+	switch r := op.Request.(type) {
+	case *pb.RequestOp_RequestRange:
+		v.collectRead(r.RequestRange.Key, r.RequestRange.RangeEnd, set)
+	case *pb.RequestOp_RequestPut:
+		v.collectWrite(r.RequestPut.Key, nil, set)
+	case *pb.RequestOp_RequestDeleteRange:
+		v.collectWrite(r.RequestDeleteRange.Key, r.RequestDeleteRange.RangeEnd, set)
+	case *pb.RequestOp_RequestTxn:
+		v.collectTxn(r.RequestTxn, set)
+	}
+}
+
+// collectRead collects the shards of a read.
+// Replicated keys can be read in any shard, so they don't add shards.
+func (v *TxnValidator) collectRead(key, rangeEnd []byte, set map[int]struct{}) {
+	if _, whole := replicatedRanges(v.configs, key, rangeEnd); whole {
+		return
+	}
+	v.collectRange(key, rangeEnd, set)
+}
+
+// collectWrite collects the shards of a write.
+// Replicated keys are written in all shards.
+func (v *TxnValidator) collectWrite(key, rangeEnd []byte, set map[int]struct{}) {
+	if parts, _ := replicatedRanges(v.configs, key, rangeEnd); len(parts) > 0 {
+		for _, cli := range v.configs.GetAllShardClis() {
+			set[cli.GetShardID()] = struct{}{}
+		}
+		return
+	}
+	v.collectRange(key, rangeEnd, set)
+}
+
+func (v *TxnValidator) collectRange(key, rangeEnd []byte, set map[int]struct{}) {
+	for _, cli := range v.configs.GetShardClis(key, rangeEnd) {
+		set[cli.GetShardID()] = struct{}{}
+	}
+}
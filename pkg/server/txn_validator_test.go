@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTxnValidator_Validate(t *testing.T) {
+	v := NewTxnValidator(newTestShardingConfigs(t))
+
+	t.Run("empty txn", func(t *testing.T) {
+		shardID, err := v.Validate(&pb.TxnRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, shardID)
+	})
+
+	t.Run("single shard", func(t *testing.T) {
+		shardID, err := v.Validate(&pb.TxnRequest{
+			Compare: []*pb.Compare{cmpExists([]byte("j"))},
+			Success: []*pb.RequestOp{opPut([]byte("k"), nil)},
+			Failure: []*pb.RequestOp{opDelete([]byte("l"))},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, shardID)
+	})
+
+	t.Run("compare in other shard", func(t *testing.T) {
+		_, err := v.Validate(&pb.TxnRequest{
+			Compare: []*pb.Compare{cmpExists([]byte("z"))},
+			Success: []*pb.RequestOp{opPut([]byte("a"), nil)},
+		})
+		assert.ErrorIs(t, err, ErrTxnDifferentShard)
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Equal(t, []int{0, 2}, err.(*TxnDifferentShardError).ShardIDs)
+	})
+
+	t.Run("nested txn after first op", func(t *testing.T) {
+		_, err := v.Validate(&pb.TxnRequest{
+			Success: []*pb.RequestOp{
+				opPut([]byte("a"), nil),
+				{Request: &pb.RequestOp_RequestTxn{RequestTxn: &pb.TxnRequest{
+					Failure: []*pb.RequestOp{opPut([]byte("j"), nil)},
+				}}},
+			},
+		})
+		assert.Equal(t, []int{0, 1}, err.(*TxnDifferentShardError).ShardIDs)
+	})
+
+	t.Run("range end", func(t *testing.T) {
+		_, err := v.Validate(&pb.TxnRequest{
+			Success: []*pb.RequestOp{
+				{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: []byte("a"), RangeEnd: noEnd}}},
+			},
+		})
+		assert.Equal(t, []int{0, 1, 2}, err.(*TxnDifferentShardError).ShardIDs)
+	})
+}
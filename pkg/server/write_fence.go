@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fenceWaitTimeout is how long a write waits for a fenced range to be moved before it fails.
+const fenceWaitTimeout = 10 * time.Second
+
+// beginWrite waits until the ranges are not fenced by migrations, and returns the function
+// to call when the write is done. Writes in flight are waited by the switch to a new version
+// of versioned sharding configs, so a migration knows all writes before its fence are done
+// once all proxies are switched to the fence. Writes fail while the proxy is suspended.
+func (s *KVProxy) beginWrite(ctx context.Context, ranges ...KeyRange) (func(), error) {
+	versioned, ok := s.configs.(*VersionedShardingConfigs)
+	if !ok {
+		return func() {}, nil
+	}
+	timeout := time.NewTimer(fenceWaitTimeout)
+	defer timeout.Stop()
+	for {
+		changed := versioned.Changed()
+		version, done := versioned.BeginWrite()
+		if err := version.Suspended(); err != nil {
+			done()
+			return nil, err
+		}
+		fenced, ok := fencedRanges(version.Configs, ranges)
+		if !ok {
+			return done, nil
+		}
+		done()
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-timeout.C:
+			return nil, status.Errorf(codes.Unavailable, "range [%q, %q) is being moved, retry later", fenced.Key, fenced.RangeEnd)
+		case <-changed:
+		}
+	}
+}
+
+// fencedRanges returns a fenced migration overlapping the ranges, ok is false if none.
+func fencedRanges(configs ShardingConfigs, ranges []KeyRange) (RangeMigration, bool) {
+	for _, r := range ranges {
+		if m, ok := fencedMigration(configs, r.Key, r.RangeEnd); ok {
+			return m, true
+		}
+	}
+	return RangeMigration{}, false
+}
+
+// txnWriteRanges returns the keys & ranges written by the ops of the txn, including nested txns.
+func txnWriteRanges(req *pb.TxnRequest) []KeyRange {
+	var ret []KeyRange
+	var collect func(ops []*pb.RequestOp)
+	collect = func(ops []*pb.RequestOp) {
+		for _, op := range ops {
+			switch r := op.Request.(type) {
+			case *pb.RequestOp_RequestPut:
+				ret = append(ret, KeyRange{Key: r.RequestPut.Key})
+			case *pb.RequestOp_RequestDeleteRange:
+				ret = append(ret, KeyRange{Key: r.RequestDeleteRange.Key, RangeEnd: r.RequestDeleteRange.RangeEnd})
+			case *pb.RequestOp_RequestTxn:
+				collect(r.RequestTxn.Success)
+				collect(r.RequestTxn.Failure)
+			}
+		}
+	}
+	collect(req.Success)
+	collect(req.Failure)
+	return ret
+}